@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPaymentTerms = 30 * 24 * time.Hour
+	autoCloseInterval   = time.Hour
+)
+
+var (
+	ErrPeriodOpen = errors.New("period has not ended yet")
+	// periods are charged as whole calendar months, a charge reference is
+	// derived from the period so other periods would bill the month twice
+	ErrNotCalendarMonth = errors.New("period is not a calendar month")
+	ErrPeriodOverlaps   = errors.New("period overlaps a charged period")
+)
+
+// Billing turns account invoices of closed periods into ledger charges.
+type Billing struct {
+	svc      Aggregator
+	registry registry.Registry
+	ledger   *ledger.Ledger
+	prepaid  *PrepaidMiddleware
+	// of accounts without a currency of their own
+	defaultCurrency string
+	// time between closing a period and the charge becoming overdue
+	terms time.Duration
+	// late distances are still accepted for this long after a period ends
+	lateness time.Duration
+}
+
+type closeResult struct {
+	AccountID     string      `json:"accountId"`
+	Status        string      `json:"status"`
+	TransactionID string      `json:"transactionId,omitempty"`
+	Amount        types.Money `json:"amount"`
+	Error         string      `json:"error,omitempty"`
+}
+
+const (
+	closeCharged        = "charged"
+	closeAlreadyCharged = "already_charged"
+	closeNothingDue     = "nothing_due"
+	closePrepaid        = "prepaid"
+	closeFailed         = "failed"
+)
+
+func (b *Billing) currency(account types.Account) string {
+	if account.Currency != "" {
+		return account.Currency
+	}
+	return b.defaultCurrency
+}
+
+// ClosePeriod charges every account for a calendar month once late
+// distances are no longer accepted for it. Accounts charged for the month
+// before are left alone, so a close can safely be repeated, accounts with a
+// charge for an overlapping period fail. Prepaid accounts are skipped, they
+// were charged as they drove.
+func (b *Billing) ClosePeriod(ctx context.Context, period types.Period, actor string) ([]closeResult, error) {
+	if !isCalendarMonth(period) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrNotCalendarMonth, period.From.Format(time.RFC3339), period.To.Format(time.RFC3339))
+	}
+	if closesAt := period.To.Add(b.lateness); closesAt.After(time.Now()) {
+		return nil, fmt.Errorf("%w: late distances are accepted until %s", ErrPeriodOpen, closesAt.Format(time.RFC3339))
+	}
+	accounts, err := b.registry.ListAccounts()
+	if err != nil {
+		return nil, err
+	}
+	due := time.Now().UTC().Add(b.terms)
+	results := make([]closeResult, 0, len(accounts))
+	for _, account := range accounts {
+		res := closeResult{AccountID: account.ID}
+		if account.Prepaid {
+			res.Status = closePrepaid
+			results = append(results, res)
+			continue
+		}
+		if overlaps := b.ledger.OverlappingCharges(account.ID, period); len(overlaps) > 0 {
+			res.Status, res.Error = closeFailed, fmt.Sprintf("%v: transaction %s", ErrPeriodOverlaps, overlaps[0].ID)
+			results = append(results, res)
+			continue
+		}
+		inv, err := b.svc.CalculateAccountInvoice(ctx, account.ID, period)
+		if err != nil {
+			res.Status, res.Error = closeFailed, err.Error()
+			results = append(results, res)
+			continue
+		}
+		res.Amount = inv.TotalAmount
+		if res.Amount.Units <= 0 {
+			res.Status = closeNothingDue
+			results = append(results, res)
+			continue
+		}
+		tx, err := b.ledger.Charge(account.ID, inv.Period, res.Amount, due, actor)
+		switch {
+		case errors.Is(err, ledger.ErrDuplicateReference):
+			res.Status, res.TransactionID, res.Amount = closeAlreadyCharged, tx.ID, tx.Postings[0].Amount
+		case err != nil:
+			res.Status, res.Error = closeFailed, err.Error()
+		default:
+			res.Status, res.TransactionID = closeCharged, tx.ID
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// isCalendarMonth reports whether the period is one month starting at
+// midnight UTC on the first.
+func isCalendarMonth(period types.Period) bool {
+	from := period.From.UTC()
+	return from.Equal(time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC)) &&
+		period.To.Equal(from.AddDate(0, 1, 0))
+}
+
+// runAutoClose closes every calendar month once the lateness window after
+// it has passed.
+func (b *Billing) runAutoClose(ctx context.Context) {
+	var closed time.Time
+	ticker := time.NewTicker(autoCloseInterval)
+	defer ticker.Stop()
+	for {
+		now := time.Now().UTC()
+		thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		period := types.Period{From: thisMonth.AddDate(0, -1, 0), To: thisMonth}
+		if !period.From.Equal(closed) && now.Sub(period.To) >= b.lateness {
+			results, err := b.ClosePeriod(ctx, period, "period-closer")
+			failed := 0
+			for _, res := range results {
+				if res.Status == closeFailed {
+					failed++
+				}
+			}
+			if err == nil && failed == 0 {
+				closed = period.From
+			}
+			logrus.WithFields(logrus.Fields{
+				"from":     period.From,
+				"to":       period.To,
+				"accounts": len(results),
+				"failed":   failed,
+				"err":      err,
+			}).Info("closed billing period")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// makeLedger keeps the journal in AGG_LEDGER_FILE, without it the ledger
+// only lives in memory.
+func makeLedger() *ledger.Ledger {
+	var store ledger.Store = ledger.NewMemoryStore()
+	if path := os.Getenv("AGG_LEDGER_FILE"); path != "" {
+		fs, err := ledger.NewFileStore(path, defaultCurrency())
+		if err != nil {
+			log.Fatalf("failed to open ledger %s: %v", path, err)
+		}
+		store = fs
+	}
+	l, err := ledger.New(store)
+	if err != nil {
+		log.Fatalf("failed to load ledger: %v", err)
+	}
+	return l
+}
+
+// paymentTerms reads AGG_PAYMENT_TERMS, 30 days when empty.
+func paymentTerms() (time.Duration, error) {
+	v := os.Getenv("AGG_PAYMENT_TERMS")
+	if v == "" {
+		return defaultPaymentTerms, nil
+	}
+	terms, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid AGG_PAYMENT_TERMS %q: %w", v, err)
+	}
+	return terms, nil
+}
@@ -2,10 +2,38 @@ package client
 
 import (
 	"context"
+	"errors"
+	"net"
 
 	"github.com/shamssahal/toll-calculator/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type Client interface {
 	Aggregate(context.Context, *types.AggregateRequest) error
 }
+
+// Retryable reports whether a failed Aggregate can be sent again. The
+// aggregator applies a distance once, so a retry of one it did take is
+// harmless. A shard that could not hand a distance to its owner answers
+// FailedPrecondition, the owner is back or the rings agree again after a
+// while.
+func Retryable(err error) bool {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrUnavailable), errors.Is(err, ErrWrongShard), errors.As(err, &netErr):
+		return true
+	}
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.FailedPrecondition
+}
+
+// InvoiceClient reads invoices from a single aggregator or a sharded
+// cluster.
+type InvoiceClient interface {
+	Invoice(ctx context.Context, id string) (*types.Invoice, error)
+	Series(context.Context, types.SeriesQuery) (*types.Series, error)
+	AccountInvoice(ctx context.Context, accountID string, period types.Period) (*types.AccountInvoice, error)
+	Accounts(context.Context) ([]types.Account, error)
+}
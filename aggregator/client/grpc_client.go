@@ -3,8 +3,10 @@ package client
 import (
 	"context"
 
+	"github.com/shamssahal/toll-calculator/tlsconfig"
 	"github.com/shamssahal/toll-calculator/types"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
@@ -14,10 +16,14 @@ type GRPCClient struct {
 }
 
 func NewGRPCClient(endpoint string) (*GRPCClient, error) {
-	conn, err := grpc.NewClient(
-		endpoint,
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	return NewGRPCClientWithTLS(endpoint, tlsconfig.Config{})
+}
 
+// NewGRPCClientWithTLS dials the aggregator over TLS (and mTLS when a client
+// certificate is configured). A config without any TLS material falls back
+// to insecure credentials.
+func NewGRPCClientWithTLS(endpoint string, tlsCfg tlsconfig.Config) (*GRPCClient, error) {
+	conn, err := dial(endpoint, tlsCfg)
 	if err != nil {
 		return nil, err
 	}
@@ -32,3 +38,17 @@ func (c *GRPCClient) Aggregate(ctx context.Context, req *types.AggregateRequest)
 	_, err := c.client.Aggregate(ctx, req)
 	return err
 }
+
+func dial(endpoint string, tlsCfg tlsconfig.Config) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsCfg.ClientEnabled() {
+		cfg, err := tlsCfg.ClientTLS()
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(cfg)
+	}
+	return grpc.NewClient(
+		endpoint,
+		grpc.WithTransportCredentials(creds))
+}
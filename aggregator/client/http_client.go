@@ -4,14 +4,34 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/shamssahal/toll-calculator/tlsconfig"
 	"github.com/shamssahal/toll-calculator/types"
 )
 
+var (
+	// ErrNotFound is returned when the aggregator does not know the
+	// requested resource.
+	ErrNotFound = errors.New("not found")
+	// ErrUnavailable is returned when the aggregator could not replicate a
+	// write to a quorum of its cluster, sending it again is safe.
+	ErrUnavailable = errors.New("aggregator unavailable")
+	// ErrWrongShard is returned when the shard could not hand a distance
+	// to the shard owning its OBU, e.g. while shards are added. Sending it
+	// again is safe as well.
+	ErrWrongShard = errors.New("obu belongs to another shard")
+)
+
 type HTTPClient struct {
 	Endpoint string
+	// falls back to http.DefaultClient when nil
+	Client *http.Client
 }
 
 func NewHTTPClient(endpoint string) *HTTPClient {
@@ -20,6 +40,31 @@ func NewHTTPClient(endpoint string) *HTTPClient {
 	}
 }
 
+// NewHTTPClientWithTLS verifies the aggregator against the configured CA and
+// presents a client certificate when mTLS is enabled. A config without any
+// TLS material yields a plain client.
+func NewHTTPClientWithTLS(endpoint string, tlsCfg tlsconfig.Config) (*HTTPClient, error) {
+	c := NewHTTPClient(endpoint)
+	if !tlsCfg.ClientEnabled() {
+		return c, nil
+	}
+	cfg, err := tlsCfg.ClientTLS()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	c.Client = &http.Client{Transport: transport}
+	return c, nil
+}
+
+func (c *HTTPClient) httpClient() *http.Client {
+	if c.Client == nil {
+		return http.DefaultClient
+	}
+	return c.Client
+}
+
 func (c *HTTPClient) Aggregate(ctx context.Context, aggReq *types.AggregateRequest) error {
 	endpoint := fmt.Sprintf("%s/aggregate", c.Endpoint)
 	var b []byte
@@ -27,21 +72,31 @@ func (c *HTTPClient) Aggregate(ctx context.Context, aggReq *types.AggregateReque
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("the service responded with a non 200 status code %d", resp.StatusCode)
+	return aggregateStatus(resp)
+}
+
+// aggregateStatus maps the response to a distance sent to an aggregator.
+func aggregateStatus(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%w: the service responded with %d", ErrUnavailable, resp.StatusCode)
+	case http.StatusMisdirectedRequest:
+		return fmt.Errorf("%w: the service responded with %d", ErrWrongShard, resp.StatusCode)
 	}
-	return nil
+	return fmt.Errorf("the service responded with a non 200 status code %d", resp.StatusCode)
 }
 
 func (c *HTTPClient) Invoice(ctx context.Context, id string) (*types.Invoice, error) {
@@ -50,7 +105,7 @@ func (c *HTTPClient) Invoice(ctx context.Context, id string) (*types.Invoice, er
 	if err != nil {
 		return nil, err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.httpClient().Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -64,3 +119,190 @@ func (c *HTTPClient) Invoice(ctx context.Context, id string) (*types.Invoice, er
 	}
 	return &invoiceData, nil
 }
+
+func (c *HTTPClient) Series(ctx context.Context, q types.SeriesQuery) (*types.Series, error) {
+	endpoint := fmt.Sprintf("%s/invoice/series?%s", c.Endpoint, q.Values().Encode())
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the service responded with a non 200 status code %d", resp.StatusCode)
+	}
+	var series types.Series
+	if err := json.NewDecoder(resp.Body).Decode(&series); err != nil {
+		return nil, err
+	}
+	return &series, nil
+}
+
+func (c *HTTPClient) AccountInvoice(ctx context.Context, accountID string, period types.Period) (*types.AccountInvoice, error) {
+	q := period.Values()
+	q.Set("id", accountID)
+	endpoint := fmt.Sprintf("%s/invoice/account?%s", c.Endpoint, q.Encode())
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the service responded with a non 200 status code %d", resp.StatusCode)
+	}
+	var invoice types.AccountInvoice
+	if err := json.NewDecoder(resp.Body).Decode(&invoice); err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+func (c *HTTPClient) Accounts(ctx context.Context) ([]types.Account, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/accounts", c.Endpoint), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the service responded with a non 200 status code %d", resp.StatusCode)
+	}
+	var accounts []types.Account
+	if err := json.NewDecoder(resp.Body).Decode(&accounts); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// Replicate hands what another aggregator accepted to this one, which
+// applies each RequestID and change once.
+func (c *HTTPClient) Replicate(ctx context.Context, batch types.ReplicaBatch) error {
+	b, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/replicate", c.Endpoint), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the service responded with a non 200 status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ReplicaSnapshot returns the whole state of the aggregator, for a peer to
+// catch up with.
+func (c *HTTPClient) ReplicaSnapshot(ctx context.Context) (types.ReplicaBatch, error) {
+	var state types.ReplicaBatch
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/replicate/snapshot", c.Endpoint), nil)
+	if err != nil {
+		return state, err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return state, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return state, fmt.Errorf("the service responded with a non 200 status code %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	return state, err
+}
+
+// getShard reads a /shard endpoint into v, the raw state of an OBU other
+// shards read when they price an invoice.
+func (c *HTTPClient) getShard(ctx context.Context, path string, q url.Values, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/shard/%s?%s", c.Endpoint, path, q.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the service responded with a non 200 status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Distance returns the total distance of an OBU the shard owns.
+func (c *HTTPClient) Distance(ctx context.Context, obuID int) (float64, error) {
+	var res struct {
+		Value float64 `json:"value"`
+	}
+	err := c.getShard(ctx, "distance", url.Values{"id": {strconv.Itoa(obuID)}}, &res)
+	return res.Value, err
+}
+
+// Buckets returns the distance per window of an OBU the shard owns, keyed
+// by window start in unix seconds.
+func (c *HTTPClient) Buckets(ctx context.Context, obuID int, resolution string, from, to time.Time) (map[int64]float64, error) {
+	q := url.Values{
+		"id":         {strconv.Itoa(obuID)},
+		"resolution": {resolution},
+		"from":       {from.Format(time.RFC3339Nano)},
+		"to":         {to.Format(time.RFC3339Nano)},
+	}
+	var res map[int64]float64
+	err := c.getShard(ctx, "buckets", q, &res)
+	return res, err
+}
+
+// Readings returns the distances of an OBU the shard owns with an event
+// time in [from, to), oldest first.
+func (c *HTTPClient) Readings(ctx context.Context, obuID int, from, to time.Time) ([]types.Distance, error) {
+	q := url.Values{
+		"id":   {strconv.Itoa(obuID)},
+		"from": {from.Format(time.RFC3339Nano)},
+		"to":   {to.Format(time.RFC3339Nano)},
+	}
+	var res []types.Distance
+	err := c.getShard(ctx, "readings", q, &res)
+	return res, err
+}
+
+// Insert hands a distance of an OBU the shard owns to it, for a shard that
+// was sent it by a client routing with another ring.
+func (c *HTTPClient) Insert(ctx context.Context, d types.Distance) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/shard/distances", c.Endpoint), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return aggregateStatus(resp)
+}
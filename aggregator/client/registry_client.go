@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
+	"github.com/shamssahal/toll-calculator/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// longest a registry call may take, the registry has no contexts
+const registryTimeout = 5 * time.Second
+
+// GRPCRegistryClient is the registry of another aggregator, e.g. the
+// coordinator of a sharded cluster. It is a registry.Registry and returns
+// its errors.
+type GRPCRegistryClient struct {
+	Endpoint string
+	client   types.RegistryClient
+}
+
+func NewGRPCRegistryClientWithTLS(endpoint string, tlsCfg tlsconfig.Config) (*GRPCRegistryClient, error) {
+	conn, err := dial(endpoint, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &GRPCRegistryClient{
+		Endpoint: endpoint,
+		client:   types.NewRegistryClient(conn),
+	}, nil
+}
+
+// registryError maps a gRPC status back to the registry error it was made
+// from, notFound is the one a missing entry is reported with.
+func registryError(err error, notFound error) error {
+	s, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	var sentinel error
+	switch s.Code() {
+	case codes.NotFound:
+		sentinel = notFound
+	case codes.InvalidArgument:
+		sentinel = registry.ErrInvalid
+	case codes.FailedPrecondition:
+		sentinel = registry.ErrAccountInUse
+	default:
+		return err
+	}
+	// the message starts with the error the server wrapped
+	return fmt.Errorf("%w%s", sentinel, strings.TrimPrefix(s.Message(), sentinel.Error()))
+}
+
+func (c *GRPCRegistryClient) PutAccount(a types.Account) (types.Account, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	res, err := c.client.PutAccount(ctx, a.Record())
+	if err != nil {
+		return a, registryError(err, registry.ErrAccountNotFound)
+	}
+	return types.AccountFromRecord(res), nil
+}
+
+func (c *GRPCRegistryClient) GetAccount(id string) (types.Account, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	res, err := c.client.GetAccount(ctx, &types.AccountID{ID: id})
+	if err != nil {
+		return types.Account{}, registryError(err, registry.ErrAccountNotFound)
+	}
+	return types.AccountFromRecord(res), nil
+}
+
+func (c *GRPCRegistryClient) DeleteAccount(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	_, err := c.client.DeleteAccount(ctx, &types.AccountID{ID: id})
+	return registryError(err, registry.ErrAccountNotFound)
+}
+
+func (c *GRPCRegistryClient) ListAccounts() ([]types.Account, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	res, err := c.client.ListAccounts(ctx, &types.None{})
+	if err != nil {
+		return nil, registryError(err, registry.ErrAccountNotFound)
+	}
+	accounts := make([]types.Account, 0, len(res.Accounts))
+	for _, a := range res.Accounts {
+		accounts = append(accounts, types.AccountFromRecord(a))
+	}
+	return accounts, nil
+}
+
+func (c *GRPCRegistryClient) PutVehicle(v types.Vehicle) (types.Vehicle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	res, err := c.client.PutVehicle(ctx, v.Record())
+	if err != nil {
+		// the account of the vehicle is missing
+		return v, registryError(err, registry.ErrAccountNotFound)
+	}
+	return types.VehicleFromRecord(res), nil
+}
+
+func (c *GRPCRegistryClient) GetVehicle(obuID int) (types.Vehicle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	res, err := c.client.GetVehicle(ctx, &types.VehicleID{ObuID: int64(obuID)})
+	if err != nil {
+		return types.Vehicle{}, registryError(err, registry.ErrVehicleNotFound)
+	}
+	return types.VehicleFromRecord(res), nil
+}
+
+func (c *GRPCRegistryClient) DeleteVehicle(obuID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	_, err := c.client.DeleteVehicle(ctx, &types.VehicleID{ObuID: int64(obuID)})
+	return registryError(err, registry.ErrVehicleNotFound)
+}
+
+func (c *GRPCRegistryClient) ListVehicles(accountID string) ([]types.Vehicle, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+	res, err := c.client.ListVehicles(ctx, &types.AccountID{ID: accountID})
+	if err != nil {
+		return nil, registryError(err, registry.ErrAccountNotFound)
+	}
+	vehicles := make([]types.Vehicle, 0, len(res.Vehicles))
+	for _, v := range res.Vehicles {
+		vehicles = append(vehicles, types.VehicleFromRecord(v))
+	}
+	return vehicles, nil
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// points every shard gets on the ring, more spread the OBUs more evenly
+const defaultVirtualNodes = 128
+
+// Shard is an aggregator of a sharded cluster. Shards are placed on the
+// ring by name, so the endpoints can differ between transports.
+type Shard struct {
+	Name     string
+	Endpoint string
+}
+
+// ParseShards reads a comma separated list of name=endpoint pairs, e.g.
+// a=http://agg-a:3000,b=http://agg-b:3000.
+func ParseShards(v string) ([]Shard, error) {
+	var shards []Shard
+	for _, s := range strings.Split(v, ",") {
+		name, endpoint, ok := strings.Cut(strings.TrimSpace(s), "=")
+		if !ok || name == "" || endpoint == "" {
+			return nil, fmt.Errorf("invalid shard %q, expected name=endpoint", s)
+		}
+		if slices.ContainsFunc(shards, func(s Shard) bool { return s.Name == name }) {
+			return nil, fmt.Errorf("duplicate shard %q", name)
+		}
+		shards = append(shards, Shard{Name: name, Endpoint: endpoint})
+	}
+	if len(shards) == 0 {
+		return nil, errors.New("no shards given")
+	}
+	return shards, nil
+}
+
+type point struct {
+	hash  uint64
+	shard int
+}
+
+// Ring assigns OBUs to shards by consistent hashing. Adding a shard only
+// moves the OBUs it takes over, about 1/n of them.
+type Ring struct {
+	shards []Shard
+	points []point
+}
+
+func NewRing(shards []Shard) *Ring {
+	r := &Ring{shards: shards}
+	for i, s := range shards {
+		for v := range defaultVirtualNodes {
+			r.points = append(r.points, point{hash: hash(s.Name + "#" + strconv.Itoa(v)), shard: i})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b point) int {
+		// a collision is settled the same way on every node
+		return cmp.Or(cmp.Compare(a.hash, b.hash), strings.Compare(shards[a.shard].Name, shards[b.shard].Name))
+	})
+	return r
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv barely mixes the last bytes, finalize it like splitmix64 so
+	// neighbouring OBUs land far apart
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Owner returns the shard holding the distances of an OBU.
+func (r *Ring) Owner(obuID int) Shard {
+	h := hash(strconv.Itoa(obuID))
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p point, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[r.points[i].shard]
+}
+
+// Coordinator is the first shard, it keeps the accounts and the ledger.
+// Unlike the owners of OBUs it depends on the order of the shards, a
+// reordered list moves it away from its data.
+func (r *Ring) Coordinator() Shard {
+	return r.shards[0]
+}
+
+func (r *Ring) Shards() []Shard {
+	return r.shards
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParseShards(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []Shard
+		wantErr bool
+	}{
+		{in: "a=http://agg-a:3000", want: []Shard{{"a", "http://agg-a:3000"}}},
+		{in: "a=http://agg-a:3000, b=http://agg-b:3000", want: []Shard{{"a", "http://agg-a:3000"}, {"b", "http://agg-b:3000"}}},
+		{in: "", wantErr: true},
+		{in: "a", wantErr: true},
+		{in: "=http://agg-a:3000", wantErr: true},
+		{in: "a=", wantErr: true},
+		{in: "a=http://agg-a:3000,", wantErr: true},
+		{in: "a=http://agg-a:3000,a=http://agg-b:3000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseShards(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func shards(n int) []Shard {
+	res := make([]Shard, n)
+	for i := range res {
+		name := fmt.Sprintf("shard-%d", i)
+		res[i] = Shard{Name: name, Endpoint: "http://" + name}
+	}
+	return res
+}
+
+// Every node places an OBU on the same shard, whatever the order or the
+// endpoints of the shards it was given.
+func TestRingOwnerIsDeterministic(t *testing.T) {
+	var (
+		ring     = NewRing(shards(3))
+		reversed = NewRing([]Shard{{"shard-2", "grpc://2"}, {"shard-1", "grpc://1"}, {"shard-0", "grpc://0"}})
+	)
+	for obuID := range 1000 {
+		owner := ring.Owner(obuID)
+		if again := NewRing(shards(3)).Owner(obuID); again != owner {
+			t.Fatalf("obu %d owned by %s and %s", obuID, owner.Name, again.Name)
+		}
+		if other := reversed.Owner(obuID); other.Name != owner.Name {
+			t.Fatalf("obu %d owned by %s and, reordered, %s", obuID, owner.Name, other.Name)
+		}
+	}
+	if got := ring.Coordinator().Name; got != "shard-0" {
+		t.Fatalf("coordinator %s", got)
+	}
+}
+
+// Adding a shard moves about 1/n of the OBUs, all of them to the new one,
+// and the shards hold about the same share.
+func TestRingAddingShardMovesItsShare(t *testing.T) {
+	const obus = 100_000
+	for _, n := range []int{2, 4, 8} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			var (
+				before = NewRing(shards(n - 1))
+				after  = NewRing(shards(n))
+				added  = shards(n)[n-1].Name
+				moved  int
+				held   = make(map[string]int)
+			)
+			for obuID := range obus {
+				from, to := before.Owner(obuID), after.Owner(obuID)
+				held[to.Name]++
+				if from == to {
+					continue
+				}
+				if to.Name != added {
+					t.Fatalf("obu %d moved from %s to %s, not to the new shard", obuID, from.Name, to.Name)
+				}
+				moved++
+			}
+			share := float64(moved) / obus
+			if want := 1 / float64(n); share < want*0.75 || share > want*1.25 {
+				t.Fatalf("%.3f of the OBUs moved, want about %.3f", share, want)
+			}
+			for name, count := range held {
+				if share := float64(count) / obus; share < 0.6/float64(n) || share > 1.4/float64(n) {
+					t.Fatalf("%s holds %.3f of the OBUs", name, share)
+				}
+			}
+		})
+	}
+}
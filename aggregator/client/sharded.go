@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/shamssahal/toll-calculator/tlsconfig"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// ShardedGRPCClient sends every distance to the shard that owns its OBU.
+type ShardedGRPCClient struct {
+	ring    *Ring
+	clients map[string]*GRPCClient
+}
+
+func NewShardedGRPCClient(shards []Shard, tlsCfg tlsconfig.Config) (*ShardedGRPCClient, error) {
+	c := &ShardedGRPCClient{
+		ring:    NewRing(shards),
+		clients: map[string]*GRPCClient{},
+	}
+	for _, s := range shards {
+		gc, err := NewGRPCClientWithTLS(s.Endpoint, tlsCfg)
+		if err != nil {
+			return nil, err
+		}
+		c.clients[s.Name] = gc
+	}
+	return c, nil
+}
+
+func (c *ShardedGRPCClient) Aggregate(ctx context.Context, req *types.AggregateRequest) error {
+	return c.clients[c.ring.Owner(int(req.ObuID)).Name].Aggregate(ctx, req)
+}
+
+// ShardedHTTPClient routes OBU calls to the owning shard and account calls
+// to the coordinator, which keeps the accounts.
+type ShardedHTTPClient struct {
+	ring    *Ring
+	clients map[string]*HTTPClient
+}
+
+func NewShardedHTTPClient(shards []Shard, tlsCfg tlsconfig.Config) (*ShardedHTTPClient, error) {
+	c := &ShardedHTTPClient{
+		ring:    NewRing(shards),
+		clients: map[string]*HTTPClient{},
+	}
+	for _, s := range shards {
+		hc, err := NewHTTPClientWithTLS(s.Endpoint, tlsCfg)
+		if err != nil {
+			return nil, err
+		}
+		c.clients[s.Name] = hc
+	}
+	return c, nil
+}
+
+// Shard returns the client of the shard that owns an OBU.
+func (c *ShardedHTTPClient) Shard(obuID int) *HTTPClient {
+	return c.clients[c.ring.Owner(obuID).Name]
+}
+
+func (c *ShardedHTTPClient) coordinator() *HTTPClient {
+	return c.clients[c.ring.Coordinator().Name]
+}
+
+func (c *ShardedHTTPClient) Aggregate(ctx context.Context, req *types.AggregateRequest) error {
+	return c.Shard(int(req.ObuID)).Aggregate(ctx, req)
+}
+
+func (c *ShardedHTTPClient) Invoice(ctx context.Context, id string) (*types.Invoice, error) {
+	obuID, err := strconv.Atoi(id)
+	if err != nil {
+		// any shard rejects it
+		return c.coordinator().Invoice(ctx, id)
+	}
+	return c.Shard(obuID).Invoice(ctx, id)
+}
+
+func (c *ShardedHTTPClient) Series(ctx context.Context, q types.SeriesQuery) (*types.Series, error) {
+	return c.Shard(q.OBUID).Series(ctx, q)
+}
+
+func (c *ShardedHTTPClient) AccountInvoice(ctx context.Context, accountID string, period types.Period) (*types.AccountInvoice, error) {
+	return c.coordinator().AccountInvoice(ctx, accountID, period)
+}
+
+func (c *ShardedHTTPClient) Accounts(ctx context.Context) ([]types.Account, error) {
+	return c.coordinator().Accounts(ctx)
+}
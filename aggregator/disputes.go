@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/shamssahal/toll-calculator/aggregator/disputes"
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+var (
+	ErrNotAnInvoice    = errors.New("transaction is not an invoice charge")
+	ErrLineNotFound    = errors.New("the invoice has no line for the OBU")
+	ErrUnknownReading  = errors.New("reading is not part of the attached evidence")
+	ErrCreditTooLarge  = errors.New("credit exceeds the invoice total")
+	ErrNothingToCredit = errors.New("re-rating does not lower the invoice")
+)
+
+// Disputes settles contested invoices. Invoices are never changed, every
+// correction is booked as a ledger credit referencing the dispute.
+type Disputes struct {
+	book    *disputes.Book
+	billing *Billing
+	// priced directly, the middlewares would count re-ratings as invoices
+	invoices *InvoiceAggregator
+	store    Storer
+}
+
+// invoice returns the charge an invoice was billed with and the invoice as
+// it is priced now.
+func (d *Disputes) invoice(ctx context.Context, invoiceID string) (ledger.Transaction, *types.AccountInvoice, error) {
+	charge, err := d.billing.ledger.Transaction(invoiceID)
+	if err != nil {
+		return charge, nil, err
+	}
+	if charge.Kind != ledger.KindCharge || charge.Period == nil {
+		return charge, nil, ErrNotAnInvoice
+	}
+	inv, err := d.invoices.CalculateAccountInvoice(ctx, charge.AccountID, *charge.Period)
+	return charge, inv, err
+}
+
+// Open disputes a whole invoice, or the line of one OBU when obuID is not 0.
+// Prepaid accounts are charged as they drive and have no invoices to
+// dispute.
+func (d *Disputes) Open(ctx context.Context, invoiceID string, obuID int, reason, actor string) (disputes.Dispute, error) {
+	charge, inv, err := d.invoice(ctx, invoiceID)
+	if err != nil {
+		return disputes.Dispute{}, err
+	}
+	if obuID != 0 && !slices.ContainsFunc(inv.Vehicles, func(v types.VehicleSubtotal) bool { return v.OBUID == obuID }) {
+		return disputes.Dispute{}, fmt.Errorf("%w %d", ErrLineNotFound, obuID)
+	}
+	return d.book.Open(disputes.Dispute{
+		AccountID: charge.AccountID,
+		InvoiceID: charge.ID,
+		Period:    *charge.Period,
+		OBUID:     obuID,
+		Reason:    reason,
+		OpenedBy:  actor,
+	})
+}
+
+// AttachEvidence snapshots the readings behind the disputed line, or behind
+// every line when the whole invoice is disputed.
+func (d *Disputes) AttachEvidence(ctx context.Context, id, actor string) (disputes.Dispute, error) {
+	dispute, err := d.book.Get(id)
+	if err != nil {
+		return dispute, err
+	}
+	obuIDs := []int{dispute.OBUID}
+	if dispute.OBUID == 0 {
+		_, inv, err := d.invoice(ctx, dispute.InvoiceID)
+		if err != nil {
+			return dispute, err
+		}
+		obuIDs = obuIDs[:0]
+		for _, v := range inv.Vehicles {
+			obuIDs = append(obuIDs, v.OBUID)
+		}
+	}
+	for _, obuID := range obuIDs {
+		readings, err := d.store.Readings(ctx, obuID, dispute.Period.From, dispute.Period.To)
+		if err != nil {
+			return dispute, err
+		}
+		ev := disputes.Evidence{OBUID: obuID, Readings: make([]disputes.Reading, len(readings)), AttachedBy: actor}
+		for i, r := range readings {
+			ev.Readings[i].Distance = r
+			ev.Distance += r.Value
+		}
+		if dispute, err = d.book.AttachEvidence(id, ev); err != nil {
+			return dispute, err
+		}
+	}
+	return dispute, nil
+}
+
+// CreditNote resolves a dispute by crediting an amount agreed with the
+// customer, taxes included.
+func (d *Disputes) CreditNote(id string, amount types.Money, memo, actor string) (disputes.Dispute, error) {
+	dispute, err := d.book.Get(id)
+	if err != nil {
+		return dispute, err
+	}
+	if dispute.Status != disputes.StatusOpen {
+		return dispute, disputes.ErrDisputeClosed
+	}
+	adjustment := types.Adjustment{Rule: "credit-note", Reason: memo, Amount: amount.Neg()}
+	if adjustment.Reason == "" {
+		adjustment.Reason = dispute.Reason
+	}
+	return d.resolve(dispute, disputes.Resolution{
+		Kind:        disputes.ResolutionCreditNote,
+		Memo:        memo,
+		Actor:       actor,
+		Adjustments: []types.Adjustment{adjustment},
+	}, amount)
+}
+
+// Rerate resolves a dispute by pricing the invoice again without readings
+// the evidence showed to be wrong, e.g. GPS jumps. What the invoice was
+// charged minus the re-rated total, taxes included, is credited, so tariff
+// or rule changes since the period was closed are credited too. Readings
+// earlier disputes of the invoice excluded stay excluded, what they and
+// credit notes credited is not credited again.
+func (d *Disputes) Rerate(ctx context.Context, id string, exclude []string, memo, actor string) (disputes.Dispute, error) {
+	dispute, err := d.book.Get(id)
+	if err != nil {
+		return dispute, err
+	}
+	if dispute.Status != disputes.StatusOpen {
+		return dispute, disputes.ErrDisputeClosed
+	}
+	// only readings that were attached can be excluded, so the resolution
+	// can be traced back to the evidence
+	attached := make(map[string]types.Distance)
+	for _, ev := range dispute.Evidence {
+		for _, r := range ev.Readings {
+			attached[r.Key] = r.Distance
+		}
+	}
+	credited, before := d.earlier(dispute)
+	excluded := make([]types.Distance, 0, len(before)+len(exclude))
+	for _, r := range before {
+		excluded = append(excluded, r)
+	}
+	for _, key := range exclude {
+		r, ok := attached[key]
+		if !ok {
+			return dispute, fmt.Errorf("%w: %q", ErrUnknownReading, key)
+		}
+		if _, ok := before[key]; !ok {
+			excluded = append(excluded, r)
+		}
+	}
+	charge, inv, err := d.invoice(ctx, dispute.InvoiceID)
+	if err != nil {
+		return dispute, err
+	}
+	rerated, err := d.invoices.RerateAccountInvoice(ctx, dispute.AccountID, dispute.Period, excluded)
+	if err != nil {
+		return dispute, err
+	}
+	// the receivable posting of the charge
+	charged := charge.Postings[0].Amount
+	credit, err := charged.Add(rerated.TotalAmount.Neg())
+	if err != nil {
+		return dispute, err
+	}
+	credit.Units -= credited
+	if credit.Units <= 0 {
+		return dispute, ErrNothingToCredit
+	}
+	adjustments := rerateAdjustments(charged, inv, rerated)
+	if credited != 0 {
+		adjustments = append(adjustments, types.Adjustment{
+			Rule:   "rerate",
+			Reason: "credited by earlier disputes of the invoice",
+			Amount: types.NewMoney(credited, credit.Currency),
+		})
+	}
+	return d.resolve(dispute, disputes.Resolution{
+		Kind:        disputes.ResolutionRerate,
+		Memo:        memo,
+		Actor:       actor,
+		Adjustments: adjustments,
+		Excluded:    exclude,
+	}, credit)
+}
+
+// earlier returns what the other resolved disputes of the invoice of a
+// dispute credited and the readings they excluded.
+func (d *Disputes) earlier(dispute disputes.Dispute) (int64, map[string]types.Distance) {
+	var (
+		credited int64
+		excluded = make(map[string]types.Distance)
+	)
+	for _, other := range d.book.List(dispute.AccountID) {
+		if other.ID == dispute.ID || other.InvoiceID != dispute.InvoiceID {
+			continue
+		}
+		credited += other.Credited()
+		maps.Copy(excluded, other.Excluded())
+	}
+	return credited, excluded
+}
+
+// rerateAdjustments lists what changed per line and in taxes, and what the
+// invoice priced now differs from what was charged. Together they add up to
+// the credit.
+func rerateAdjustments(charged types.Money, inv, rerated *types.AccountInvoice) []types.Adjustment {
+	var res []types.Adjustment
+	if repriced, err := inv.TotalAmount.Add(charged.Neg()); err == nil && !repriced.IsZero() {
+		res = append(res, types.Adjustment{
+			Rule:   "rerate",
+			Reason: "tariff and rules changed since the invoice was charged",
+			Amount: repriced,
+		})
+	}
+	for n, line := range inv.Vehicles {
+		diff := rerated.Vehicles[n].Amount
+		diff.Units -= line.Amount.Units
+		if diff.IsZero() {
+			continue
+		}
+		res = append(res, types.Adjustment{
+			Rule:   "rerate",
+			Reason: fmt.Sprintf("%s: %.3f km instead of %.3f km", line.Plate, rerated.Vehicles[n].Distance, line.Distance),
+			Amount: diff,
+		})
+	}
+	taxDiff := withTaxes(types.NewMoney(0, inv.TotalAmount.Currency), rerated.Taxes)
+	taxDiff.Units -= withTaxes(types.NewMoney(0, inv.TotalAmount.Currency), inv.Taxes).Units
+	if !taxDiff.IsZero() {
+		res = append(res, types.Adjustment{Rule: "rerate", Reason: "tax", Amount: taxDiff})
+	}
+	return res
+}
+
+// resolve books the credit and closes the dispute. The credit is referenced
+// by the dispute, so resolving again after a failure to save the dispute
+// does not credit twice. All disputes of an invoice together never credit
+// more than it charged.
+func (d *Disputes) resolve(dispute disputes.Dispute, res disputes.Resolution, credit types.Money) (disputes.Dispute, error) {
+	charge, err := d.billing.ledger.Transaction(dispute.InvoiceID)
+	if err != nil {
+		return dispute, err
+	}
+	credited, _ := d.earlier(dispute)
+	// the receivable posting of the charge
+	if credited+credit.Units > charge.Postings[0].Amount.Units {
+		return dispute, ErrCreditTooLarge
+	}
+	memo := fmt.Sprintf("dispute %s", dispute.ID)
+	if res.Memo != "" {
+		memo += ": " + res.Memo
+	}
+	tx, err := d.billing.ledger.Post(ledger.KindCredit, dispute.AccountID, credit, "dispute:"+dispute.ID, memo, res.Actor)
+	if err != nil && !errors.Is(err, ledger.ErrDuplicateReference) {
+		return dispute, err
+	}
+	res.TransactionID = tx.ID
+	d.billing.prepaid.Refresh(dispute.AccountID)
+	return d.book.Resolve(dispute.ID, res)
+}
+
+func (d *Disputes) Reject(id, memo, actor string) (disputes.Dispute, error) {
+	return d.book.Resolve(id, disputes.Resolution{
+		Kind:  disputes.ResolutionRejected,
+		Memo:  memo,
+		Actor: actor,
+	})
+}
+
+// makeDisputes keeps the dispute history in AGG_DISPUTES_FILE, without it
+// disputes only live in memory.
+func makeDisputes() *disputes.Book {
+	var store disputes.Store = disputes.NewMemoryStore()
+	if path := os.Getenv("AGG_DISPUTES_FILE"); path != "" {
+		fs, err := disputes.NewFileStore(path)
+		if err != nil {
+			log.Fatalf("failed to open disputes %s: %v", path, err)
+		}
+		store = fs
+	}
+	book, err := disputes.New(store)
+	if err != nil {
+		log.Fatalf("failed to load disputes: %v", err)
+	}
+	return book
+}
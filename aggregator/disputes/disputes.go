@@ -0,0 +1,314 @@
+// Package disputes tracks customers contesting an invoice or one of its
+// lines. A dispute never changes the invoice, it is resolved with a credit
+// note or a re-rating that is booked as a credit and recorded on the
+// dispute as adjustments.
+package disputes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+const (
+	StatusOpen     = "open"
+	StatusResolved = "resolved"
+	StatusRejected = "rejected"
+)
+
+const (
+	// an amount agreed with the customer is credited
+	ResolutionCreditNote = "credit_note"
+	// the invoice is priced again without readings found to be wrong
+	ResolutionRerate   = "rerate"
+	ResolutionRejected = "rejected"
+)
+
+var (
+	ErrDisputeNotFound = errors.New("dispute not found")
+	ErrAlreadyOpen     = errors.New("the invoice line is already disputed")
+	ErrDisputeClosed   = errors.New("dispute is closed")
+)
+
+// Evidence is a snapshot of the readings behind one line of the disputed
+// invoice, taken when it was attached.
+type Evidence struct {
+	OBUID    int       `json:"obuID"`
+	Readings []Reading `json:"readings"`
+	// the readings summed up
+	Distance   float64   `json:"distance"`
+	AttachedBy string    `json:"attachedBy"`
+	AttachedAt time.Time `json:"attachedAt"`
+}
+
+// Reading is a distance of the evidence and the key to exclude it by.
+type Reading struct {
+	Key string `json:"key"`
+	types.Distance
+}
+
+// keyReadings gives every reading a key. RequestIDs can be empty or
+// repeat, the key is a hash of the reading instead, numbered when the
+// same reading was aggregated more than once.
+func keyReadings(readings []Reading) {
+	seen := make(map[string]int, len(readings))
+	for i := range readings {
+		r := &readings[i]
+		sum := sha256.Sum256(fmt.Appendf(nil, "%d|%d|%g|%s|%d", r.OBUID, r.Unix, r.Value, r.RequestID, r.ReceivedAt))
+		key := hex.EncodeToString(sum[:8])
+		if n := seen[key]; n > 0 {
+			r.Key = fmt.Sprintf("%s-%d", key, n)
+		} else {
+			r.Key = key
+		}
+		seen[key]++
+	}
+}
+
+type Resolution struct {
+	Kind  string    `json:"kind"`
+	Memo  string    `json:"memo,omitempty"`
+	Actor string    `json:"actor"`
+	At    time.Time `json:"at"`
+	// ledger credit booked for the dispute, empty when it was rejected
+	TransactionID string `json:"transactionId,omitempty"`
+	// what the credit is made of, negative amounts lower the invoice
+	Adjustments []types.Adjustment `json:"adjustments,omitempty"`
+	// keys of the readings the invoice was re-rated without
+	Excluded []string `json:"excluded,omitempty"`
+}
+
+type Dispute struct {
+	ID        string `json:"id"`
+	AccountID string `json:"accountId"`
+	// ledger charge the invoice was billed with
+	InvoiceID string       `json:"invoiceId"`
+	Period    types.Period `json:"period"`
+	// the disputed line, 0 when the whole invoice is disputed
+	OBUID      int         `json:"obuID,omitempty"`
+	Reason     string      `json:"reason"`
+	Status     string      `json:"status"`
+	OpenedBy   string      `json:"openedBy"`
+	OpenedAt   time.Time   `json:"openedAt"`
+	Evidence   []Evidence  `json:"evidence"`
+	Resolution *Resolution `json:"resolution,omitempty"`
+	// when the dispute last changed, of two states of a dispute the later
+	// one wins
+	UpdatedAt time.Time `json:"updatedAt,omitzero"`
+}
+
+// Credited is what a resolved dispute credited in minor units, its
+// adjustments summed up.
+func (d Dispute) Credited() int64 {
+	if d.Status != StatusResolved || d.Resolution == nil {
+		return 0
+	}
+	var units int64
+	for _, a := range d.Resolution.Adjustments {
+		units -= a.Amount.Units
+	}
+	return units
+}
+
+// Excluded returns the readings of the evidence a resolved dispute re-rated
+// the invoice without, by key.
+func (d Dispute) Excluded() map[string]types.Distance {
+	if d.Status != StatusResolved || d.Resolution == nil || len(d.Resolution.Excluded) == 0 {
+		return nil
+	}
+	keys := make(map[string]bool, len(d.Resolution.Excluded))
+	for _, key := range d.Resolution.Excluded {
+		keys[key] = true
+	}
+	res := make(map[string]types.Distance, len(keys))
+	for _, ev := range d.Evidence {
+		for _, r := range ev.Readings {
+			if keys[r.Key] {
+				res[r.Key] = r.Distance
+			}
+		}
+	}
+	return res
+}
+
+// Book holds the current state of every dispute.
+type Book struct {
+	mu       sync.RWMutex
+	store    Store
+	disputes []Dispute
+	byID     map[string]int
+	// called with every new state, see OnSave
+	onSave func(Dispute) error
+}
+
+// New replays the dispute history of the store, the last state of each
+// dispute wins.
+func New(store Store) (*Book, error) {
+	history, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	b := &Book{store: store, byID: make(map[string]int)}
+	for _, d := range history {
+		// evidence attached before readings had keys
+		for _, ev := range d.Evidence {
+			if len(ev.Readings) > 0 && ev.Readings[0].Key == "" {
+				keyReadings(ev.Readings)
+			}
+		}
+		b.index(d)
+	}
+	return b, nil
+}
+
+func (b *Book) index(d Dispute) {
+	if i, ok := b.byID[d.ID]; ok {
+		b.disputes[i] = d
+		return
+	}
+	b.disputes = append(b.disputes, d)
+	b.byID[d.ID] = len(b.disputes) - 1
+}
+
+// OnSave has fn called with every new state of a dispute from then on,
+// once it is stored and outside the lock of the book. Its error is returned
+// to the caller of the change. Set it before the book is used.
+func (b *Book) OnSave(fn func(Dispute) error) {
+	b.onSave = fn
+}
+
+// saved hands a new state to the OnSave hook, the caller no longer holds
+// b.mu.
+func (b *Book) saved(d Dispute, err error) (Dispute, error) {
+	if err != nil || b.onSave == nil {
+		return d, err
+	}
+	return d, b.onSave(d)
+}
+
+// save persists a new state of a dispute, the caller holds b.mu.
+func (b *Book) save(d Dispute) (Dispute, error) {
+	now := time.Now().UTC()
+	if i, ok := b.byID[d.ID]; ok && !now.After(b.disputes[i].UpdatedAt) {
+		// a state applied from another book may be ahead of this clock
+		now = b.disputes[i].UpdatedAt.Add(time.Nanosecond)
+	}
+	d.UpdatedAt = now
+	if err := b.store.Append(d); err != nil {
+		return d, err
+	}
+	b.index(d)
+	return d, nil
+}
+
+// Open starts a dispute. While a line, or the whole invoice, is disputed
+// opening it again returns the open dispute with ErrAlreadyOpen.
+func (b *Book) Open(d Dispute) (Dispute, error) {
+	return b.saved(b.open(d))
+}
+
+func (b *Book) open(d Dispute) (Dispute, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, open := range b.disputes {
+		if open.Status == StatusOpen && open.InvoiceID == d.InvoiceID && open.OBUID == d.OBUID {
+			return open, ErrAlreadyOpen
+		}
+	}
+	d.ID = uuid.New().String()
+	d.Status = StatusOpen
+	d.OpenedAt = time.Now().UTC()
+	d.Evidence = []Evidence{}
+	d.Resolution = nil
+	return b.save(d)
+}
+
+func (b *Book) Get(id string) (Dispute, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	i, ok := b.byID[id]
+	if !ok {
+		return Dispute{}, ErrDisputeNotFound
+	}
+	return b.disputes[i], nil
+}
+
+// List returns the disputes of an account, or of every account when the id
+// is empty, oldest first.
+func (b *Book) List(accountID string) []Dispute {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	res := []Dispute{}
+	for _, d := range b.disputes {
+		if accountID == "" || d.AccountID == accountID {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// update applies fn to an open dispute and saves the result.
+func (b *Book) update(id string, fn func(*Dispute)) (Dispute, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i, ok := b.byID[id]
+	if !ok {
+		return Dispute{}, ErrDisputeNotFound
+	}
+	d := b.disputes[i]
+	if d.Status != StatusOpen {
+		return d, ErrDisputeClosed
+	}
+	// copy, the stored state must not change if saving fails
+	d.Evidence = slices.Clone(d.Evidence)
+	fn(&d)
+	return b.save(d)
+}
+
+// AttachEvidence adds the readings of a line to a dispute. Attaching a line
+// again replaces its earlier snapshot, late readings may have arrived.
+func (b *Book) AttachEvidence(id string, ev Evidence) (Dispute, error) {
+	ev.AttachedAt = time.Now().UTC()
+	keyReadings(ev.Readings)
+	return b.saved(b.update(id, func(d *Dispute) {
+		d.Evidence = slices.DeleteFunc(d.Evidence, func(e Evidence) bool {
+			return e.OBUID == ev.OBUID
+		})
+		d.Evidence = append(d.Evidence, ev)
+	}))
+}
+
+// Resolve closes a dispute, rejected or not depending on the kind of the
+// resolution.
+func (b *Book) Resolve(id string, res Resolution) (Dispute, error) {
+	res.At = time.Now().UTC()
+	return b.saved(b.update(id, func(d *Dispute) {
+		d.Status = StatusResolved
+		if res.Kind == ResolutionRejected {
+			d.Status = StatusRejected
+		}
+		d.Resolution = &res
+	}))
+}
+
+// Apply stores a state of a dispute another book of the cluster saved,
+// unless the book holds a later one.
+func (b *Book) Apply(d Dispute) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if i, ok := b.byID[d.ID]; ok && !d.UpdatedAt.After(b.disputes[i].UpdatedAt) {
+		return false, nil
+	}
+	if err := b.store.Append(d); err != nil {
+		return false, err
+	}
+	b.index(d)
+	return true, nil
+}
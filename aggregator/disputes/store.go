@@ -0,0 +1,72 @@
+package disputes
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/shamssahal/toll-calculator/aggregator/jsonl"
+)
+
+// Store persists every state a dispute went through, states are only ever
+// appended.
+type Store interface {
+	Append(Dispute) error
+	Load() ([]Dispute, error)
+}
+
+type MemoryStore struct {
+	mu      sync.Mutex
+	history []Dispute
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Append(d Dispute) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, d)
+	return nil
+}
+
+func (s *MemoryStore) Load() ([]Dispute, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Dispute(nil), s.history...), nil
+}
+
+// FileStore keeps the history as JSON Lines, synced after every change.
+type FileStore struct {
+	file *jsonl.File
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	f, err := jsonl.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{file: f}, nil
+}
+
+func (s *FileStore) Append(d Dispute) error {
+	return s.file.Append(d)
+}
+
+// Load reads the history, a torn last line is cut off.
+func (s *FileStore) Load() ([]Dispute, error) {
+	var history []Dispute
+	err := s.file.Load(func(line []byte) error {
+		var d Dispute
+		if err := json.Unmarshal(line, &d); err != nil {
+			return err
+		}
+		history = append(history, d)
+		return nil
+	})
+	return history, err
+}
+
+func (s *FileStore) Close() error {
+	return s.file.Close()
+}
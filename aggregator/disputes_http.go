@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/shamssahal/toll-calculator/aggregator/disputes"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+func registerDisputeRoutes(mux *http.ServeMux, d *Disputes) {
+	disputeHandler := newHTTPMetricHandler("/disputes")
+	mux.HandleFunc("POST /disputes", disputeHandler.instrumentAndLog(handleOpenDispute(d)))
+	mux.HandleFunc("GET /disputes", disputeHandler.instrumentAndLog(handleListDisputes(d)))
+	mux.HandleFunc("GET /disputes/{id}", disputeHandler.instrumentAndLog(handleGetDispute(d)))
+	mux.HandleFunc("POST /disputes/{id}/evidence", disputeHandler.instrumentAndLog(handleAttachEvidence(d)))
+	mux.HandleFunc("POST /disputes/{id}/credit-note", disputeHandler.instrumentAndLog(handleCreditNote(d)))
+	mux.HandleFunc("POST /disputes/{id}/rerate", disputeHandler.instrumentAndLog(handleRerate(d)))
+	mux.HandleFunc("POST /disputes/{id}/reject", disputeHandler.instrumentAndLog(handleRejectDispute(d)))
+}
+
+func writeDisputeError(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, disputes.ErrDisputeNotFound):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrNotAnInvoice), errors.Is(err, ErrLineNotFound), errors.Is(err, ErrUnknownReading),
+		errors.Is(err, ErrCreditTooLarge):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, disputes.ErrDisputeClosed), errors.Is(err, ErrNothingToCredit):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrReadingsExpired):
+		writeJSON(w, http.StatusGone, map[string]string{"error": err.Error()})
+	default:
+		return writeLedgerError(w, err)
+	}
+	return err
+}
+
+// handleOpenDispute opens a dispute on an invoice, the ledger charge it was
+// billed with, or on one of its lines. Opening an open dispute again
+// returns it with 409.
+func handleOpenDispute(d *Disputes) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var req struct {
+			InvoiceID string `json:"invoiceId"`
+			OBUID     int    `json:"obuID"`
+			Reason    string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		if req.InvoiceID == "" || req.Reason == "" {
+			err := errors.New("invoiceId and reason are required")
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		dispute, err := d.Open(r.Context(), req.InvoiceID, req.OBUID, req.Reason, actor(r))
+		if errors.Is(err, disputes.ErrAlreadyOpen) {
+			writeJSON(w, http.StatusConflict, dispute)
+			return err
+		}
+		if err != nil {
+			return writeDisputeError(w, err)
+		}
+		writeJSON(w, http.StatusCreated, dispute)
+		return nil
+	}
+}
+
+func handleListDisputes(d *Disputes) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		writeJSON(w, http.StatusOK, d.book.List(r.URL.Query().Get("accountId")))
+		return nil
+	}
+}
+
+func handleGetDispute(d *Disputes) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dispute, err := d.book.Get(r.PathValue("id"))
+		if err != nil {
+			return writeDisputeError(w, err)
+		}
+		writeJSON(w, http.StatusOK, dispute)
+		return nil
+	}
+}
+
+func handleAttachEvidence(d *Disputes) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		dispute, err := d.AttachEvidence(r.Context(), r.PathValue("id"), actor(r))
+		if err != nil {
+			return writeDisputeError(w, err)
+		}
+		writeJSON(w, http.StatusCreated, dispute)
+		return nil
+	}
+}
+
+func handleCreditNote(d *Disputes) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var req struct {
+			// in major units of the account currency, taxes included
+			Amount json.Number `json:"amount"`
+			Memo   string      `json:"memo"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		dispute, err := d.book.Get(r.PathValue("id"))
+		if err != nil {
+			return writeDisputeError(w, err)
+		}
+		account, err := d.billing.registry.GetAccount(dispute.AccountID)
+		if err != nil {
+			return writeDisputeError(w, err)
+		}
+		amount, err := types.ParseMoney(req.Amount.String(), d.billing.currency(account))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		if dispute, err = d.CreditNote(dispute.ID, amount, req.Memo, actor(r)); err != nil {
+			return writeDisputeError(w, err)
+		}
+		writeJSON(w, http.StatusOK, dispute)
+		return nil
+	}
+}
+
+func handleRerate(d *Disputes) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var req struct {
+			// keys of attached readings to price the invoice without
+			Exclude []string `json:"exclude"`
+			Memo    string   `json:"memo"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		dispute, err := d.Rerate(r.Context(), r.PathValue("id"), req.Exclude, req.Memo, actor(r))
+		if err != nil {
+			return writeDisputeError(w, err)
+		}
+		writeJSON(w, http.StatusOK, dispute)
+		return nil
+	}
+}
+
+func handleRejectDispute(d *Disputes) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var req struct {
+			Memo string `json:"memo"`
+		}
+		// the memo is optional
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		dispute, err := d.Reject(r.PathValue("id"), req.Memo, actor(r))
+		if err != nil {
+			return writeDisputeError(w, err)
+		}
+		writeJSON(w, http.StatusOK, dispute)
+		return nil
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/disputes"
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// newTestDisputes charges an account for the distances of OBU 7, at 3.70
+// EUR per km without taxes, and returns the charge.
+func newTestDisputes(t *testing.T, distances ...float64) (*Disputes, ledger.Transaction) {
+	t.Helper()
+	var (
+		ctx   = context.Background()
+		store = NewMemoryStore(defaultReadingsRetention)
+		reg   = registry.NewMemoryRegistry()
+	)
+	l, err := ledger.New(ledger.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := disputes.New(disputes.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := reg.PutAccount(types.Account{Name: "fleet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.PutVehicle(types.Vehicle{OBUID: 7, Plate: "B-7", Class: types.ClassCar, AccountID: account.ID}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Hour)
+	period := types.Period{From: now.Add(-48 * time.Hour), To: now.Add(-time.Hour)}
+	for i, v := range distances {
+		d := types.Distance{OBUID: 7, Value: v, Unix: period.From.Add(time.Duration(i+1) * time.Minute).UnixNano(), RequestID: fmt.Sprintf("r%d", i)}
+		if err := store.Insert(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invoice := NewInvoiceAggregator(store, reg, Tariff{Currency: "EUR"}, nil)
+	inv, err := invoice.CalculateAccountInvoice(ctx, account.ID, period)
+	if err != nil {
+		t.Fatal(err)
+	}
+	charge, err := l.Charge(account.ID, period, inv.TotalAmount, period.To.Add(14*24*time.Hour), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	billing := &Billing{
+		svc:      invoice,
+		registry: reg,
+		ledger:   l,
+		prepaid:  &PrepaidMiddleware{registry: reg, ledger: l, accounts: make(map[string]*prepaidAccount)},
+
+		defaultCurrency: "EUR",
+	}
+	return &Disputes{book: book, billing: billing, invoices: invoice, store: store}, charge
+}
+
+// openWithEvidence disputes the line of OBU 7 and returns the keys of its
+// readings by distance.
+func openWithEvidence(t *testing.T, d *Disputes, invoiceID string) (disputes.Dispute, map[float64]string) {
+	t.Helper()
+	ctx := context.Background()
+	dispute, err := d.Open(ctx, invoiceID, 7, "gps jump", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dispute, err = d.AttachEvidence(ctx, dispute.ID, "test"); err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[float64]string)
+	for _, r := range dispute.Evidence[0].Readings {
+		keys[r.Value] = r.Key
+	}
+	return dispute, keys
+}
+
+func credited(t *testing.T, d *Disputes, accountID string) int64 {
+	t.Helper()
+	return d.billing.ledger.Balance(accountID, time.Now()).Credited.Units
+}
+
+// A later dispute of the same invoice credits what earlier ones did not.
+func TestRerateCreditsOnce(t *testing.T) {
+	ctx := context.Background()
+	d, charge := newTestDisputes(t, 10, 10, 10, 500, 300)
+	if charge.Postings[0].Amount.Units != 307_100 {
+		t.Fatalf("charged %v", charge.Postings[0].Amount)
+	}
+
+	first, keys := openWithEvidence(t, d, charge.ID)
+	first, err := d.Rerate(ctx, first.ID, []string{keys[500]}, "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := credited(t, d, charge.AccountID); got != 185_000 {
+		t.Fatalf("credited %d", got)
+	}
+	if got := first.Credited(); got != 185_000 {
+		t.Fatalf("adjustments add up to %d", got)
+	}
+
+	// the same reading again
+	second, keys := openWithEvidence(t, d, charge.ID)
+	if _, err := d.Rerate(ctx, second.ID, []string{keys[500]}, "", "test"); !errors.Is(err, ErrNothingToCredit) {
+		t.Fatalf("got %v, want ErrNothingToCredit", err)
+	}
+
+	// another reading, the first one stays excluded
+	second, err = d.Rerate(ctx, second.ID, []string{keys[300]}, "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := credited(t, d, charge.AccountID); got != 185_000+111_000 {
+		t.Fatalf("credited %d", got)
+	}
+	if got := second.Credited(); got != 111_000 {
+		t.Fatalf("adjustments add up to %d", got)
+	}
+}
+
+// A credit note lowers what a re-rating credits, all disputes of an invoice
+// together credit at most what it charged.
+func TestDisputeCreditCap(t *testing.T) {
+	ctx := context.Background()
+	d, charge := newTestDisputes(t, 10, 500)
+
+	note, err := d.Open(ctx, charge.ID, 0, "goodwill", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreditNote(note.ID, types.NewMoney(10_000, "EUR"), "goodwill", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	rerate, keys := openWithEvidence(t, d, charge.ID)
+	if _, err := d.Rerate(ctx, rerate.ID, []string{keys[500]}, "", "test"); err != nil {
+		t.Fatal(err)
+	}
+	// 500 km at 3.70, less the credit note
+	if got := credited(t, d, charge.AccountID); got != 10_000+175_000 {
+		t.Fatalf("credited %d", got)
+	}
+
+	// 37.00 are left on the invoice
+	over, err := d.Open(ctx, charge.ID, 0, "more", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreditNote(over.ID, types.NewMoney(3_701, "EUR"), "", "test"); !errors.Is(err, ErrCreditTooLarge) {
+		t.Fatalf("got %v, want ErrCreditTooLarge", err)
+	}
+	if _, err := d.CreditNote(over.ID, types.NewMoney(3_700, "EUR"), "", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.billing.ledger.Owed(charge.AccountID); !got.IsZero() {
+		t.Fatalf("owed %v once fully credited", got)
+	}
+
+	last, keys := openWithEvidence(t, d, charge.ID)
+	if _, err := d.Rerate(ctx, last.ID, []string{keys[10]}, "", "test"); !errors.Is(err, ErrNothingToCredit) {
+		t.Fatalf("got %v, want ErrNothingToCredit", err)
+	}
+}
@@ -0,0 +1,207 @@
+// Package eventlog is the append-only log of every distance the aggregator
+// accepted. Totals, buckets and invoices are all derived from it, so state
+// can be rebuilt and invoices re-rated after a tariff fix.
+package eventlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+type Event struct {
+	// 1 for the first event, without gaps
+	Seq      uint64         `json:"seq"`
+	Distance types.Distance `json:"distance"`
+}
+
+// Log keeps events as JSON Lines. Appends are group committed: events
+// written while an fsync is running are made durable together by the next
+// one.
+type Log struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	// of the last event written
+	seq uint64
+	// end of the last event written, where the next one starts
+	offset int64
+	// the last durable event and the offset after it
+	synced       uint64
+	syncedOffset int64
+	// bumped when a failed write or sync cut off the events after synced,
+	// cut holds the last durable event of every earlier generation
+	gen    uint64
+	cut    []uint64
+	broken bool
+
+	// held by the append running the fsync, the others wait for it
+	syncMu sync.Mutex
+}
+
+// Open opens or creates a log. A torn last line from a crash mid-write is
+// cut off so the next event starts on a line of its own.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{path: path, file: f}
+	err = l.Replay(0, func(ev Event, next int64) error {
+		l.seq, l.offset = ev.Seq, next
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.synced, l.syncedOffset = l.seq, l.offset
+	if err := l.truncate(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// truncate cuts the file after the last durable event, the caller holds
+// l.mu.
+func (l *Log) truncate() error {
+	if err := l.file.Truncate(l.syncedOffset); err != nil {
+		return err
+	}
+	if _, err := l.file.Seek(l.syncedOffset, io.SeekStart); err != nil {
+		return err
+	}
+	l.seq, l.offset = l.synced, l.syncedOffset
+	l.broken = false
+	return nil
+}
+
+// fail gives up on the events that are not durable yet, they are cut off
+// before the next event is written. The caller holds l.mu.
+func (l *Log) fail() {
+	l.cut = append(l.cut, l.synced)
+	l.gen++
+	l.broken = true
+}
+
+// Append writes the next event and returns its sequence number once it is
+// durable. After a failed write or sync the events that were not durable
+// yet fail as well and the log continues after the last one that was.
+func (l *Log) Append(d types.Distance) (uint64, error) {
+	l.mu.Lock()
+	if l.broken {
+		if err := l.truncate(); err != nil {
+			l.mu.Unlock()
+			return 0, err
+		}
+	}
+	ev := Event{Seq: l.seq + 1, Distance: d}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		l.mu.Unlock()
+		return 0, err
+	}
+	b = append(b, '\n')
+	if _, err := l.file.Write(b); err != nil {
+		l.fail()
+		l.mu.Unlock()
+		return 0, err
+	}
+	l.seq = ev.Seq
+	l.offset += int64(len(b))
+	gen := l.gen
+	l.mu.Unlock()
+	return ev.Seq, l.sync(ev.Seq, gen)
+}
+
+var errCutOff = errors.New("event was cut off after a failed write")
+
+// sync returns once the event seq of generation gen is durable. The first
+// caller to get syncMu syncs every event written so far, the ones waiting
+// behind it usually find theirs synced already.
+func (l *Log) sync(seq, gen uint64) error {
+	l.syncMu.Lock()
+	defer l.syncMu.Unlock()
+	l.mu.Lock()
+	if gen != l.gen {
+		durable := seq <= l.cut[gen]
+		l.mu.Unlock()
+		if !durable {
+			return errCutOff
+		}
+		return nil
+	}
+	if seq <= l.synced {
+		l.mu.Unlock()
+		return nil
+	}
+	target, targetOffset := l.seq, l.offset
+	l.mu.Unlock()
+
+	err := l.file.Sync()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if gen != l.gen {
+		// a write failed meanwhile, what reached the disk is unknown
+		return errCutOff
+	}
+	if err != nil {
+		l.fail()
+		return err
+	}
+	l.synced, l.syncedOffset = target, targetOffset
+	return nil
+}
+
+// Position returns the sequence number of the last durable event and the
+// offset after it.
+func (l *Log) Position() (uint64, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.synced, l.syncedOffset
+}
+
+// Replay calls fn for every complete event from the offset on, in order,
+// with the offset of the event after it. A torn last line is skipped,
+// anything else that does not parse is an error.
+func (l *Log) Replay(offset int64, fn func(ev Event, next int64) error) error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReaderSize(f, 1<<20)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		next := offset + int64(len(line))
+		var ev Event
+		if err := json.Unmarshal(bytes.TrimSuffix(line, []byte("\n")), &ev); err != nil {
+			return fmt.Errorf("%s at offset %d: %w", l.path, offset, err)
+		}
+		if err := fn(ev, next); err != nil {
+			return err
+		}
+		offset = next
+	}
+}
+
+func (l *Log) Close() error {
+	return l.file.Close()
+}
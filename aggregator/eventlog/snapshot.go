@@ -0,0 +1,62 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot is the state derived from the log up to and including an event,
+// replaying starts after it instead of from the beginning.
+type Snapshot struct {
+	Seq uint64 `json:"seq"`
+	// where the event after Seq starts in the log
+	Offset int64     `json:"offset"`
+	At     time.Time `json:"at"`
+	// owned by whoever derives the state
+	State json.RawMessage `json:"state"`
+}
+
+// SaveSnapshot replaces the snapshot at path. It is written next to it
+// first, a crash leaves either the old or the new snapshot behind.
+func SaveSnapshot(path string, s Snapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadSnapshot reads the snapshot at path, ok is false when there is none.
+func LoadSnapshot(path string) (s Snapshot, ok bool, err error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, err
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, false, err
+	}
+	return s, true, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	kafkaBroker        = "localhost:9092"
+	accountEventsTopic = "account-events"
+)
+
+type EventProducer interface {
+	ProduceEvent(types.AccountEvent) error
+	Close()
+}
+
+type kafkaEventProducer struct {
+	producer *kafka.Producer
+	topic    string
+}
+
+func NewKafkaEventProducer(topic string) (EventProducer, error) {
+	p, err := kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers": kafkaBroker,
+	})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for e := range p.Events() {
+			if ev, ok := e.(*kafka.Message); ok && ev.TopicPartition.Error != nil {
+				logrus.Errorf("account event delivery failed: %v", ev.TopicPartition.Error)
+			}
+		}
+	}()
+	return &kafkaEventProducer{
+		producer: p,
+		topic:    topic,
+	}, nil
+}
+
+// eventKey is the key of the events of an OBU. Events published before
+// they were keyed by OBU are keyed by account id and lack the prefix.
+func eventKey(obuID int) []byte {
+	return []byte("obu:" + strconv.Itoa(obuID))
+}
+
+// ProduceEvent keys events by OBU so a compacted topic keeps the latest
+// state of every OBU.
+func (p *kafkaEventProducer) ProduceEvent(ev types.AccountEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return p.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{
+			Topic:     &p.topic,
+			Partition: kafka.PartitionAny,
+		},
+		Key:   eventKey(ev.OBUID),
+		Value: b,
+	}, nil)
+}
+
+func (p *kafkaEventProducer) Close() {
+	p.producer.Flush(5_000)
+	p.producer.Close()
+}
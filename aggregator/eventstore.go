@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/eventlog"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultSnapshotEvery = 10_000
+
+var (
+	errSnapshotMismatch = errors.New("snapshot does not match the event log")
+	errStopReplay       = errors.New("stop replaying")
+)
+
+// EventSourcedStore logs every distance before aggregating it in memory,
+// readings are served from memory for as long as they are retained. On
+// start the latest snapshot is loaded and only the events after it are
+// replayed.
+type EventSourcedStore struct {
+	*MemoryStore
+	log          *eventlog.Log
+	snapshotPath string
+	// events between snapshots
+	snapshotEvery uint64
+
+	// held shared by inserts from appending until applying, a snapshot
+	// holds it exclusively so the state matches the position of the log
+	mu            sync.RWMutex
+	sinceSnapshot atomic.Uint64
+	snapshotting  atomic.Bool
+}
+
+func NewEventSourcedStore(l *eventlog.Log, snapshotPath string, snapshotEvery uint64, retention time.Duration) (*EventSourcedStore, error) {
+	s := &EventSourcedStore{
+		MemoryStore:   NewMemoryStore(retention),
+		log:           l,
+		snapshotPath:  snapshotPath,
+		snapshotEvery: snapshotEvery,
+	}
+	start := time.Now()
+	snap, ok, err := eventlog.LoadSnapshot(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load snapshot %s: %w", snapshotPath, err)
+	}
+	var offset int64
+	if seq, _ := l.Position(); ok && snap.Seq <= seq {
+		var state storeState
+		if err := json.Unmarshal(snap.State, &state); err != nil {
+			return nil, fmt.Errorf("failed to load snapshot %s: %w", snapshotPath, err)
+		}
+		s.restore(state)
+		offset = snap.Offset
+		if state.Retention == 0 {
+			// written before snapshots kept readings
+			if err := s.retainUntil(offset); err != nil {
+				return nil, err
+			}
+		}
+	} else if ok {
+		logrus.WithField("snapshot", snapshotPath).Warn("snapshot is ahead of the event log, replaying all events")
+		snap = eventlog.Snapshot{}
+	}
+	replayed, err := s.replay(snap.Seq, offset)
+	if err != nil {
+		return nil, err
+	}
+	logrus.WithFields(logrus.Fields{
+		"snapshotSeq": snap.Seq,
+		"replayed":    replayed,
+		"took":        time.Since(start),
+	}).Info("restored aggregator state from the event log")
+	return s, nil
+}
+
+// replay applies the events after seq, starting at offset. A log that does
+// not continue the snapshot there was replaced, it is replayed from the
+// beginning into an empty state.
+func (s *EventSourcedStore) replay(seq uint64, offset int64) (uint64, error) {
+	var replayed uint64
+	s.MemoryStore.mu.Lock()
+	defer s.MemoryStore.mu.Unlock()
+	err := s.log.Replay(offset, func(ev eventlog.Event, _ int64) error {
+		if ev.Seq != seq+1 {
+			return errSnapshotMismatch
+		}
+		s.apply(ev.Distance)
+		s.retain(ev.Distance)
+		seq = ev.Seq
+		replayed++
+		return nil
+	})
+	if errors.Is(err, errSnapshotMismatch) {
+		logrus.WithField("snapshot", s.snapshotPath).Warn("snapshot does not match the event log, replaying all events")
+		fresh := NewMemoryStore(s.retention)
+		s.data, s.hours, s.days, s.readings = fresh.data, fresh.hours, fresh.days, fresh.readings
+		replayed = 0
+		err = s.log.Replay(0, func(ev eventlog.Event, _ int64) error {
+			s.apply(ev.Distance)
+			s.retain(ev.Distance)
+			replayed++
+			return nil
+		})
+	}
+	s.sinceSnapshot.Store(replayed)
+	return replayed, err
+}
+
+// retainUntil keeps the readings of the events before offset, which the
+// state already holds.
+func (s *EventSourcedStore) retainUntil(offset int64) error {
+	s.MemoryStore.mu.Lock()
+	defer s.MemoryStore.mu.Unlock()
+	err := s.log.Replay(0, func(ev eventlog.Event, next int64) error {
+		if next > offset {
+			return errStopReplay
+		}
+		s.retain(ev.Distance)
+		return nil
+	})
+	if errors.Is(err, errStopReplay) {
+		return nil
+	}
+	return err
+}
+
+// Insert returns once the distance is durable and applied. Concurrent
+// inserts share an fsync.
+func (s *EventSourcedStore) Insert(ctx context.Context, d types.Distance) error {
+	s.mu.RLock()
+	if _, err := s.log.Append(d); err != nil {
+		s.mu.RUnlock()
+		return err
+	}
+	s.MemoryStore.Insert(ctx, d)
+	s.mu.RUnlock()
+	if n := s.sinceSnapshot.Add(1); s.snapshotEvery > 0 && n >= s.snapshotEvery && s.snapshotting.CompareAndSwap(false, true) {
+		go s.snapshot()
+	}
+	return nil
+}
+
+// snapshot waits for the inserts in flight, copies the state and writes
+// it.
+func (s *EventSourcedStore) snapshot() {
+	defer s.snapshotting.Store(false)
+	s.mu.Lock()
+	s.MemoryStore.mu.RLock()
+	state := s.state(true)
+	s.MemoryStore.mu.RUnlock()
+	seq, offset := s.log.Position()
+	s.sinceSnapshot.Store(0)
+	s.mu.Unlock()
+	if err := s.saveSnapshot(state, seq, offset); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"seq":   seq,
+			"error": err,
+		}).Error("failed to write snapshot")
+	}
+}
+
+func (s *EventSourcedStore) saveSnapshot(state storeState, seq uint64, offset int64) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return eventlog.SaveSnapshot(s.snapshotPath, eventlog.Snapshot{
+		Seq:    seq,
+		Offset: offset,
+		At:     time.Now().UTC(),
+		State:  b,
+	})
+}
+
+// makeEventLog opens AGG_EVENT_LOG, nil when it is not set.
+func makeEventLog() *eventlog.Log {
+	path := os.Getenv("AGG_EVENT_LOG")
+	if path == "" {
+		return nil
+	}
+	l, err := eventlog.Open(path)
+	if err != nil {
+		log.Fatalf("failed to open event log %s: %v", path, err)
+	}
+	return l
+}
+
+// snapshotEvery reads AGG_SNAPSHOT_EVERY, the number of events between
+// snapshots, 0 disables them.
+func snapshotEvery() uint64 {
+	v := os.Getenv("AGG_SNAPSHOT_EVERY")
+	if v == "" {
+		return defaultSnapshotEvery
+	}
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		log.Fatalf("invalid AGG_SNAPSHOT_EVERY %q: %v", v, err)
+	}
+	return n
+}
+
+func snapshotPath() string {
+	return os.Getenv("AGG_EVENT_LOG") + ".snapshot"
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 
 	"github.com/shamssahal/toll-calculator/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type GRPCAggregatorServer struct {
@@ -13,12 +16,29 @@ type GRPCAggregatorServer struct {
 
 func (s *GRPCAggregatorServer) Aggregate(ctx context.Context, req *types.AggregateRequest) (*types.None, error) {
 	distance := types.Distance{
-		OBUID:     int(req.ObuID),
-		Value:     float64(req.Value),
-		Unix:      int64(req.Unix),
-		RequestID: string(req.RequestID),
+		OBUID:      int(req.ObuID),
+		Value:      float64(req.Value),
+		Unix:       int64(req.Unix),
+		RequestID:  string(req.RequestID),
+		ReceivedAt: req.ReceivedAt,
+		PrevLat:    req.PrevLat,
+		PrevLong:   req.PrevLong,
+		CurrLat:    req.CurrLat,
+		CurrLong:   req.CurrLong,
+		Blocked:    req.Blocked,
 	}
 	err := s.svc.AggregateDistance(ctx, distance)
+	if errors.Is(err, ErrNoQuorum) {
+		// retrying is safe, the RequestID, or the key derived from the
+		// distance without one, is applied once
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	if errors.Is(err, ErrDuplicate) {
+		return &types.None{}, nil
+	}
+	if errors.Is(err, ErrWrongShard) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
 	if err != nil {
 		return nil, err
 	}
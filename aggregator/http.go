@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"time"
@@ -59,6 +60,19 @@ func (h *HTTPmetricHandler) instrumentAndLog(next HTTPHandlerWithError) http.Han
 	}
 }
 
+// aggregateStatus maps the errors of aggregating a distance to status codes.
+func aggregateStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrLateEvent):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrNoQuorum):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrWrongShard):
+		return http.StatusMisdirectedRequest
+	}
+	return http.StatusInternalServerError
+}
+
 func handleAggregate(svc Aggregator) HTTPHandlerWithError {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		var distance types.Distance
@@ -66,8 +80,9 @@ func handleAggregate(svc Aggregator) HTTPHandlerWithError {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 			return err
 		}
-		if err := svc.AggregateDistance(context.Background(), distance); err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		// a retry of a distance aggregated already succeeds
+		if err := svc.AggregateDistance(context.Background(), distance); err != nil && !errors.Is(err, ErrDuplicate) {
+			writeJSON(w, aggregateStatus(err), map[string]string{"error": err.Error()})
 			return err
 		}
 
@@ -95,3 +110,42 @@ func handleGetInvoice(svc Aggregator) HTTPHandlerWithError {
 		return nil
 	}
 }
+
+func handleGetSeries(svc Aggregator) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		q, err := types.ParseSeriesQuery(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		series, err := svc.DistanceSeries(r.Context(), q)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return err
+		}
+		writeJSON(w, http.StatusOK, series)
+		return nil
+	}
+}
+
+func handleGetAccountInvoice(svc Aggregator) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		accountID := r.URL.Query().Get("id")
+		if accountID == "" {
+			err := errors.New("missing 'id' query parameter")
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		period, err := types.ParsePeriod(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		invoice, err := svc.CalculateAccountInvoice(r.Context(), accountID, period)
+		if err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, http.StatusOK, invoice)
+		return nil
+	}
+}
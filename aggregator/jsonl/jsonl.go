@@ -0,0 +1,71 @@
+// Package jsonl keeps append-only histories, e.g. the ledger journal, as
+// JSON Lines. Every line is synced before Append returns.
+package jsonl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type File struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// Open opens or creates the file at path.
+func Open(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &File{path: path, file: f}, nil
+}
+
+// Append writes v as the next line.
+func (f *File) Append(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+// Load calls fn for every line, in order. A torn last line from a crash
+// mid-write is cut off so the next line starts on a line of its own. An
+// error of fn is returned with the path and the number of the line.
+func (f *File) Load(fn func(line []byte) error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i+1 < len(b) {
+		if err := f.file.Truncate(int64(i + 1)); err != nil {
+			return err
+		}
+		b = b[:i+1]
+	}
+	for n, line := range bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("%s line %d: %w", f.path, n+1, err)
+		}
+	}
+	return nil
+}
+
+func (f *File) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+var ErrLateEvent = errors.New("event is older than the lateness window")
+
+// LatenessMiddleware orders distances by event time rather than arrival.
+// Every OBU has a watermark trailing the newest event time seen for it by
+// the lateness window. Events above the watermark are accepted in any order,
+// events below it arrived too late and are dropped.
+type LatenessMiddleware struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	newest map[int]int64
+
+	outOfOrderCounter prometheus.Counter
+	lateCounter       prometheus.Counter
+
+	next Aggregator
+}
+
+// NewLatenessMiddleware returns next unchanged for a window <= 0.
+func NewLatenessMiddleware(next Aggregator, window time.Duration) Aggregator {
+	if window <= 0 {
+		return next
+	}
+	return &LatenessMiddleware{
+		window: window,
+		newest: make(map[int]int64),
+		outOfOrderCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "aggregator",
+			Name:      "out_of_order_events_total",
+			Help:      "Distances accepted with an event time before the newest one of their OBU.",
+		}),
+		lateCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "aggregator",
+			Name:      "late_events_total",
+			Help:      "Distances dropped for arriving after the lateness window.",
+		}),
+		next: next,
+	}
+}
+
+func (m *LatenessMiddleware) AggregateDistance(ctx context.Context, distance types.Distance) error {
+	if distance.Unix == 0 {
+		// producers that predate event times
+		distance.Unix = time.Now().UnixNano()
+	}
+	m.mu.Lock()
+	newest := m.newest[distance.OBUID]
+	if behind := time.Duration(newest - distance.Unix); behind > m.window {
+		m.mu.Unlock()
+		m.lateCounter.Inc()
+		return fmt.Errorf("%w: obu %d event is %s behind the newest one", ErrLateEvent, distance.OBUID, behind)
+	} else if behind > 0 {
+		m.outOfOrderCounter.Inc()
+	} else {
+		m.newest[distance.OBUID] = distance.Unix
+	}
+	m.mu.Unlock()
+	return m.next.AggregateDistance(ctx, distance)
+}
+
+func (m *LatenessMiddleware) CalculateInvoice(ctx context.Context, obuID int) (*types.Invoice, error) {
+	return m.next.CalculateInvoice(ctx, obuID)
+}
+
+func (m *LatenessMiddleware) DistanceSeries(ctx context.Context, q types.SeriesQuery) (*types.Series, error) {
+	return m.next.DistanceSeries(ctx, q)
+}
+
+func (m *LatenessMiddleware) CalculateAccountInvoice(ctx context.Context, accountID string, period types.Period) (*types.AccountInvoice, error) {
+	return m.next.CalculateAccountInvoice(ctx, accountID, period)
+}
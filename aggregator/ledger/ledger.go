@@ -0,0 +1,503 @@
+// Package ledger is the double-entry book of what accounts were charged and
+// what they paid. Transactions are append-only, mistakes are corrected with
+// reversals so the journal doubles as the audit trail.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+const (
+	KindCharge   = "charge"
+	KindPayment  = "payment"
+	KindCredit   = "credit"
+	KindRefund   = "refund"
+	KindReversal = "reversal"
+	// drawn from a prepaid balance as the account drives
+	KindUsage = "usage"
+)
+
+// ledger accounts on the operator side
+const (
+	RevenueAccount = "revenue:tolls"
+	CashAccount    = "cash"
+	CreditsAccount = "credits"
+)
+
+var (
+	ErrDuplicateReference  = errors.New("a transaction with this reference already exists")
+	ErrTransactionNotFound = errors.New("transaction not found")
+	ErrAlreadyReversed     = errors.New("transaction is already reversed")
+	ErrInvalidAmount       = errors.New("amount must be positive")
+	ErrUnbalanced          = errors.New("postings do not balance")
+)
+
+// ReceivableAccount is what a customer account owes, positive balances are
+// owed to the operator.
+func ReceivableAccount(accountID string) string {
+	return "receivable:" + accountID
+}
+
+// Posting debits (positive) or credits (negative) a ledger account.
+type Posting struct {
+	LedgerAccount string      `json:"ledgerAccount"`
+	Amount        types.Money `json:"amount"`
+}
+
+type Transaction struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// customer account the transaction belongs to
+	AccountID string `json:"accountId"`
+	// unique, makes posting the same payment or charge twice harmless
+	Reference string    `json:"reference"`
+	Memo      string    `json:"memo,omitempty"`
+	Actor     string    `json:"actor"`
+	At        time.Time `json:"at"`
+	// charges only
+	Period *types.Period `json:"period,omitempty"`
+	DueAt  *time.Time    `json:"dueAt,omitempty"`
+	// reversals only
+	Reverses string    `json:"reverses,omitempty"`
+	Postings []Posting `json:"postings"`
+}
+
+// validate checks that the postings are in one currency and balance, and
+// that charges have a period and a due date.
+func (tx Transaction) validate() error {
+	if tx.Kind == KindCharge && (tx.Period == nil || tx.DueAt == nil) {
+		return errors.New("charge without period or due date")
+	}
+	if len(tx.Postings) < 2 {
+		return ErrUnbalanced
+	}
+	var sum types.Money
+	for _, p := range tx.Postings {
+		if p.Amount.Currency == "" {
+			return fmt.Errorf("%w: posting without currency", ErrUnbalanced)
+		}
+		var err error
+		if sum, err = sum.Add(p.Amount); err != nil {
+			return err
+		}
+	}
+	if !sum.IsZero() {
+		return fmt.Errorf("%w: off by %s", ErrUnbalanced, sum)
+	}
+	return nil
+}
+
+func (tx Transaction) currency() string {
+	return tx.Postings[0].Amount.Currency
+}
+
+// receivable returns the minor units the transaction adds to what the
+// customer owes.
+func (tx Transaction) receivable() int64 {
+	var sum int64
+	for _, p := range tx.Postings {
+		if p.LedgerAccount == ReceivableAccount(tx.AccountID) {
+			sum += p.Amount.Units
+		}
+	}
+	return sum
+}
+
+type Ledger struct {
+	mu    sync.RWMutex
+	store Store
+	txs   []Transaction
+	byID  map[string]int
+	byRef map[string]int
+	// transaction id to the id of its reversal
+	reversed map[string]string
+	// running receivable per customer account
+	owed map[string]int64
+	// every customer account is kept in the currency of its first
+	// transaction
+	currency map[string]string
+	// called with every transaction posted, see OnPost
+	onPost func(Transaction) error
+}
+
+// transactions with a reference get an id derived from it, so ledgers of a
+// cluster posting the same reference post the same transaction
+var referenceSpace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("github.com/shamssahal/toll-calculator/ledger"))
+
+// New replays the transactions of the store.
+func New(store Store) (*Ledger, error) {
+	txs, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	l := &Ledger{
+		store:    store,
+		byID:     make(map[string]int),
+		byRef:    make(map[string]int),
+		reversed: make(map[string]string),
+		owed:     make(map[string]int64),
+		currency: make(map[string]string),
+	}
+	for _, tx := range txs {
+		l.index(tx)
+	}
+	return l, nil
+}
+
+func (l *Ledger) index(tx Transaction) {
+	l.txs = append(l.txs, tx)
+	l.byID[tx.ID] = len(l.txs) - 1
+	l.byRef[tx.Reference] = len(l.txs) - 1
+	if tx.Kind == KindReversal {
+		l.reversed[tx.Reverses] = tx.ID
+	}
+	l.owed[tx.AccountID] += tx.receivable()
+	l.currency[tx.AccountID] = tx.currency()
+}
+
+// OnPost has fn called with every transaction posted from then on, once it
+// is in the journal and outside the lock of the ledger. Its error is
+// returned to the caller of the post. Set it before the ledger is used.
+func (l *Ledger) OnPost(fn func(Transaction) error) {
+	l.onPost = fn
+}
+
+// post persists a transaction. A transaction with a reference that was
+// posted before returns the earlier one with ErrDuplicateReference.
+func (l *Ledger) post(tx Transaction) (Transaction, error) {
+	tx, err := l.add(tx)
+	if err != nil || l.onPost == nil {
+		return tx, err
+	}
+	return tx, l.onPost(tx)
+}
+
+func (l *Ledger) add(tx Transaction) (Transaction, error) {
+	if err := tx.validate(); err != nil {
+		return tx, err
+	}
+	if tx.Reference == "" {
+		tx.ID = uuid.New().String()
+		tx.Reference = tx.ID
+	} else {
+		tx.ID = uuid.NewSHA1(referenceSpace, []byte(tx.Reference)).String()
+	}
+	tx.At = time.Now().UTC()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cur, ok := l.currency[tx.AccountID]; ok && cur != tx.currency() {
+		return tx, fmt.Errorf("%w: account %s is kept in %s", types.ErrCurrencyMismatch, tx.AccountID, cur)
+	}
+	if tx.Kind == KindReversal {
+		if _, ok := l.reversed[tx.Reverses]; ok {
+			return tx, ErrAlreadyReversed
+		}
+	}
+	if i, ok := l.byRef[tx.Reference]; ok {
+		return l.txs[i], ErrDuplicateReference
+	}
+	if err := l.store.Append(tx); err != nil {
+		return tx, err
+	}
+	l.index(tx)
+	return tx, nil
+}
+
+// Apply adds a transaction another ledger of the cluster posted. One the
+// ledger holds already, or whose reference it posted itself, is skipped.
+func (l *Ledger) Apply(tx Transaction) (bool, error) {
+	if err := tx.validate(); err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.byID[tx.ID]; ok {
+		return false, nil
+	}
+	if _, ok := l.byRef[tx.Reference]; ok {
+		return false, nil
+	}
+	if err := l.store.Append(tx); err != nil {
+		return false, err
+	}
+	l.index(tx)
+	return true, nil
+}
+
+// All returns the whole journal, oldest first.
+func (l *Ledger) All() []Transaction {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return slices.Clone(l.txs)
+}
+
+func chargeReference(accountID string, period types.Period) string {
+	return fmt.Sprintf("charge:%s:%d:%d", accountID, period.From.Unix(), period.To.Unix())
+}
+
+// Charge bills an account for a closed period. The reference is derived
+// from the period so every period is charged at most once.
+func (l *Ledger) Charge(accountID string, period types.Period, amount types.Money, due time.Time, actor string) (Transaction, error) {
+	if amount.Units <= 0 {
+		return Transaction{}, ErrInvalidAmount
+	}
+	return l.post(Transaction{
+		Kind:      KindCharge,
+		AccountID: accountID,
+		Reference: chargeReference(accountID, period),
+		Memo:      fmt.Sprintf("tolls %s to %s", period.From.Format(time.RFC3339), period.To.Format(time.RFC3339)),
+		Actor:     actor,
+		Period:    &period,
+		DueAt:     &due,
+		Postings: []Posting{
+			{LedgerAccount: ReceivableAccount(accountID), Amount: amount},
+			{LedgerAccount: RevenueAccount, Amount: amount.Neg()},
+		},
+	})
+}
+
+// Post records a payment, credit or refund for an account.
+func (l *Ledger) Post(kind, accountID string, amount types.Money, reference, memo, actor string) (Transaction, error) {
+	if amount.Units <= 0 {
+		return Transaction{}, ErrInvalidAmount
+	}
+	var counter string
+	switch kind {
+	case KindPayment, KindRefund:
+		counter = CashAccount
+	case KindCredit:
+		counter = CreditsAccount
+	default:
+		return Transaction{}, fmt.Errorf("cannot post a %s", kind)
+	}
+	receivable := amount.Neg()
+	if kind == KindRefund {
+		// money goes back to the customer
+		receivable = amount
+	}
+	return l.post(Transaction{
+		Kind:      kind,
+		AccountID: accountID,
+		Reference: reference,
+		Memo:      memo,
+		Actor:     actor,
+		Postings: []Posting{
+			{LedgerAccount: ReceivableAccount(accountID), Amount: receivable},
+			{LedgerAccount: counter, Amount: receivable.Neg()},
+		},
+	})
+}
+
+// Usage draws from the prepaid balance of an account, once per reference.
+func (l *Ledger) Usage(accountID string, amount types.Money, reference, memo string) (Transaction, error) {
+	if amount.Units <= 0 {
+		return Transaction{}, ErrInvalidAmount
+	}
+	return l.post(Transaction{
+		Kind:      KindUsage,
+		AccountID: accountID,
+		Reference: reference,
+		Memo:      memo,
+		Actor:     "aggregator",
+		Postings: []Posting{
+			{LedgerAccount: ReceivableAccount(accountID), Amount: amount},
+			{LedgerAccount: RevenueAccount, Amount: amount.Neg()},
+		},
+	})
+}
+
+// Owed is the balance of an account without the breakdown of Balance,
+// negative when the account is in credit.
+func (l *Ledger) Owed(accountID string) types.Money {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return types.NewMoney(l.owed[accountID], l.currency[accountID])
+}
+
+// Reverse posts the mirror image of a transaction.
+func (l *Ledger) Reverse(txID, memo, actor string) (Transaction, error) {
+	orig, err := l.Transaction(txID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if orig.Kind == KindReversal {
+		return Transaction{}, errors.New("reversals cannot be reversed")
+	}
+	postings := make([]Posting, len(orig.Postings))
+	for i, p := range orig.Postings {
+		postings[i] = Posting{LedgerAccount: p.LedgerAccount, Amount: p.Amount.Neg()}
+	}
+	return l.post(Transaction{
+		Kind:      KindReversal,
+		AccountID: orig.AccountID,
+		Reference: "reversal:" + orig.ID,
+		Memo:      memo,
+		Actor:     actor,
+		Reverses:  orig.ID,
+		Postings:  postings,
+	})
+}
+
+// ChargeFor returns the charge of an account for a period.
+func (l *Ledger) ChargeFor(accountID string, period types.Period) (Transaction, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i, ok := l.byRef[chargeReference(accountID, period)]
+	if !ok {
+		return Transaction{}, ErrTransactionNotFound
+	}
+	return l.txs[i], nil
+}
+
+// OverlappingCharges returns the charges of an account that are not
+// reversed and cover part of period without being for period itself.
+func (l *Ledger) OverlappingCharges(accountID string, period types.Period) []Transaction {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var txs []Transaction
+	for _, tx := range l.txs {
+		if tx.AccountID != accountID || tx.Kind != KindCharge || tx.Period == nil {
+			continue
+		}
+		if _, ok := l.reversed[tx.ID]; ok {
+			continue
+		}
+		p := *tx.Period
+		if p.From.Equal(period.From) && p.To.Equal(period.To) {
+			continue
+		}
+		if p.From.Before(period.To) && period.From.Before(p.To) {
+			txs = append(txs, tx)
+		}
+	}
+	return txs
+}
+
+func (l *Ledger) Transaction(id string) (Transaction, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	i, ok := l.byID[id]
+	if !ok {
+		return Transaction{}, ErrTransactionNotFound
+	}
+	return l.txs[i], nil
+}
+
+// Transactions returns the journal of an account, oldest first.
+func (l *Ledger) Transactions(accountID string) []Transaction {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	txs := []Transaction{}
+	for _, tx := range l.txs {
+		if tx.AccountID == accountID {
+			txs = append(txs, tx)
+		}
+	}
+	return txs
+}
+
+type Balance struct {
+	AccountID string `json:"accountId"`
+	// what the account owes, negative when it paid in advance
+	Balance  types.Money `json:"balance"`
+	Charged  types.Money `json:"charged"`
+	Paid     types.Money `json:"paid"`
+	Credited types.Money `json:"credited"`
+	Refunded types.Money `json:"refunded"`
+	// drawn from a prepaid balance
+	Used types.Money `json:"used"`
+	// unsettled charges past their due date, payments settle the oldest
+	// charges first
+	Overdue      types.Money `json:"overdue"`
+	OverdueSince *time.Time  `json:"overdueSince,omitempty"`
+}
+
+func (l *Ledger) Balance(accountID string, now time.Time) Balance {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.balance(accountID, now)
+}
+
+func (l *Ledger) balance(accountID string, now time.Time) Balance {
+	var (
+		balance, charged, paid, credited, refunded, used, overdue int64
+		overdueSince                                              *time.Time
+		charges                                                   []Transaction
+	)
+	for _, tx := range l.txs {
+		if tx.AccountID != accountID {
+			continue
+		}
+		balance += tx.receivable()
+		// reversed transactions and their reversals cancel out
+		if _, ok := l.reversed[tx.ID]; ok || tx.Kind == KindReversal {
+			continue
+		}
+		amount := tx.receivable()
+		switch tx.Kind {
+		case KindCharge:
+			charged += amount
+			charges = append(charges, tx)
+		case KindPayment:
+			paid -= amount
+		case KindCredit:
+			credited -= amount
+		case KindRefund:
+			refunded += amount
+		case KindUsage:
+			used += amount
+		}
+	}
+
+	settled := paid + credited - refunded - used
+	slices.SortStableFunc(charges, func(a, b Transaction) int {
+		return a.DueAt.Compare(*b.DueAt)
+	})
+	for _, c := range charges {
+		open := c.receivable() - max(0, min(settled, c.receivable()))
+		settled -= c.receivable() - open
+		if open > 0 && c.DueAt.Before(now) {
+			overdue += open
+			if overdueSince == nil {
+				overdueSince = c.DueAt
+			}
+		}
+	}
+	cur := l.currency[accountID]
+	return Balance{
+		AccountID:    accountID,
+		Balance:      types.NewMoney(balance, cur),
+		Charged:      types.NewMoney(charged, cur),
+		Paid:         types.NewMoney(paid, cur),
+		Credited:     types.NewMoney(credited, cur),
+		Refunded:     types.NewMoney(refunded, cur),
+		Used:         types.NewMoney(used, cur),
+		Overdue:      types.NewMoney(overdue, cur),
+		OverdueSince: overdueSince,
+	}
+}
+
+// Overdue returns the balances of all accounts with overdue charges.
+func (l *Ledger) Overdue(now time.Time) []Balance {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	seen := make(map[string]bool)
+	overdue := []Balance{}
+	for _, tx := range l.txs {
+		if seen[tx.AccountID] {
+			continue
+		}
+		seen[tx.AccountID] = true
+		if b := l.balance(tx.AccountID, now); b.Overdue.Units > 0 {
+			overdue = append(overdue, b)
+		}
+	}
+	return overdue
+}
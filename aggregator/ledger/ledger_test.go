@@ -0,0 +1,250 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+func eur(units int64) types.Money {
+	return types.NewMoney(units, "EUR")
+}
+
+func newLedger(t *testing.T) *Ledger {
+	t.Helper()
+	l, err := New(NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func month(year int, m time.Month) types.Period {
+	from := time.Date(year, m, 1, 0, 0, 0, 0, time.UTC)
+	return types.Period{From: from, To: from.AddDate(0, 1, 0)}
+}
+
+func TestValidate(t *testing.T) {
+	var (
+		p   = month(2026, time.January)
+		due = p.To
+	)
+	tests := []struct {
+		name string
+		tx   Transaction
+		want error
+	}{
+		{
+			name: "balanced",
+			tx: Transaction{Kind: KindPayment, Postings: []Posting{
+				{LedgerAccount: "a", Amount: eur(5)}, {LedgerAccount: "b", Amount: eur(-5)},
+			}},
+		},
+		{
+			name: "balanced over three postings",
+			tx: Transaction{Kind: KindPayment, Postings: []Posting{
+				{LedgerAccount: "a", Amount: eur(5)}, {LedgerAccount: "b", Amount: eur(-2)}, {LedgerAccount: "c", Amount: eur(-3)},
+			}},
+		},
+		{
+			name: "unbalanced",
+			tx: Transaction{Kind: KindPayment, Postings: []Posting{
+				{LedgerAccount: "a", Amount: eur(5)}, {LedgerAccount: "b", Amount: eur(-4)},
+			}},
+			want: ErrUnbalanced,
+		},
+		{
+			name: "single posting",
+			tx:   Transaction{Kind: KindPayment, Postings: []Posting{{LedgerAccount: "a", Amount: eur(0)}}},
+			want: ErrUnbalanced,
+		},
+		{
+			name: "posting without currency",
+			tx: Transaction{Kind: KindPayment, Postings: []Posting{
+				{LedgerAccount: "a", Amount: eur(5)}, {LedgerAccount: "b", Amount: types.Money{Units: -5}},
+			}},
+			want: ErrUnbalanced,
+		},
+		{
+			name: "two currencies",
+			tx: Transaction{Kind: KindPayment, Postings: []Posting{
+				{LedgerAccount: "a", Amount: eur(5)}, {LedgerAccount: "b", Amount: types.NewMoney(-5, "USD")},
+			}},
+			want: types.ErrCurrencyMismatch,
+		},
+		{
+			name: "charge without due date",
+			tx: Transaction{Kind: KindCharge, Period: &p, Postings: []Posting{
+				{LedgerAccount: "a", Amount: eur(5)}, {LedgerAccount: "b", Amount: eur(-5)},
+			}},
+			want: errors.New("charge without period or due date"),
+		},
+		{
+			name: "charge",
+			tx: Transaction{Kind: KindCharge, Period: &p, DueAt: &due, Postings: []Posting{
+				{LedgerAccount: "a", Amount: eur(5)}, {LedgerAccount: "b", Amount: eur(-5)},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tx.validate()
+			switch {
+			case tt.want == nil && err != nil:
+				t.Fatalf("got %v", err)
+			case tt.want != nil && err == nil:
+				t.Fatalf("got no error, want %v", tt.want)
+			case tt.want != nil && !errors.Is(err, tt.want) && err.Error() != tt.want.Error():
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPostIsIdempotentByReference(t *testing.T) {
+	l := newLedger(t)
+	first, err := l.Post(KindPayment, "acc", eur(500), "bank-1", "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := l.Post(KindPayment, "acc", eur(500), "bank-1", "", "test")
+	if !errors.Is(err, ErrDuplicateReference) || again.ID != first.ID {
+		t.Fatalf("got %v, %v for the same reference", again.ID, err)
+	}
+	if _, err := l.Post(KindPayment, "acc", eur(0), "bank-2", "", "test"); !errors.Is(err, ErrInvalidAmount) {
+		t.Fatalf("got %v, want ErrInvalidAmount", err)
+	}
+	if _, err := l.Post(KindPayment, "acc", types.NewMoney(5, "USD"), "bank-3", "", "test"); !errors.Is(err, types.ErrCurrencyMismatch) {
+		t.Fatalf("got %v, want ErrCurrencyMismatch", err)
+	}
+	if _, err := l.Usage("acc", eur(30), "usage:r1", "obu 1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Usage("acc", eur(30), "usage:r1", "obu 1"); !errors.Is(err, ErrDuplicateReference) {
+		t.Fatalf("got %v, want the draw of a distance posted once", err)
+	}
+	if got := l.Owed("acc"); got != eur(-470) {
+		t.Fatalf("owed %v", got)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	var (
+		l   = newLedger(t)
+		p   = month(2026, time.January)
+		now = p.To.AddDate(0, 2, 0)
+	)
+	charge, err := l.Charge("acc", p, eur(1000), p.To.AddDate(0, 0, 14), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := l.Balance("acc", now); b.Overdue != eur(1000) {
+		t.Fatalf("overdue %v before the reversal", b.Overdue)
+	}
+	reversal, err := l.Reverse(charge.ID, "wrong tariff", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Reverse(charge.ID, "again", "test"); !errors.Is(err, ErrAlreadyReversed) {
+		t.Fatalf("got %v, want ErrAlreadyReversed", err)
+	}
+	if _, err := l.Reverse(reversal.ID, "undo", "test"); err == nil {
+		t.Fatal("reversed a reversal")
+	}
+	if _, err := l.Reverse("missing", "", "test"); !errors.Is(err, ErrTransactionNotFound) {
+		t.Fatalf("got %v, want ErrTransactionNotFound", err)
+	}
+	b := l.Balance("acc", now)
+	if !b.Balance.IsZero() || !b.Charged.IsZero() || !b.Overdue.IsZero() {
+		t.Fatalf("got %+v after the reversal", b)
+	}
+	// the period can be charged again once its charge is reversed
+	if got := l.OverlappingCharges("acc", types.Period{From: p.From, To: p.To.AddDate(0, 0, 1)}); len(got) != 0 {
+		t.Fatalf("reversed charge overlaps: %v", got)
+	}
+}
+
+// Payments settle the oldest charges first, only what is left of a charge
+// past its due date is overdue.
+func TestOverdue(t *testing.T) {
+	var (
+		jan, feb = month(2026, time.January), month(2026, time.February)
+		janDue   = feb.From.AddDate(0, 0, 14)
+		febDue   = feb.To.AddDate(0, 0, 14)
+	)
+	tests := []struct {
+		name      string
+		paid      int64
+		now       time.Time
+		want      int64
+		wantSince *time.Time
+	}{
+		{name: "nothing due yet", now: janDue.Add(-time.Hour)},
+		{name: "january unpaid", now: janDue.Add(time.Hour), want: 1000, wantSince: &janDue},
+		{name: "january partly paid", paid: 800, now: janDue.Add(time.Hour), want: 200, wantSince: &janDue},
+		{name: "january paid, february not due", paid: 1200, now: janDue.Add(time.Hour)},
+		{name: "payment covers january, rest of february", paid: 1200, now: febDue.Add(time.Hour), want: 300, wantSince: &febDue},
+		{name: "both unpaid", now: febDue.Add(time.Hour), want: 1500, wantSince: &janDue},
+		{name: "all paid", paid: 1500, now: febDue.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLedger(t)
+			if _, err := l.Charge("acc", jan, eur(1000), janDue, "test"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := l.Charge("acc", feb, eur(500), febDue, "test"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.paid > 0 {
+				if _, err := l.Post(KindPayment, "acc", eur(tt.paid), "bank", "", "test"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b := l.Balance("acc", tt.now)
+			if b.Overdue != eur(tt.want) && !(tt.want == 0 && b.Overdue.IsZero()) {
+				t.Fatalf("overdue %v, want %d", b.Overdue, tt.want)
+			}
+			switch {
+			case tt.wantSince == nil && b.OverdueSince != nil:
+				t.Fatalf("overdue since %v", b.OverdueSince)
+			case tt.wantSince != nil && (b.OverdueSince == nil || !b.OverdueSince.Equal(*tt.wantSince)):
+				t.Fatalf("overdue since %v, want %v", b.OverdueSince, tt.wantSince)
+			}
+			if got := len(l.Overdue(tt.now)); got != 0 != (tt.want > 0) {
+				t.Fatalf("%d overdue accounts", got)
+			}
+			if b.Balance != eur(1500-tt.paid) && !(tt.paid == 1500 && b.Balance.IsZero()) {
+				t.Fatalf("balance %v", b.Balance)
+			}
+		})
+	}
+}
+
+// A reloaded journal has the same balances and still refuses duplicates.
+func TestReload(t *testing.T) {
+	store := NewMemoryStore()
+	l, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := month(2026, time.January)
+	if _, err := l.Charge("acc", p, eur(1000), p.To, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Post(KindCredit, "acc", eur(100), "goodwill", "", "test"); err != nil {
+		t.Fatal(err)
+	}
+	l, err = New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Owed("acc"); got != eur(900) {
+		t.Fatalf("owed %v after reload", got)
+	}
+	if _, err := l.Charge("acc", p, eur(1000), p.To, "test"); !errors.Is(err, ErrDuplicateReference) {
+		t.Fatalf("got %v, want ErrDuplicateReference", err)
+	}
+}
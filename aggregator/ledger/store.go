@@ -0,0 +1,112 @@
+package ledger
+
+import (
+	"encoding/json"
+	"math/big"
+	"sync"
+
+	"github.com/shamssahal/toll-calculator/aggregator/jsonl"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// Store persists the journal, transactions are only ever appended.
+type Store interface {
+	Append(Transaction) error
+	Load() ([]Transaction, error)
+}
+
+type MemoryStore struct {
+	mu  sync.Mutex
+	txs []Transaction
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Append(tx Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txs = append(s.txs, tx)
+	return nil
+}
+
+func (s *MemoryStore) Load() ([]Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Transaction(nil), s.txs...), nil
+}
+
+// FileStore keeps the journal as JSON Lines, synced after every
+// transaction.
+type FileStore struct {
+	file *jsonl.File
+	// of postings written before amounts carried a currency
+	legacyCurrency string
+}
+
+// NewFileStore opens the journal at path. Postings of transactions written
+// before amounts carried a currency are in cents of legacyCurrency.
+func NewFileStore(path, legacyCurrency string) (*FileStore, error) {
+	f, err := jsonl.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{file: f, legacyCurrency: legacyCurrency}, nil
+}
+
+func (s *FileStore) Append(tx Transaction) error {
+	return s.file.Append(tx)
+}
+
+// Load reads the journal. A torn last line from a crash mid-write is cut
+// off, anything else that does not parse or does not balance is an error.
+func (s *FileStore) Load() ([]Transaction, error) {
+	var txs []Transaction
+	err := s.file.Load(func(line []byte) error {
+		tx, err := s.decode(line)
+		if err != nil {
+			return err
+		}
+		if err := tx.validate(); err != nil {
+			return err
+		}
+		txs = append(txs, tx)
+		return nil
+	})
+	return txs, err
+}
+
+// decode reads a transaction, taking the amounts of legacy postings from
+// their amountCents.
+func (s *FileStore) decode(line []byte) (Transaction, error) {
+	var tx struct {
+		Transaction
+		// shadows Transaction.Postings
+		Postings []struct {
+			Posting
+			AmountCents *int64 `json:"amountCents"`
+		} `json:"postings"`
+	}
+	if err := json.Unmarshal(line, &tx); err != nil {
+		return Transaction{}, err
+	}
+	res := tx.Transaction
+	res.Postings = make([]Posting, len(tx.Postings))
+	for i, p := range tx.Postings {
+		res.Postings[i] = p.Posting
+		if p.AmountCents == nil || p.Amount.Currency != "" {
+			continue
+		}
+		amount, err := types.ParseMoney(big.NewRat(*p.AmountCents, 100).FloatString(2), s.legacyCurrency)
+		if err != nil {
+			return Transaction{}, err
+		}
+		res.Postings[i].Amount = amount
+	}
+	return res, nil
+}
+
+func (s *FileStore) Close() error {
+	return s.file.Close()
+}
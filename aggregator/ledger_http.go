@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+func registerLedgerRoutes(mux *http.ServeMux, b *Billing) {
+	var (
+		billingHandler = newHTTPMetricHandler("/billing")
+		ledgerHandler  = newHTTPMetricHandler("/ledger")
+	)
+	mux.HandleFunc("POST /billing/close", billingHandler.instrumentAndLog(handleClosePeriod(b)))
+	mux.HandleFunc("POST /ledger/accounts/{id}/payments", ledgerHandler.instrumentAndLog(handlePost(b, ledger.KindPayment)))
+	mux.HandleFunc("POST /ledger/accounts/{id}/credits", ledgerHandler.instrumentAndLog(handlePost(b, ledger.KindCredit)))
+	mux.HandleFunc("POST /ledger/accounts/{id}/refunds", ledgerHandler.instrumentAndLog(handlePost(b, ledger.KindRefund)))
+	mux.HandleFunc("GET /ledger/accounts/{id}/balance", ledgerHandler.instrumentAndLog(handleGetBalance(b)))
+	mux.HandleFunc("GET /ledger/accounts/{id}/transactions", ledgerHandler.instrumentAndLog(handleGetTransactions(b)))
+	mux.HandleFunc("POST /ledger/transactions/{id}/reverse", ledgerHandler.instrumentAndLog(handleReverse(b)))
+	mux.HandleFunc("GET /ledger/overdue", ledgerHandler.instrumentAndLog(handleGetOverdue(b)))
+}
+
+// actor names who posted a transaction in the audit trail.
+func actor(r *http.Request) string {
+	if a := r.Header.Get("X-Actor"); a != "" {
+		return a
+	}
+	return "api"
+}
+
+func writeLedgerError(w http.ResponseWriter, err error) error {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ledger.ErrInvalidAmount), errors.Is(err, ledger.ErrUnbalanced), errors.Is(err, ErrPeriodOpen),
+		errors.Is(err, ErrNotCalendarMonth), errors.Is(err, types.ErrCurrencyMismatch):
+		status = http.StatusBadRequest
+	case errors.Is(err, ledger.ErrTransactionNotFound), errors.Is(err, registry.ErrAccountNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ledger.ErrDuplicateReference), errors.Is(err, ledger.ErrAlreadyReversed):
+		status = http.StatusConflict
+	case errors.Is(err, ErrNoQuorum):
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+	return err
+}
+
+func handleClosePeriod(b *Billing) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		period, err := types.ParsePeriod(r.URL.Query())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		results, err := b.ClosePeriod(r.Context(), period, actor(r))
+		if err != nil {
+			return writeLedgerError(w, err)
+		}
+		writeJSON(w, http.StatusOK, results)
+		return nil
+	}
+}
+
+type postRequest struct {
+	// in major units of the account currency, e.g. 12.50 or "12.50"
+	Amount    json.Number `json:"amount"`
+	Reference string      `json:"reference"`
+	Memo      string      `json:"memo"`
+}
+
+// handlePost records payments, credits and refunds. Reposting a reference
+// returns the original transaction with 409.
+func handlePost(b *Billing, kind string) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var req postRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		accountID := r.PathValue("id")
+		account, err := b.registry.GetAccount(accountID)
+		if err != nil {
+			return writeLedgerError(w, err)
+		}
+		amount, err := types.ParseMoney(req.Amount.String(), b.currency(account))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		tx, err := b.ledger.Post(kind, accountID, amount, req.Reference, req.Memo, actor(r))
+		if errors.Is(err, ledger.ErrDuplicateReference) {
+			writeJSON(w, http.StatusConflict, tx)
+			return err
+		}
+		if err != nil {
+			return writeLedgerError(w, err)
+		}
+		b.prepaid.Refresh(accountID)
+		writeJSON(w, http.StatusCreated, tx)
+		return nil
+	}
+}
+
+func handleReverse(b *Billing) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var req struct {
+			Memo string `json:"memo"`
+		}
+		// the memo is optional
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		tx, err := b.ledger.Reverse(r.PathValue("id"), req.Memo, actor(r))
+		if err != nil {
+			return writeLedgerError(w, err)
+		}
+		b.prepaid.Refresh(tx.AccountID)
+		writeJSON(w, http.StatusCreated, tx)
+		return nil
+	}
+}
+
+func handleGetBalance(b *Billing) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		accountID := r.PathValue("id")
+		if _, err := b.registry.GetAccount(accountID); err != nil {
+			return writeLedgerError(w, err)
+		}
+		writeJSON(w, http.StatusOK, b.ledger.Balance(accountID, time.Now()))
+		return nil
+	}
+}
+
+func handleGetTransactions(b *Billing) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		accountID := r.PathValue("id")
+		if _, err := b.registry.GetAccount(accountID); err != nil {
+			return writeLedgerError(w, err)
+		}
+		writeJSON(w, http.StatusOK, b.ledger.Transactions(accountID))
+		return nil
+	}
+}
+
+func handleGetOverdue(b *Billing) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		writeJSON(w, http.StatusOK, b.ledger.Overdue(time.Now()))
+		return nil
+	}
+}
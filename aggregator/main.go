@@ -15,9 +15,12 @@ import (
 
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
 	"github.com/shamssahal/toll-calculator/types"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 func writeJSON(rw http.ResponseWriter, status int, v any) error {
@@ -26,7 +29,7 @@ func writeJSON(rw http.ResponseWriter, status int, v any) error {
 	return json.NewEncoder(rw).Encode(v)
 }
 
-func makeHTTPTransportLayer(httpListenAddr string, svc Aggregator) {
+func makeHTTPTransportLayer(httpListenAddr string, svc Aggregator, reg registry.Registry, billing *Billing, disputes *Disputes, replication *ReplicatedStore, sharding *ShardedStore) {
 	fmt.Printf("Starting distance aggregator HTTP Transport Layer on port %s\n", httpListenAddr)
 	var (
 		timeout          = time.Second * 10
@@ -34,12 +37,25 @@ func makeHTTPTransportLayer(httpListenAddr string, svc Aggregator) {
 		mux              = http.NewServeMux()
 		aggregateHandler = newHTTPMetricHandler("/aggregate")
 		invoiceHandler   = newHTTPMetricHandler("/invoice")
+		seriesHandler    = newHTTPMetricHandler("/invoice/series")
+		accountHandler   = newHTTPMetricHandler("/invoice/account")
 	)
 	defer cancel()
 
 	mux.HandleFunc("POST /aggregate", aggregateHandler.instrumentAndLog(handleAggregate(svc)))
 	mux.HandleFunc("GET /invoice", invoiceHandler.instrumentAndLog(handleGetInvoice(svc)))
+	mux.HandleFunc("GET /invoice/series", seriesHandler.instrumentAndLog(handleGetSeries(svc)))
+	mux.HandleFunc("GET /invoice/account", accountHandler.instrumentAndLog(handleGetAccountInvoice(svc)))
 	mux.Handle("GET /metrics", promhttp.Handler())
+	registerRegistryRoutes(mux, reg)
+	registerLedgerRoutes(mux, billing)
+	registerDisputeRoutes(mux, disputes)
+	if replication != nil {
+		registerReplicationRoutes(mux, replication)
+	}
+	if sharding != nil {
+		registerShardRoutes(mux, sharding)
+	}
 
 	srv := &http.Server{
 		Addr:              httpListenAddr,
@@ -55,7 +71,7 @@ func makeHTTPTransportLayer(httpListenAddr string, svc Aggregator) {
 	defer close(srvErrCh)
 
 	go func() {
-		srvErrCh <- srv.ListenAndServe()
+		srvErrCh <- tlsconfig.ListenAndServe(srv, tlsconfig.FromEnv("AGG"))
 
 	}()
 
@@ -68,7 +84,7 @@ func makeHTTPTransportLayer(httpListenAddr string, svc Aggregator) {
 	gracefulShutdown(ctx, timeout, srv)
 }
 
-func makeGRPCTransport(listenAddr string, svc Aggregator) error {
+func makeGRPCTransport(listenAddr string, svc Aggregator, reg registry.Registry) error {
 	fmt.Printf("Starting distance aggregator gRPC Transport Layer on port %s\n", listenAddr)
 
 	ln, err := net.Listen("tcp", listenAddr)
@@ -77,9 +93,18 @@ func makeGRPCTransport(listenAddr string, svc Aggregator) error {
 	}
 	defer ln.Close()
 
-	serverRegistrar := grpc.NewServer([]grpc.ServerOption{}...)
+	opts := []grpc.ServerOption{}
+	if tlsCfg := tlsconfig.FromEnv("AGG"); tlsCfg.Enabled() {
+		cfg, err := tlsCfg.ServerTLS()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(cfg)))
+	}
+	serverRegistrar := grpc.NewServer(opts...)
 	server := NewGRPCServer(svc)
 	types.RegisterAggregatorServer(serverRegistrar, server)
+	types.RegisterRegistryServer(serverRegistrar, NewGRPCRegistryServer(reg))
 	return serverRegistrar.Serve(ln)
 }
 
@@ -93,22 +118,98 @@ func Chain(a Aggregator, mws ...func(Aggregator) Aggregator) Aggregator {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "rebuild" {
+		if err := rebuild(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rebalance" {
+		if err := rebalance(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	var (
 		httpListenAddr = os.Getenv("AGG_HTTP_PORT")
 		grpcListenAddr = os.Getenv("AGG_GRPC_PORT")
 		store          = makeStore()
-		svc            = NewInvoiceAggregator(store)
+		reg            = makeRegistry()
+		ledger         = makeLedger()
+		book           = makeDisputes()
+		replication    = makeReplication(store)
 	)
-	svc = Chain(
-		svc,
+	if replication != nil {
+		store = replication
+		reg = replication.ReplicateRegistry(reg)
+		replication.ReplicateLedger(ledger)
+		replication.ReplicateDisputes(book)
+		replication.Bootstrap(context.Background())
+		go replication.Run(context.Background())
+	}
+	sharding := makeSharding(store)
+	if sharding != nil {
+		store = sharding
+		reg = makeShardRegistry(sharding, reg)
+	}
+	tariff, err := tariffFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine, err := makeRules()
+	if err != nil {
+		log.Fatal(err)
+	}
+	events, err := NewKafkaEventProducer(accountEventsTopic)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer events.Close()
+	var (
+		invoice = NewInvoiceAggregator(store, reg, tariff, engine)
+		prepaid = NewPrepaidMiddleware(invoice, invoice, reg, ledger, events)
+	)
+	// registry changes go through prepaid so it can follow vehicles
+	reg = prepaid.WatchRegistry(reg)
+	go func() {
+		if err := prepaid.RefreshAll(); err != nil {
+			logrus.Errorf("failed to publish prepaid account states: %v", err)
+		}
+	}()
+	svc := Chain(
+		prepaid,
 		func(s Aggregator) Aggregator { return (NewMetricsMiddleware(s)) },
 		func(s Aggregator) Aggregator { return (NewLogMiddleware(s)) },
+		func(s Aggregator) Aggregator { return (NewLatenessMiddleware(s, latenessWindow())) },
 	)
+	terms, err := paymentTerms()
+	if err != nil {
+		log.Fatal(err)
+	}
+	billing := &Billing{
+		svc:      svc,
+		registry: reg,
+		ledger:   ledger,
+		prepaid:  prepaid,
+		terms:    terms,
+		lateness: latenessWindow(),
+
+		defaultCurrency: tariff.Currency,
+	}
+	disputes := &Disputes{
+		book:     book,
+		billing:  billing,
+		invoices: invoice,
+		store:    store,
+	}
+	if os.Getenv("AGG_AUTO_CLOSE") == "true" {
+		go billing.runAutoClose(context.Background())
+	}
 	go func() {
-		log.Fatal(makeGRPCTransport(grpcListenAddr, svc))
+		log.Fatal(makeGRPCTransport(grpcListenAddr, svc, reg))
 	}()
-	makeHTTPTransportLayer(httpListenAddr, svc)
+	makeHTTPTransportLayer(httpListenAddr, svc, reg, billing, disputes, replication, sharding)
 }
 
 func gracefulShutdown(ctx context.Context, timeout time.Duration, srv *http.Server) {
@@ -129,19 +230,69 @@ func gracefulShutdown(ctx context.Context, timeout time.Duration, srv *http.Serv
 
 }
 
+// makeStore keeps the state in memory, event sourced from AGG_EVENT_LOG
+// or recovered from the write-ahead log in AGG_WAL_DIR when one is set.
 func makeStore() Storer {
 	storeType := os.Getenv("AGG_STORE_TYPE")
 	switch storeType {
 	case "memory":
-		return NewMemoryStore()
+		walDir := os.Getenv("AGG_WAL_DIR")
+		if walDir != "" && os.Getenv("AGG_EVENT_LOG") != "" {
+			log.Fatal("AGG_EVENT_LOG and AGG_WAL_DIR cannot both be set")
+		}
+		if walDir != "" {
+			store, err := NewWALStore(walDir, walSegmentSize(), snapshotEvery(), readingsRetention())
+			if err != nil {
+				log.Fatalf("failed to recover the wal in %s: %v", walDir, err)
+			}
+			return store
+		}
+		l := makeEventLog()
+		if l == nil {
+			return NewMemoryStore(readingsRetention())
+		}
+		store, err := NewEventSourcedStore(l, snapshotPath(), snapshotEvery(), readingsRetention())
+		if err != nil {
+			log.Fatal(err)
+		}
+		return store
 	default:
 		log.Fatalf("invalid store type given %s", storeType)
 		return nil
 	}
 }
 
+// makeRegistry persists the vehicle registry to AGG_REGISTRY_FILE, without
+// it the registry only lives in memory.
+func makeRegistry() registry.Registry {
+	path := os.Getenv("AGG_REGISTRY_FILE")
+	if path == "" {
+		return registry.NewMemoryRegistry()
+	}
+	reg, err := registry.NewFileRegistry(path, defaultCurrency())
+	if err != nil {
+		log.Fatalf("failed to load vehicle registry %s: %v", path, err)
+	}
+	return reg
+}
+
+// latenessWindow reads AGG_LATENESS_WINDOW, empty or 0 accepts events of
+// any age.
+func latenessWindow() time.Duration {
+	v := os.Getenv("AGG_LATENESS_WINDOW")
+	if v == "" {
+		return 0
+	}
+	window, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid AGG_LATENESS_WINDOW %q: %v", v, err)
+	}
+	return window
+}
+
 func init() {
-	if err := godotenv.Load(); err != nil {
+	// without a .env the environment is used as is, e.g. in tests
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
 		log.Fatal(err)
 	}
 }
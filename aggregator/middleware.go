@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,6 +20,7 @@ type MetricsMiddleware struct {
 	reqCounterCalc prometheus.Counter
 	errCounterAgg  prometheus.Counter
 	errCounterCalc prometheus.Counter
+	dupCounterAgg  prometheus.Counter
 	reqLatencyAgg  prometheus.Histogram
 	reqLatencyCalc prometheus.Histogram
 
@@ -48,6 +50,11 @@ func NewMetricsMiddleware(next Aggregator) Aggregator {
 		Namespace: "caclulator",
 		Name:      "error_counter",
 	})
+	dupCounterAgg := promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "aggregator",
+		Name:      "duplicate_counter",
+		Help:      "Distances sent again that were aggregated already.",
+	})
 	reqLatencyAgg := promauto.NewHistogram(prometheus.HistogramOpts{
 		Namespace: "aggregator",
 		Name:      "request_latency",
@@ -64,6 +71,7 @@ func NewMetricsMiddleware(next Aggregator) Aggregator {
 		reqCounterCalc: reqCounterCalc,
 		errCounterAgg:  errCounterAgg,
 		errCounterCalc: errCounterCalc,
+		dupCounterAgg:  dupCounterAgg,
 		reqLatencyAgg:  reqLatencyAgg,
 		reqLatencyCalc: reqLatencyCalc,
 	}
@@ -101,11 +109,53 @@ func (m *LogMiddleware) CalculateInvoice(ctx context.Context, obuID int) (inv *t
 	return
 }
 
+func (m *LogMiddleware) DistanceSeries(ctx context.Context, q types.SeriesQuery) (series *types.Series, err error) {
+	defer func(start time.Time) {
+		fields := logrus.Fields{
+			"took":       time.Since(start),
+			"err":        err,
+			"OBUID":      q.OBUID,
+			"resolution": q.Resolution,
+			"from":       q.From,
+			"to":         q.To,
+		}
+		if series != nil {
+			fields["points"] = len(series.Points)
+			fields["totalDist"] = series.TotalDistance
+		}
+		logrus.WithFields(fields).Info("Distance series: ")
+	}(time.Now())
+	series, err = m.next.DistanceSeries(ctx, q)
+	return
+}
+
+func (m *LogMiddleware) CalculateAccountInvoice(ctx context.Context, accountID string, period types.Period) (inv *types.AccountInvoice, err error) {
+	defer func(start time.Time) {
+		fields := logrus.Fields{
+			"took":      time.Since(start),
+			"err":       err,
+			"accountId": accountID,
+			"from":      period.From,
+			"to":        period.To,
+		}
+		if inv != nil {
+			fields["vehicles"] = len(inv.Vehicles)
+			fields["totalAmount"] = inv.TotalAmount
+		}
+		logrus.WithFields(fields).Info("Calculated account invoice: ")
+	}(time.Now())
+	inv, err = m.next.CalculateAccountInvoice(ctx, accountID, period)
+	return
+}
+
 func (m *MetricsMiddleware) AggregateDistance(ctx context.Context, distance types.Distance) (err error) {
 	defer func(start time.Time) {
 		m.reqLatencyAgg.Observe(time.Since(start).Seconds())
 		m.reqCounterAgg.Inc()
-		if err != nil {
+		switch {
+		case errors.Is(err, ErrDuplicate):
+			m.dupCounterAgg.Inc()
+		case err != nil:
 			m.errCounterAgg.Inc()
 		}
 	}(time.Now())
@@ -124,3 +174,27 @@ func (m *MetricsMiddleware) CalculateInvoice(ctx context.Context, obuID int) (in
 	inv, err = m.next.CalculateInvoice(ctx, obuID)
 	return
 }
+
+func (m *MetricsMiddleware) DistanceSeries(ctx context.Context, q types.SeriesQuery) (series *types.Series, err error) {
+	defer func(start time.Time) {
+		m.reqLatencyCalc.Observe(time.Since(start).Seconds())
+		m.reqCounterCalc.Inc()
+		if err != nil {
+			m.errCounterCalc.Inc()
+		}
+	}(time.Now())
+	series, err = m.next.DistanceSeries(ctx, q)
+	return
+}
+
+func (m *MetricsMiddleware) CalculateAccountInvoice(ctx context.Context, accountID string, period types.Period) (inv *types.AccountInvoice, err error) {
+	defer func(start time.Time) {
+		m.reqLatencyCalc.Observe(time.Since(start).Seconds())
+		m.reqCounterCalc.Inc()
+		if err != nil {
+			m.errCounterCalc.Inc()
+		}
+	}(time.Now())
+	inv, err = m.next.CalculateAccountInvoice(ctx, accountID, period)
+	return
+}
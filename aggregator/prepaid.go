@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+type pricer interface {
+	pricing(obuID int) (quote, error)
+	multiplier(ctx context.Context, d types.Distance, q quote) (float64, error)
+}
+
+// PrepaidMiddleware draws the cost of every aggregated distance from the
+// balance of prepaid accounts and publishes an AccountEvent for each of
+// their OBUs whenever the balance falls below the low balance threshold,
+// runs out or is topped up again.
+type PrepaidMiddleware struct {
+	pricer   pricer
+	registry registry.Registry
+	ledger   *ledger.Ledger
+	events   EventProducer
+
+	mu       sync.Mutex
+	accounts map[string]*prepaidAccount
+
+	eventCounter   *prometheus.CounterVec
+	blockedCounter prometheus.Counter
+
+	next Aggregator
+}
+
+// prepaidAccount is the draw state of one account. mu is held across the
+// draw, events are published under publishMu so draws of the account go on
+// while they are produced.
+type prepaidAccount struct {
+	mu sync.Mutex
+	// fractions of a minor unit not drawn yet
+	remainder float64
+	// current balance state, bumping version on every change
+	state   string
+	version uint64
+
+	publishMu sync.Mutex
+	// version of the state last published
+	published uint64
+}
+
+func NewPrepaidMiddleware(next Aggregator, p pricer, reg registry.Registry, l *ledger.Ledger, events EventProducer) *PrepaidMiddleware {
+	return &PrepaidMiddleware{
+		pricer:   p,
+		registry: reg,
+		ledger:   l,
+		events:   events,
+		accounts: make(map[string]*prepaidAccount),
+		eventCounter: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "aggregator",
+			Name:      "account_events_total",
+			Help:      "Prepaid balance events published, by type.",
+		}, []string{"type"}),
+		blockedCounter: promauto.NewCounter(prometheus.CounterOpts{
+			Namespace: "aggregator",
+			Name:      "blocked_distances_total",
+			Help:      "Distances of readings the data receivers flagged as blocked.",
+		}),
+		next: next,
+	}
+}
+
+func (m *PrepaidMiddleware) account(id string) *prepaidAccount {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.accounts[id]
+	if !ok {
+		a = &prepaidAccount{}
+		m.accounts[id] = a
+	}
+	return a
+}
+
+// AggregateDistance draws the balance once per distance, when it is first
+// aggregated. A duplicate was drawn for already, one that missed the quorum
+// is held here and drawn for, a retry of it is a duplicate. Failing to draw
+// the balance is logged.
+func (m *PrepaidMiddleware) AggregateDistance(ctx context.Context, distance types.Distance) error {
+	err := m.next.AggregateDistance(ctx, distance)
+	if err != nil && !errors.Is(err, ErrNoQuorum) {
+		return err
+	}
+	if distance.Blocked {
+		m.blockedCounter.Inc()
+	}
+	if err := m.draw(ctx, distance); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"obuID": distance.OBUID,
+			"error": err,
+		}).Error("failed to draw prepaid balance")
+	}
+	return err
+}
+
+// draw charges the distance like an invoice would, exemptions and
+// discounts included. A single distance is often worth less than a minor
+// unit, so fractions are carried over to the next one instead of being
+// rounded away. A distance the data receiver flagged as blocked although the
+// account is not depleted, or no longer prepaid, publishes the state of the
+// account again, the receiver missed it.
+func (m *PrepaidMiddleware) draw(ctx context.Context, distance types.Distance) error {
+	q, err := m.pricer.pricing(distance.OBUID)
+	if err != nil {
+		return err
+	}
+	if q.account == nil || !q.account.Prepaid {
+		if distance.Blocked {
+			var accountID string
+			if q.vehicle != nil {
+				accountID = q.vehicle.AccountID
+			}
+			return m.produce(types.AccountReleased, accountID, distance.OBUID)
+		}
+		return nil
+	}
+	multiplier, err := m.pricer.multiplier(ctx, distance, q)
+	if err != nil {
+		return err
+	}
+	exp, err := types.Exponent(q.currency)
+	if err != nil {
+		return err
+	}
+	account := *q.account
+	a := m.account(account.ID)
+	a.mu.Lock()
+	remainder := a.remainder
+	units := remainder + distance.Value*q.price*multiplier*math.Pow10(exp)
+	whole := int64(units)
+	a.remainder = units - float64(whole)
+	if whole > 0 {
+		memo := fmt.Sprintf("obu %d, %.3f at %.4f", distance.OBUID, distance.Value, q.price)
+		// keyed by distance, a draw posted already is not posted twice
+		_, err := m.ledger.Usage(account.ID, types.NewMoney(whole, q.currency), "usage:"+keyed(distance).RequestID, memo)
+		if errors.Is(err, ledger.ErrDuplicateReference) {
+			a.remainder = remainder
+			a.mu.Unlock()
+			return nil
+		}
+		if errors.Is(err, ErrNoQuorum) {
+			// drawn here, the peers get it from the backlog
+			logrus.WithFields(logrus.Fields{
+				"accountID": account.ID,
+				"error":     err,
+			}).Warn("prepaid draw not replicated yet")
+		} else if err != nil {
+			a.remainder += float64(whole)
+			a.mu.Unlock()
+			return err
+		}
+	}
+	m.update(a, account)
+	if distance.Blocked && a.state != types.AccountDepleted {
+		a.version++
+	}
+	a.mu.Unlock()
+	return m.publish(account.ID, a)
+}
+
+// Refresh re-evaluates the balance state of an account after payments,
+// credits or reversals were posted for it.
+func (m *PrepaidMiddleware) Refresh(accountID string) {
+	account, err := m.registry.GetAccount(accountID)
+	if err != nil || !account.Prepaid {
+		return
+	}
+	a := m.account(accountID)
+	a.mu.Lock()
+	m.update(a, account)
+	a.mu.Unlock()
+	if err := m.publish(accountID, a); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"accountID": accountID,
+			"error":     err,
+		}).Error("failed to publish account event")
+	}
+}
+
+// RefreshAll publishes the state of every prepaid account, a restarted
+// aggregator does not know what it published before.
+func (m *PrepaidMiddleware) RefreshAll() error {
+	accounts, err := m.registry.ListAccounts()
+	if err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		m.Refresh(account.ID)
+	}
+	return nil
+}
+
+// balanceState returns the state of a prepaid account for its balance.
+func (m *PrepaidMiddleware) balanceState(account types.Account) string {
+	balance := m.ledger.Owed(account.ID).Neg()
+	switch {
+	case balance.Units <= 0:
+		return types.AccountDepleted
+	case balance.Units < account.LowBalance.Units:
+		// thresholds are kept in the account currency
+		return types.AccountLowBalance
+	}
+	return types.AccountReplenished
+}
+
+// update sets the state of the account from its balance, the caller holds
+// a.mu.
+func (m *PrepaidMiddleware) update(a *prepaidAccount, account types.Account) {
+	if state := m.balanceState(account); state != a.state || a.version == 0 {
+		a.state = state
+		a.version++
+	}
+}
+
+// publish sends the state of the account to every OBU of it unless it was
+// published already. A state that fails to publish is sent again by the
+// next draw or refresh.
+func (m *PrepaidMiddleware) publish(accountID string, a *prepaidAccount) error {
+	a.publishMu.Lock()
+	defer a.publishMu.Unlock()
+	a.mu.Lock()
+	state, version := a.state, a.version
+	a.mu.Unlock()
+	if version == a.published {
+		return nil
+	}
+	vehicles, err := m.registry.ListVehicles(accountID)
+	if err != nil {
+		return err
+	}
+	for _, v := range vehicles {
+		if err := m.produce(state, accountID, v.OBUID); err != nil {
+			return err
+		}
+	}
+	a.published = version
+	logrus.WithFields(logrus.Fields{
+		"accountID": accountID,
+		"type":      state,
+		"obus":      len(vehicles),
+	}).Info("prepaid balance changed")
+	return nil
+}
+
+func (m *PrepaidMiddleware) produce(state, accountID string, obuID int) error {
+	ev := types.AccountEvent{
+		Type:      state,
+		AccountID: accountID,
+		OBUID:     obuID,
+		At:        time.Now().UnixNano(),
+	}
+	if state != types.AccountReleased {
+		ev.Balance = m.ledger.Owed(accountID).Neg()
+	}
+	if err := m.events.ProduceEvent(ev); err != nil {
+		return err
+	}
+	m.eventCounter.WithLabelValues(state).Inc()
+	return nil
+}
+
+// vehicleChanged publishes the state of the account an OBU now belongs to,
+// or releases it when that account is not prepaid.
+func (m *PrepaidMiddleware) vehicleChanged(obuID int, accountID string) error {
+	account, err := m.registry.GetAccount(accountID)
+	if errors.Is(err, registry.ErrAccountNotFound) || err == nil && !account.Prepaid {
+		return m.produce(types.AccountReleased, accountID, obuID)
+	}
+	if err != nil {
+		return err
+	}
+	a := m.account(accountID)
+	a.publishMu.Lock()
+	defer a.publishMu.Unlock()
+	a.mu.Lock()
+	m.update(a, account)
+	state := a.state
+	a.mu.Unlock()
+	return m.produce(state, accountID, obuID)
+}
+
+// accountReleased releases every OBU of an account that is no longer
+// prepaid.
+func (m *PrepaidMiddleware) accountReleased(accountID string) error {
+	m.mu.Lock()
+	delete(m.accounts, accountID)
+	m.mu.Unlock()
+	vehicles, err := m.registry.ListVehicles(accountID)
+	if err != nil {
+		return err
+	}
+	for _, v := range vehicles {
+		if err := m.produce(types.AccountReleased, accountID, v.OBUID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchRegistry returns reg publishing the state of the OBUs whose account
+// changes, so the blocklist of the data receivers follows vehicles that are
+// added, moved or removed and accounts that become postpaid.
+func (m *PrepaidMiddleware) WatchRegistry(reg registry.Registry) registry.Registry {
+	return &prepaidRegistry{Registry: reg, prepaid: m}
+}
+
+type prepaidRegistry struct {
+	registry.Registry
+	prepaid *PrepaidMiddleware
+}
+
+func (r *prepaidRegistry) PutAccount(account types.Account) (types.Account, error) {
+	old, err := r.Registry.GetAccount(account.ID)
+	wasPrepaid := err == nil && old.Prepaid
+	account, err = r.Registry.PutAccount(account)
+	if err != nil {
+		return account, err
+	}
+	switch {
+	case account.Prepaid:
+		r.prepaid.Refresh(account.ID)
+	case wasPrepaid:
+		r.logError(r.prepaid.accountReleased(account.ID), account.ID)
+	}
+	return account, nil
+}
+
+func (r *prepaidRegistry) PutVehicle(v types.Vehicle) (types.Vehicle, error) {
+	v, err := r.Registry.PutVehicle(v)
+	if err != nil {
+		return v, err
+	}
+	r.logError(r.prepaid.vehicleChanged(v.OBUID, v.AccountID), v.AccountID)
+	return v, nil
+}
+
+func (r *prepaidRegistry) DeleteVehicle(obuID int) error {
+	v, err := r.Registry.GetVehicle(obuID)
+	if err != nil {
+		return err
+	}
+	if err := r.Registry.DeleteVehicle(obuID); err != nil {
+		return err
+	}
+	r.logError(r.prepaid.produce(types.AccountReleased, v.AccountID, obuID), v.AccountID)
+	return nil
+}
+
+// logError logs a failed event, the registry change itself went through.
+func (r *prepaidRegistry) logError(err error, accountID string) {
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"accountID": accountID,
+			"error":     err,
+		}).Error("failed to publish account event")
+	}
+}
+
+func (m *PrepaidMiddleware) CalculateInvoice(ctx context.Context, obuID int) (*types.Invoice, error) {
+	return m.next.CalculateInvoice(ctx, obuID)
+}
+
+func (m *PrepaidMiddleware) DistanceSeries(ctx context.Context, q types.SeriesQuery) (*types.Series, error) {
+	return m.next.DistanceSeries(ctx, q)
+}
+
+func (m *PrepaidMiddleware) CalculateAccountInvoice(ctx context.Context, accountID string, period types.Period) (*types.AccountInvoice, error) {
+	return m.next.CalculateAccountInvoice(ctx, accountID, period)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// fakeEvents records the account events it is given.
+type fakeEvents struct {
+	mu     sync.Mutex
+	events []types.AccountEvent
+}
+
+func (e *fakeEvents) ProduceEvent(ev types.AccountEvent) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, ev)
+	return nil
+}
+
+func (e *fakeEvents) Close() {}
+
+func (e *fakeEvents) take() []types.AccountEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	events := e.events
+	e.events = nil
+	return events
+}
+
+// newTestPrepaid draws from the ledger of n an account with OBU 1 in it
+// holding balance, at 3.70 EUR per km. Its metrics are not registered, so
+// tests can make more than one.
+func newTestPrepaid(t *testing.T, n *node, balance int64) (*PrepaidMiddleware, *fakeEvents, types.Account) {
+	t.Helper()
+	account, err := n.reg.PutAccount(types.Account{Name: "fleet", Prepaid: true, LowBalance: types.NewMoney(1000, "EUR")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.reg.PutVehicle(types.Vehicle{OBUID: 1, Plate: "B-1", Class: types.ClassCar, AccountID: account.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.ledger.Post(ledger.KindPayment, account.ID, types.NewMoney(balance, "EUR"), "top-up", "", "test"); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		invoice = NewInvoiceAggregator(n.store, n.reg, Tariff{Currency: "EUR"}, nil)
+		events  = &fakeEvents{}
+	)
+	m := &PrepaidMiddleware{
+		pricer:         invoice,
+		registry:       n.reg,
+		ledger:         n.ledger,
+		events:         events,
+		accounts:       make(map[string]*prepaidAccount),
+		eventCounter:   prometheus.NewCounterVec(prometheus.CounterOpts{Name: "account_events_total"}, []string{"type"}),
+		blockedCounter: prometheus.NewCounter(prometheus.CounterOpts{Name: "blocked_distances_total"}),
+		next:           invoice,
+	}
+	return m, events, account
+}
+
+func balance(n *node, account types.Account) int64 {
+	return n.ledger.Owed(account.ID).Neg().Units
+}
+
+// A distance sent again, also after it missed the quorum, is drawn once.
+func TestPrepaidDrawsOncePerDistance(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		nodes = newCluster(t, 2, 0)
+		a, b  = nodes[0], nodes[1]
+	)
+	m, _, account := newTestPrepaid(t, a, 10_000)
+	eventually(t, "the peer holds the account", func() bool { return balance(b, account) == 10_000 })
+
+	d := distance(1, 10, "r1")
+	if err := m.AggregateDistance(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AggregateDistance(ctx, d); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+	if got := balance(a, account); got != 10_000-3_700 {
+		t.Fatalf("balance %d after a redelivery", got)
+	}
+
+	b.down.Store(true)
+	retried := distance(1, 10, "r2")
+	if err := m.AggregateDistance(ctx, retried); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("got %v, want ErrNoQuorum", err)
+	}
+	// held here and drawn for, the peer gets both from the backlog
+	if got := balance(a, account); got != 10_000-7_400 {
+		t.Fatalf("balance %d after a write short of the quorum", got)
+	}
+	b.down.Store(false)
+	if err := m.AggregateDistance(ctx, retried); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("got %v, want ErrDuplicate once a quorum holds it", err)
+	}
+	for i, n := range nodes {
+		eventually(t, "balance converges", func() bool {
+			return balance(n, account) == 10_000-7_400 && total(n, 1) == 20
+		})
+		if got := n.ledger.Balance(account.ID, time.Now()).Used.Units; got != 7_400 {
+			t.Fatalf("node %d used %d", i, got)
+		}
+	}
+}
+
+// A distance flagged as blocked while the account is not depleted means
+// the data receiver missed an event, the state is published again.
+func TestPrepaidRepublishesStateOfBlockedDistance(t *testing.T) {
+	var (
+		ctx = context.Background()
+		n   = newNode(t, 0, defaultReadingsRetention)
+	)
+	m, events, _ := newTestPrepaid(t, n, 10_000)
+
+	if err := m.AggregateDistance(ctx, distance(1, 1, "r1")); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); len(got) != 1 || got[0].Type != types.AccountReplenished {
+		t.Fatalf("got events %+v", got)
+	}
+	if err := m.AggregateDistance(ctx, distance(1, 1, "r2")); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); len(got) != 0 {
+		t.Fatalf("state published again without a change: %+v", got)
+	}
+
+	flagged := distance(1, 1, "r3")
+	flagged.Blocked = true
+	if err := m.AggregateDistance(ctx, flagged); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); len(got) != 1 || got[0].Type != types.AccountReplenished || got[0].OBUID != 1 {
+		t.Fatalf("got events %+v for a flagged distance", got)
+	}
+
+	// the account is depleted, the receiver is right to flag
+	if err := m.AggregateDistance(ctx, distance(1, 30, "r4")); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); len(got) != 1 || got[0].Type != types.AccountDepleted {
+		t.Fatalf("got events %+v", got)
+	}
+	flagged = distance(1, 1, "r5")
+	flagged.Blocked = true
+	if err := m.AggregateDistance(ctx, flagged); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); len(got) != 0 {
+		t.Fatalf("got events %+v for a depleted account", got)
+	}
+
+	// a vehicle moved to a postpaid account is released
+	postpaid, err := n.reg.PutAccount(types.Account{Name: "postpaid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.reg.PutVehicle(types.Vehicle{OBUID: 1, Plate: "B-1", Class: types.ClassCar, AccountID: postpaid.ID}); err != nil {
+		t.Fatal(err)
+	}
+	flagged = distance(1, 1, "r6")
+	flagged.Blocked = true
+	if err := m.AggregateDistance(ctx, flagged); err != nil {
+		t.Fatal(err)
+	}
+	if got := events.take(); len(got) != 1 || got[0].Type != types.AccountReleased || got[0].AccountID != postpaid.ID {
+		t.Fatalf("got events %+v for a postpaid account", got)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/aggregator/rules"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// per km prices by vehicle class, vehicles missing from the registry pay
+// basePrice
+var defaultClassPrices = map[string]float64{
+	types.ClassMotorcycle: 1.9,
+	types.ClassCar:        basePrice,
+	types.ClassVan:        5.2,
+	types.ClassTruck:      9.4,
+	types.ClassBus:        7.1,
+}
+
+// Tariff is everything that turns distance into money.
+type Tariff struct {
+	// currency of the class prices and of accounts without one
+	Currency    string
+	ClassPrices map[string]float64
+	// units of a currency per unit of Currency, for accounts billed in
+	// another currency
+	ExchangeRates map[string]float64
+	Rounding      types.RoundingRules
+	VAT           taxRates
+}
+
+// defaultCurrency reads AGG_CURRENCY. Amounts stored before they carried a
+// currency are in it.
+func defaultCurrency() string {
+	if v := os.Getenv("AGG_CURRENCY"); v != "" {
+		return v
+	}
+	return types.DefaultCurrency
+}
+
+// tariffFromEnv reads AGG_CURRENCY, AGG_CLASS_PRICES, AGG_EXCHANGE_RATES,
+// AGG_ROUNDING and AGG_VAT_RATES.
+func tariffFromEnv() (Tariff, error) {
+	t := Tariff{Currency: defaultCurrency()}
+	if _, err := types.Exponent(t.Currency); err != nil {
+		return t, fmt.Errorf("invalid AGG_CURRENCY: %w", err)
+	}
+	var err error
+	if t.ClassPrices, err = classPrices(); err != nil {
+		return t, err
+	}
+	if t.ExchangeRates, err = exchangeRates(); err != nil {
+		return t, err
+	}
+	if t.Rounding, err = types.ParseRoundingRules(os.Getenv("AGG_ROUNDING")); err != nil {
+		return t, fmt.Errorf("invalid AGG_ROUNDING: %w", err)
+	}
+	if t.VAT, err = parseTaxRates(os.Getenv("AGG_VAT_RATES")); err != nil {
+		return t, fmt.Errorf("invalid AGG_VAT_RATES: %w", err)
+	}
+	return t, nil
+}
+
+// classPrices applies AGG_CLASS_PRICES, e.g. "truck=10.5,van=6", on top of
+// the defaults.
+func classPrices() (map[string]float64, error) {
+	prices := make(map[string]float64, len(defaultClassPrices))
+	for class, price := range defaultClassPrices {
+		prices[class] = price
+	}
+	v := os.Getenv("AGG_CLASS_PRICES")
+	if v == "" {
+		return prices, nil
+	}
+	for _, pair := range strings.Split(v, ",") {
+		class, price, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || !slices.Contains(types.VehicleClasses, class) {
+			return nil, fmt.Errorf("invalid class price %q", pair)
+		}
+		p, err := strconv.ParseFloat(price, 64)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("invalid class price %q", pair)
+		}
+		prices[class] = p
+	}
+	return prices, nil
+}
+
+// exchangeRates reads AGG_EXCHANGE_RATES, e.g. "USD=1.08,GBP=0.85".
+func exchangeRates() (map[string]float64, error) {
+	rates := make(map[string]float64)
+	v := os.Getenv("AGG_EXCHANGE_RATES")
+	if v == "" {
+		return rates, nil
+	}
+	for _, pair := range strings.Split(v, ",") {
+		currency, rate, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid exchange rate %q", pair)
+		}
+		if _, err := types.Exponent(currency); err != nil {
+			return nil, err
+		}
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate %q", pair)
+		}
+		rates[currency] = r
+	}
+	return rates, nil
+}
+
+// quote is what an OBU pays per km and in which currency.
+type quote struct {
+	// nil for OBUs missing from the registry
+	vehicle *types.Vehicle
+	account *types.Account
+	// per km, in currency
+	price    float64
+	currency string
+}
+
+// country is the billing country, "" when it is unknown.
+func (q quote) country() string {
+	if q.account == nil {
+		return ""
+	}
+	return q.account.BillingAddress.Country
+}
+
+// pricing looks up the vehicle an OBU is installed in, its account and its
+// price per km.
+func (i *InvoiceAggregator) pricing(obuID int) (quote, error) {
+	v, err := i.registry.GetVehicle(obuID)
+	if errors.Is(err, registry.ErrVehicleNotFound) {
+		return quote{price: basePrice, currency: i.tariff.Currency}, nil
+	}
+	if err != nil {
+		return quote{}, err
+	}
+	account, err := i.registry.GetAccount(v.AccountID)
+	if err != nil {
+		return quote{}, err
+	}
+	return i.vehiclePricing(v, account)
+}
+
+func (i *InvoiceAggregator) vehiclePricing(v types.Vehicle, account types.Account) (quote, error) {
+	q := quote{
+		vehicle:  &v,
+		account:  &account,
+		price:    i.classPrice(v.Class),
+		currency: i.accountCurrency(account),
+	}
+	if q.currency != i.tariff.Currency {
+		rate, ok := i.tariff.ExchangeRates[q.currency]
+		if !ok {
+			return q, fmt.Errorf("no exchange rate from %s to %s", i.tariff.Currency, q.currency)
+		}
+		q.price *= rate
+	}
+	return q, nil
+}
+
+func (i *InvoiceAggregator) classPrice(class string) float64 {
+	if price, ok := i.tariff.ClassPrices[class]; ok {
+		return price
+	}
+	return basePrice
+}
+
+func (i *InvoiceAggregator) accountCurrency(account types.Account) string {
+	if account.Currency != "" {
+		return account.Currency
+	}
+	return i.tariff.Currency
+}
+
+// amount rounds distance times price to the currency of the quote.
+func (i *InvoiceAggregator) amount(q quote, distance float64) (types.Money, error) {
+	return types.FromFloat(distance*q.price, q.currency, i.tariff.Rounding.For(q.currency))
+}
+
+// ruleInput describes an OBU and what it drove to the rules. Vehicles
+// missing from the registry only match rules on their OBU.
+func (i *InvoiceAggregator) ruleInput(ctx context.Context, obuID int, q quote, usage []rules.Usage) (rules.Input, error) {
+	in := rules.Input{OBUID: obuID, Usage: usage, Rounding: i.tariff.Rounding.For(q.currency)}
+	if q.vehicle != nil {
+		in.Plate, in.Class, in.AccountID = q.vehicle.Plate, q.vehicle.Class, q.vehicle.AccountID
+	}
+	if i.rules.NeedsMonthlyDistance() && len(usage) > 0 {
+		at := usage[0].At.UTC()
+		month := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+		buckets, err := i.store.Buckets(ctx, obuID, types.ResolutionHour, month, at)
+		if err != nil {
+			return in, err
+		}
+		for _, d := range buckets {
+			in.DrivenBefore += d
+		}
+	}
+	return in, nil
+}
+
+// usage returns the hourly distance of an OBU in [from, to) for the rules.
+func (i *InvoiceAggregator) usage(ctx context.Context, obuID int, from, to time.Time) ([]rules.Usage, error) {
+	if i.rules == nil {
+		return nil, nil
+	}
+	buckets, err := i.store.Buckets(ctx, obuID, types.ResolutionHour, from, to)
+	if err != nil {
+		return nil, err
+	}
+	usage := make([]rules.Usage, 0, len(buckets))
+	for start, dist := range buckets {
+		usage = append(usage, rules.Usage{At: time.Unix(start, 0).UTC(), Distance: dist})
+	}
+	slices.SortFunc(usage, func(a, b rules.Usage) int {
+		return a.At.Compare(b.At)
+	})
+	return usage, nil
+}
+
+// adjust runs the rules for an amount an OBU incurred over its usage.
+func (i *InvoiceAggregator) adjust(ctx context.Context, obuID int, q quote, amount types.Money, usage []rules.Usage) ([]types.Adjustment, error) {
+	if i.rules == nil {
+		return nil, nil
+	}
+	in, err := i.ruleInput(ctx, obuID, q, usage)
+	if err != nil {
+		return nil, err
+	}
+	in.Amount = amount
+	return i.rules.Evaluate(in), nil
+}
+
+// multiplier is the share of a single distance left to pay after the
+// rules. The distance is aggregated already, it does not count towards the
+// monthly distance driven before it.
+func (i *InvoiceAggregator) multiplier(ctx context.Context, d types.Distance, q quote) (float64, error) {
+	if i.rules == nil {
+		return 1, nil
+	}
+	usage := []rules.Usage{{At: time.Unix(0, d.Unix).UTC(), Distance: d.Value}}
+	in, err := i.ruleInput(ctx, d.OBUID, q, usage)
+	if err != nil {
+		return 0, err
+	}
+	// the buckets up to the hour of the distance hold it
+	in.DrivenBefore = max(0, in.DrivenBefore-d.Value)
+	return i.rules.Multiplier(in), nil
+}
+
+// netAmount adds the adjustments to an amount, they share its currency.
+func netAmount(amount types.Money, adjustments []types.Adjustment) types.Money {
+	for _, a := range adjustments {
+		amount.Units += a.Amount.Units
+	}
+	return amount
+}
+
+// makeRules loads AGG_RULES_FILE, without it invoices are not adjusted.
+func makeRules() (*rules.Engine, error) {
+	path := os.Getenv("AGG_RULES_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	return rules.Load(path)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+
+	"github.com/shamssahal/toll-calculator/aggregator/client"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+type rebalanceResult struct {
+	Shard    string `json:"shard"`
+	Readings int    `json:"readings"`
+	// distances copied to each new owner
+	Moved map[string]int `json:"moved"`
+	Error string         `json:"error,omitempty"`
+}
+
+// rebalance copies the distances every shard of AGG_SHARDS holds to the
+// shard that owns their OBU on the ring of AGG_SHARDS. A shard applies a
+// RequestID once, so it is safe to run again, results are written to
+// stdout as JSON. To add shards:
+//
+//  1. start the new shards with the new AGG_SHARDS, the new shards appended
+//     to it. The first shard is the coordinator, it keeps the accounts, the
+//     ledger and the disputes, which are not rebalanced, so it stays first
+//  2. run aggregator rebalance with the new AGG_SHARDS
+//  3. restart the other shards and the clients with the new AGG_SHARDS
+//  4. run it again for the distances the old ring routed in the meantime
+//
+// Until then a shard hands a distance it does not own on its ring to the
+// owner, and the clients retry one that could not be handed on. The copies
+// stay on the old shards, which no longer serve them.
+//
+//	aggregator rebalance
+//	aggregator rebalance -dry-run
+func rebalance(args []string) error {
+	var (
+		fs     = flag.NewFlagSet("rebalance", flag.ExitOnError)
+		dryRun = fs.Bool("dry-run", false, "only count the distances to move")
+	)
+	fs.Parse(args)
+
+	v := os.Getenv("AGG_SHARDS")
+	if v == "" {
+		return errors.New("AGG_SHARDS is not set")
+	}
+	shards, err := client.ParseShards(v)
+	if err != nil {
+		return err
+	}
+	var (
+		ring    = client.NewRing(shards)
+		clients = map[string]*client.HTTPClient{}
+		enc     = json.NewEncoder(os.Stdout)
+		ctx     = context.Background()
+	)
+	for _, s := range shards {
+		c, err := client.NewHTTPClientWithTLS(s.Endpoint, tlsconfig.FromEnv("AGG_PEER"))
+		if err != nil {
+			return err
+		}
+		clients[s.Name] = c
+	}
+	for _, s := range shards {
+		res := rebalanceShard(ctx, ring, clients, s.Name, *dryRun)
+		if res.Error != "" {
+			logrus.WithFields(logrus.Fields{
+				"shard": s.Name,
+				"error": res.Error,
+			}).Error("failed to rebalance shard")
+		}
+		if err := enc.Encode(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rebalanceShard(ctx context.Context, ring *client.Ring, clients map[string]*client.HTTPClient, shard string, dryRun bool) rebalanceResult {
+	res := rebalanceResult{Shard: shard, Moved: map[string]int{}}
+	state, err := clients[shard].ReplicaSnapshot(ctx)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Readings = len(state.Distances)
+	moving := map[string][]types.Distance{}
+	for _, d := range state.Distances {
+		if owner := ring.Owner(d.OBUID).Name; owner != shard {
+			moving[owner] = append(moving[owner], d)
+		}
+	}
+	for owner, ds := range moving {
+		for len(ds) > 0 {
+			batch := ds[:min(len(ds), replicationBatch)]
+			if !dryRun {
+				if err := clients[owner].Replicate(ctx, types.ReplicaBatch{Distances: batch}); err != nil {
+					res.Error = err.Error()
+					return res
+				}
+			}
+			res.Moved[owner] += len(batch)
+			ds = ds[len(batch):]
+		}
+	}
+	return res
+}
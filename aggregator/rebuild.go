@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/url"
+	"os"
+
+	"github.com/shamssahal/toll-calculator/aggregator/eventlog"
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+type rebuildSummary struct {
+	Events   uint64  `json:"events"`
+	OBUs     int     `json:"obus"`
+	Distance float64 `json:"distance"`
+	Snapshot string  `json:"snapshot,omitempty"`
+}
+
+type rerateResult struct {
+	AccountID string `json:"accountId"`
+	// what the account was charged for the period, nil when it was not
+	Charged *types.Money `json:"charged,omitempty"`
+	// the invoice priced with the current tariff and rules
+	Invoice *types.AccountInvoice `json:"invoice,omitempty"`
+	// rerated minus charged, negative when the account was overcharged
+	Difference *types.Money `json:"difference,omitempty"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// rebuild replays the whole event log of AGG_EVENT_LOG into an empty state.
+// By default the state replaces the snapshot, with -rerate the invoices of
+// a period are priced again with the tariff and rules of the environment
+// and compared to what the ledger charged. Results are written to stdout
+// as JSON.
+//
+//	aggregator rebuild
+//	aggregator rebuild -rerate -period 2026-09
+func rebuild(args []string) error {
+	var (
+		fs      = flag.NewFlagSet("rebuild", flag.ExitOnError)
+		rerate  = fs.Bool("rerate", false, "re-rate invoices instead of writing a snapshot")
+		period  = fs.String("period", "", "re-rate: month to re-rate, e.g. 2026-09")
+		from    = fs.String("from", "", "re-rate: period start, RFC 3339")
+		to      = fs.String("to", "", "re-rate: period end, RFC 3339")
+		account = fs.String("account", "", "re-rate: only this account (all when empty)")
+	)
+	fs.Parse(args)
+
+	l := makeEventLog()
+	if l == nil {
+		return errors.New("AGG_EVENT_LOG is not set")
+	}
+	defer l.Close()
+	var (
+		store   = NewMemoryStore(readingsRetention())
+		summary rebuildSummary
+		offset  int64
+	)
+	err := l.Replay(0, func(ev eventlog.Event, next int64) error {
+		store.apply(ev.Distance)
+		store.retain(ev.Distance)
+		summary.Events, offset = ev.Seq, next
+		summary.Distance += ev.Distance.Value
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	summary.OBUs = len(store.data)
+	logrus.WithFields(logrus.Fields{
+		"events": summary.Events,
+		"obus":   summary.OBUs,
+	}).Info("replayed the event log")
+
+	enc := json.NewEncoder(os.Stdout)
+	if !*rerate {
+		// a running aggregator keeps its own snapshots, this one is picked
+		// up on its next start
+		es := &EventSourcedStore{MemoryStore: store, log: l, snapshotPath: snapshotPath()}
+		if err := es.saveSnapshot(store.state(true), summary.Events, offset); err != nil {
+			return err
+		}
+		summary.Snapshot = es.snapshotPath
+		return enc.Encode(summary)
+	}
+
+	q := url.Values{}
+	for k, v := range map[string]string{"period": *period, "from": *from, "to": *to} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	p, err := types.ParsePeriod(q)
+	if err != nil {
+		return err
+	}
+	tariff, err := tariffFromEnv()
+	if err != nil {
+		return err
+	}
+	engine, err := makeRules()
+	if err != nil {
+		return err
+	}
+	var (
+		reg      = makeRegistry()
+		journal  = makeLedger()
+		invoices = NewInvoiceAggregator(store, reg, tariff, engine)
+	)
+	accountIDs := []string{*account}
+	if *account == "" {
+		accounts, err := reg.ListAccounts()
+		if err != nil {
+			return err
+		}
+		accountIDs = accountIDs[:0]
+		for _, a := range accounts {
+			accountIDs = append(accountIDs, a.ID)
+		}
+	}
+	// vehicles are billed to the account they belong to now, like a
+	// regular invoice would be
+	for _, id := range accountIDs {
+		if err := enc.Encode(rerateAccount(invoices, journal, id, p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func rerateAccount(invoices *InvoiceAggregator, journal *ledger.Ledger, accountID string, period types.Period) rerateResult {
+	res := rerateResult{AccountID: accountID}
+	inv, err := invoices.CalculateAccountInvoice(context.Background(), accountID, period)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Invoice = inv
+	charge, err := journal.ChargeFor(accountID, inv.Period)
+	if err != nil {
+		return res
+	}
+	charged := charge.Postings[0].Amount
+	diff, err := inv.TotalAmount.Add(charged.Neg())
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Charged, res.Difference = &charged, &diff
+	return res
+}
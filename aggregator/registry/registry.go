@@ -0,0 +1,315 @@
+// Package registry maps OBUs to vehicles and the accounts that own them.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+var (
+	ErrAccountNotFound = errors.New("account not found")
+	ErrVehicleNotFound = errors.New("vehicle not found")
+	ErrAccountInUse    = errors.New("account still owns vehicles")
+	ErrInvalid         = errors.New("invalid registry entry")
+)
+
+type Registry interface {
+	// PutAccount creates or replaces an account, an empty id creates a new
+	// one.
+	PutAccount(types.Account) (types.Account, error)
+	GetAccount(string) (types.Account, error)
+	DeleteAccount(string) error
+	ListAccounts() ([]types.Account, error)
+	PutVehicle(types.Vehicle) (types.Vehicle, error)
+	GetVehicle(int) (types.Vehicle, error)
+	DeleteVehicle(int) error
+	// ListVehicles returns the vehicles of an account, or all of them for
+	// an empty account id.
+	ListVehicles(string) ([]types.Vehicle, error)
+}
+
+func validateVehicle(v types.Vehicle) error {
+	switch {
+	case v.OBUID <= 0:
+		return fmt.Errorf("%w: obuID must be positive", ErrInvalid)
+	case !slices.Contains(types.VehicleClasses, v.Class):
+		return fmt.Errorf("%w: class must be one of %s", ErrInvalid, strings.Join(types.VehicleClasses, ", "))
+	case v.AccountID == "":
+		return fmt.Errorf("%w: accountId is required", ErrInvalid)
+	}
+	return nil
+}
+
+type MemoryRegistry struct {
+	mu       sync.RWMutex
+	accounts map[string]types.Account
+	vehicles map[int]types.Vehicle
+}
+
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		accounts: make(map[string]types.Account),
+		vehicles: make(map[int]types.Vehicle),
+	}
+}
+
+func (r *MemoryRegistry) PutAccount(a types.Account) (types.Account, error) {
+	if a.Name == "" {
+		return a, fmt.Errorf("%w: name is required", ErrInvalid)
+	}
+	if a.Currency != "" {
+		if _, err := types.Exponent(a.Currency); err != nil {
+			return a, fmt.Errorf("%w: %v", ErrInvalid, err)
+		}
+	}
+	switch {
+	case a.LowBalance.Units < 0:
+		return a, fmt.Errorf("%w: lowBalance must not be negative", ErrInvalid)
+	case a.Currency != "" && !a.LowBalance.IsZero() && a.LowBalance.Currency != a.Currency:
+		return a, fmt.Errorf("%w: lowBalance must be in %s", ErrInvalid, a.Currency)
+	}
+	if a.ID == "" {
+		a.ID = uuid.New().String()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.accounts[a.ID] = a
+	return a, nil
+}
+
+func (r *MemoryRegistry) GetAccount(id string) (types.Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a, ok := r.accounts[id]
+	if !ok {
+		return a, ErrAccountNotFound
+	}
+	return a, nil
+}
+
+func (r *MemoryRegistry) DeleteAccount(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.accounts[id]; !ok {
+		return ErrAccountNotFound
+	}
+	for _, v := range r.vehicles {
+		if v.AccountID == id {
+			return ErrAccountInUse
+		}
+	}
+	delete(r.accounts, id)
+	return nil
+}
+
+func (r *MemoryRegistry) ListAccounts() ([]types.Account, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	accounts := make([]types.Account, 0, len(r.accounts))
+	for _, a := range r.accounts {
+		accounts = append(accounts, a)
+	}
+	slices.SortFunc(accounts, func(a, b types.Account) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return accounts, nil
+}
+
+func (r *MemoryRegistry) PutVehicle(v types.Vehicle) (types.Vehicle, error) {
+	if err := validateVehicle(v); err != nil {
+		return v, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.accounts[v.AccountID]; !ok {
+		return v, ErrAccountNotFound
+	}
+	r.vehicles[v.OBUID] = v
+	return v, nil
+}
+
+func (r *MemoryRegistry) GetVehicle(obuID int) (types.Vehicle, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	v, ok := r.vehicles[obuID]
+	if !ok {
+		return v, ErrVehicleNotFound
+	}
+	return v, nil
+}
+
+func (r *MemoryRegistry) DeleteVehicle(obuID int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.vehicles[obuID]; !ok {
+		return ErrVehicleNotFound
+	}
+	delete(r.vehicles, obuID)
+	return nil
+}
+
+func (r *MemoryRegistry) ListVehicles(accountID string) ([]types.Vehicle, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.accounts[accountID]; accountID != "" && !ok {
+		return nil, ErrAccountNotFound
+	}
+	vehicles := []types.Vehicle{}
+	for _, v := range r.vehicles {
+		if accountID == "" || v.AccountID == accountID {
+			vehicles = append(vehicles, v)
+		}
+	}
+	slices.SortFunc(vehicles, func(a, b types.Vehicle) int {
+		return a.OBUID - b.OBUID
+	})
+	return vehicles, nil
+}
+
+type snapshot struct {
+	Accounts []types.Account `json:"accounts"`
+	Vehicles []types.Vehicle `json:"vehicles"`
+}
+
+// FileRegistry is a MemoryRegistry persisted to a JSON file after every
+// change. A missing file starts an empty registry.
+type FileRegistry struct {
+	*MemoryRegistry
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileRegistry loads the registry at path. Accounts written before
+// amounts carried a currency have their low balance in major units of
+// legacyCurrency, or of their own currency, they are migrated on load.
+func NewFileRegistry(path, legacyCurrency string) (*FileRegistry, error) {
+	r := &FileRegistry{
+		MemoryRegistry: NewMemoryRegistry(),
+		path:           path,
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap struct {
+		Accounts []json.RawMessage `json:"accounts"`
+		Vehicles []types.Vehicle   `json:"vehicles"`
+	}
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return nil, err
+	}
+	migrated := 0
+	for _, raw := range snap.Accounts {
+		a, legacy, err := decodeAccount(raw, legacyCurrency)
+		if err != nil {
+			return nil, err
+		}
+		if legacy {
+			migrated++
+		}
+		r.accounts[a.ID] = a
+	}
+	for _, v := range snap.Vehicles {
+		r.vehicles[v.OBUID] = v
+	}
+	// write the migrated accounts back once
+	if migrated > 0 {
+		if err := r.save(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// decodeAccount reads an account and reports whether its low balance was
+// still a number of major units.
+func decodeAccount(raw json.RawMessage, legacyCurrency string) (types.Account, bool, error) {
+	var v struct {
+		types.Account
+		// shadows Account.LowBalance
+		LowBalance json.RawMessage `json:"lowBalance"`
+	}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return types.Account{}, false, err
+	}
+	a := v.Account
+	if len(v.LowBalance) == 0 || string(v.LowBalance) == "null" {
+		return a, false, nil
+	}
+	if v.LowBalance[0] == '{' {
+		err := json.Unmarshal(v.LowBalance, &a.LowBalance)
+		return a, false, err
+	}
+	var major float64
+	if err := json.Unmarshal(v.LowBalance, &major); err != nil {
+		return a, false, fmt.Errorf("account %s: lowBalance: %w", a.ID, err)
+	}
+	currency := a.Currency
+	if currency == "" {
+		currency = legacyCurrency
+	}
+	var err error
+	a.LowBalance, err = types.FromFloat(major, currency, types.DefaultRounding)
+	if err != nil {
+		return a, false, fmt.Errorf("account %s: lowBalance: %w", a.ID, err)
+	}
+	return a, true, nil
+}
+
+func (r *FileRegistry) PutAccount(a types.Account) (types.Account, error) {
+	a, err := r.MemoryRegistry.PutAccount(a)
+	if err != nil {
+		return a, err
+	}
+	return a, r.save()
+}
+
+func (r *FileRegistry) DeleteAccount(id string) error {
+	if err := r.MemoryRegistry.DeleteAccount(id); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileRegistry) PutVehicle(v types.Vehicle) (types.Vehicle, error) {
+	v, err := r.MemoryRegistry.PutVehicle(v)
+	if err != nil {
+		return v, err
+	}
+	return v, r.save()
+}
+
+func (r *FileRegistry) DeleteVehicle(obuID int) error {
+	if err := r.MemoryRegistry.DeleteVehicle(obuID); err != nil {
+		return err
+	}
+	return r.save()
+}
+
+func (r *FileRegistry) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var snap snapshot
+	snap.Accounts, _ = r.ListAccounts()
+	snap.Vehicles, _ = r.ListVehicles("")
+	b, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
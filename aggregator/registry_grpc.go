@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/types"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type GRPCRegistryServer struct {
+	types.UnimplementedRegistryServer
+	reg registry.Registry
+}
+
+func NewGRPCRegistryServer(reg registry.Registry) *GRPCRegistryServer {
+	return &GRPCRegistryServer{
+		reg: reg,
+	}
+}
+
+// registryStatus maps registry errors to gRPC status codes.
+func registryStatus(err error) error {
+	code := codes.Internal
+	switch {
+	case errors.Is(err, registry.ErrAccountNotFound), errors.Is(err, registry.ErrVehicleNotFound):
+		code = codes.NotFound
+	case errors.Is(err, registry.ErrInvalid):
+		code = codes.InvalidArgument
+	case errors.Is(err, registry.ErrAccountInUse):
+		code = codes.FailedPrecondition
+	case errors.Is(err, ErrNoQuorum):
+		code = codes.Unavailable
+	}
+	return status.Error(code, err.Error())
+}
+
+func (s *GRPCRegistryServer) PutAccount(ctx context.Context, req *types.AccountRecord) (*types.AccountRecord, error) {
+	account, err := s.reg.PutAccount(types.AccountFromRecord(req))
+	if err != nil {
+		return nil, registryStatus(err)
+	}
+	return account.Record(), nil
+}
+
+func (s *GRPCRegistryServer) GetAccount(ctx context.Context, req *types.AccountID) (*types.AccountRecord, error) {
+	account, err := s.reg.GetAccount(req.ID)
+	if err != nil {
+		return nil, registryStatus(err)
+	}
+	return account.Record(), nil
+}
+
+func (s *GRPCRegistryServer) DeleteAccount(ctx context.Context, req *types.AccountID) (*types.None, error) {
+	if err := s.reg.DeleteAccount(req.ID); err != nil {
+		return nil, registryStatus(err)
+	}
+	return &types.None{}, nil
+}
+
+func (s *GRPCRegistryServer) ListAccounts(ctx context.Context, req *types.None) (*types.AccountList, error) {
+	accounts, err := s.reg.ListAccounts()
+	if err != nil {
+		return nil, registryStatus(err)
+	}
+	list := &types.AccountList{}
+	for _, a := range accounts {
+		list.Accounts = append(list.Accounts, a.Record())
+	}
+	return list, nil
+}
+
+func (s *GRPCRegistryServer) PutVehicle(ctx context.Context, req *types.VehicleRecord) (*types.VehicleRecord, error) {
+	vehicle, err := s.reg.PutVehicle(types.VehicleFromRecord(req))
+	if err != nil {
+		return nil, registryStatus(err)
+	}
+	return vehicle.Record(), nil
+}
+
+func (s *GRPCRegistryServer) GetVehicle(ctx context.Context, req *types.VehicleID) (*types.VehicleRecord, error) {
+	vehicle, err := s.reg.GetVehicle(int(req.ObuID))
+	if err != nil {
+		return nil, registryStatus(err)
+	}
+	return vehicle.Record(), nil
+}
+
+func (s *GRPCRegistryServer) DeleteVehicle(ctx context.Context, req *types.VehicleID) (*types.None, error) {
+	if err := s.reg.DeleteVehicle(int(req.ObuID)); err != nil {
+		return nil, registryStatus(err)
+	}
+	return &types.None{}, nil
+}
+
+func (s *GRPCRegistryServer) ListVehicles(ctx context.Context, req *types.AccountID) (*types.VehicleList, error) {
+	vehicles, err := s.reg.ListVehicles(req.ID)
+	if err != nil {
+		return nil, registryStatus(err)
+	}
+	list := &types.VehicleList{}
+	for _, v := range vehicles {
+		list.Vehicles = append(list.Vehicles, v.Record())
+	}
+	return list, nil
+}
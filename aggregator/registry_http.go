@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+func registerRegistryRoutes(mux *http.ServeMux, reg registry.Registry) {
+	var (
+		accountsHandler = newHTTPMetricHandler("/accounts")
+		vehiclesHandler = newHTTPMetricHandler("/vehicles")
+	)
+	mux.HandleFunc("GET /accounts", accountsHandler.instrumentAndLog(handleListAccounts(reg)))
+	mux.HandleFunc("POST /accounts", accountsHandler.instrumentAndLog(handlePutAccount(reg)))
+	mux.HandleFunc("GET /accounts/{id}", accountsHandler.instrumentAndLog(handleGetAccount(reg)))
+	mux.HandleFunc("PUT /accounts/{id}", accountsHandler.instrumentAndLog(handlePutAccount(reg)))
+	mux.HandleFunc("DELETE /accounts/{id}", accountsHandler.instrumentAndLog(handleDeleteAccount(reg)))
+	mux.HandleFunc("GET /vehicles", vehiclesHandler.instrumentAndLog(handleListVehicles(reg)))
+	mux.HandleFunc("GET /vehicles/{obuID}", vehiclesHandler.instrumentAndLog(handleGetVehicle(reg)))
+	mux.HandleFunc("PUT /vehicles/{obuID}", vehiclesHandler.instrumentAndLog(handlePutVehicle(reg)))
+	mux.HandleFunc("DELETE /vehicles/{obuID}", vehiclesHandler.instrumentAndLog(handleDeleteVehicle(reg)))
+}
+
+// writeRegistryError maps registry errors to status codes.
+func writeRegistryError(w http.ResponseWriter, err error) error {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, registry.ErrAccountNotFound), errors.Is(err, registry.ErrVehicleNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, registry.ErrInvalid):
+		status = http.StatusBadRequest
+	case errors.Is(err, registry.ErrAccountInUse):
+		status = http.StatusConflict
+	case errors.Is(err, ErrNoQuorum):
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+	return err
+}
+
+func handleListAccounts(reg registry.Registry) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		accounts, err := reg.ListAccounts()
+		if err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, http.StatusOK, accounts)
+		return nil
+	}
+}
+
+// handlePutAccount creates an account on POST /accounts and replaces one on
+// PUT /accounts/{id}.
+func handlePutAccount(reg registry.Registry) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var account types.Account
+		if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		status := http.StatusCreated
+		account.ID = r.PathValue("id")
+		if account.ID != "" {
+			if _, err := reg.GetAccount(account.ID); err != nil {
+				return writeRegistryError(w, err)
+			}
+			status = http.StatusOK
+		}
+		account, err := reg.PutAccount(account)
+		if err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, status, account)
+		return nil
+	}
+}
+
+func handleGetAccount(reg registry.Registry) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		account, err := reg.GetAccount(r.PathValue("id"))
+		if err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, http.StatusOK, account)
+		return nil
+	}
+}
+
+func handleDeleteAccount(reg registry.Registry) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := reg.DeleteAccount(r.PathValue("id")); err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{})
+		return nil
+	}
+}
+
+func handleListVehicles(reg registry.Registry) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		vehicles, err := reg.ListVehicles(r.URL.Query().Get("account"))
+		if err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, http.StatusOK, vehicles)
+		return nil
+	}
+}
+
+func obuIDFromPath(w http.ResponseWriter, r *http.Request) (int, error) {
+	obuID, err := strconv.Atoi(r.PathValue("obuID"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "incorrect obuID in path"})
+	}
+	return obuID, err
+}
+
+func handleGetVehicle(reg registry.Registry) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		obuID, err := obuIDFromPath(w, r)
+		if err != nil {
+			return err
+		}
+		vehicle, err := reg.GetVehicle(obuID)
+		if err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, http.StatusOK, vehicle)
+		return nil
+	}
+}
+
+func handlePutVehicle(reg registry.Registry) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		obuID, err := obuIDFromPath(w, r)
+		if err != nil {
+			return err
+		}
+		var vehicle types.Vehicle
+		if err := json.NewDecoder(r.Body).Decode(&vehicle); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		vehicle.OBUID = obuID
+		if vehicle, err = reg.PutVehicle(vehicle); err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, http.StatusOK, vehicle)
+		return nil
+	}
+}
+
+func handleDeleteVehicle(reg registry.Registry) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		obuID, err := obuIDFromPath(w, r)
+		if err != nil {
+			return err
+		}
+		if err := reg.DeleteVehicle(obuID); err != nil {
+			return writeRegistryError(w, err)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{})
+		return nil
+	}
+}
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shamssahal/toll-calculator/aggregator/client"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReplicationTimeout = 2 * time.Second
+	// distances and changes a peer may fall behind by, past it the peer is
+	// sent the whole state again once it is back
+	defaultReplicationBacklog = 1_000_000
+	// distances and changes sent to a lagging peer per request
+	replicationBatch = 500
+)
+
+var (
+	ErrNoQuorum        = errors.New("write was not replicated to a quorum of aggregators")
+	ErrDuplicate       = errors.New("distance was aggregated already")
+	errBacklogOverflow = errors.New("backlog overflowed, the peer is sent the whole state")
+)
+
+// Peer is another aggregator of the cluster. ReplicatedStore is one itself,
+// so nodes can be wired to each other in process.
+type Peer interface {
+	Replicate(ctx context.Context, batch types.ReplicaBatch) error
+	ReplicaSnapshot(ctx context.Context) (types.ReplicaBatch, error)
+}
+
+// ReplicatedStore keeps the state of a cluster of aggregators in sync, the
+// distances and, once they are added with ReplicateRegistry,
+// ReplicateLedger and ReplicateDisputes, the registry, ledger and disputes.
+// Every node accepts writes and sends them to all of its peers, a write is
+// acknowledged once a quorum of nodes, itself included, holds it. Reads are
+// served from the local state.
+//
+// Distances are a set keyed by RequestID, applying one twice is a no-op,
+// so writes can be retried on any node and replicas converge regardless of
+// the order distances arrive in. A retry of a distance the node holds is
+// reported with ErrDuplicate. RequestIDs are remembered for the readings
+// retention, older distances are refused. Ledger transactions are a set
+// keyed by id as well, accounts, vehicles and disputes are last writer
+// wins.
+//
+// Every peer is sent the writes in the order they were made from a backlog,
+// retried in the background while the peer is down. One that fell too far
+// behind is sent the whole state again.
+// A node that starts merges the state of every reachable peer before
+// serving.
+type ReplicatedStore struct {
+	Storer
+	// breaks ties between changes made at the same time on two nodes
+	node      string
+	peers     []*replica
+	quorum    int
+	timeout   time.Duration
+	retention time.Duration
+	states    []replicatedState
+	byKind    map[string]replicatedState
+
+	mu sync.Mutex
+	// event time of every RequestID applied, until it is past the
+	// retention
+	seen   map[string]int64
+	pruned time.Time
+	// distances that missed the quorum, a retry of one is sent again
+	unconfirmed map[string]types.Distance
+}
+
+// replicatedState is state of an aggregator besides its distances, changes
+// to it are replicated along with them.
+type replicatedState interface {
+	// kinds of the changes the state applies
+	kinds() []string
+	// apply applies a change another node made, reporting whether it was
+	// new
+	apply(types.Change) (bool, error)
+	// changes returns the whole state, for a peer catching up
+	changes() ([]types.Change, error)
+}
+
+// replica is a peer and what it has yet to receive. Batches are sent to it
+// in the order they were written, one request at a time.
+type replica struct {
+	name       string
+	peer       Peer
+	maxBacklog int
+
+	mu sync.Mutex
+	// batches the peer has yet to receive and the distances and changes
+	// in them
+	backlog []types.ReplicaBatch
+	entries int
+	// batches ever queued and delivered, the backlog holds the ones in
+	// between, failed is the last one a failed request included
+	queued, delivered, failed uint64
+	lastErr                   error
+	// closed and replaced after every request, wakes the waiting writers
+	done chan struct{}
+	// bumped whenever the backlog overflows, the peer is sent the whole
+	// state until resynced catches up
+	overflows, resynced uint64
+	wake                chan struct{}
+
+	backlogSize prometheus.Gauge
+	resyncs     prometheus.Counter
+}
+
+var (
+	replicationBacklog = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "aggregator",
+		Name:      "replication_backlog",
+		Help:      "Distances and changes a peer has yet to receive.",
+	}, []string{"peer"})
+	replicationResyncs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aggregator",
+		Name:      "replication_resyncs_total",
+		Help:      "Backlogs that overflowed, the peer is sent the whole state instead.",
+	}, []string{"peer"})
+	replicationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "aggregator",
+		Name:      "replication_errors_total",
+		Help:      "Failed attempts to send distances and changes to a peer.",
+	}, []string{"peer"})
+)
+
+// NewReplicatedStore wraps local, which may already hold distances. quorum
+// is the number of nodes a write has to reach, 0 is a majority of the
+// cluster, retention the one of the readings of local. Add the peers and
+// Bootstrap before serving.
+func NewReplicatedStore(local Storer, quorum int, timeout, retention time.Duration) (*ReplicatedStore, error) {
+	if quorum < 0 {
+		return nil, fmt.Errorf("invalid quorum %d", quorum)
+	}
+	existing, err := local.AllReadings(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	s := &ReplicatedStore{
+		Storer:    local,
+		node:      uuid.New().String(),
+		quorum:    quorum,
+		timeout:   timeout,
+		retention: retention,
+		byKind:    make(map[string]replicatedState),
+		seen:      make(map[string]int64, len(existing)),
+		pruned:    time.Now(),
+
+		unconfirmed: make(map[string]types.Distance),
+	}
+	for _, d := range existing {
+		d = keyed(d)
+		s.seen[d.RequestID] = d.Unix
+	}
+	return s, nil
+}
+
+func (s *ReplicatedStore) AddPeer(name string, p Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers = append(s.peers, &replica{
+		name:        name,
+		peer:        p,
+		maxBacklog:  defaultReplicationBacklog,
+		done:        make(chan struct{}),
+		wake:        make(chan struct{}, 1),
+		backlogSize: replicationBacklog.WithLabelValues(name),
+		resyncs:     replicationResyncs.WithLabelValues(name),
+	})
+}
+
+// track replicates st, before the store is bootstrapped.
+func (s *ReplicatedStore) track(st replicatedState) {
+	s.states = append(s.states, st)
+	for _, kind := range st.kinds() {
+		s.byKind[kind] = st
+	}
+}
+
+// Bootstrap merges what the peers hold. A peer that is down is skipped,
+// it has nothing a quorum does not have.
+func (s *ReplicatedStore) Bootstrap(ctx context.Context) {
+	peers, _ := s.cluster()
+	for _, r := range peers {
+		snapCtx, cancel := context.WithTimeout(ctx, s.timeout*10)
+		state, err := r.peer.ReplicaSnapshot(snapCtx)
+		cancel()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"peer":  r.name,
+				"error": err,
+			}).Warn("failed to catch up with peer")
+			continue
+		}
+		distances, err := s.applyAll(ctx, state.Distances)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"peer":  r.name,
+				"error": err,
+			}).Error("failed to apply distances of peer")
+			continue
+		}
+		changes, err := s.applyChanges(state.Changes)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"peer":  r.name,
+				"error": err,
+			}).Error("failed to apply changes of peer")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"peer":      r.name,
+			"distances": distances,
+			"changes":   changes,
+		}).Info("caught up with peer")
+	}
+}
+
+// Run sends the backlogs of the peers until ctx is done, writes do not
+// reach a quorum without it.
+func (s *ReplicatedStore) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	peers, _ := s.cluster()
+	for _, r := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.run(ctx, s.timeout, s.ReplicaSnapshot)
+		}()
+	}
+	wg.Wait()
+}
+
+// keyed gives a distance without RequestID one derived from the distance
+// itself, so a retry of it is still applied once.
+func keyed(d types.Distance) types.Distance {
+	if d.RequestID == "" {
+		sum := sha256.Sum256(fmt.Appendf(nil, "%d|%d|%g|%d", d.OBUID, d.Unix, d.Value, d.ReceivedAt))
+		d.RequestID = "sha256:" + hex.EncodeToString(sum[:16])
+	}
+	return d
+}
+
+// Insert returns once a quorum of aggregators holds d. Distances older than
+// the readings retention are refused, their RequestIDs are forgotten and a
+// retry could not be told apart. A distance the node holds already is only
+// sent again when it missed the quorum, ErrDuplicate is returned once a
+// quorum holds it.
+func (s *ReplicatedStore) Insert(ctx context.Context, d types.Distance) error {
+	d = keyed(d)
+	if d.Unix < s.horizon(time.Now()) {
+		return fmt.Errorf("%w: obu %d event is older than the readings retention of %s", ErrLateEvent, d.OBUID, s.retention)
+	}
+	applied, err := s.apply(ctx, d)
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return s.confirm(ctx, d.RequestID)
+	}
+	if err := s.send(ctx, types.ReplicaBatch{Distances: []types.Distance{d}}); err != nil {
+		// the peers get it from the backlogs, a retry sends it again
+		s.mu.Lock()
+		s.unconfirmed[d.RequestID] = d
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// confirm returns once a quorum holds a distance the node has already. One
+// that missed the quorum is sent again, the peers ignore it when they got
+// it from the backlog since.
+func (s *ReplicatedStore) confirm(ctx context.Context, requestID string) error {
+	s.mu.Lock()
+	d, ok := s.unconfirmed[requestID]
+	s.mu.Unlock()
+	if ok {
+		if err := s.send(ctx, types.ReplicaBatch{Distances: []types.Distance{d}}); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		delete(s.unconfirmed, requestID)
+		s.mu.Unlock()
+	}
+	return ErrDuplicate
+}
+
+// sendChange replicates a change made to the local state.
+func (s *ReplicatedStore) sendChange(c types.Change) error {
+	return s.send(context.Background(), types.ReplicaBatch{Changes: []types.Change{c}})
+}
+
+// send returns once a quorum of nodes holds batch.
+func (s *ReplicatedStore) send(ctx context.Context, batch types.ReplicaBatch) error {
+	return s.enqueue(batch)(ctx)
+}
+
+// enqueue queues batch for every peer, the peers receive batches in the
+// order they were queued. The returned func waits until a quorum of nodes,
+// this one counted as holding it, has batch. The peers that miss it get it
+// once they are back.
+func (s *ReplicatedStore) enqueue(batch types.ReplicaBatch) func(context.Context) error {
+	peers, quorum := s.cluster()
+	type queued struct {
+		seq, overflows uint64
+		ok             bool
+	}
+	positions := make([]queued, len(peers))
+	for i, r := range peers {
+		seq, overflows, ok := r.enqueue(batch)
+		positions[i] = queued{seq, overflows, ok}
+	}
+	return func(ctx context.Context) error {
+		if len(peers) == 0 {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+		results := make(chan error, len(peers))
+		for i, r := range peers {
+			go func() {
+				if !positions[i].ok {
+					results <- errBacklogOverflow
+					return
+				}
+				results <- r.wait(ctx, positions[i].seq, positions[i].overflows)
+			}()
+		}
+		var (
+			acks    = 1
+			lastErr error
+		)
+		for received := 0; acks < quorum && received < len(peers); received++ {
+			if err := <-results; err != nil {
+				lastErr = err
+				continue
+			}
+			acks++
+		}
+		if acks < quorum {
+			return fmt.Errorf("%w: %d of %d: %v", ErrNoQuorum, acks, quorum, lastErr)
+		}
+		return nil
+	}
+}
+
+// cluster returns the peers and the number of nodes a write has to reach.
+func (s *ReplicatedStore) cluster() ([]*replica, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.quorum > 0 {
+		return s.peers, s.quorum
+	}
+	return s.peers, (len(s.peers)+1)/2 + 1
+}
+
+// horizon is the event time in unix nanoseconds RequestIDs are remembered
+// from.
+func (s *ReplicatedStore) horizon(now time.Time) int64 {
+	return now.Add(-s.retention).UnixNano()
+}
+
+// apply inserts d into the local store unless it has it already. A
+// distance past the retention is skipped, no node retains it any longer.
+func (s *ReplicatedStore) apply(ctx context.Context, d types.Distance) (bool, error) {
+	d = keyed(d)
+	now := time.Now()
+	horizon := s.horizon(now)
+	s.mu.Lock()
+	if _, ok := s.seen[d.RequestID]; ok || d.Unix < horizon {
+		s.mu.Unlock()
+		return false, nil
+	}
+	s.seen[d.RequestID] = d.Unix
+	if now.Sub(s.pruned) >= pruneInterval {
+		maps.DeleteFunc(s.seen, func(_ string, unix int64) bool { return unix < horizon })
+		maps.DeleteFunc(s.unconfirmed, func(_ string, d types.Distance) bool { return d.Unix < horizon })
+		s.pruned = now
+	}
+	s.mu.Unlock()
+	// the store orders concurrent inserts itself, e.g. into one group commit
+	if err := s.Storer.Insert(ctx, d); err != nil {
+		s.mu.Lock()
+		delete(s.seen, d.RequestID)
+		s.mu.Unlock()
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *ReplicatedStore) applyAll(ctx context.Context, distances []types.Distance) (int, error) {
+	applied := 0
+	for _, d := range distances {
+		ok, err := s.apply(ctx, d)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+func (s *ReplicatedStore) applyChanges(changes []types.Change) (int, error) {
+	applied := 0
+	for _, c := range changes {
+		st, ok := s.byKind[c.Kind]
+		if !ok {
+			return applied, fmt.Errorf("%s %s: unknown kind of change", c.Kind, c.Key)
+		}
+		ok, err := st.apply(c)
+		if err != nil {
+			return applied, fmt.Errorf("%s %s: %w", c.Kind, c.Key, err)
+		}
+		if ok {
+			applied++
+		}
+	}
+	return applied, nil
+}
+
+// Replicate applies what another aggregator accepted. It is not sent on,
+// the node that accepted it sends it to every peer.
+func (s *ReplicatedStore) Replicate(ctx context.Context, batch types.ReplicaBatch) error {
+	if _, err := s.applyAll(ctx, batch.Distances); err != nil {
+		return err
+	}
+	_, err := s.applyChanges(batch.Changes)
+	return err
+}
+
+// ReplicaSnapshot returns the whole local state, the retained distances
+// and the changes that make up the replicated registry, ledger and
+// disputes.
+func (s *ReplicatedStore) ReplicaSnapshot(ctx context.Context) (types.ReplicaBatch, error) {
+	distances, err := s.Storer.AllReadings(ctx)
+	if err != nil {
+		return types.ReplicaBatch{}, err
+	}
+	state := types.ReplicaBatch{Distances: distances}
+	for _, st := range s.states {
+		changes, err := st.changes()
+		if err != nil {
+			return types.ReplicaBatch{}, err
+		}
+		state.Changes = append(state.Changes, changes...)
+	}
+	return state, nil
+}
+
+func size(b types.ReplicaBatch) int {
+	return len(b.Distances) + len(b.Changes)
+}
+
+// enqueue adds batch to the backlog and returns its sequence number and the
+// overflows it was added after. It is not added when the backlog overflows,
+// the peer gets it with the whole state.
+func (r *replica) enqueue(batch types.ReplicaBatch) (seq, overflows uint64, ok bool) {
+	r.mu.Lock()
+	if r.entries+size(batch) > r.maxBacklog {
+		// the peer has been gone too long to keep everything it missed
+		clear(r.backlog)
+		r.backlog, r.entries = r.backlog[:0], 0
+		r.delivered = r.queued
+		r.overflows++
+		r.resyncs.Inc()
+		r.notify()
+	} else {
+		r.backlog = append(r.backlog, batch)
+		r.entries += size(batch)
+		r.queued++
+		seq, ok = r.queued, true
+	}
+	overflows = r.overflows
+	r.backlogSize.Set(float64(r.entries))
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+	return seq, overflows, ok
+}
+
+// notify wakes the writers waiting on the peer, the caller holds r.mu.
+func (r *replica) notify() {
+	close(r.done)
+	r.done = make(chan struct{})
+}
+
+// wait returns once the peer received the batch queued as seq, or a
+// request holding it failed.
+func (r *replica) wait(ctx context.Context, seq, overflows uint64) error {
+	for {
+		r.mu.Lock()
+		var (
+			overflowed = r.overflows != overflows
+			delivered  = r.delivered >= seq
+			failed     = r.failed >= seq
+			err, done  = r.lastErr, r.done
+		)
+		r.mu.Unlock()
+		switch {
+		case overflowed:
+			return errBacklogOverflow
+		case delivered:
+			return nil
+		case failed:
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+		}
+	}
+}
+
+// head merges the oldest batches of the backlog into one request of about
+// replicationBatch distances and changes, and returns how many it holds.
+// The caller holds r.mu.
+func (r *replica) head() (types.ReplicaBatch, int) {
+	var (
+		merged types.ReplicaBatch
+		n      int
+	)
+	for _, b := range r.backlog {
+		if n > 0 && size(merged)+size(b) > replicationBatch {
+			break
+		}
+		merged.Distances = append(merged.Distances, b.Distances...)
+		merged.Changes = append(merged.Changes, b.Changes...)
+		n++
+	}
+	return merged, n
+}
+
+// run sends the backlog, waiting a little longer after every failure.
+func (r *replica) run(ctx context.Context, timeout time.Duration, snapshot func(context.Context) (types.ReplicaBatch, error)) {
+	const maxWait = 30 * time.Second
+	wait := time.Second
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-time.After(wait):
+		}
+		if err := r.catchUp(ctx, timeout, snapshot); err != nil {
+			replicationErrors.WithLabelValues(r.name).Inc()
+			r.mu.Lock()
+			backlog := r.entries
+			r.mu.Unlock()
+			logrus.WithFields(logrus.Fields{
+				"peer":    r.name,
+				"backlog": backlog,
+				"error":   err,
+			}).Warn("failed to replicate backlog")
+			wait = min(wait*2, maxWait)
+			continue
+		}
+		wait = time.Second
+	}
+}
+
+// catchUp sends the whole state when the backlog overflowed, and the
+// backlog until it is empty.
+func (r *replica) catchUp(ctx context.Context, timeout time.Duration, snapshot func(context.Context) (types.ReplicaBatch, error)) error {
+	for {
+		r.mu.Lock()
+		overflows, stale := r.overflows, r.overflows != r.resynced
+		batch, n := r.head()
+		r.mu.Unlock()
+		if stale {
+			if err := r.resync(ctx, timeout, snapshot); err != nil {
+				return err
+			}
+			r.mu.Lock()
+			r.resynced = overflows
+			r.mu.Unlock()
+			continue
+		}
+		if n == 0 {
+			return nil
+		}
+		err := r.send(ctx, timeout, batch)
+		r.mu.Lock()
+		// enqueue only appends, the batches are still the head unless the
+		// backlog overflowed in the meantime
+		if r.overflows == overflows {
+			if err != nil {
+				r.failed, r.lastErr = r.delivered+uint64(n), err
+			} else {
+				clear(r.backlog[:n])
+				r.backlog = r.backlog[n:]
+				r.entries -= size(batch)
+				r.delivered += uint64(n)
+				r.backlogSize.Set(float64(r.entries))
+			}
+			r.notify()
+		}
+		r.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// resync sends the whole local state in batches. What was written since
+// the snapshot is in the backlog.
+func (r *replica) resync(ctx context.Context, timeout time.Duration, snapshot func(context.Context) (types.ReplicaBatch, error)) error {
+	state, err := snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	distances, changes := len(state.Distances), len(state.Changes)
+	for size(state) > 0 {
+		batch := types.ReplicaBatch{
+			Distances: state.Distances[:min(len(state.Distances), replicationBatch)],
+			Changes:   state.Changes[:min(len(state.Changes), replicationBatch)],
+		}
+		if err := r.send(ctx, timeout, batch); err != nil {
+			return err
+		}
+		state.Distances = state.Distances[len(batch.Distances):]
+		state.Changes = state.Changes[len(batch.Changes):]
+	}
+	logrus.WithFields(logrus.Fields{
+		"peer":      r.name,
+		"distances": distances,
+		"changes":   changes,
+	}).Info("resynced peer")
+	return nil
+}
+
+func (r *replica) send(ctx context.Context, timeout time.Duration, batch types.ReplicaBatch) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return r.peer.Replicate(ctx, batch)
+}
+
+// makeReplication replicates store to the aggregators in AGG_PEERS, a
+// comma separated list of their HTTP endpoints. Peers are verified with the
+// AGG_PEER TLS settings. A shard without peers still accepts the distances
+// a rebalance moves to it, nil when neither is configured. The rest of the
+// state is added and the store bootstrapped by the caller.
+func makeReplication(store Storer) *ReplicatedStore {
+	v := os.Getenv("AGG_PEERS")
+	if v == "" && os.Getenv("AGG_SHARDS") == "" {
+		return nil
+	}
+	quorum := 0
+	if v := os.Getenv("AGG_REPLICATION_QUORUM"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("invalid AGG_REPLICATION_QUORUM %q: %v", v, err)
+		}
+		quorum = n
+	}
+	timeout := defaultReplicationTimeout
+	if v := os.Getenv("AGG_REPLICATION_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid AGG_REPLICATION_TIMEOUT %q: %v", v, err)
+		}
+		timeout = d
+	}
+	s, err := NewReplicatedStore(store, quorum, timeout, readingsRetention())
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, endpoint := range strings.Split(v, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+		if endpoint == "" {
+			continue
+		}
+		c, err := client.NewHTTPClientWithTLS(endpoint, tlsconfig.FromEnv("AGG_PEER"))
+		if err != nil {
+			log.Fatalf("failed to create client for peer %s: %v", endpoint, err)
+		}
+		s.AddPeer(endpoint, c)
+	}
+	if n := len(s.peers) + 1; quorum > n {
+		log.Fatalf("AGG_REPLICATION_QUORUM %d is larger than the cluster of %d aggregators", quorum, n)
+	}
+	return s
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// registerReplicationRoutes serves the peers of the cluster. Replicated
+// distances and changes skip the middlewares and hooks, the node that
+// accepted them ran them.
+func registerReplicationRoutes(mux *http.ServeMux, s *ReplicatedStore) {
+	replicationHandler := newHTTPMetricHandler("/replicate")
+	mux.HandleFunc("POST /replicate", replicationHandler.instrumentAndLog(handleReplicate(s)))
+	mux.HandleFunc("GET /replicate/snapshot", replicationHandler.instrumentAndLog(handleReplicaSnapshot(s)))
+}
+
+func handleReplicate(s *ReplicatedStore) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var batch types.ReplicaBatch
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		if err := s.Replicate(r.Context(), batch); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]string{})
+	}
+}
+
+func handleReplicaSnapshot(s *ReplicatedStore) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		state, err := s.ReplicaSnapshot(r.Context())
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return err
+		}
+		return writeJSON(w, http.StatusOK, state)
+	}
+}
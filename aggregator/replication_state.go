@@ -0,0 +1,375 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/disputes"
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+// kinds of replicated changes
+const (
+	changeAccount     = "account"
+	changeVehicle     = "vehicle"
+	changeTransaction = "transaction"
+	changeDispute     = "dispute"
+)
+
+// newChange returns the change setting an entry to v, a nil v deletes it.
+func newChange(kind, key string, v any, ver version) (types.Change, error) {
+	c := types.Change{Kind: kind, Key: key, Version: ver.at, Node: ver.node, Deleted: v == nil}
+	if v == nil {
+		return c, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return c, err
+	}
+	c.Data = data
+	return c, nil
+}
+
+// version orders the changes of a registry entry.
+type version struct {
+	// unix nanoseconds
+	at      int64
+	node    string
+	deleted bool
+}
+
+// before reports whether c is a later change than the one at v.
+func (v version) before(c types.Change) bool {
+	if c.Version != v.at {
+		return c.Version > v.at
+	}
+	return c.Node > v.node
+}
+
+// ReplicateRegistry returns reg sending every change to the cluster, the
+// changes of the peers are applied to reg itself. Accounts and vehicles are
+// last writer wins. Their versions are only kept in memory, a node that
+// restarts takes the entries of its peers over its own.
+func (s *ReplicatedStore) ReplicateRegistry(reg registry.Registry) registry.Registry {
+	r := &replicatedRegistry{
+		Registry: reg,
+		cluster:  s,
+		versions: make(map[string]version),
+	}
+	s.track(r)
+	return r
+}
+
+type replicatedRegistry struct {
+	registry.Registry
+	cluster *ReplicatedStore
+
+	// held across a change and its version, not while it is replicated
+	mu sync.Mutex
+	// by kind and key, deleted entries included
+	versions map[string]version
+}
+
+// commit gives a local change the next version of its entry and queues it
+// for the peers, the caller holds r.mu. The peers get the changes in the
+// order they were made, a vehicle after its account. The returned func
+// waits for the quorum, without r.mu.
+func (r *replicatedRegistry) commit(kind, key string, v any) (func(context.Context) error, error) {
+	id := kind + "/" + key
+	ver := version{
+		at:      max(time.Now().UnixNano(), r.versions[id].at+1),
+		node:    r.cluster.node,
+		deleted: v == nil,
+	}
+	r.versions[id] = ver
+	c, err := newChange(kind, key, v, ver)
+	if err != nil {
+		return nil, err
+	}
+	return r.cluster.enqueue(types.ReplicaBatch{Changes: []types.Change{c}}), nil
+}
+
+func (r *replicatedRegistry) PutAccount(a types.Account) (types.Account, error) {
+	r.mu.Lock()
+	a, err := r.Registry.PutAccount(a)
+	if err != nil {
+		r.mu.Unlock()
+		return a, err
+	}
+	replicated, err := r.commit(changeAccount, a.ID, a)
+	r.mu.Unlock()
+	if err != nil {
+		return a, err
+	}
+	return a, replicated(context.Background())
+}
+
+func (r *replicatedRegistry) DeleteAccount(id string) error {
+	r.mu.Lock()
+	if err := r.Registry.DeleteAccount(id); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	replicated, err := r.commit(changeAccount, id, nil)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return replicated(context.Background())
+}
+
+func (r *replicatedRegistry) PutVehicle(v types.Vehicle) (types.Vehicle, error) {
+	r.mu.Lock()
+	v, err := r.Registry.PutVehicle(v)
+	if err != nil {
+		r.mu.Unlock()
+		return v, err
+	}
+	replicated, err := r.commit(changeVehicle, strconv.Itoa(v.OBUID), v)
+	r.mu.Unlock()
+	if err != nil {
+		return v, err
+	}
+	return v, replicated(context.Background())
+}
+
+func (r *replicatedRegistry) DeleteVehicle(obuID int) error {
+	r.mu.Lock()
+	if err := r.Registry.DeleteVehicle(obuID); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	replicated, err := r.commit(changeVehicle, strconv.Itoa(obuID), nil)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return replicated(context.Background())
+}
+
+func (r *replicatedRegistry) kinds() []string {
+	return []string{changeAccount, changeVehicle}
+}
+
+func (r *replicatedRegistry) apply(c types.Change) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := c.Kind + "/" + c.Key
+	if cur, ok := r.versions[id]; ok && !cur.before(c) {
+		return false, nil
+	}
+	err := r.write(c)
+	switch {
+	case err == nil:
+	case c.Deleted && (errors.Is(err, registry.ErrAccountNotFound) || errors.Is(err, registry.ErrVehicleNotFound)):
+		// deleted here as well
+	case errors.Is(err, registry.ErrAccountNotFound) && !r.accountDeleted(c):
+		// a vehicle of an account made on a third node that has not sent
+		// it here yet, the peer sends the change again
+		return false, fmt.Errorf("%s %s: %w", c.Kind, c.Key, err)
+	case errors.Is(err, registry.ErrAccountNotFound), errors.Is(err, registry.ErrAccountInUse), errors.Is(err, registry.ErrInvalid):
+		// conflicts with a change made at the same time on another node,
+		// e.g. a vehicle of an account deleted there, the entry catches
+		// up with its next change or when the node restarts
+		logrus.WithFields(logrus.Fields{
+			"kind":  c.Kind,
+			"key":   c.Key,
+			"error": err,
+		}).Warn("skipped conflicting registry change")
+		return false, nil
+	default:
+		return false, err
+	}
+	r.versions[id] = version{at: c.Version, node: c.Node, deleted: c.Deleted}
+	return true, nil
+}
+
+// accountDeleted reports whether the account of a vehicle change was
+// deleted, the caller holds r.mu.
+func (r *replicatedRegistry) accountDeleted(c types.Change) bool {
+	var v types.Vehicle
+	if c.Kind != changeVehicle || json.Unmarshal(c.Data, &v) != nil {
+		return false
+	}
+	return r.versions[changeAccount+"/"+v.AccountID].deleted
+}
+
+// write applies a change to the registry, the caller holds r.mu.
+func (r *replicatedRegistry) write(c types.Change) error {
+	if c.Kind == changeAccount {
+		if c.Deleted {
+			return r.Registry.DeleteAccount(c.Key)
+		}
+		var a types.Account
+		if err := json.Unmarshal(c.Data, &a); err != nil {
+			return err
+		}
+		_, err := r.Registry.PutAccount(a)
+		return err
+	}
+	obuID, err := strconv.Atoi(c.Key)
+	if err != nil {
+		return err
+	}
+	if c.Deleted {
+		return r.Registry.DeleteVehicle(obuID)
+	}
+	var v types.Vehicle
+	if err := json.Unmarshal(c.Data, &v); err != nil {
+		return err
+	}
+	_, err = r.Registry.PutVehicle(v)
+	return err
+}
+
+// changes returns the accounts before the vehicles they own, and the
+// deletions of vehicles before the ones of their accounts.
+func (r *replicatedRegistry) changes() ([]types.Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	accounts, err := r.Registry.ListAccounts()
+	if err != nil {
+		return nil, err
+	}
+	vehicles, err := r.Registry.ListVehicles("")
+	if err != nil {
+		return nil, err
+	}
+	var changes, deleted []types.Change
+	for _, a := range accounts {
+		c, err := newChange(changeAccount, a.ID, a, r.versions[changeAccount+"/"+a.ID])
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	for _, v := range vehicles {
+		key := strconv.Itoa(v.OBUID)
+		c, err := newChange(changeVehicle, key, v, r.versions[changeVehicle+"/"+key])
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	for id, ver := range r.versions {
+		if !ver.deleted {
+			continue
+		}
+		kind, key, _ := strings.Cut(id, "/")
+		c, _ := newChange(kind, key, nil, ver)
+		deleted = append(deleted, c)
+	}
+	// vehicle sorts after account
+	slices.SortFunc(deleted, func(a, b types.Change) int {
+		return -cmp.Compare(a.Kind, b.Kind)
+	})
+	return append(changes, deleted...), nil
+}
+
+// ReplicateLedger sends every transaction l posts to the cluster and posts
+// the transactions of the peers to l. Transactions are a set keyed by id,
+// one with a reference has an id derived from it, so a payment posted on
+// two nodes is posted once.
+func (s *ReplicatedStore) ReplicateLedger(l *ledger.Ledger) {
+	r := &replicatedLedger{ledger: l, cluster: s}
+	l.OnPost(r.posted)
+	s.track(r)
+}
+
+type replicatedLedger struct {
+	ledger  *ledger.Ledger
+	cluster *ReplicatedStore
+}
+
+func (r *replicatedLedger) posted(tx ledger.Transaction) error {
+	c, err := newChange(changeTransaction, tx.ID, tx, version{})
+	if err != nil {
+		return err
+	}
+	return r.cluster.sendChange(c)
+}
+
+func (r *replicatedLedger) kinds() []string {
+	return []string{changeTransaction}
+}
+
+func (r *replicatedLedger) apply(c types.Change) (bool, error) {
+	var tx ledger.Transaction
+	if err := json.Unmarshal(c.Data, &tx); err != nil {
+		return false, err
+	}
+	return r.ledger.Apply(tx)
+}
+
+func (r *replicatedLedger) changes() ([]types.Change, error) {
+	var changes []types.Change
+	for _, tx := range r.ledger.All() {
+		c, err := newChange(changeTransaction, tx.ID, tx, version{})
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// ReplicateDisputes sends every new state of a dispute of b to the cluster
+// and saves the states of the peers to b, the later state of a dispute
+// wins.
+func (s *ReplicatedStore) ReplicateDisputes(b *disputes.Book) {
+	r := &replicatedDisputes{book: b, cluster: s}
+	b.OnSave(r.saved)
+	s.track(r)
+}
+
+type replicatedDisputes struct {
+	book    *disputes.Book
+	cluster *ReplicatedStore
+}
+
+func (r *replicatedDisputes) change(d disputes.Dispute) (types.Change, error) {
+	return newChange(changeDispute, d.ID, d, version{at: d.UpdatedAt.UnixNano()})
+}
+
+func (r *replicatedDisputes) saved(d disputes.Dispute) error {
+	c, err := r.change(d)
+	if err != nil {
+		return err
+	}
+	return r.cluster.sendChange(c)
+}
+
+func (r *replicatedDisputes) kinds() []string {
+	return []string{changeDispute}
+}
+
+func (r *replicatedDisputes) apply(c types.Change) (bool, error) {
+	var d disputes.Dispute
+	if err := json.Unmarshal(c.Data, &d); err != nil {
+		return false, err
+	}
+	return r.book.Apply(d)
+}
+
+func (r *replicatedDisputes) changes() ([]types.Change, error) {
+	var changes []types.Change
+	for _, d := range r.book.List("") {
+		c, err := r.change(d)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/disputes"
+	"github.com/shamssahal/toll-calculator/aggregator/ledger"
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+var errNodeDown = errors.New("node is down")
+
+// node is an aggregator of an in-process cluster.
+type node struct {
+	store  *ReplicatedStore
+	reg    registry.Registry
+	ledger *ledger.Ledger
+	book   *disputes.Book
+	down   atomic.Bool
+}
+
+func newNode(t *testing.T, quorum int, retention time.Duration) *node {
+	t.Helper()
+	s, err := NewReplicatedStore(NewMemoryStore(retention), quorum, time.Second, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ledger.New(ledger.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := disputes.New(disputes.NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &node{store: s, ledger: l, book: b}
+	n.reg = s.ReplicateRegistry(registry.NewMemoryRegistry())
+	s.ReplicateLedger(l)
+	s.ReplicateDisputes(b)
+	return n
+}
+
+// peer reaches a node of the cluster unless it is down.
+type peer struct{ n *node }
+
+func (p peer) Replicate(ctx context.Context, batch types.ReplicaBatch) error {
+	if p.n.down.Load() {
+		return errNodeDown
+	}
+	return p.n.store.Replicate(ctx, batch)
+}
+
+func (p peer) ReplicaSnapshot(ctx context.Context) (types.ReplicaBatch, error) {
+	if p.n.down.Load() {
+		return types.ReplicaBatch{}, errNodeDown
+	}
+	return p.n.store.ReplicaSnapshot(ctx)
+}
+
+// connect makes the nodes in to peers of n.
+func connect(n *node, to ...*node) {
+	for i, p := range to {
+		n.store.AddPeer(fmt.Sprintf("node-%d", i), peer{p})
+	}
+}
+
+// newCluster wires size nodes to each other and retries their backlogs
+// until the test ends.
+func newCluster(t *testing.T, size, quorum int) []*node {
+	t.Helper()
+	nodes := make([]*node, size)
+	for i := range nodes {
+		nodes[i] = newNode(t, quorum, defaultReadingsRetention)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	for i, n := range nodes {
+		var others []*node
+		for j, p := range nodes {
+			if i != j {
+				others = append(others, p)
+			}
+		}
+		connect(n, others...)
+		go n.store.Run(ctx)
+	}
+	return nodes
+}
+
+func distance(obuID int, value float64, requestID string) types.Distance {
+	return types.Distance{OBUID: obuID, Value: value, Unix: time.Now().UnixNano(), RequestID: requestID}
+}
+
+// eventually fails the test unless cond holds within a few backlog retries.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: timed out", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func total(n *node, obuID int) float64 {
+	v, _ := n.store.Get(context.Background(), obuID)
+	return v
+}
+
+func TestReplicationSurvivesNodeLoss(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		nodes   = newCluster(t, 3, 0)
+		a, b, c = nodes[0], nodes[1], nodes[2]
+	)
+	account, err := a.reg.PutAccount(types.Account{Name: "fleet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.reg.PutVehicle(types.Vehicle{OBUID: 1, Plate: "B-1", Class: types.ClassCar, AccountID: account.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.store.Insert(ctx, distance(1, 10, "r1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.ledger.Post(ledger.KindPayment, account.ID, types.NewMoney(500, "EUR"), "bank-1", "", "test"); err != nil {
+		t.Fatal(err)
+	}
+	dispute, err := a.book.Open(disputes.Dispute{AccountID: account.ID, InvoiceID: "charge", Reason: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.down.Store(true)
+	for i, n := range []*node{b, c} {
+		eventually(t, fmt.Sprintf("node %d holds the writes of the lost node", i+1), func() bool {
+			_, vErr := n.reg.GetVehicle(1)
+			_, dErr := n.book.Get(dispute.ID)
+			return vErr == nil && dErr == nil && total(n, 1) == 10 &&
+				n.ledger.Balance(account.ID, time.Now()).Paid.Units == 500
+		})
+	}
+
+	// two of three nodes are a quorum
+	if err := b.store.Insert(ctx, distance(1, 5, "r2")); err != nil {
+		t.Fatal(err)
+	}
+	account.Name = "fleet 2"
+	if _, err := b.reg.PutAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.book.Resolve(dispute.ID, disputes.Resolution{Kind: disputes.ResolutionRejected, Actor: "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	a.down.Store(false)
+	for i, n := range nodes {
+		eventually(t, fmt.Sprintf("node %d converges", i), func() bool {
+			got, _ := n.reg.GetAccount(account.ID)
+			d, _ := n.book.Get(dispute.ID)
+			return total(n, 1) == 15 && got.Name == "fleet 2" && d.Status == disputes.StatusRejected
+		})
+	}
+}
+
+// A retry on any node, of a distance with or without RequestID, is
+// counted once.
+func TestReplicationAppliesRetriesOnce(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		nodes   = newCluster(t, 3, 0)
+		a, b, c = nodes[0], nodes[1], nodes[2]
+	)
+	d := types.Distance{OBUID: 1, Value: 10, Unix: time.Now().UnixNano(), ReceivedAt: time.Now().UnixNano()}
+	if err := a.store.Insert(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.store.Insert(ctx, d); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+	eventually(t, "node 1 holds the distance", func() bool { return total(b, 1) == 10 })
+	if err := b.store.Insert(ctx, d); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("got %v, want ErrDuplicate on another node", err)
+	}
+
+	b.down.Store(true)
+	c.down.Store(true)
+	retried := distance(2, 1, "r1")
+	if err := a.store.Insert(ctx, retried); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("got %v, want ErrNoQuorum", err)
+	}
+	// still short of the quorum
+	if err := a.store.Insert(ctx, retried); !errors.Is(err, ErrNoQuorum) {
+		t.Fatalf("got %v, want ErrNoQuorum while the peers are down", err)
+	}
+	b.down.Store(false)
+	c.down.Store(false)
+	if err := a.store.Insert(ctx, retried); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("got %v, want ErrDuplicate once a quorum holds it", err)
+	}
+	if err := a.store.Insert(ctx, retried); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+
+	for i, n := range nodes {
+		eventually(t, fmt.Sprintf("node %d holds both distances", i), func() bool {
+			return total(n, 1) == 10 && total(n, 2) == 1
+		})
+	}
+	// the backlogs are drained, nothing was counted twice
+	eventually(t, "backlogs drained", func() bool {
+		for _, r := range a.store.peers {
+			r.mu.Lock()
+			n := r.entries
+			r.mu.Unlock()
+			if n > 0 {
+				return false
+			}
+		}
+		return true
+	})
+	for i, n := range nodes {
+		if total(n, 1) != 10 || total(n, 2) != 1 {
+			t.Fatalf("node %d counted %v and %v", i, total(n, 1), total(n, 2))
+		}
+	}
+}
+
+// A peer that falls behind by more than its backlog holds is sent the
+// whole state once it is back.
+func TestReplicationResyncsOverflowingPeer(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		nodes = newCluster(t, 2, 1)
+		a, b  = nodes[0], nodes[1]
+	)
+	a.store.peers[0].maxBacklog = 2
+	b.down.Store(true)
+	account, err := a.reg.PutAccount(types.Account{Name: "fleet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 5 {
+		if err := a.store.Insert(ctx, distance(1, 1, fmt.Sprintf("r%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := a.store.peers[0]
+	eventually(t, "backlog overflows", func() bool {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.overflows > 0
+	})
+
+	b.down.Store(false)
+	eventually(t, "peer resynced", func() bool {
+		_, err := b.reg.GetAccount(account.ID)
+		return err == nil && total(b, 1) == 5
+	})
+}
+
+// A node that starts merges the state of its peers, deletions included.
+func TestBootstrapCatchesUpWithPeers(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		nodes = newCluster(t, 2, 0)
+		a     = nodes[0]
+	)
+	account, err := a.reg.PutAccount(types.Account{Name: "fleet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for obuID := 1; obuID <= 2; obuID++ {
+		if _, err := a.reg.PutVehicle(types.Vehicle{OBUID: obuID, Plate: "B-1", Class: types.ClassCar, AccountID: account.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.reg.DeleteVehicle(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.store.Insert(ctx, distance(1, 10, "r1")); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := a.ledger.Post(ledger.KindPayment, account.ID, types.NewMoney(500, "EUR"), "bank-1", "", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a node restarting with a registry that missed the deletion
+	c := newNode(t, 0, defaultReadingsRetention)
+	restored := c.reg.(*replicatedRegistry).Registry
+	restored.PutAccount(account)
+	restored.PutVehicle(types.Vehicle{OBUID: 2, Plate: "B-1", Class: types.ClassCar, AccountID: account.ID})
+	connect(c, nodes...)
+	c.store.Bootstrap(ctx)
+
+	if total(c, 1) != 10 {
+		t.Fatalf("got distance %v", total(c, 1))
+	}
+	if _, err := c.reg.GetVehicle(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.reg.GetVehicle(2); !errors.Is(err, registry.ErrVehicleNotFound) {
+		t.Fatalf("got %v for the deleted vehicle", err)
+	}
+	if _, err := c.ledger.Transaction(tx.ID); err != nil {
+		t.Fatal(err)
+	}
+	// posting the payment again on the new node is a duplicate
+	if _, err := c.ledger.Post(ledger.KindPayment, account.ID, types.NewMoney(500, "EUR"), "bank-1", "", "test"); !errors.Is(err, ledger.ErrDuplicateReference) {
+		t.Fatalf("got %v, want ErrDuplicateReference", err)
+	}
+}
+
+// RequestIDs are forgotten once their distances are past the retention,
+// distances that old are refused.
+func TestReplicationForgetsExpiredRequestIDs(t *testing.T) {
+	ctx := context.Background()
+	n := newNode(t, 0, time.Hour)
+	old := distance(1, 1, "old")
+	old.Unix = time.Now().Add(-2 * time.Hour).UnixNano()
+	if err := n.store.Insert(ctx, old); !errors.Is(err, ErrLateEvent) {
+		t.Fatalf("got %v, want ErrLateEvent", err)
+	}
+
+	n.store.mu.Lock()
+	n.store.seen["expired"] = old.Unix
+	n.store.pruned = time.Time{}
+	n.store.mu.Unlock()
+	if err := n.store.Insert(ctx, distance(1, 1, "new")); err != nil {
+		t.Fatal(err)
+	}
+	n.store.mu.Lock()
+	defer n.store.mu.Unlock()
+	if _, ok := n.store.seen["expired"]; ok || len(n.store.seen) != 1 {
+		t.Fatalf("got seen %v", n.store.seen)
+	}
+}
@@ -0,0 +1,308 @@
+// Package rules applies exemptions, discounts and promotions to invoices.
+// Every rule that applies shows up on the invoice as an adjustment with the
+// reason, so customers can see why they pay less than distance times price.
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+const (
+	// waives whatever is left to pay
+	TypeExemption = "exemption"
+	// takes a percentage off what is left to pay
+	TypeDiscount = "discount"
+)
+
+var ErrInvalid = errors.New("invalid rule")
+
+// Match selects the vehicles a rule applies to. Every non-empty field has
+// to match, an empty Match applies to every vehicle.
+type Match struct {
+	OBUIDs   []int    `json:"obuIDs,omitempty"`
+	Plates   []string `json:"plates,omitempty"`
+	Classes  []string `json:"classes,omitempty"`
+	Accounts []string `json:"accounts,omitempty"`
+}
+
+func (m Match) matches(in Input) bool {
+	return (len(m.OBUIDs) == 0 || slices.Contains(m.OBUIDs, in.OBUID)) &&
+		(len(m.Plates) == 0 || slices.Contains(m.Plates, in.Plate)) &&
+		(len(m.Classes) == 0 || slices.Contains(m.Classes, in.Class)) &&
+		(len(m.Accounts) == 0 || slices.Contains(m.Accounts, in.AccountID))
+}
+
+type Rule struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Match  Match  `json:"match"`
+	// discounts only, in percent
+	Percent float64 `json:"percent,omitempty"`
+	// frequent users: the rule applies to the km a vehicle drives in a
+	// calendar month beyond this distance
+	MinMonthlyDistance float64 `json:"minMonthlyDistance,omitempty"`
+	// promotions: the rule only applies to the km driven from ValidFrom
+	// until ValidUntil
+	ValidFrom  *time.Time `json:"validFrom,omitempty"`
+	ValidUntil *time.Time `json:"validUntil,omitempty"`
+}
+
+func (r Rule) validate() error {
+	switch {
+	case r.ID == "":
+		return fmt.Errorf("%w: id is required", ErrInvalid)
+	case r.Reason == "":
+		return fmt.Errorf("%w %s: reason is required", ErrInvalid, r.ID)
+	case r.Type != TypeExemption && r.Type != TypeDiscount:
+		return fmt.Errorf("%w %s: type must be %s or %s", ErrInvalid, r.ID, TypeExemption, TypeDiscount)
+	case r.Type == TypeDiscount && (r.Percent <= 0 || r.Percent > 100):
+		return fmt.Errorf("%w %s: percent must be in (0, 100]", ErrInvalid, r.ID)
+	case r.MinMonthlyDistance < 0:
+		return fmt.Errorf("%w %s: minMonthlyDistance must not be negative", ErrInvalid, r.ID)
+	case r.ValidFrom != nil && r.ValidUntil != nil && !r.ValidUntil.After(*r.ValidFrom):
+		return fmt.Errorf("%w %s: validUntil must be after validFrom", ErrInvalid, r.ID)
+	}
+	for _, class := range r.Match.Classes {
+		if !slices.Contains(types.VehicleClasses, class) {
+			return fmt.Errorf("%w %s: unknown class %q", ErrInvalid, r.ID, class)
+		}
+	}
+	return nil
+}
+
+type Engine struct {
+	rules []Rule
+}
+
+// New checks the rules and keeps their order.
+func New(rules []Rule) (*Engine, error) {
+	seen := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		if seen[r.ID] {
+			return nil, fmt.Errorf("%w: duplicate id %s", ErrInvalid, r.ID)
+		}
+		seen[r.ID] = true
+	}
+	return &Engine{rules: rules}, nil
+}
+
+// Load reads a JSON array of rules.
+func Load(path string) (*Engine, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return New(rules)
+}
+
+// NeedsMonthlyDistance reports whether any rule looks at the monthly
+// distance, which is costly to compute.
+func (e *Engine) NeedsMonthlyDistance() bool {
+	if e == nil {
+		return false
+	}
+	for _, r := range e.rules {
+		if r.MinMonthlyDistance > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// factor is the share of what is left the rule takes.
+func (r Rule) factor() *big.Rat {
+	if r.Type == TypeExemption {
+		return big.NewRat(1, 1)
+	}
+	// the shortest decimal of the percentage is what was configured
+	f, _ := new(big.Rat).SetString(strconv.FormatFloat(r.Percent, 'f', -1, 64))
+	return f.Quo(f, big.NewRat(100, 1))
+}
+
+// applies reports whether the rule covers a segment of distance driven at
+// the given time, after monthly km in the calendar month.
+func (r Rule) applies(in Input, at time.Time, monthly float64) bool {
+	return r.Match.matches(in) &&
+		monthly >= r.MinMonthlyDistance &&
+		(r.ValidFrom == nil || !at.Before(*r.ValidFrom)) &&
+		(r.ValidUntil == nil || at.Before(*r.ValidUntil))
+}
+
+// Usage is distance driven at a point in time, e.g. the distance of an
+// hour bucket or of a single reading.
+type Usage struct {
+	At       time.Time
+	Distance float64
+}
+
+// Input is what the rules know about a vehicle when it is invoiced.
+type Input struct {
+	OBUID     int
+	Plate     string
+	Class     string
+	AccountID string
+	// of the whole usage, before any adjustment
+	Amount   types.Money
+	Rounding types.Rounding
+	// what was driven, in time order. Rules are evaluated for every usage
+	// at its own time, a promotion only discounts the distance driven while
+	// it ran.
+	Usage []Usage
+	// driven in the calendar month of the first usage before it, frequent
+	// user discounts only take the km beyond their threshold
+	DrivenBefore float64
+}
+
+// segment is distance every rule either covers in full or not at all.
+type segment struct {
+	at       time.Time
+	distance float64
+	// driven in the calendar month before the segment
+	monthly float64
+}
+
+// thresholds returns the monthly distances rules start to apply at.
+func (e *Engine) thresholds() []float64 {
+	var ts []float64
+	for _, r := range e.rules {
+		if r.MinMonthlyDistance > 0 && !slices.Contains(ts, r.MinMonthlyDistance) {
+			ts = append(ts, r.MinMonthlyDistance)
+		}
+	}
+	slices.Sort(ts)
+	return ts
+}
+
+// segments splits the usage where the monthly distance crosses a threshold.
+func (e *Engine) segments(in Input) []segment {
+	var (
+		segments   []segment
+		thresholds = e.thresholds()
+		monthly    = in.DrivenBefore
+		month      time.Time
+	)
+	for i, u := range in.Usage {
+		at := u.At.UTC()
+		start := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if i > 0 && !start.Equal(month) {
+			monthly = 0
+		}
+		month = start
+		left := u.Distance
+		for _, t := range thresholds {
+			if monthly < t && monthly+left > t {
+				segments = append(segments, segment{at: u.At, distance: t - monthly, monthly: monthly})
+				left -= t - monthly
+				monthly = t
+			}
+		}
+		if left > 0 {
+			segments = append(segments, segment{at: u.At, distance: left, monthly: monthly})
+			monthly += left
+		}
+	}
+	return segments
+}
+
+// shares returns, per rule, the share of the usage it takes off, and the
+// share left to pay. In every segment the rules run in order, discounts
+// compound and an exemption waives the rest.
+func (e *Engine) shares(in Input) ([]*big.Rat, *big.Rat) {
+	var (
+		shares = make([]*big.Rat, len(e.rules))
+		left   = new(big.Rat)
+		total  = new(big.Rat)
+	)
+	for i := range shares {
+		shares[i] = new(big.Rat)
+	}
+	for _, seg := range e.segments(in) {
+		dist := new(big.Rat)
+		if dist.SetFloat64(seg.distance) == nil {
+			continue
+		}
+		total.Add(total, dist)
+		for i, r := range e.rules {
+			if !r.applies(in, seg.at, seg.monthly) {
+				continue
+			}
+			off := new(big.Rat).Mul(dist, r.factor())
+			shares[i].Add(shares[i], off)
+			dist.Sub(dist, off)
+			if r.Type == TypeExemption {
+				break
+			}
+		}
+		left.Add(left, dist)
+	}
+	if total.Sign() == 0 {
+		return shares, big.NewRat(1, 1)
+	}
+	for _, sh := range shares {
+		sh.Quo(sh, total)
+	}
+	return shares, left.Quo(left, total)
+}
+
+// Evaluate runs the rules over the usage and returns an adjustment for
+// every rule that took something off. Adjustments are negative and rounded
+// on their own, an amount that is waived in full nets to zero.
+func (e *Engine) Evaluate(in Input) []types.Adjustment {
+	if e == nil || in.Amount.Units <= 0 {
+		return nil
+	}
+	var (
+		adjustments  []types.Adjustment
+		shares, rest = e.shares(in)
+		left         = in.Amount
+	)
+	for i, r := range e.rules {
+		if shares[i].Sign() == 0 || left.Units <= 0 {
+			continue
+		}
+		amount := in.Amount.Mul(shares[i], in.Rounding).Neg()
+		if -amount.Units > left.Units {
+			amount.Units = -left.Units
+		}
+		adjustments = append(adjustments, types.Adjustment{
+			Rule:   r.ID,
+			Reason: r.Reason,
+			Amount: amount,
+		})
+		left.Units += amount.Units
+	}
+	if rest.Sign() == 0 && left.Units > 0 && len(adjustments) > 0 {
+		// rounding left a remainder of a waived amount
+		adjustments[len(adjustments)-1].Amount.Units -= left.Units
+	}
+	return adjustments
+}
+
+// Multiplier is the share of an amount left after the rules, for amounts
+// too small to be rounded on their own like prepaid draws. Input.Amount is
+// not looked at.
+func (e *Engine) Multiplier(in Input) float64 {
+	if e == nil {
+		return 1
+	}
+	_, rest := e.shares(in)
+	m, _ := rest.Float64()
+	return m
+}
@@ -0,0 +1,210 @@
+package rules
+
+import (
+	"testing"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+func at(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func ptr[T any](v T) *T { return &v }
+
+var (
+	exemption = Rule{ID: "emergency", Type: TypeExemption, Reason: "emergency", Match: Match{Plates: []string{"AMB-112"}}}
+	discount  = Rule{ID: "discount", Type: TypeDiscount, Reason: "discount", Percent: 10}
+	frequent  = Rule{ID: "frequent", Type: TypeDiscount, Reason: "frequent", Percent: 10, MinMonthlyDistance: 1000}
+	summer    = Rule{
+		ID: "summer", Type: TypeDiscount, Reason: "summer", Percent: 20,
+		ValidFrom: ptr(at("2026-06-01T00:00:00Z")), ValidUntil: ptr(at("2026-09-01T00:00:00Z")),
+	}
+)
+
+// usage drives km at each of the given times.
+func usage(km float64, times ...string) []Usage {
+	var u []Usage
+	for _, t := range times {
+		u = append(u, Usage{At: at(t), Distance: km})
+	}
+	return u
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		in    Input
+		// adjustment per rule id, in minor units
+		want map[string]int64
+	}{
+		{
+			name:  "no rule applies",
+			rules: []Rule{exemption},
+			in:    Input{Plate: "B-1", Amount: types.NewMoney(1000, "EUR"), Usage: usage(100, "2026-03-01T10:00:00Z")},
+			want:  map[string]int64{},
+		},
+		{
+			name:  "exemption waives the amount",
+			rules: []Rule{exemption},
+			in:    Input{Plate: "AMB-112", Amount: types.NewMoney(1000, "EUR"), Usage: usage(100, "2026-03-01T10:00:00Z")},
+			want:  map[string]int64{"emergency": -1000},
+		},
+		{
+			name:  "discounts compound",
+			rules: []Rule{discount, {ID: "second", Type: TypeDiscount, Reason: "second", Percent: 20}},
+			in:    Input{Amount: types.NewMoney(1000, "EUR"), Usage: usage(100, "2026-03-01T10:00:00Z")},
+			want:  map[string]int64{"discount": -100, "second": -180},
+		},
+		{
+			name:  "exemption waives what discounts left, rounding included",
+			rules: []Rule{discount, {ID: "all", Type: TypeExemption, Reason: "all"}},
+			in:    Input{Amount: types.NewMoney(333, "EUR"), Usage: usage(7, "2026-03-01T10:00:00Z", "2026-03-01T11:00:00Z", "2026-03-01T12:00:00Z")},
+			want:  map[string]int64{"discount": -33, "all": -300},
+		},
+		{
+			name:  "frequent user discount only takes the km beyond the threshold",
+			rules: []Rule{frequent},
+			in: Input{
+				Amount:       types.NewMoney(1000, "EUR"),
+				Usage:        usage(100, "2026-03-10T10:00:00Z", "2026-03-10T11:00:00Z"),
+				DrivenBefore: 900,
+			},
+			// 100 of 200 km are past the threshold
+			want: map[string]int64{"frequent": -50},
+		},
+		{
+			name:  "frequent user threshold not reached",
+			rules: []Rule{frequent},
+			in: Input{
+				Amount:       types.NewMoney(1000, "EUR"),
+				Usage:        usage(100, "2026-03-10T10:00:00Z"),
+				DrivenBefore: 800,
+			},
+			want: map[string]int64{},
+		},
+		{
+			name:  "frequent user threshold starts over every month",
+			rules: []Rule{frequent},
+			in: Input{
+				Amount:       types.NewMoney(1000, "EUR"),
+				Usage:        usage(200, "2026-03-31T22:00:00Z", "2026-04-01T01:00:00Z"),
+				DrivenBefore: 900,
+			},
+			// 100 km past the threshold in march, none in april
+			want: map[string]int64{"frequent": -25},
+		},
+		{
+			name:  "promotion ending mid period only covers the km driven while it ran",
+			rules: []Rule{summer},
+			in:    Input{Amount: types.NewMoney(1000, "EUR"), Usage: usage(100, "2026-08-31T12:00:00Z", "2026-09-01T12:00:00Z")},
+			want:  map[string]int64{"summer": -100},
+		},
+		{
+			name:  "promotion running now does not cover earlier km",
+			rules: []Rule{summer},
+			in:    Input{Amount: types.NewMoney(1000, "EUR"), Usage: usage(100, "2026-03-01T12:00:00Z")},
+			want:  map[string]int64{},
+		},
+		{
+			name:  "nothing to pay",
+			rules: []Rule{discount},
+			in:    Input{Amount: types.NewMoney(0, "EUR"), Usage: usage(100, "2026-03-01T12:00:00Z")},
+			want:  map[string]int64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := New(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.in.Rounding = types.DefaultRounding
+			got := map[string]int64{}
+			for _, a := range e.Evaluate(tt.in) {
+				if a.Amount.Currency != tt.in.Amount.Currency {
+					t.Errorf("%s: currency %q", a.Rule, a.Amount.Currency)
+				}
+				got[a.Rule] = a.Amount.Units
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for id, units := range tt.want {
+				if got[id] != units {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMultiplier(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		in    Input
+		want  float64
+	}{
+		{name: "no rules", in: Input{Usage: usage(1, "2026-03-01T10:00:00Z")}, want: 1},
+		{name: "exemption", rules: []Rule{exemption}, in: Input{Plate: "AMB-112", Usage: usage(1, "2026-03-01T10:00:00Z")}, want: 0},
+		{name: "discount", rules: []Rule{discount}, in: Input{Usage: usage(1, "2026-03-01T10:00:00Z")}, want: 0.9},
+		{
+			name:  "reading crossing the frequent user threshold",
+			rules: []Rule{frequent},
+			in:    Input{Usage: usage(2, "2026-03-01T10:00:00Z"), DrivenBefore: 999},
+			want:  0.95,
+		},
+		{name: "promotion over", rules: []Rule{summer}, in: Input{Usage: usage(1, "2026-09-01T00:00:00Z")}, want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := New(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.rules == nil {
+				e = nil
+			}
+			if got := e.Multiplier(tt.in); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+	}{
+		{name: "missing id", rules: []Rule{{Type: TypeExemption, Reason: "r"}}},
+		{name: "missing reason", rules: []Rule{{ID: "a", Type: TypeExemption}}},
+		{name: "unknown type", rules: []Rule{{ID: "a", Type: "coupon", Reason: "r"}}},
+		{name: "discount without percent", rules: []Rule{{ID: "a", Type: TypeDiscount, Reason: "r"}}},
+		{name: "discount over 100 percent", rules: []Rule{{ID: "a", Type: TypeDiscount, Reason: "r", Percent: 120}}},
+		{name: "negative threshold", rules: []Rule{{ID: "a", Type: TypeExemption, Reason: "r", MinMonthlyDistance: -1}}},
+		{
+			name:  "promotion ending before it starts",
+			rules: []Rule{{ID: "a", Type: TypeExemption, Reason: "r", ValidFrom: ptr(at("2026-09-01T00:00:00Z")), ValidUntil: ptr(at("2026-06-01T00:00:00Z"))}},
+		},
+		{name: "unknown class", rules: []Rule{{ID: "a", Type: TypeExemption, Reason: "r", Match: Match{Classes: []string{"tank"}}}}},
+		{name: "duplicate id", rules: []Rule{discount, discount}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.rules); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+	if _, err := New([]Rule{exemption, discount, frequent, summer}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,19 +3,35 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/aggregator/rules"
 	"github.com/shamssahal/toll-calculator/types"
 )
 
-const basePrice = 3.7
+const (
+	basePrice = 3.7
+	// upper bound on the windows returned by one series query
+	maxSeriesPoints = 10_000
+)
+
+// endOfTime bounds queries over everything an OBU ever drove.
+var endOfTime = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
 
 type Aggregator interface {
 	AggregateDistance(context.Context, types.Distance) error
 	CalculateInvoice(context.Context, int) (*types.Invoice, error)
+	DistanceSeries(context.Context, types.SeriesQuery) (*types.Series, error)
+	CalculateAccountInvoice(context.Context, string, types.Period) (*types.AccountInvoice, error)
 }
 
 type InvoiceAggregator struct {
-	store Storer
+	store    Storer
+	registry registry.Registry
+	tariff   Tariff
+	// nil without any rules
+	rules *rules.Engine
 }
 
 func (i *InvoiceAggregator) AggregateDistance(ctx context.Context, distance types.Distance) error {
@@ -27,16 +43,176 @@ func (i *InvoiceAggregator) CalculateInvoice(ctx context.Context, obuID int) (*t
 	if err != nil {
 		return nil, fmt.Errorf("could not find data for the obuid %d", obuID)
 	}
+	q, err := i.pricing(obuID)
+	if err != nil {
+		return nil, err
+	}
 	inv := &types.Invoice{
 		OBUID:         obuID,
 		TotalDistance: dist,
-		TotalAmount:   basePrice * dist,
+		PricePerKm:    q.price,
+	}
+	if q.vehicle != nil {
+		inv.Plate = q.vehicle.Plate
+		inv.Class = q.vehicle.Class
+		inv.AccountID = q.vehicle.AccountID
+	}
+	if inv.Subtotal, err = i.amount(q, dist); err != nil {
+		return nil, err
+	}
+	usage, err := i.usage(ctx, obuID, time.Time{}, endOfTime)
+	if err != nil {
+		return nil, err
+	}
+	inv.Adjustments, err = i.adjust(ctx, obuID, q, inv.Subtotal, usage)
+	if err != nil {
+		return nil, err
 	}
+	inv.NetAmount = netAmount(inv.Subtotal, inv.Adjustments)
+	inv.Taxes = i.tariff.VAT.taxes(inv.NetAmount, q.country(), i.tariff.Rounding.For(q.currency))
+	inv.TotalAmount = withTaxes(inv.NetAmount, inv.Taxes)
 	return inv, nil
 
 }
-func NewInvoiceAggregator(store Storer) Aggregator {
+
+// DistanceSeries returns every window in the range, including the ones
+// without any distance.
+func (i *InvoiceAggregator) DistanceSeries(ctx context.Context, q types.SeriesQuery) (*types.Series, error) {
+	window, err := types.Window(q.Resolution)
+	if err != nil {
+		return nil, err
+	}
+	from := q.From.UTC().Truncate(window)
+	to := q.To.UTC()
+	if n := to.Sub(from) / window; n > maxSeriesPoints {
+		return nil, fmt.Errorf("range spans %d windows, at most %d are allowed", n, maxSeriesPoints)
+	}
+	buckets, err := i.store.Buckets(ctx, q.OBUID, q.Resolution, from, to)
+	if err != nil {
+		return nil, err
+	}
+	pricing, err := i.pricing(q.OBUID)
+	if err != nil {
+		return nil, err
+	}
+	series := &types.Series{
+		OBUID:       q.OBUID,
+		Resolution:  q.Resolution,
+		From:        from,
+		To:          to,
+		TotalAmount: types.NewMoney(0, pricing.currency),
+		Points:      []types.SeriesPoint{},
+	}
+	for start := from; start.Before(to); start = start.Add(window) {
+		dist := buckets[start.Unix()]
+		amount, err := i.amount(pricing, dist)
+		if err != nil {
+			return nil, err
+		}
+		series.Points = append(series.Points, types.SeriesPoint{
+			Start:    start,
+			Distance: dist,
+			Amount:   amount,
+		})
+		series.TotalDistance += dist
+		// the total is the sum of the rounded points
+		series.TotalAmount.Units += amount.Units
+	}
+	return series, nil
+}
+
+// CalculateAccountInvoice bills every vehicle of the account for the
+// distance driven in the period, at hour granularity of event time.
+func (i *InvoiceAggregator) CalculateAccountInvoice(ctx context.Context, accountID string, period types.Period) (*types.AccountInvoice, error) {
+	return i.accountInvoice(ctx, accountID, period, nil)
+}
+
+// RerateAccountInvoice prices an account invoice again as if the excluded
+// readings had never been aggregated.
+func (i *InvoiceAggregator) RerateAccountInvoice(ctx context.Context, accountID string, period types.Period, excluded []types.Distance) (*types.AccountInvoice, error) {
+	return i.accountInvoice(ctx, accountID, period, excluded)
+}
+
+func (i *InvoiceAggregator) accountInvoice(ctx context.Context, accountID string, period types.Period, excluded []types.Distance) (*types.AccountInvoice, error) {
+	account, err := i.registry.GetAccount(accountID)
+	if err != nil {
+		return nil, err
+	}
+	vehicles, err := i.registry.ListVehicles(accountID)
+	if err != nil {
+		return nil, err
+	}
+	currency := i.accountCurrency(account)
+	inv := &types.AccountInvoice{
+		Account:   account,
+		Period:    types.Period{From: period.From.UTC().Truncate(time.Hour), To: period.To.UTC()},
+		Vehicles:  []types.VehicleSubtotal{},
+		NetAmount: types.NewMoney(0, currency),
+	}
+	var (
+		exclude      = make(map[int]int64)
+		excludeHours = make(map[int]map[int64]float64)
+	)
+	for _, d := range excluded {
+		exclude[d.OBUID] += toFixed(d.Value)
+		if excludeHours[d.OBUID] == nil {
+			excludeHours[d.OBUID] = make(map[int64]float64)
+		}
+		excludeHours[d.OBUID][time.Unix(0, d.Unix).Truncate(time.Hour).Unix()] += d.Value
+	}
+	for _, v := range vehicles {
+		buckets, err := i.store.Buckets(ctx, v.OBUID, types.ResolutionHour, inv.Period.From, inv.Period.To)
+		if err != nil {
+			return nil, err
+		}
+		var dist float64
+		for _, d := range buckets {
+			dist += d
+		}
+		if n, ok := exclude[v.OBUID]; ok {
+			dist = fromFixed(max(0, toFixed(dist)-n))
+		}
+		q, err := i.vehiclePricing(v, account)
+		if err != nil {
+			return nil, err
+		}
+		line := types.VehicleSubtotal{
+			OBUID:      v.OBUID,
+			Plate:      v.Plate,
+			Class:      v.Class,
+			Distance:   dist,
+			PricePerKm: q.price,
+		}
+		if line.Subtotal, err = i.amount(q, dist); err != nil {
+			return nil, err
+		}
+		usage, err := i.usage(ctx, v.OBUID, inv.Period.From, inv.Period.To)
+		if err != nil {
+			return nil, err
+		}
+		for j, u := range usage {
+			usage[j].Distance = max(0, u.Distance-excludeHours[v.OBUID][u.At.Unix()])
+		}
+		line.Adjustments, err = i.adjust(ctx, v.OBUID, q, line.Subtotal, usage)
+		if err != nil {
+			return nil, err
+		}
+		line.Amount = netAmount(line.Subtotal, line.Adjustments)
+		inv.Vehicles = append(inv.Vehicles, line)
+		inv.TotalDistance += dist
+		inv.NetAmount.Units += line.Amount.Units
+	}
+	// tax is due on the invoice total rather than per vehicle
+	inv.Taxes = i.tariff.VAT.taxes(inv.NetAmount, account.BillingAddress.Country, i.tariff.Rounding.For(currency))
+	inv.TotalAmount = withTaxes(inv.NetAmount, inv.Taxes)
+	return inv, nil
+}
+
+func NewInvoiceAggregator(store Storer, reg registry.Registry, tariff Tariff, r *rules.Engine) *InvoiceAggregator {
 	return &InvoiceAggregator{
-		store: store,
+		store:    store,
+		registry: reg,
+		tariff:   tariff,
+		rules:    r,
 	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/aggregator/client"
+	"github.com/shamssahal/toll-calculator/aggregator/registry"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// ErrWrongShard is returned for a distance of an OBU another shard owns
+// that could not be handed to it, the client sends it again.
+var ErrWrongShard = errors.New("obu belongs to another shard")
+
+// ShardedStore holds the OBUs the ring assigns to this shard. Clients send
+// every distance to its owner, reads of OBUs other shards own are answered
+// by them, so any shard can price any invoice. A distance of another shard,
+// sent by a client with another ring while shards are added, is handed to
+// its owner.
+//
+// Sharding covers distances only. Accounts, the ledger and disputes are
+// kept by the coordinator, the first shard, the gateway sends account
+// calls there and the other shards read its registry. Prepaid balances
+// are drawn by the shard that aggregates a distance and are not supported
+// by a sharded cluster yet, prepaid accounts are refused.
+type ShardedStore struct {
+	Storer
+	self   client.Shard
+	ring   *client.Ring
+	shards map[string]*client.HTTPClient
+}
+
+func NewShardedStore(local Storer, self string, shards []client.Shard, tlsCfg tlsconfig.Config) (*ShardedStore, error) {
+	s := &ShardedStore{
+		Storer: local,
+		ring:   client.NewRing(shards),
+		shards: map[string]*client.HTTPClient{},
+	}
+	for _, shard := range shards {
+		if shard.Name == self {
+			s.self = shard
+			continue
+		}
+		c, err := client.NewHTTPClientWithTLS(shard.Endpoint, tlsCfg)
+		if err != nil {
+			return nil, err
+		}
+		s.shards[shard.Name] = c
+	}
+	if s.self.Name == "" {
+		return nil, fmt.Errorf("shard %q is not one of the shards", self)
+	}
+	return s, nil
+}
+
+// owner returns the client of the shard owning an OBU, nil for this one.
+func (s *ShardedStore) owner(obuID int) *client.HTTPClient {
+	return s.shards[s.ring.Owner(obuID).Name]
+}
+
+func (s *ShardedStore) Insert(ctx context.Context, d types.Distance) error {
+	c := s.owner(d.OBUID)
+	if c == nil {
+		return s.Storer.Insert(ctx, d)
+	}
+	// the owner inserts it into its local store, it is never handed on to
+	// a third shard
+	err := c.Insert(ctx, d)
+	if client.Retryable(err) {
+		return fmt.Errorf("%w: obu %d is owned by %s: %v", ErrWrongShard, d.OBUID, s.ring.Owner(d.OBUID).Name, err)
+	}
+	return err
+}
+
+func (s *ShardedStore) Get(ctx context.Context, obuID int) (float64, error) {
+	c := s.owner(obuID)
+	if c == nil {
+		return s.Storer.Get(ctx, obuID)
+	}
+	return c.Distance(ctx, obuID)
+}
+
+func (s *ShardedStore) Buckets(ctx context.Context, obuID int, resolution string, from, to time.Time) (map[int64]float64, error) {
+	c := s.owner(obuID)
+	if c == nil {
+		return s.Storer.Buckets(ctx, obuID, resolution, from, to)
+	}
+	return c.Buckets(ctx, obuID, resolution, from, to)
+}
+
+func (s *ShardedStore) Readings(ctx context.Context, obuID int, from, to time.Time) ([]types.Distance, error) {
+	c := s.owner(obuID)
+	if c == nil {
+		return s.Storer.Readings(ctx, obuID, from, to)
+	}
+	return c.Readings(ctx, obuID, from, to)
+}
+
+// shardRegistry refuses prepaid accounts, a shard cannot draw the balance
+// of an account from the ledger of the coordinator.
+type shardRegistry struct {
+	registry.Registry
+}
+
+func (r shardRegistry) PutAccount(a types.Account) (types.Account, error) {
+	if a.Prepaid {
+		return a, fmt.Errorf("%w: prepaid accounts are not supported by a sharded cluster", registry.ErrInvalid)
+	}
+	return r.Registry.PutAccount(a)
+}
+
+// makeShardRegistry returns the registry of the coordinator, local on the
+// coordinator itself, over gRPC at AGG_COORDINATOR_GRPC on the other
+// shards, so every shard prices with the same vehicles. A coordinator
+// holding prepaid accounts does not start.
+func makeShardRegistry(s *ShardedStore, local registry.Registry) registry.Registry {
+	coordinator := s.ring.Coordinator()
+	if s.self.Name == coordinator.Name {
+		accounts, err := local.ListAccounts()
+		if err != nil {
+			log.Fatalf("failed to list accounts: %v", err)
+		}
+		for _, a := range accounts {
+			if a.Prepaid {
+				log.Fatalf("account %s is prepaid, prepaid accounts are not supported by a sharded cluster", a.ID)
+			}
+		}
+		return shardRegistry{local}
+	}
+	endpoint := os.Getenv("AGG_COORDINATOR_GRPC")
+	if endpoint == "" {
+		log.Fatalf("AGG_COORDINATOR_GRPC is not set, shard %s reads the registry of %s", s.self.Name, coordinator.Name)
+	}
+	c, err := client.NewGRPCRegistryClientWithTLS(endpoint, tlsconfig.FromEnv("AGG_PEER"))
+	if err != nil {
+		log.Fatalf("failed to create registry client for %s: %v", endpoint, err)
+	}
+	return shardRegistry{c}
+}
+
+// makeSharding makes store the shard AGG_SHARD of AGG_SHARDS, nil when
+// AGG_SHARDS is empty. Shards are reached with the AGG_PEER TLS settings.
+func makeSharding(store Storer) *ShardedStore {
+	v := os.Getenv("AGG_SHARDS")
+	if v == "" {
+		return nil
+	}
+	shards, err := client.ParseShards(v)
+	if err != nil {
+		log.Fatalf("invalid AGG_SHARDS: %v", err)
+	}
+	s, err := NewShardedStore(store, os.Getenv("AGG_SHARD"), shards, tlsconfig.FromEnv("AGG_PEER"))
+	if err != nil {
+		log.Fatalf("invalid AGG_SHARD: %v", err)
+	}
+	return s
+}
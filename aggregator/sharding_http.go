@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// registerShardRoutes serves the OBUs of this shard to the other shards.
+// They read and write the local store, a shard never asks another one on
+// behalf of a third.
+func registerShardRoutes(mux *http.ServeMux, s *ShardedStore) {
+	shardHandler := newHTTPMetricHandler("/shard")
+	mux.HandleFunc("POST /shard/distances", shardHandler.instrumentAndLog(handleShardInsert(s.Storer)))
+	mux.HandleFunc("GET /shard/distance", shardHandler.instrumentAndLog(handleShardDistance(s.Storer)))
+	mux.HandleFunc("GET /shard/buckets", shardHandler.instrumentAndLog(handleShardBuckets(s.Storer)))
+	mux.HandleFunc("GET /shard/readings", shardHandler.instrumentAndLog(handleShardReadings(s.Storer)))
+}
+
+// shardQuery parses the id and the optional from and to of a shard read.
+func shardQuery(r *http.Request) (obuID int, from, to time.Time, err error) {
+	q := r.URL.Query()
+	if obuID, err = strconv.Atoi(q.Get("id")); err != nil {
+		return 0, from, to, err
+	}
+	if v := q.Get("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return 0, from, to, err
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			return 0, from, to, err
+		}
+	}
+	return obuID, from, to, nil
+}
+
+// handleShardInsert takes a distance another shard was sent, its lateness
+// was checked there.
+func handleShardInsert(store Storer) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var d types.Distance
+		if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		if err := store.Insert(r.Context(), d); err != nil && !errors.Is(err, ErrDuplicate) {
+			writeJSON(w, aggregateStatus(err), map[string]string{"error": err.Error()})
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]string{})
+	}
+}
+
+func handleShardDistance(store Storer) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		obuID, _, _, err := shardQuery(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		dist, err := store.Get(r.Context(), obuID)
+		if err != nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+			return err
+		}
+		return writeJSON(w, http.StatusOK, map[string]float64{"value": dist})
+	}
+}
+
+func handleShardBuckets(store Storer) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		obuID, from, to, err := shardQuery(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		buckets, err := store.Buckets(r.Context(), obuID, r.URL.Query().Get("resolution"), from, to)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		return writeJSON(w, http.StatusOK, buckets)
+	}
+}
+
+func handleShardReadings(store Storer) HTTPHandlerWithError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		obuID, from, to, err := shardQuery(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return err
+		}
+		readings, err := store.Readings(r.Context(), obuID, from, to)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return err
+		}
+		if readings == nil {
+			readings = []types.Distance{}
+		}
+		return writeJSON(w, http.StatusOK, readings)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shamssahal/toll-calculator/aggregator/client"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
+)
+
+// A shard hands a distance of an OBU it does not own to the owner, and
+// tells the client to send it again when the owner cannot be reached.
+func TestShardedStoreInsertHandsDistanceToOwner(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		aLocal = NewMemoryStore(defaultReadingsRetention)
+		bLocal = NewMemoryStore(defaultReadingsRetention)
+		mux    = http.NewServeMux()
+		srv    = httptest.NewServer(mux)
+	)
+	defer srv.Close()
+	shards := []client.Shard{{Name: "a", Endpoint: "http://127.0.0.1:1"}, {Name: "b", Endpoint: srv.URL}}
+	a, err := NewShardedStore(aLocal, "a", shards, tlsconfig.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewShardedStore(bLocal, "b", shards, tlsconfig.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registerShardRoutes(mux, b)
+
+	// an OBU of each shard
+	owned := map[string]int{}
+	for obuID := 1; len(owned) < 2; obuID++ {
+		if name := a.ring.Owner(obuID).Name; owned[name] == 0 {
+			owned[name] = obuID
+		}
+	}
+	if err := a.Insert(ctx, distance(owned["a"], 1, "r1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Insert(ctx, distance(owned["b"], 2, "r2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		store Storer
+		obuID int
+		want  float64
+	}{
+		{aLocal, owned["a"], 1},
+		{bLocal, owned["b"], 2},
+		{aLocal, owned["b"], 0},
+	} {
+		if got, _ := tt.store.Get(ctx, tt.obuID); got != tt.want {
+			t.Fatalf("obu %d: got %v, want %v", tt.obuID, got, tt.want)
+		}
+	}
+	// reads of another shard's OBU are answered by it
+	if got, err := a.Get(ctx, owned["b"]); err != nil || got != 2 {
+		t.Fatalf("got %v, %v through the other shard", got, err)
+	}
+
+	srv.Close()
+	if err := a.Insert(ctx, distance(owned["b"], 3, "r3")); !errors.Is(err, ErrWrongShard) {
+		t.Fatalf("got %v, want ErrWrongShard", err)
+	}
+	if got, _ := aLocal.Get(ctx, owned["b"]); got != 0 {
+		t.Fatalf("kept %v of a distance it does not own", got)
+	}
+}
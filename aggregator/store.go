@@ -1,8 +1,17 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/shamssahal/toll-calculator/types"
 )
@@ -10,27 +19,249 @@ import (
 type Storer interface {
 	Insert(context.Context, types.Distance) error
 	Get(context.Context, int) (float64, error)
+	// Buckets returns the distance per window of the resolution for the
+	// windows starting in [from, to), keyed by window start in unix seconds.
+	Buckets(ctx context.Context, obuID int, resolution string, from, to time.Time) (map[int64]float64, error)
+	// Readings returns the distances of an OBU with an event time in
+	// [from, to), oldest first. They are the evidence behind an invoice,
+	// ErrReadingsExpired when from is past the retention.
+	Readings(ctx context.Context, obuID int, from, to time.Time) ([]types.Distance, error)
+	// AllReadings returns every distance still retained of every OBU, in
+	// no particular order.
+	AllReadings(ctx context.Context) ([]types.Distance, error)
+}
+
+const (
+	// how long readings are kept as evidence by default, invoices have to
+	// be disputed within it
+	defaultReadingsRetention = 180 * 24 * time.Hour
+	pruneInterval            = time.Hour
+)
+
+var ErrReadingsExpired = errors.New("readings are no longer retained")
+
+// distances are summed as integer millionths, float sums drift over
+// millions of additions
+const distanceScale = 1e6
+
+func toFixed(v float64) int64 {
+	return int64(math.Round(v * distanceScale))
+}
+
+func fromFixed(v int64) float64 {
+	return float64(v) / distanceScale
+}
+
+// buckets maps an OBU to its distance per window start in unix seconds
+type buckets map[int]map[int64]int64
+
+func (b buckets) add(obuID int, start int64, value int64) {
+	if b[obuID] == nil {
+		b[obuID] = make(map[int64]int64)
+	}
+	b[obuID][start] += value
 }
 
 type MemoryStore struct {
-	data map[int]float64
+	mu   sync.RWMutex
+	data map[int]int64
+	// tumbling windows keyed by event time, days are UTC days
+	hours buckets
+	days  buckets
+	// every distance as it was aggregated, per OBU, until its event time
+	// is older than the retention
+	readings  map[int][]types.Distance
+	retention time.Duration
+	pruned    time.Time
 }
 
 func (m *MemoryStore) Insert(ctx context.Context, d types.Distance) error {
-	m.data[d.OBUID] += d.Value
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.apply(d)
+	m.retain(d)
 	return nil
 }
 
+// retain keeps d as evidence unless it is already past the retention, and
+// every pruneInterval drops the readings that passed it. The caller holds
+// m.mu.
+func (m *MemoryStore) retain(d types.Distance) {
+	now := time.Now()
+	if d.Unix >= m.horizon(now) {
+		m.readings[d.OBUID] = append(m.readings[d.OBUID], d)
+	}
+	if now.Sub(m.pruned) >= pruneInterval {
+		m.prune(now)
+	}
+}
+
+// horizon is the event time in unix nanoseconds readings are kept from.
+func (m *MemoryStore) horizon(now time.Time) int64 {
+	return now.Add(-m.retention).UnixNano()
+}
+
+func (m *MemoryStore) prune(now time.Time) {
+	horizon := m.horizon(now)
+	for obuID, r := range m.readings {
+		r = slices.DeleteFunc(r, func(d types.Distance) bool { return d.Unix < horizon })
+		if len(r) == 0 {
+			delete(m.readings, obuID)
+			continue
+		}
+		m.readings[obuID] = r
+	}
+	m.pruned = now
+}
+
+// apply adds a distance to the totals and buckets, the caller holds m.mu.
+func (m *MemoryStore) apply(d types.Distance) {
+	at := time.Unix(0, d.Unix)
+	value := toFixed(d.Value)
+	m.data[d.OBUID] += value
+	m.hours.add(d.OBUID, at.Truncate(time.Hour).Unix(), value)
+	m.days.add(d.OBUID, at.Truncate(24*time.Hour).Unix(), value)
+}
+
 func (m *MemoryStore) Get(ctx context.Context, obuID int) (float64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	if dist, ok := m.data[obuID]; !ok {
 		return 0.0, fmt.Errorf("could not find data for obuId %d", obuID)
 	} else {
-		return dist, nil
+		return fromFixed(dist), nil
+	}
+}
+
+func (m *MemoryStore) Buckets(ctx context.Context, obuID int, resolution string, from, to time.Time) (map[int64]float64, error) {
+	// restore swaps the maps under the lock
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var b buckets
+	switch resolution {
+	case types.ResolutionHour:
+		b = m.hours
+	case types.ResolutionDay:
+		b = m.days
+	default:
+		return nil, fmt.Errorf("unknown resolution %q", resolution)
 	}
+	res := make(map[int64]float64)
+	for start, dist := range b[obuID] {
+		if start >= from.Unix() && start < to.Unix() {
+			res[start] = fromFixed(dist)
+		}
+	}
+	return res, nil
+}
+
+func (m *MemoryStore) Readings(ctx context.Context, obuID int, from, to time.Time) ([]types.Distance, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if horizon := m.horizon(time.Now()); from.UnixNano() < horizon {
+		return nil, fmt.Errorf("%w before %s", ErrReadingsExpired, time.Unix(0, horizon).UTC().Format(time.RFC3339))
+	}
+	res := []types.Distance{}
+	for _, d := range m.readings[obuID] {
+		if d.Unix >= from.UnixNano() && d.Unix < to.UnixNano() {
+			res = append(res, d)
+		}
+	}
+	// late readings are appended out of event time order
+	slices.SortStableFunc(res, func(a, b types.Distance) int {
+		return cmp.Compare(a.Unix, b.Unix)
+	})
+	return res, nil
+}
+
+// storeState is what a snapshot keeps of a MemoryStore.
+type storeState struct {
+	Totals map[int]int64 `json:"totals"`
+	Hours  buckets       `json:"hours"`
+	Days   buckets       `json:"days"`
+	// the readings still retained, and for how long they are. Event
+	// sourced snapshots without a retention were taken before they kept
+	// readings, the WAL keeps them in its segments instead.
+	Readings  map[int][]types.Distance `json:"readings,omitempty"`
+	Retention time.Duration            `json:"retention,omitempty"`
+}
+
+// state copies the totals and buckets, and the readings when asked to.
+// The caller holds m.mu.
+func (m *MemoryStore) state(readings bool) storeState {
+	s := storeState{
+		Totals: maps.Clone(m.data),
+		Hours:  make(buckets, len(m.hours)),
+		Days:   make(buckets, len(m.days)),
+	}
+	for obuID, b := range m.hours {
+		s.Hours[obuID] = maps.Clone(b)
+	}
+	for obuID, b := range m.days {
+		s.Days[obuID] = maps.Clone(b)
+	}
+	if readings {
+		s.Retention = m.retention
+		s.Readings = make(map[int][]types.Distance, len(m.readings))
+		for obuID, r := range m.readings {
+			s.Readings[obuID] = slices.Clone(r)
+		}
+	}
+	return s
 }
 
-func NewMemoryStore() *MemoryStore {
+func (m *MemoryStore) restore(s storeState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data, m.hours, m.days = s.Totals, s.Hours, s.Days
+	if m.data == nil {
+		m.data = make(map[int]int64)
+	}
+	if m.hours == nil {
+		m.hours = make(buckets)
+	}
+	if m.days == nil {
+		m.days = make(buckets)
+	}
+	m.readings = s.Readings
+	if m.readings == nil {
+		m.readings = make(map[int][]types.Distance)
+	}
+	m.prune(time.Now())
+}
+
+func (m *MemoryStore) AllReadings(ctx context.Context) ([]types.Distance, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	res := []types.Distance{}
+	for _, r := range m.readings {
+		res = append(res, r...)
+	}
+	return res, nil
+}
+
+// NewMemoryStore keeps readings for retention after their event time.
+func NewMemoryStore(retention time.Duration) *MemoryStore {
 	return &MemoryStore{
-		data: make(map[int]float64),
+		data:      make(map[int]int64),
+		hours:     make(buckets),
+		days:      make(buckets),
+		readings:  make(map[int][]types.Distance),
+		retention: retention,
+		pruned:    time.Now(),
+	}
+}
+
+// readingsRetention reads AGG_READINGS_RETENTION, how long readings are
+// kept as evidence for disputes, 180 days when empty.
+func readingsRetention() time.Duration {
+	v := os.Getenv("AGG_READINGS_RETENTION")
+	if v == "" {
+		return defaultReadingsRetention
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Fatalf("invalid AGG_READINGS_RETENTION %q", v)
 	}
+	return d
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// anyCountry is the rate of countries without one of their own and of
+// OBUs without a billing address.
+const anyCountry = "*"
+
+type taxRate struct {
+	// in percent as configured, e.g. "7.7"
+	percent string
+	factor  *big.Rat
+}
+
+// taxRates are the VAT rates by billing country.
+type taxRates map[string]taxRate
+
+// parseTaxRates reads rates like "DE=19,CH=7.7,*=20". Rates are parsed as
+// exact decimals.
+func parseTaxRates(s string) (taxRates, error) {
+	rates := taxRates{}
+	if s == "" {
+		return rates, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		country, percent, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || country == "" {
+			return nil, fmt.Errorf("invalid tax rate %q", pair)
+		}
+		f, ok := new(big.Rat).SetString(percent)
+		if !ok || f.Sign() < 0 || f.Cmp(big.NewRat(100, 1)) > 0 {
+			return nil, fmt.Errorf("invalid tax rate %q", pair)
+		}
+		rates[strings.ToUpper(country)] = taxRate{
+			percent: percent,
+			factor:  f.Quo(f, big.NewRat(100, 1)),
+		}
+	}
+	return rates, nil
+}
+
+// taxes returns the VAT line for a net amount, none when no rate applies.
+func (t taxRates) taxes(amount types.Money, country string, r types.Rounding) []types.TaxLine {
+	rate, ok := t[strings.ToUpper(country)]
+	if !ok {
+		if rate, ok = t[anyCountry]; !ok {
+			return nil
+		}
+	}
+	return []types.TaxLine{{
+		Name:   "VAT",
+		Rate:   rate.percent,
+		Base:   amount,
+		Amount: amount.Mul(rate.factor, r),
+	}}
+}
+
+// withTaxes adds the taxes to a net amount.
+func withTaxes(amount types.Money, taxes []types.TaxLine) types.Money {
+	for _, t := range taxes {
+		amount.Units += t.Amount.Units
+	}
+	return amount
+}
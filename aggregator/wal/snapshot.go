@@ -0,0 +1,67 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// snapshotFile holds the state up to and including a record, as
+//
+//	crc  uint32, CRC-32C of the rest
+//	lsn  uint64
+//	state
+const snapshotFile = "snapshot"
+
+// SaveSnapshot replaces the snapshot of the log. It is written next to it
+// first, a crash leaves either the old or the new snapshot behind. The
+// records it covers can be compacted afterwards.
+func (w *WAL) SaveSnapshot(lsn uint64, state []byte) error {
+	b := make([]byte, 12, 12+len(state))
+	binary.LittleEndian.PutUint64(b[4:12], lsn)
+	b = append(b, state...)
+	binary.LittleEndian.PutUint32(b[0:4], crc32.Checksum(b[4:], table))
+
+	path := filepath.Join(w.dir, snapshotFile)
+	tmp, err := os.CreateTemp(w.dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(w.dir)
+}
+
+// LoadSnapshot reads the snapshot in dir, ok is false when there is none.
+// Open the log from lsn+1 to replay what came after it.
+func LoadSnapshot(dir string) (lsn uint64, state []byte, ok bool, err error) {
+	path := filepath.Join(dir, snapshotFile)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if len(b) < 12 || crc32.Checksum(b[4:], table) != binary.LittleEndian.Uint32(b[0:4]) {
+		return 0, nil, false, fmt.Errorf("%w: snapshot %s", ErrCorrupt, path)
+	}
+	return binary.LittleEndian.Uint64(b[4:12]), b[12:], true, nil
+}
@@ -0,0 +1,480 @@
+// Package wal is a segmented write-ahead log. Records are checksummed and
+// group committed: concurrent appends are written together and made
+// durable with a single fsync.
+//
+// A record on disk is
+//
+//	length  uint32, of the payload
+//	crc     uint32, CRC-32C of the payload
+//	payload
+//
+// Segments are named after the sequence number (LSN) of their first record
+// and rotated once they grow past the segment size. A crash can leave a
+// torn record at the end of the last segment, it is cut off on open. A
+// batch that fails to be written is cut off the same way, the log goes on
+// after the last record that was durable.
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	headerSize         = 8
+	segmentExt         = ".wal"
+	DefaultSegmentSize = 64 << 20
+	// records written with one fsync at most
+	maxBatch = 4096
+	// a length beyond this is a torn or corrupt header rather than a record
+	maxRecordSize = 16 << 20
+)
+
+var (
+	ErrClosed  = errors.New("wal is closed")
+	ErrCorrupt = errors.New("wal is corrupt")
+)
+
+// Result reports whether a record is durable, and its LSN when it is.
+type Result struct {
+	LSN uint64
+	Err error
+}
+
+var table = crc32.MakeTable(crc32.Castagnoli)
+
+type Options struct {
+	SegmentSize int64
+	// called after every group commit, e.g. for metrics
+	OnCommit func(records int, took time.Duration)
+}
+
+type request struct {
+	// nil for a barrier that only waits for the records before it
+	payload []byte
+	done    chan Result
+}
+
+type WAL struct {
+	dir  string
+	opts Options
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan request
+
+	// owned by the writer goroutine, records get their LSN when they are
+	// written
+	segment      *os.File
+	segmentFirst uint64
+	segmentSize  int64
+	writerLSN    uint64
+	// set when a batch could not be cut off after a failed write, the
+	// next batch tries again
+	broken error
+
+	stopped chan struct{}
+}
+
+// Open recovers the log in dir, creating it when needed, and calls fn for
+// every record it holds, oldest first. Records from LSN from on have to be
+// there, the ones before are only kept until they are compacted. A torn or
+// corrupt tail of the last segment is truncated, corruption anywhere else
+// is an error.
+func Open(dir string, from uint64, opts Options, fn func(lsn uint64, payload []byte) error) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		dir:     dir,
+		opts:    opts,
+		queue:   make(chan request, maxBatch),
+		stopped: make(chan struct{}),
+	}
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	next := uint64(1)
+	if len(segments) == 0 {
+		// a log started after a snapshot continues its numbering
+		next = max(next, from)
+	} else if segments[0] > from {
+		return nil, fmt.Errorf("%w: records %d to %d are missing", ErrCorrupt, from, segments[0]-1)
+	}
+	for i, first := range segments {
+		if i == 0 {
+			next = first
+		}
+		if first != next {
+			return nil, fmt.Errorf("%w: segment %d does not follow record %d", ErrCorrupt, first, next-1)
+		}
+		last := i == len(segments)-1
+		if next, err = w.replaySegment(first, last, fn); err != nil {
+			return nil, err
+		}
+	}
+	if next < from {
+		return nil, fmt.Errorf("%w: records %d to %d are missing", ErrCorrupt, next, from-1)
+	}
+	w.writerLSN = next
+	if len(segments) == 0 {
+		err = w.createSegment(next)
+	} else {
+		err = w.openSegment(segments[len(segments)-1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	go w.write()
+	return w, nil
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, segmentExt)
+}
+
+// segments returns the first LSN of every segment, in order.
+func (w *WAL) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []uint64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), segmentExt)
+		if !ok {
+			continue
+		}
+		first, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		res = append(res, first)
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+// replaySegment reads the records of a segment and returns the LSN after
+// the last one.
+func (w *WAL) replaySegment(first uint64, last bool, fn func(uint64, []byte) error) (uint64, error) {
+	path := filepath.Join(w.dir, segmentName(first))
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var (
+		r      = bufio.NewReaderSize(f, 1<<20)
+		lsn    = first
+		offset int64
+		header [headerSize]byte
+	)
+	for {
+		payload, err := readRecord(r, header[:])
+		if errors.Is(err, io.EOF) {
+			return lsn, nil
+		}
+		if err != nil {
+			if !last {
+				return 0, fmt.Errorf("%w: %s at offset %d: %v", ErrCorrupt, path, offset, err)
+			}
+			// a write the crash interrupted, nothing after it was
+			// acknowledged
+			if err := os.Truncate(path, offset); err != nil {
+				return 0, err
+			}
+			return lsn, nil
+		}
+		if err := fn(lsn, payload); err != nil {
+			return 0, err
+		}
+		lsn++
+		offset += headerSize + int64(len(payload))
+	}
+}
+
+// readRecord returns io.EOF at a clean end of the segment only.
+func readRecord(r io.Reader, header []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("torn header: %w", err)
+	}
+	size := binary.LittleEndian.Uint32(header[0:4])
+	sum := binary.LittleEndian.Uint32(header[4:8])
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			// the header made it, not a clean end
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("torn record: %w", err)
+	}
+	if crc32.Checksum(payload, table) != sum {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+func (w *WAL) createSegment(first uint64) error {
+	f, err := os.OpenFile(filepath.Join(w.dir, segmentName(first)), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	w.segment, w.segmentFirst, w.segmentSize = f, first, 0
+	// the new file is only durable once its directory entry is
+	return syncDir(w.dir)
+}
+
+func (w *WAL) openSegment(first uint64) error {
+	f, err := os.OpenFile(filepath.Join(w.dir, segmentName(first)), os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.segment, w.segmentFirst, w.segmentSize = f, first, info.Size()
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Append writes a record and returns its LSN once it is durable.
+func (w *WAL) Append(payload []byte) (uint64, error) {
+	done, err := w.Enqueue(payload)
+	if err != nil {
+		return 0, err
+	}
+	res := <-done
+	return res.LSN, res.Err
+}
+
+// Enqueue hands a record to the writer without waiting for it. Records
+// are written in the order they were enqueued, done reports when the
+// record is durable and its LSN.
+func (w *WAL) Enqueue(payload []byte) (<-chan Result, error) {
+	if payload == nil {
+		payload = []byte{}
+	}
+	done := make(chan Result, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+	w.queue <- request{payload: payload, done: done}
+	return done, nil
+}
+
+// Sync returns once every record enqueued before it is durable.
+func (w *WAL) Sync() error {
+	done := make(chan Result, 1)
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.queue <- request{done: done}
+	w.mu.Unlock()
+	return (<-done).Err
+}
+
+// write is the writer goroutine, it takes whatever queued up while the
+// previous batch was synced and commits it as the next batch.
+func (w *WAL) write() {
+	defer close(w.stopped)
+	buf := bufio.NewWriterSize(w.segment, 1<<20)
+	batch := make([]request, 0, maxBatch)
+	for req := range w.queue {
+		batch = append(batch[:0], req)
+	drain:
+		for len(batch) < maxBatch {
+			select {
+			case req, ok := <-w.queue:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		start := time.Now()
+		first := w.writerLSN
+		records, err := w.commit(buf, batch)
+		if w.opts.OnCommit != nil && err == nil && records > 0 {
+			w.opts.OnCommit(records, time.Since(start))
+		}
+		lsn := first
+		for _, req := range batch {
+			res := Result{Err: err}
+			if req.payload != nil && err == nil {
+				res.LSN = lsn
+				lsn++
+			}
+			req.done <- res
+		}
+	}
+	buf.Flush()
+	w.segment.Sync()
+	w.segment.Close()
+}
+
+func (w *WAL) commit(buf *bufio.Writer, batch []request) (int, error) {
+	if w.broken != nil {
+		if err := w.repair(buf, w.segmentSize); err != nil {
+			return 0, err
+		}
+	}
+	var (
+		records = 0
+		size    = w.segmentSize
+		header  [headerSize]byte
+	)
+	for _, req := range batch {
+		if req.payload == nil {
+			continue
+		}
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(req.payload)))
+		binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(req.payload, table))
+		buf.Write(header[:])
+		buf.Write(req.payload)
+		w.segmentSize += headerSize + int64(len(req.payload))
+		records++
+	}
+	err := buf.Flush()
+	if err == nil {
+		err = w.segment.Sync()
+	}
+	if err != nil {
+		// what reached the disk is unknown, none of it was acknowledged
+		if rerr := w.repair(buf, size); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+		return 0, fmt.Errorf("wal write failed: %w", err)
+	}
+	w.writerLSN += uint64(records)
+	if w.segmentSize >= w.opts.SegmentSize {
+		// the batch is durable either way, rotating is tried again after
+		// the next one when it fails
+		if err := w.rotate(buf); err != nil {
+			w.broken = err
+		}
+	}
+	return records, nil
+}
+
+// repair reopens the current segment and cuts it off at size, the end of
+// the last durable record. Until it succeeds every batch fails.
+func (w *WAL) repair(buf *bufio.Writer, size int64) error {
+	w.segment.Close()
+	path := filepath.Join(w.dir, segmentName(w.segmentFirst))
+	err := os.Truncate(path, size)
+	if err == nil {
+		err = w.openSegment(w.segmentFirst)
+	}
+	if err == nil {
+		if err = w.segment.Sync(); err != nil {
+			w.segment.Close()
+		}
+	}
+	if err != nil {
+		// the segment is closed, writing fails until a repair succeeds
+		w.segmentSize = size
+		w.broken = err
+		buf.Reset(w.segment)
+		return err
+	}
+	w.broken = nil
+	buf.Reset(w.segment)
+	return nil
+}
+
+// rotate seals the current segment, everything in it is synced.
+func (w *WAL) rotate(buf *bufio.Writer) error {
+	if err := w.segment.Close(); err != nil {
+		return err
+	}
+	if err := w.createSegment(w.writerLSN); err != nil {
+		return err
+	}
+	buf.Reset(w.segment)
+	return nil
+}
+
+// Compact removes the sealed segments that only hold records up to and
+// including lsn, e.g. because a snapshot covers them, and were last written
+// before the given time.
+func (w *WAL) Compact(lsn uint64, before time.Time) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	removed := false
+	// the last segment is the one being written
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i+1]-1 > lsn {
+			break
+		}
+		path := filepath.Join(w.dir, segmentName(segments[i]))
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(before) {
+			break
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed = true
+	}
+	if removed {
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+// Close waits for the queued records to be written.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+	<-w.stopped
+	return nil
+}
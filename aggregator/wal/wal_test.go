@@ -0,0 +1,318 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type record struct {
+	lsn     uint64
+	payload string
+}
+
+// open opens the log in dir and returns the records it replayed.
+func open(t *testing.T, dir string, from uint64, opts Options) (*WAL, []record) {
+	t.Helper()
+	var records []record
+	w, err := Open(dir, from, opts, func(lsn uint64, payload []byte) error {
+		records = append(records, record{lsn, string(payload)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, records
+}
+
+func appendAll(t *testing.T, w *WAL, payloads ...string) {
+	t.Helper()
+	for _, p := range payloads {
+		if _, err := w.Append([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func wantRecords(t *testing.T, got []record, first uint64, payloads ...string) {
+	t.Helper()
+	if len(got) != len(payloads) {
+		t.Fatalf("got %d records %v, want %v", len(got), got, payloads)
+	}
+	for i, p := range payloads {
+		if want := (record{first + uint64(i), p}); got[i] != want {
+			t.Fatalf("record %d: got %v, want %v", i, got[i], want)
+		}
+	}
+}
+
+// lastSegment returns the path of the segment being written.
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+	w := &WAL{dir: dir}
+	segments, err := w.segments()
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("no segments: %v", err)
+	}
+	return filepath.Join(dir, segmentName(segments[len(segments)-1]))
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	w, records := open(t, dir, 1, Options{})
+	if len(records) != 0 {
+		t.Fatalf("new log replayed %v", records)
+	}
+	appendAll(t, w, "a", "b", "c")
+	w.Close()
+
+	w, records = open(t, dir, 1, Options{})
+	defer w.Close()
+	wantRecords(t, records, 1, "a", "b", "c")
+	if lsn, err := w.Append([]byte("d")); err != nil || lsn != 4 {
+		t.Fatalf("got lsn %d, %v", lsn, err)
+	}
+}
+
+// A crash mid-write leaves part of the last record behind, recovering cuts
+// it off and the log goes on after the last complete record.
+func TestTornTail(t *testing.T) {
+	tests := []struct {
+		name string
+		// damages the last segment, which holds a, b and c
+		tear func(t *testing.T, path string, size int64)
+		want []string
+	}{
+		{
+			name: "torn header",
+			tear: func(t *testing.T, path string, size int64) {
+				appendBytes(t, path, []byte{5, 0, 0})
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "torn payload",
+			tear: func(t *testing.T, path string, size int64) {
+				appendBytes(t, path, []byte{5, 0, 0, 0, 1, 2, 3, 4, 'x', 'y'})
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "truncated last record",
+			tear: func(t *testing.T, path string, size int64) {
+				if err := os.Truncate(path, size-1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "last record fails its checksum",
+			tear: func(t *testing.T, path string, size int64) {
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b[size-1] ^= 0xff
+				if err := os.WriteFile(path, b, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, _ := open(t, dir, 1, Options{})
+			appendAll(t, w, "a", "b", "c")
+			w.Close()
+			path := lastSegment(t, dir)
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.tear(t, path, info.Size())
+
+			w, records := open(t, dir, 1, Options{})
+			wantRecords(t, records, 1, tt.want...)
+			appendAll(t, w, "d")
+			w.Close()
+
+			w, records = open(t, dir, 1, Options{})
+			defer w.Close()
+			wantRecords(t, records, 1, append(tt.want, "d")...)
+		})
+	}
+}
+
+func appendBytes(t *testing.T, path string, b []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCorruptSealedSegment(t *testing.T) {
+	dir := t.TempDir()
+	// every record seals a segment
+	w, _ := open(t, dir, 1, Options{SegmentSize: 1})
+	appendAll(t, w, "a", "b", "c")
+	w.Close()
+
+	path := filepath.Join(dir, segmentName(2))
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open(dir, 1, Options{SegmentSize: 1}, func(uint64, []byte) error { return nil })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestMissingRecords(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := open(t, dir, 1, Options{SegmentSize: 1})
+	appendAll(t, w, "a", "b", "c")
+	w.Close()
+	if err := os.Remove(filepath.Join(dir, segmentName(1))); err != nil {
+		t.Fatal(err)
+	}
+	// a snapshot covering record 1 does without it
+	w, records := open(t, dir, 2, Options{SegmentSize: 1})
+	w.Close()
+	wantRecords(t, records, 2, "b", "c")
+
+	_, err := Open(dir, 1, Options{SegmentSize: 1}, func(uint64, []byte) error { return nil })
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	const n = 200
+	var (
+		mu      sync.Mutex
+		commits int
+		records int
+	)
+	opts := Options{OnCommit: func(r int, _ time.Duration) {
+		mu.Lock()
+		commits++
+		records += r
+		mu.Unlock()
+	}}
+	dir := t.TempDir()
+	w, _ := open(t, dir, 1, opts)
+	var (
+		wg   sync.WaitGroup
+		lsns = make([]uint64, n)
+	)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lsn, err := w.Append(fmt.Appendf(nil, "%d", i))
+			if err != nil {
+				t.Error(err)
+			}
+			lsns[i] = lsn
+		}()
+	}
+	wg.Wait()
+	w.Close()
+	if records != n {
+		t.Fatalf("committed %d records, want %d", records, n)
+	}
+	t.Logf("%d records in %d commits", records, commits)
+
+	_, replayed := open(t, dir, 1, Options{})
+	if len(replayed) != n {
+		t.Fatalf("replayed %d records, want %d", len(replayed), n)
+	}
+	for _, r := range replayed {
+		if want := fmt.Sprint(slices.Index(lsns, r.lsn)); r.payload != want {
+			t.Fatalf("record %d holds %q, want %q", r.lsn, r.payload, want)
+		}
+	}
+}
+
+// A failed write fails its batch only, the log cuts it off and goes on.
+func TestRecoversFromFailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := open(t, dir, 1, Options{})
+	appendAll(t, w, "a")
+	// the writer is idle, nothing else uses the segment
+	w.segment.Close()
+	if _, err := w.Append([]byte("lost")); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	if lsn, err := w.Append([]byte("b")); err != nil || lsn != 2 {
+		t.Fatalf("got lsn %d, %v", lsn, err)
+	}
+	w.Close()
+
+	w, records := open(t, dir, 1, Options{})
+	defer w.Close()
+	wantRecords(t, records, 1, "a", "b")
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := open(t, dir, 1, Options{SegmentSize: 1})
+	defer w.Close()
+	appendAll(t, w, "a", "b", "c", "d")
+
+	// segments written since are kept
+	if err := w.Compact(2, time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := w.segments(); len(segments) != 5 {
+		t.Fatalf("got segments %v", segments)
+	}
+	if err := w.Compact(2, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := w.segments(); len(segments) != 3 || segments[0] != 3 {
+		t.Fatalf("got segments %v", segments)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	if _, _, ok, err := LoadSnapshot(dir); ok || err != nil {
+		t.Fatalf("got %v, %v for a log without snapshot", ok, err)
+	}
+	w, _ := open(t, dir, 1, Options{})
+	defer w.Close()
+	if err := w.SaveSnapshot(7, []byte("state")); err != nil {
+		t.Fatal(err)
+	}
+	lsn, state, ok, err := LoadSnapshot(dir)
+	if err != nil || !ok || lsn != 7 || string(state) != "state" {
+		t.Fatalf("got %d %q %v %v", lsn, state, ok, err)
+	}
+
+	path := filepath.Join(dir, snapshotFile)
+	b, _ := os.ReadFile(path)
+	b[len(b)-1] ^= 0xff
+	os.WriteFile(path, b, 0o600)
+	if _, _, _, err := LoadSnapshot(dir); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("got %v, want ErrCorrupt", err)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shamssahal/toll-calculator/aggregator/wal"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+// WALStore is a MemoryStore that survives crashes. Every insert is written
+// to the write-ahead log and applied once it is durable, concurrent
+// inserts share an fsync. Snapshots hold the totals and buckets, segments
+// are compacted once a snapshot covers them and their readings are past
+// the retention. On start the latest snapshot is loaded, the records after
+// it are replayed and the readings of the ones before it retained.
+type WALStore struct {
+	*MemoryStore
+	wal           *wal.WAL
+	snapshotEvery uint64
+
+	// held shared by inserts from enqueuing until applying, a snapshot
+	// holds it exclusively so the state holds exactly the records up to
+	// lastLSN
+	mu            sync.RWMutex
+	lastLSN       atomic.Uint64
+	sinceSnapshot atomic.Uint64
+	snapshotting  atomic.Bool
+}
+
+func NewWALStore(dir string, segmentSize int64, snapshotEvery uint64, retention time.Duration) (*WALStore, error) {
+	s := &WALStore{
+		MemoryStore:   NewMemoryStore(retention),
+		snapshotEvery: snapshotEvery,
+	}
+	start := time.Now()
+	lsn, b, ok, err := wal.LoadSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	// snapshots taken before they left readings to the log hold them
+	readingsInSnapshot := false
+	if ok {
+		var state storeState
+		if err := json.Unmarshal(b, &state); err != nil {
+			return nil, fmt.Errorf("failed to load wal snapshot: %w", err)
+		}
+		s.restore(state)
+		s.lastLSN.Store(lsn)
+		readingsInSnapshot = state.Readings != nil
+	}
+	var (
+		replayed  uint64
+		batchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "aggregator",
+			Name:      "wal_commit_records",
+			Help:      "Records made durable by one group commit.",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 7),
+		})
+		commitLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "aggregator",
+			Name:      "wal_commit_seconds",
+			Help:      "Time to write and fsync one group commit.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 10),
+		})
+	)
+	opts := wal.Options{
+		SegmentSize: segmentSize,
+		OnCommit: func(records int, took time.Duration) {
+			batchSize.Observe(float64(records))
+			commitLatency.Observe(took.Seconds())
+		},
+	}
+	s.MemoryStore.mu.Lock()
+	s.wal, err = wal.Open(dir, lsn+1, opts, func(lsn uint64, payload []byte) error {
+		var d types.Distance
+		if err := json.Unmarshal(payload, &d); err != nil {
+			return fmt.Errorf("wal record %d: %w", lsn, err)
+		}
+		if lsn <= s.lastLSN.Load() {
+			// the snapshot holds the totals and buckets
+			if !readingsInSnapshot {
+				s.retain(d)
+			}
+			return nil
+		}
+		s.apply(d)
+		s.retain(d)
+		s.lastLSN.Store(lsn)
+		replayed++
+		return nil
+	})
+	s.MemoryStore.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.sinceSnapshot.Store(replayed)
+	logrus.WithFields(logrus.Fields{
+		"snapshotLSN": lsn,
+		"replayed":    replayed,
+		"took":        time.Since(start),
+	}).Info("recovered aggregator state from the wal")
+	return s, nil
+}
+
+// Insert returns once the distance is durable and applied.
+func (s *WALStore) Insert(ctx context.Context, d types.Distance) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	done, err := s.wal.Enqueue(b)
+	if err != nil {
+		s.mu.RUnlock()
+		return err
+	}
+	res := <-done
+	if res.Err != nil {
+		s.mu.RUnlock()
+		return res.Err
+	}
+	s.MemoryStore.Insert(ctx, d)
+	for {
+		last := s.lastLSN.Load()
+		if res.LSN <= last || s.lastLSN.CompareAndSwap(last, res.LSN) {
+			break
+		}
+	}
+	s.mu.RUnlock()
+	if n := s.sinceSnapshot.Add(1); s.snapshotEvery > 0 && n >= s.snapshotEvery && s.snapshotting.CompareAndSwap(false, true) {
+		go s.snapshot()
+	}
+	return nil
+}
+
+// snapshot waits for the inserts in flight, copies the totals and buckets
+// and writes them, then drops the segments it covers.
+func (s *WALStore) snapshot() {
+	defer s.snapshotting.Store(false)
+	s.mu.Lock()
+	s.MemoryStore.mu.RLock()
+	state := s.state(false)
+	s.MemoryStore.mu.RUnlock()
+	lsn := s.lastLSN.Load()
+	s.sinceSnapshot.Store(0)
+	s.mu.Unlock()
+	if err := s.saveSnapshot(state, lsn); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"lsn":   lsn,
+			"error": err,
+		}).Error("failed to snapshot the wal")
+	}
+}
+
+func (s *WALStore) saveSnapshot(state storeState, lsn uint64) error {
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := s.wal.SaveSnapshot(lsn, b); err != nil {
+		return err
+	}
+	// the readings of a segment written before the horizon are past it
+	return s.wal.Compact(lsn, time.Now().Add(-s.retention))
+}
+
+func (s *WALStore) Close() error {
+	return s.wal.Close()
+}
+
+// walSegmentSize reads AGG_WAL_SEGMENT_SIZE in bytes, 64 MiB when empty.
+func walSegmentSize() int64 {
+	v := os.Getenv("AGG_WAL_SEGMENT_SIZE")
+	if v == "" {
+		return wal.DefaultSegmentSize
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		log.Fatalf("invalid AGG_WAL_SEGMENT_SIZE %q", v)
+	}
+	return n
+}
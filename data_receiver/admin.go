@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/shamssahal/toll-calculator/data_receiver/auth"
+	"github.com/sirupsen/logrus"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v any) error {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
+
+// registerAdminRoutes mounts the operator endpoints. They are only
+// exposed when an admin token is configured.
+func (dr *DataReceiver) registerAdminRoutes(mux *http.ServeMux, adminToken string) {
+	if adminToken == "" {
+		return
+	}
+	mux.HandleFunc("POST /admin/devices/{id}/revoke", requireAdmin(adminToken, dr.handleRevokeDevice))
+	mux.HandleFunc("GET /admin/sessions", requireAdmin(adminToken, dr.handleListSessions))
+	mux.HandleFunc("DELETE /admin/sessions/{id}", requireAdmin(adminToken, dr.handleDisconnectSession))
+}
+
+func requireAdmin(adminToken string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+adminToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (dr *DataReceiver) handleRevokeDevice(w http.ResponseWriter, r *http.Request) {
+	if dr.auth == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "device authentication is disabled"})
+		return
+	}
+	id := r.PathValue("id")
+	if err := dr.auth.Revoke(id); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, auth.ErrUnknownDevice) {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	closed := dr.sessions.disconnectDevice(id, websocket.ClosePolicyViolation, auth.ErrDeviceRevoked.Error())
+	logrus.WithFields(logrus.Fields{
+		"device":   id,
+		"sessions": closed,
+	}).Info("device revoked")
+	writeJSON(w, http.StatusOK, map[string]int{"disconnected": closed})
+}
+
+func (dr *DataReceiver) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, dr.sessions.list())
+}
+
+func (dr *DataReceiver) handleDisconnectSession(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	sess, ok := dr.sessions.get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+		return
+	}
+	sess.disconnect(websocket.ClosePolicyViolation, "disconnected by operator")
+	logrus.WithFields(logrus.Fields{
+		"session": id,
+		"device":  sess.deviceID(),
+	}).Info("session disconnected")
+	writeJSON(w, http.StatusOK, map[string]string{})
+}
@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type Device struct {
+	ID      string `json:"id"`
+	Secret  string `json:"secret"`
+	OBUIDs  []int  `json:"obuIDs"`
+	Revoked bool   `json:"revoked"`
+}
+
+func (d *Device) Allows(obuID int) bool {
+	return slices.Contains(d.OBUIDs, obuID)
+}
+
+type Registry interface {
+	Get(string) (*Device, error)
+	Revoke(string) error
+}
+
+type MemoryRegistry struct {
+	mu      sync.RWMutex
+	devices map[string]Device
+}
+
+func NewMemoryRegistry(devices ...Device) *MemoryRegistry {
+	r := &MemoryRegistry{
+		devices: make(map[string]Device, len(devices)),
+	}
+	for _, d := range devices {
+		r.devices[d.ID] = d
+	}
+	return r
+}
+
+func (r *MemoryRegistry) Get(deviceID string) (*Device, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	dev, ok := r.devices[deviceID]
+	if !ok {
+		return nil, ErrUnknownDevice
+	}
+	return &dev, nil
+}
+
+func (r *MemoryRegistry) Revoke(deviceID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dev, ok := r.devices[deviceID]
+	if !ok {
+		return ErrUnknownDevice
+	}
+	dev.Revoked = true
+	r.devices[deviceID] = dev
+	return nil
+}
+
+func (r *MemoryRegistry) list() []Device {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	devices := make([]Device, 0, len(r.devices))
+	for _, d := range r.devices {
+		devices = append(devices, d)
+	}
+	slices.SortFunc(devices, func(a, b Device) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return devices
+}
+
+// FileRegistry is a MemoryRegistry loaded from a JSON array of devices.
+// Revocations are written back to the file so they survive restarts.
+type FileRegistry struct {
+	*MemoryRegistry
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileRegistry(path string) (*FileRegistry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	if err := json.Unmarshal(b, &devices); err != nil {
+		return nil, err
+	}
+	return &FileRegistry{
+		MemoryRegistry: NewMemoryRegistry(devices...),
+		path:           path,
+	}, nil
+}
+
+func (r *FileRegistry) Revoke(deviceID string) error {
+	if err := r.MemoryRegistry.Revoke(deviceID); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, err := json.MarshalIndent(r.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid device token")
+	ErrTokenExpired  = errors.New("device token expired")
+	ErrUnknownDevice = errors.New("unknown device")
+	ErrDeviceRevoked = errors.New("device revoked")
+	ErrOBUNotAllowed = errors.New("obu not allowed for device")
+)
+
+// NewToken signs a device token of the form <deviceID>.<expiryUnix>.<hmac>
+// where the hmac is HMAC-SHA256 over "<deviceID>.<expiryUnix>" keyed with the
+// device secret. Devices present it when upgrading to a websocket.
+func NewToken(deviceID, secret string, expiry time.Time) string {
+	payload := fmt.Sprintf("%s.%d", deviceID, expiry.Unix())
+	return payload + "." + sign(payload, secret)
+}
+
+func sign(payload, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseToken splits a token from the right so device IDs may contain dots.
+func parseToken(token string) (deviceID string, expiry time.Time, payload, sig string, err error) {
+	i := strings.LastIndex(token, ".")
+	if i <= 0 {
+		return "", time.Time{}, "", "", ErrInvalidToken
+	}
+	payload, sig = token[:i], token[i+1:]
+	j := strings.LastIndex(payload, ".")
+	if j <= 0 {
+		return "", time.Time{}, "", "", ErrInvalidToken
+	}
+	exp, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}, "", "", ErrInvalidToken
+	}
+	return payload[:j], time.Unix(exp, 0), payload, sig, nil
+}
+
+type Authenticator struct {
+	registry Registry
+}
+
+func NewAuthenticator(registry Registry) *Authenticator {
+	return &Authenticator{
+		registry: registry,
+	}
+}
+
+// Authenticate verifies the token signature against the registered device
+// secret and returns the device the connection is bound to.
+func (a *Authenticator) Authenticate(token string) (*Device, error) {
+	deviceID, expiry, payload, sig, err := parseToken(token)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := a.registry.Get(deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(sig), []byte(sign(payload, dev.Secret))) {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().After(expiry) {
+		return nil, ErrTokenExpired
+	}
+	if dev.Revoked {
+		return nil, ErrDeviceRevoked
+	}
+	return dev, nil
+}
+
+// Authorize consults the registry on every reading so a revocation takes
+// effect on already established connections as well.
+func (a *Authenticator) Authorize(deviceID string, obuID int) error {
+	dev, err := a.registry.Get(deviceID)
+	if err != nil {
+		return err
+	}
+	if dev.Revoked {
+		return ErrDeviceRevoked
+	}
+	if !dev.Allows(obuID) {
+		return ErrOBUNotAllowed
+	}
+	return nil
+}
+
+func (a *Authenticator) Revoke(deviceID string) error {
+	return a.registry.Revoke(deviceID)
+}
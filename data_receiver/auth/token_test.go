@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthenticate(t *testing.T) {
+	var (
+		now = time.Now()
+		reg = NewMemoryRegistry(
+			Device{ID: "dev.1", Secret: "s1", OBUIDs: []int{1}},
+			Device{ID: "dev-2", Secret: "s2", OBUIDs: []int{2}, Revoked: true},
+		)
+		a     = NewAuthenticator(reg)
+		valid = NewToken("dev.1", "s1", now.Add(time.Hour))
+	)
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{name: "valid, the id holds a dot", token: valid},
+		{name: "expired", token: NewToken("dev.1", "s1", now.Add(-time.Minute)), want: ErrTokenExpired},
+		{name: "signed with another secret", token: NewToken("dev.1", "other", now.Add(time.Hour)), want: ErrInvalidToken},
+		{name: "tampered expiry", token: "dev.1.9999999999" + valid[len(valid)-65:], want: ErrInvalidToken},
+		{name: "tampered mac", token: valid[:len(valid)-1] + "0", want: ErrInvalidToken},
+		{name: "unknown device", token: NewToken("dev-3", "s1", now.Add(time.Hour)), want: ErrUnknownDevice},
+		{name: "revoked device", token: NewToken("dev-2", "s2", now.Add(time.Hour)), want: ErrDeviceRevoked},
+		{name: "empty", token: "", want: ErrInvalidToken},
+		{name: "no mac", token: "dev-1", want: ErrInvalidToken},
+		{name: "no expiry", token: "dev-1.abc", want: ErrInvalidToken},
+		{name: "expiry not a number", token: "dev-1.soon.abc", want: ErrInvalidToken},
+		{name: "no device id", token: ".123.abc", want: ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev, err := a.Authenticate(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && dev.ID != "dev.1" {
+				t.Fatalf("got device %q", dev.ID)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a := NewAuthenticator(NewMemoryRegistry(Device{ID: "dev-1", Secret: "s1", OBUIDs: []int{1}}))
+	if err := a.Authorize("dev-1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Authorize("dev-1", 2); !errors.Is(err, ErrOBUNotAllowed) {
+		t.Fatalf("got %v, want ErrOBUNotAllowed", err)
+	}
+	if err := a.Revoke("dev-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Authorize("dev-1", 1); !errors.Is(err, ErrDeviceRevoked) {
+		t.Fatalf("got %v, want ErrDeviceRevoked", err)
+	}
+}
+
+// A revocation is written to the file and survives a restart.
+func TestFileRegistryPersistsRevocation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	b, _ := json.Marshal([]Device{
+		{ID: "dev-1", Secret: "s1", OBUIDs: []int{1}},
+		{ID: "dev-2", Secret: "s2", OBUIDs: []int{2}},
+	})
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	reg, err := NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Revoke("dev-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Revoke("dev-3"); !errors.Is(err, ErrUnknownDevice) {
+		t.Fatalf("got %v, want ErrUnknownDevice", err)
+	}
+
+	reg, err = NewFileRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, revoked := range map[string]bool{"dev-1": true, "dev-2": false} {
+		dev, err := reg.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dev.Revoked != revoked || dev.Secret == "" {
+			t.Fatalf("reloaded %+v", dev)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const accountEventsTopic = "account-events"
+
+const (
+	blockedOff    = "off"
+	blockedFlag   = "flag"
+	blockedReject = "reject"
+)
+
+var ErrAccountBlocked = errors.New("account is blocked")
+
+var blockedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "data_receiver",
+	Name:      "blocked_readings_total",
+	Help:      "Readings of blocked accounts, by action (flag, reject).",
+}, []string{"action"})
+
+// Blocklist follows the account events of the aggregator and holds the
+// OBUs of depleted prepaid accounts.
+type Blocklist struct {
+	action string
+
+	mu sync.RWMutex
+	// blocked OBU to its account
+	obus map[int]string
+}
+
+func NewBlocklist(action string) *Blocklist {
+	return &Blocklist{
+		action: action,
+		obus:   make(map[int]string),
+	}
+}
+
+func (b *Blocklist) apply(ev types.AccountEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ev.Blocked() {
+		b.obus[ev.OBUID] = ev.AccountID
+		return
+	}
+	delete(b.obus, ev.OBUID)
+}
+
+func (b *Blocklist) Blocked(obuID int) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	_, ok := b.obus[obuID]
+	return ok
+}
+
+// Check flags a reading of a blocked OBU or returns ErrAccountBlocked,
+// depending on the configured action.
+func (b *Blocklist) Check(data *types.OBUData) error {
+	if b == nil || !b.Blocked(data.OBUID) {
+		return nil
+	}
+	blockedCounter.WithLabelValues(b.action).Inc()
+	if b.action == blockedReject {
+		return ErrAccountBlocked
+	}
+	data.Blocked = true
+	return nil
+}
+
+// follow reads the topic from the beginning under a group of its own, every
+// receiver needs the full state and a compacted topic keeps it small.
+func (b *Blocklist) follow(topic string) error {
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  kafkaBroker,
+		"group.id":           "data-receiver-" + uuid.New().String(),
+		"auto.offset.reset":  "earliest",
+		"enable.auto.commit": false,
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.SubscribeTopics([]string{topic}, nil); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			msg, err := c.ReadMessage(-1)
+			if err != nil {
+				logrus.Errorf("account events consumer error %s", err)
+				continue
+			}
+			// events keyed by account predate the ones keyed by OBU, the
+			// aggregator published the state of every OBU again since
+			if !bytes.HasPrefix(msg.Key, []byte("obu:")) {
+				continue
+			}
+			var ev types.AccountEvent
+			if err := json.Unmarshal(msg.Value, &ev); err != nil {
+				logrus.Errorf("JSON serialization error: %s", err)
+				continue
+			}
+			b.apply(ev)
+			logrus.WithFields(logrus.Fields{
+				"accountID": ev.AccountID,
+				"type":      ev.Type,
+				"obuID":     ev.OBUID,
+			}).Info("account event")
+		}
+	}()
+	return nil
+}
+
+// makeBlocklist reads DR_BLOCKED_READINGS, off (or empty) accepts readings
+// of any account, flag marks readings of depleted prepaid accounts and
+// reject refuses them.
+func makeBlocklist() (*Blocklist, error) {
+	action := os.Getenv("DR_BLOCKED_READINGS")
+	switch action {
+	case "", blockedOff:
+		return nil, nil
+	case blockedFlag, blockedReject:
+	default:
+		return nil, fmt.Errorf("invalid DR_BLOCKED_READINGS %q, expected off, flag or reject", action)
+	}
+	b := NewBlocklist(action)
+	if err := b.follow(accountEventsTopic); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
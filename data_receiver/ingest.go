@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shamssahal/toll-calculator/data_receiver/auth"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxIngestBytes   = 16 << 20
+	maxIngestRecords = 50_000
+)
+
+const (
+	ingestAccepted = "accepted"
+	ingestRejected = "rejected"
+)
+
+type ingestResult struct {
+	Index     int    `json:"index"`
+	RequestID string `json:"requestId,omitempty"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ingestResponse struct {
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Results  []ingestResult `json:"results"`
+}
+
+func (resp *ingestResponse) add(res ingestResult) {
+	if res.Status == ingestAccepted {
+		resp.Accepted++
+	} else {
+		resp.Rejected++
+	}
+	resp.Results = append(resp.Results, res)
+}
+
+func validateOBUData(data types.OBUData) error {
+	if data.OBUID <= 0 {
+		return fmt.Errorf("invalid obuID %d", data.OBUID)
+	}
+	for _, lat := range []float64{data.CurrLat, data.PrevLat} {
+		if lat < -90 || lat > 90 {
+			return fmt.Errorf("latitude %f out of range", lat)
+		}
+	}
+	for _, long := range []float64{data.CurrLong, data.PrevLong} {
+		if long < -180 || long > 180 {
+			return fmt.Errorf("longitude %f out of range", long)
+		}
+	}
+	return nil
+}
+
+// handleIngest accepts buffered telemetry uploaded in bulk, either as a JSON
+// array of readings or as NDJSON (one reading per line). Every record is
+// validated and produced on its own and reported back with its index.
+// Records go through the same checks and rate limits as websocket
+// readings, the ones over the limit are rejected for the device to upload
+// again later.
+func (dr *DataReceiver) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if dr.draining.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "draining"})
+		return
+	}
+	var dev *auth.Device
+	if dr.auth != nil {
+		var err error
+		if dev, err = dr.auth.Authenticate(deviceToken(r)); err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+	}
+
+	var (
+		body = bufio.NewReader(http.MaxBytesReader(w, r.Body, maxIngestBytes))
+		resp = &ingestResponse{Results: []ingestResult{}}
+	)
+	ingest := func(index int, raw []byte) error {
+		if index >= maxIngestRecords {
+			return fmt.Errorf("batch exceeds %d records", maxIngestRecords)
+		}
+		res := ingestResult{Index: index, Status: ingestRejected}
+		var data types.OBUData
+		if err := json.Unmarshal(raw, &data); err != nil {
+			res.Error = err.Error()
+			resp.add(res)
+			return nil
+		}
+		if data.RequestID == "" {
+			data.RequestID = uuid.New().String()
+		}
+		data.ReceivedAt = time.Now().UnixNano()
+		res.RequestID = data.RequestID
+		if err := dr.ingestOne(r, dev, data); err != nil {
+			res.Error = err.Error()
+			if errors.Is(err, auth.ErrDeviceRevoked) {
+				return err
+			}
+		} else {
+			res.Status = ingestAccepted
+		}
+		resp.add(res)
+		return nil
+	}
+
+	var err error
+	if isJSONArray(body) {
+		err = decodeArray(body, ingest)
+	} else {
+		err = decodeNDJSON(body, ingest)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"remote_addr": r.RemoteAddr,
+			"accepted":    resp.Accepted,
+			"error":       err,
+		}).Warn("ingest aborted")
+		status := http.StatusBadRequest
+		if errors.Is(err, auth.ErrDeviceRevoked) {
+			// revoked while the batch was read, the records before it
+			// were taken
+			status = http.StatusForbidden
+		}
+		writeJSON(w, status, map[string]any{
+			"error":    err.Error(),
+			"accepted": resp.Accepted,
+			"rejected": resp.Rejected,
+			"results":  resp.Results,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (dr *DataReceiver) ingestOne(r *http.Request, dev *auth.Device, data types.OBUData) error {
+	if err := dr.admit(dev, &data); err != nil {
+		return err
+	}
+	return dr.produceWithBackpressure(r.Context(), data)
+}
+
+func isJSONArray(r *bufio.Reader) bool {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0] == '['
+		}
+	}
+}
+
+func decodeArray(r io.Reader, fn func(int, []byte) error) error {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		if err := fn(i, raw); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// decodeNDJSON reports malformed lines individually instead of failing the
+// whole upload. Blank lines are skipped.
+func decodeNDJSON(r io.Reader, fn func(int, []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for i := 0; scanner.Scan(); {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(i, line); err != nil {
+			return err
+		}
+		i++
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/data_receiver/auth"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// revokingProducer revokes the device once it produced a reading.
+type revokingProducer struct {
+	*fakeProducer
+	reg *auth.MemoryRegistry
+}
+
+func (p revokingProducer) ProduceData(data types.OBUData) error {
+	p.reg.Revoke("dev-1")
+	return p.fakeProducer.ProduceData(data)
+}
+
+func TestIngestStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		revoke bool
+		want   int
+	}{
+		{name: "batch", body: `[{"obuID":1},{"obuID":1}]`, want: http.StatusOK},
+		{name: "malformed batch", body: `[{"obuID":1},`, want: http.StatusBadRequest},
+		{name: "device revoked during the batch", body: `[{"obuID":1},{"obuID":1}]`, revoke: true, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				reg  = auth.NewMemoryRegistry(auth.Device{ID: "dev-1", Secret: "s1", OBUIDs: []int{1}})
+				prod DataProducer
+			)
+			prod = newFakeProducer()
+			if tt.revoke {
+				prod = revokingProducer{newFakeProducer(), reg}
+			}
+			dr := newTestReceiver(prod, rateLimitConfig{})
+			dr.auth = auth.NewAuthenticator(reg)
+			req := httptest.NewRequest("POST", "/ingest", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+auth.NewToken("dev-1", "s1", time.Now().Add(time.Hour)))
+			rec := httptest.NewRecorder()
+			dr.handleIngest(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
@@ -2,16 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/shamssahal/toll-calculator/data_receiver/auth"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
 	"github.com/shamssahal/toll-calculator/types"
 	"github.com/sirupsen/logrus"
 )
@@ -21,22 +30,58 @@ const (
 	httpListenAddr  = ":30000"
 	maxKafkaTimeout = 10_000
 	kafkaTopic      = "obudata"
+	// how long a connection stops reading while the producer queue is
+	// full before it is closed with CloseTryAgainLater
+	maxBackpressureWait = 5 * time.Second
+	// time between reporting unready and refusing new connections
+	drainDelay = 5 * time.Second
+	// how long devices get to finish in flight readings on shutdown
+	drainTimeout = 10 * time.Second
+)
+
+var (
+	ErrRateLimited = errors.New("rate limited")
+	// wraps the errors of the device registry
+	errUnauthorized = errors.New("device not authorized")
 )
 
 type DataReceiver struct {
 	upgrader websocket.Upgrader
 	prod     DataProducer
+	// nil when no device registry is configured, in which case
+	// connections are accepted unauthenticated
+	auth     *auth.Authenticator
+	limiter  *RateLimiter
+	sessions *SessionRegistry
+	ready    atomic.Bool
+	draining atomic.Bool
+
+	// nil when readings of blocked accounts are accepted as usual
+	blocklist *Blocklist
 }
 
-func (dr *DataReceiver) wsReceiveLoop(ctx context.Context, conn *websocket.Conn, cancel context.CancelFunc) {
-	defer cancel()
+func (dr *DataReceiver) wsReceiveLoop(ctx context.Context, sess *session) {
+	defer sess.cancel()
+	connLimit := dr.limiter.connLimiter()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
+			// throttling the reads pushes back on the device through tcp
+			throttled, err := connLimit.Wait(ctx)
+			if err != nil {
+				return
+			}
+			if throttled {
+				rateLimitedCounter.WithLabelValues("connection").Inc()
+			}
 			var data types.OBUData
-			if err := conn.ReadJSON(&data); err != nil {
+			if err := sess.conn.ReadJSON(&data); err != nil {
+				if isDecodeError(err) {
+					log.Println("read error : ", err)
+					continue
+				}
 				if websocket.IsCloseError(
 					err,
 					websocket.CloseNormalClosure,
@@ -46,25 +91,193 @@ func (dr *DataReceiver) wsReceiveLoop(ctx context.Context, conn *websocket.Conn,
 					log.Println("Websocket connection closed")
 					return
 				}
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					logrus.WithField("session", sess.id).Info("closing idle websocket connection")
+					return
+				}
 				log.Println("read error : ", err)
+				return
+			}
+			data.ReceivedAt = time.Now().UnixNano()
+			sess.received(data.OBUID)
+			if err := dr.admit(sess.device, &data); err != nil {
+				if errors.Is(err, ErrRateLimited) {
+					sess.ack(data.RequestID, types.AckRateLimited, nil)
+					continue
+				}
+				logrus.WithFields(logrus.Fields{
+					"device": sess.deviceID(),
+					"obuID":  data.OBUID,
+					"error":  err,
+				}).Warn("rejected reading")
+				if errors.Is(err, errUnauthorized) && !errors.Is(err, auth.ErrOBUNotAllowed) {
+					closeConn(sess.conn, websocket.ClosePolicyViolation, err.Error())
+					return
+				}
+				sess.ack(data.RequestID, types.AckRejected, err)
 				continue
 			}
-			if err := dr.produceData(data); err != nil {
+			if err := dr.produceWS(ctx, sess, data); err != nil {
+				if errors.Is(err, ErrProducerQueueFull) {
+					backpressureClosedCounter.Inc()
+					closeConn(sess.conn, websocket.CloseTryAgainLater, "producer queue full")
+					return
+				}
 				log.Printf("kafka producer err: %v\n", err)
+				sess.ack(data.RequestID, types.AckFailed, err)
+				continue
+			}
+		}
+	}
+}
+
+// isDecodeError reports whether a ReadJSON error was caused by a malformed
+// message rather than by the connection, in which case reading can go on.
+func isDecodeError(err error) bool {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second),
+	)
+}
+
+// produceWS produces a reading of a websocket session. A device that asked
+// for acks gets one from the delivery report, once kafka holds the reading
+// or finally failed to. Readings in flight when the session ends are not
+// acked, the device sends them again.
+func (dr *DataReceiver) produceWS(ctx context.Context, sess *session, data types.OBUData) error {
+	if !sess.acks {
+		return dr.produceWithBackpressure(ctx, data)
+	}
+	return retryWhileQueueFull(ctx, func() error {
+		return dr.prod.ProduceDataAck(data, func(err error) {
+			if err != nil {
+				log.Printf("kafka delivery err: %v\n", err)
+				sess.ack(data.RequestID, types.AckFailed, err)
+				return
 			}
+			sess.ack(data.RequestID, types.AckOK, nil)
+		})
+	})
+}
+
+// produceWithBackpressure retries with exponential backoff while the
+// producer queue is full. The caller stops reading in the meantime, so the
+// device is slowed down instead of its readings being dropped.
+func (dr *DataReceiver) produceWithBackpressure(ctx context.Context, data types.OBUData) error {
+	return retryWhileQueueFull(ctx, func() error {
+		return dr.produceData(data)
+	})
+}
+
+func retryWhileQueueFull(ctx context.Context, produce func() error) error {
+	var (
+		backoff  = 10 * time.Millisecond
+		deadline = time.Now().Add(maxBackpressureWait)
+	)
+	for {
+		err := produce()
+		if !errors.Is(err, ErrProducerQueueFull) {
+			return err
 		}
+		backpressureCounter.Inc()
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 500*time.Millisecond)
+	}
+}
+
+// admit runs the checks every reading goes through, whichever transport
+// it arrived on: validation, device authorization, the blocklist and the
+// per OBU and global rate limits.
+func (dr *DataReceiver) admit(dev *auth.Device, data *types.OBUData) error {
+	if err := validateOBUData(*data); err != nil {
+		return err
+	}
+	if err := dr.authorize(dev, data.OBUID); err != nil {
+		return fmt.Errorf("%w: %w", errUnauthorized, err)
 	}
+	if err := dr.blocklist.Check(data); err != nil {
+		return err
+	}
+	if !dr.limiter.AllowOBU(data.OBUID) {
+		rateLimitedCounter.WithLabelValues("obu").Inc()
+		return ErrRateLimited
+	}
+	if !dr.limiter.AllowGlobal() {
+		rateLimitedCounter.WithLabelValues("global").Inc()
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// authorize checks that the device bound to the connection may still
+// report readings for the given OBU. It is a no-op when auth is disabled.
+func (dr *DataReceiver) authorize(dev *auth.Device, obuID int) error {
+	if dr.auth == nil {
+		return nil
+	}
+	return dr.auth.Authorize(dev.ID, obuID)
 }
 
 func (dr *DataReceiver) produceData(data types.OBUData) error {
 	return dr.prod.ProduceData(data)
 }
 
-func (dr *DataReceiver) cleanup() {
+// shutdown drains the receiver so that no accepted reading is lost:
+//  1. report unready and give load balancers time to stop routing to us
+//  2. refuse new upgrades and ingest requests
+//  3. ask connected devices to reconnect elsewhere and wait for the
+//     readings they have in flight to be produced
+//  4. stop the http server (waiting for running ingest requests) and mqtt
+//  5. flush and close the producer
+func (dr *DataReceiver) shutdown(ctx context.Context, srv *http.Server, mqttSub *MQTTSubscriber) {
+	dr.ready.Store(false)
+	logrus.Infof("Marked unready, draining in %s", drainDelay)
+	time.Sleep(drainDelay)
+
+	dr.draining.Store(true)
+	drainCtx, cancel := context.WithTimeout(ctx, drainTimeout)
+	dr.sessions.drain(drainCtx)
+	cancel()
+	logrus.Info("Websocket sessions drained")
+
+	gracefulShutdown(ctx, drainTimeout, srv)
+	if mqttSub != nil {
+		mqttSub.Unsubscribe()
+	}
+	// flushing before disconnecting from mqtt lets the pending
+	// deliveries be acknowledged to the broker
 	dr.prod.Flush(maxKafkaTimeout)
+	if mqttSub != nil {
+		mqttSub.Stop()
+	}
 	dr.prod.Close()
 }
 
+func (dr *DataReceiver) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !dr.ready.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
 func NewDataReceiver() (*DataReceiver, error) {
 	var (
 		p   DataProducer
@@ -75,13 +288,26 @@ func NewDataReceiver() (*DataReceiver, error) {
 		return nil, err
 	}
 	p = NewLogMiddleware(p)
+	authenticator, err := makeAuthenticator()
+	if err != nil {
+		return nil, err
+	}
+	blocklist, err := makeBlocklist()
+	if err != nil {
+		return nil, err
+	}
 	return &DataReceiver{
-		prod: p,
+		prod:      p,
+		auth:      authenticator,
+		blocklist: blocklist,
+		limiter:   NewRateLimiter(rateLimitConfigFromEnv()),
+		sessions:  NewSessionRegistry(),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
+			// devices are not browsers, they authenticate with a device token instead
 			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow all origins for development
+				return true
 			},
 		},
 	}, nil
@@ -91,27 +317,74 @@ func NewDataReceiver() (*DataReceiver, error) {
 // which returns the http handler for the /ws enpoint
 func (dr *DataReceiver) handleWS(ctx context.Context) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if dr.draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		var dev *auth.Device
+		if dr.auth != nil {
+			var err error
+			dev, err = dr.auth.Authenticate(deviceToken(r))
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"remote_addr": r.RemoteAddr,
+					"error":       err,
+				}).Warn("device authentication failed")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
 		conn, err := dr.upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			return
 		}
 		ctx, cancel := context.WithCancel(ctx)
+		sess := newSession(conn, r.RemoteAddr, dev, cancel)
+		sess.acks = r.URL.Query().Get("ack") == "1"
+		if !dr.sessions.add(sess) {
+			closeConn(conn, websocket.CloseServiceRestart, "reconnect elsewhere")
+			cancel()
+			conn.Close()
+			return
+		}
+		sess.seen()
+		conn.SetPongHandler(func(string) error {
+			sess.seen()
+			return nil
+		})
 		//contex watcher for canceled context
 		// closes the connection the momemt
 		// the passed context ctx is cancelled in receive loop
 		go func() {
 			<-ctx.Done()
+			dr.sessions.remove(sess.id)
 			conn.Close()
 		}()
+		go sess.heartbeat(ctx)
 		// receive loop to listen to
-		go dr.wsReceiveLoop(ctx, conn, cancel)
+		go func() {
+			defer dr.sessions.loopDone()
+			dr.wsReceiveLoop(ctx, sess)
+		}()
 	}
 }
 
+// deviceToken reads the token from the Authorization header and falls
+// back to the token query parameter for clients that cannot set headers
+func deviceToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
 func (dr *DataReceiver) makeHTTPTransportLayer(ctx context.Context) {
 	mux := http.NewServeMux()
-	timeout := time.Second * 10
 	mux.HandleFunc("/ws", dr.handleWS(ctx))
+	mux.HandleFunc("POST /ingest", dr.handleIngest)
+	mux.HandleFunc("GET /readyz", dr.handleReady)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	dr.registerAdminRoutes(mux, os.Getenv("DR_ADMIN_TOKEN"))
 
 	srv := &http.Server{
 		Addr:              httpListenAddr,
@@ -125,10 +398,19 @@ func (dr *DataReceiver) makeHTTPTransportLayer(ctx context.Context) {
 	srvErrCh := make(chan error, 1)
 	defer close(srvErrCh)
 	go func() {
-		srvErrCh <- srv.ListenAndServe()
+		srvErrCh <- tlsconfig.ListenAndServe(srv, tlsconfig.FromEnv("DR"))
 
 	}()
 
+	var mqttSub *MQTTSubscriber
+	if cfg := mqttConfigFromEnv(); cfg.broker != "" {
+		mqttSub = NewMQTTSubscriber(cfg, dr)
+		if err := mqttSub.Start(); err != nil {
+			logrus.Errorf("failed to start mqtt subscriber %v", err)
+		}
+	}
+	dr.ready.Store(true)
+
 	select {
 	case sig := <-sigCh:
 		logrus.Info("Received interruption signal. Shutting down gracefully, signal:", sig)
@@ -138,8 +420,7 @@ func (dr *DataReceiver) makeHTTPTransportLayer(ctx context.Context) {
 		}
 	}
 
-	dr.cleanup()
-	gracefulShutdown(ctx, timeout, srv)
+	dr.shutdown(ctx, srv, mqttSub)
 }
 
 func main() {
@@ -172,3 +453,23 @@ func gracefulShutdown(ctx context.Context, timeout time.Duration, srv *http.Serv
 	logrus.Info("Graceful shutdown complete")
 
 }
+
+func makeAuthenticator() (*auth.Authenticator, error) {
+	path := os.Getenv("DR_DEVICE_REGISTRY")
+	if path == "" {
+		logrus.Warn("no device registry configured, accepting unauthenticated devices")
+		return nil, nil
+	}
+	registry, err := auth.NewFileRegistry(path)
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewAuthenticator(registry), nil
+}
+
+func init() {
+	// without a .env the environment is used as is, e.g. in tests
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	rateLimitedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "data_receiver",
+		Name:      "rate_limited_total",
+		Help:      "Readings throttled or dropped by a rate limit, by scope (connection, obu, global).",
+	}, []string{"scope"})
+	backpressureCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "data_receiver",
+		Name:      "backpressure_total",
+		Help:      "Produce attempts that found the producer queue full.",
+	})
+	backpressureClosedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "data_receiver",
+		Name:      "backpressure_closed_total",
+		Help:      "Connections closed because the producer queue stayed full.",
+	})
+)
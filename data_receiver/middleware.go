@@ -18,22 +18,30 @@ func NewLogMiddleware(next DataProducer) *LogMiddleware {
 }
 
 func (l *LogMiddleware) ProduceData(data types.OBUData) error {
-	defer func() {
-		start := time.Now()
-		logrus.WithFields(logrus.Fields{
-			"obuID":     data.OBUID,
-			"currLat":   data.CurrLat,
-			"currLong":  data.CurrLong,
-			"prevLat":   data.PrevLat,
-			"prevLong":  data.PrevLong,
-			"timestamp": start,
-			"took":      time.Since(start),
-			"requestId": data.RequestID,
-		}).Info("producing to kafka")
-	}()
+	defer l.log(data)
 	return l.next.ProduceData(data)
 }
 
+func (l *LogMiddleware) ProduceDataAck(data types.OBUData, onDelivery DeliveryFunc) error {
+	defer l.log(data)
+	return l.next.ProduceDataAck(data, onDelivery)
+}
+
+func (l *LogMiddleware) log(data types.OBUData) {
+	start := time.Now()
+	logrus.WithFields(logrus.Fields{
+		"obuID":      data.OBUID,
+		"currLat":    data.CurrLat,
+		"currLong":   data.CurrLong,
+		"prevLat":    data.PrevLat,
+		"prevLong":   data.PrevLong,
+		"timestamp":  start,
+		"took":       time.Since(start),
+		"requestId":  data.RequestID,
+		"capturedAt": data.CapturedAt,
+	}).Info("producing to kafka")
+}
+
 func (l *LogMiddleware) Flush(timeout int) {
 	l.next.Flush(timeout)
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/google/uuid"
+	"github.com/shamssahal/toll-calculator/data_receiver/auth"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMQTTTopic    = "obu/+/data"
+	defaultMQTTClientID = "data-receiver"
+	deliveryRetryDelay  = time.Second
+)
+
+type mqttConfig struct {
+	broker   string
+	topic    string
+	clientID string
+	username string
+	password string
+}
+
+// mqttConfigFromEnv reads DR_MQTT_*. The adapter is disabled when no
+// broker is configured.
+func mqttConfigFromEnv() mqttConfig {
+	cfg := mqttConfig{
+		broker:   os.Getenv("DR_MQTT_BROKER"),
+		topic:    os.Getenv("DR_MQTT_TOPIC"),
+		clientID: os.Getenv("DR_MQTT_CLIENT_ID"),
+		username: os.Getenv("DR_MQTT_USERNAME"),
+		password: os.Getenv("DR_MQTT_PASSWORD"),
+	}
+	if cfg.topic == "" {
+		cfg.topic = defaultMQTTTopic
+	}
+	if cfg.clientID == "" {
+		cfg.clientID = defaultMQTTClientID
+	}
+	return cfg
+}
+
+// MQTTSubscriber subscribes to one topic per OBU and feeds the readings into
+// the receiver's producer chain, after the same checks and rate limits as
+// the other transports. Messages are received with QoS 1 and only
+// acknowledged to the broker once kafka confirmed delivery, so the broker
+// redelivers anything the receiver lost.
+type MQTTSubscriber struct {
+	cfg    mqttConfig
+	dr     *DataReceiver
+	client mqtt.Client
+	acks   *ackQueue
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func NewMQTTSubscriber(cfg mqttConfig, dr *DataReceiver) *MQTTSubscriber {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &MQTTSubscriber{
+		cfg:    cfg,
+		dr:     dr,
+		acks:   &ackQueue{},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.broker).
+		SetClientID(cfg.clientID).
+		SetUsername(cfg.username).
+		SetPassword(cfg.password).
+		// keep the session so unacknowledged messages are redelivered
+		SetCleanSession(false).
+		SetAutoAckDisabled(true).
+		SetOrderMatters(true).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(s.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logrus.Warnf("mqtt connection lost: %v", err)
+		})
+	s.client = mqtt.NewClient(opts)
+	return s
+}
+
+func (s *MQTTSubscriber) Start() error {
+	if s.dr.auth != nil && !hasDeviceLevel(s.cfg.topic) {
+		return fmt.Errorf("mqtt topic %s has no device level, devices could not be authorized", s.cfg.topic)
+	}
+	logrus.Infof("Starting mqtt subscriber on %s topic %s", s.cfg.broker, s.cfg.topic)
+	token := s.client.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+// Unsubscribe stops new messages from arriving while the ones in flight can
+// still be acknowledged.
+func (s *MQTTSubscriber) Unsubscribe() {
+	token := s.client.Unsubscribe(s.cfg.topic)
+	token.WaitTimeout(time.Second)
+}
+
+func (s *MQTTSubscriber) Stop() {
+	s.cancel()
+	s.client.Disconnect(uint(time.Second / time.Millisecond))
+}
+
+// onConnect (re)subscribes on every connect since the broker may have
+// dropped the subscription while we were away.
+func (s *MQTTSubscriber) onConnect(c mqtt.Client) {
+	token := c.Subscribe(s.cfg.topic, 1, s.handleMessage)
+	token.Wait()
+	if err := token.Error(); err != nil {
+		logrus.Errorf("mqtt subscribe error: %v", err)
+	}
+}
+
+func (s *MQTTSubscriber) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	pending := s.acks.push(msg)
+	data, dev, err := s.decode(msg)
+	if err == nil {
+		err = s.dr.admit(dev, &data)
+	}
+	if err != nil {
+		// redelivery would not fix a bad payload, an unauthorized device
+		// or a blocked account, ack and drop it. Readings over the rate
+		// limit are dropped like on the other transports.
+		logrus.WithFields(logrus.Fields{
+			"topic": msg.Topic(),
+			"error": err,
+		}).Warn("rejected mqtt reading")
+		s.acks.complete(pending)
+		return
+	}
+	s.produce(pending, data)
+}
+
+// produce blocks the subscriber while the producer queue is full which
+// in turn stops the broker from sending beyond its in-flight window.
+// Failed deliveries are retried until they succeed or the subscriber stops.
+func (s *MQTTSubscriber) produce(pending *pendingAck, data types.OBUData) {
+	err := retryWhileQueueFull(s.ctx, func() error {
+		return s.dr.prod.ProduceDataAck(data, func(err error) {
+			if err != nil {
+				logrus.Errorf("mqtt reading delivery failed, retrying: %v", err)
+				time.AfterFunc(deliveryRetryDelay, func() {
+					if s.ctx.Err() == nil {
+						s.produce(pending, data)
+					}
+				})
+				return
+			}
+			s.acks.complete(pending)
+		})
+	})
+	if err != nil && s.ctx.Err() == nil {
+		// not acking would stall every later message behind this one
+		logrus.Errorf("kafka producer err, dropping mqtt reading: %v", err)
+		s.acks.complete(pending)
+	}
+}
+
+// decode maps a message to a reading and the device that published it,
+// nil when devices are not authenticated.
+func (s *MQTTSubscriber) decode(msg mqtt.Message) (types.OBUData, *auth.Device, error) {
+	var data types.OBUData
+	if err := json.Unmarshal(msg.Payload(), &data); err != nil {
+		return data, nil, err
+	}
+	deviceID, obuID, err := topicIDs(s.cfg.topic, msg.Topic())
+	if err != nil {
+		return data, nil, err
+	}
+	if data.OBUID == 0 {
+		data.OBUID = obuID
+	}
+	if data.OBUID != obuID {
+		return data, nil, fmt.Errorf("payload obuID %d does not match topic %s", data.OBUID, msg.Topic())
+	}
+	if data.RequestID == "" {
+		data.RequestID = uuid.New().String()
+	}
+	data.ReceivedAt = time.Now().UnixNano()
+	var dev *auth.Device
+	if s.dr.auth != nil {
+		dev = &auth.Device{ID: deviceID}
+	}
+	return data, dev, nil
+}
+
+// topicIDs extracts the ids at the single level wildcards of filter. The
+// last one is the OBU, the one before it the device if the filter has one,
+// e.g. devices/+/obu/+/data and devices/gw-1/obu/42/data. The broker has to
+// restrict every device to the topics of its own id.
+func topicIDs(filter, topic string) (deviceID string, obuID int, err error) {
+	var (
+		levels = strings.Split(topic, "/")
+		ids    []string
+	)
+	for i, level := range strings.Split(filter, "/") {
+		if level == "+" && i < len(levels) {
+			ids = append(ids, levels[i])
+		}
+	}
+	if len(ids) == 0 {
+		return "", 0, fmt.Errorf("no obuID in topic %s", topic)
+	}
+	if obuID, err = strconv.Atoi(ids[len(ids)-1]); err != nil {
+		return "", 0, fmt.Errorf("no obuID in topic %s", topic)
+	}
+	if len(ids) > 1 {
+		deviceID = ids[len(ids)-2]
+	}
+	return deviceID, obuID, nil
+}
+
+func hasDeviceLevel(filter string) bool {
+	return strings.Count(filter, "+") >= 2
+}
+
+// ackQueue acknowledges messages in the order they were received as
+// required by MQTT, even though kafka may confirm them out of order.
+type ackQueue struct {
+	mu      sync.Mutex
+	pending []*pendingAck
+}
+
+type pendingAck struct {
+	msg  mqtt.Message
+	done bool
+}
+
+func (q *ackQueue) push(msg mqtt.Message) *pendingAck {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p := &pendingAck{msg: msg}
+	q.pending = append(q.pending, p)
+	return p
+}
+
+func (q *ackQueue) complete(p *pendingAck) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p.done = true
+	for len(q.pending) > 0 && q.pending[0].done {
+		q.pending[0].msg.Ack()
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+	}
+}
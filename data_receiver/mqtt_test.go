@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	mochiauth "github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/shamssahal/toll-calculator/data_receiver/auth"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+const testTopic = "devices/+/obu/+/data"
+
+// fakeProducer records the readings it is given. Delivery reports are sent
+// right away unless hold is set, in which case they are never sent.
+type fakeProducer struct {
+	mu       sync.Mutex
+	produced []types.OBUData
+	// deliveries to fail before the first success, per RequestID
+	failures map[string]int
+	hold     bool
+	ch       chan types.OBUData
+}
+
+func newFakeProducer() *fakeProducer {
+	return &fakeProducer{
+		failures: map[string]int{},
+		ch:       make(chan types.OBUData, 100),
+	}
+}
+
+func (p *fakeProducer) ProduceData(data types.OBUData) error {
+	return p.ProduceDataAck(data, nil)
+}
+
+func (p *fakeProducer) ProduceDataAck(data types.OBUData, onDelivery DeliveryFunc) error {
+	p.mu.Lock()
+	p.produced = append(p.produced, data)
+	var err error
+	if p.failures[data.RequestID] > 0 {
+		p.failures[data.RequestID]--
+		err = fmt.Errorf("broker unavailable")
+	}
+	hold := p.hold
+	p.mu.Unlock()
+	p.ch <- data
+	if onDelivery != nil && !hold {
+		go onDelivery(err)
+	}
+	return nil
+}
+
+func (p *fakeProducer) Flush(int) {}
+func (p *fakeProducer) Close()    {}
+
+func (p *fakeProducer) next(t *testing.T) types.OBUData {
+	t.Helper()
+	select {
+	case data := <-p.ch:
+		return data
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reading produced")
+		return types.OBUData{}
+	}
+}
+
+// startBroker runs an embedded broker that lets every client in.
+func startBroker(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	srv := mochi.New(&mochi.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := srv.AddHook(new(mochiauth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: addr})); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return "tcp://" + addr
+}
+
+func newTestReceiver(prod DataProducer, limits rateLimitConfig, devices ...auth.Device) *DataReceiver {
+	dr := &DataReceiver{
+		prod:     prod,
+		limiter:  NewRateLimiter(limits),
+		sessions: NewSessionRegistry(),
+	}
+	if len(devices) > 0 {
+		dr.auth = auth.NewAuthenticator(auth.NewMemoryRegistry(devices...))
+	}
+	return dr
+}
+
+func startSubscriber(t *testing.T, broker, clientID string, dr *DataReceiver) *MQTTSubscriber {
+	t.Helper()
+	sub := NewMQTTSubscriber(mqttConfig{broker: broker, topic: testTopic, clientID: clientID}, dr)
+	if err := sub.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// the subscription is made by the connect handler
+	time.Sleep(100 * time.Millisecond)
+	return sub
+}
+
+// stop waits for the delivered readings to be acknowledged to the broker
+// before disconnecting, like the receiver does on shutdown.
+func stop(t *testing.T, sub *MQTTSubscriber) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sub.acks.mu.Lock()
+		pending := len(sub.acks.pending)
+		sub.acks.mu.Unlock()
+		if pending == 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sub.Stop()
+}
+
+func newPublisher(t *testing.T, broker string) mqtt.Client {
+	t.Helper()
+	c := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID(fmt.Sprintf("publisher-%d", time.Now().UnixNano())))
+	if token := c.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	t.Cleanup(func() { c.Disconnect(100) })
+	return c
+}
+
+func publish(t *testing.T, c mqtt.Client, topic string, data types.OBUData) {
+	t.Helper()
+	b, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token := c.Publish(topic, 1, false, b); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+}
+
+func TestMQTTAdmission(t *testing.T) {
+	devices := []auth.Device{
+		{ID: "gw-1", OBUIDs: []int{1, 2, 3, 4}},
+		{ID: "gw-revoked", OBUIDs: []int{1}, Revoked: true},
+	}
+	tests := []struct {
+		name   string
+		topic  string
+		data   types.OBUData
+		limits rateLimitConfig
+		// readings published before data, e.g. to use up a rate limit
+		before int
+		// OBUs of depleted accounts, handled as blockAction
+		blocked     []int
+		blockAction string
+		accepted    bool
+		// the reading is produced flagged as blocked
+		flagged bool
+	}{
+		{name: "allowed obu", topic: "devices/gw-1/obu/1/data", data: types.OBUData{CurrLat: 1, CurrLong: 2}, accepted: true},
+		{name: "obu of another device", topic: "devices/gw-1/obu/9/data", data: types.OBUData{}},
+		{name: "unknown device", topic: "devices/gw-x/obu/1/data", data: types.OBUData{}},
+		{name: "revoked device", topic: "devices/gw-revoked/obu/1/data", data: types.OBUData{}},
+		{name: "invalid reading", topic: "devices/gw-1/obu/1/data", data: types.OBUData{CurrLat: 100}},
+		{name: "payload of another obu", topic: "devices/gw-1/obu/1/data", data: types.OBUData{OBUID: 2}},
+		{name: "blocked account", topic: "devices/gw-1/obu/1/data", data: types.OBUData{}, blocked: []int{1}, blockAction: blockedReject},
+		{name: "blocked account, flagged", topic: "devices/gw-1/obu/1/data", data: types.OBUData{}, blocked: []int{1}, blockAction: blockedFlag, accepted: true, flagged: true},
+		{name: "other obu of a flagging receiver", topic: "devices/gw-1/obu/2/data", data: types.OBUData{}, blocked: []int{1}, blockAction: blockedFlag, accepted: true},
+		{
+			name:   "obu over its rate limit",
+			topic:  "devices/gw-1/obu/1/data",
+			data:   types.OBUData{},
+			limits: rateLimitConfig{obuRate: 0.001, obuBurst: 1},
+			before: 1,
+		},
+	}
+	broker := startBroker(t)
+	pub := newPublisher(t, broker)
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prod := newFakeProducer()
+			dr := newTestReceiver(prod, tt.limits, devices...)
+			if tt.blocked != nil {
+				dr.blocklist = NewBlocklist(tt.blockAction)
+				for _, obuID := range tt.blocked {
+					dr.blocklist.apply(types.AccountEvent{Type: types.AccountDepleted, AccountID: "acc", OBUID: obuID})
+				}
+			}
+			sub := startSubscriber(t, broker, fmt.Sprintf("receiver-%d", i), dr)
+			defer stop(t, sub)
+
+			for j := range tt.before {
+				publish(t, pub, tt.topic, types.OBUData{RequestID: fmt.Sprintf("before-%d", j)})
+				prod.next(t)
+			}
+			tt.data.RequestID = "reading"
+			publish(t, pub, tt.topic, tt.data)
+			// messages are handled in order, once the sentinel is produced
+			// the reading was either produced or dropped
+			publish(t, pub, "devices/gw-1/obu/4/data", types.OBUData{RequestID: "sentinel"})
+			var got []types.OBUData
+			for {
+				data := prod.next(t)
+				if data.RequestID == "sentinel" {
+					break
+				}
+				got = append(got, data)
+			}
+			if tt.accepted && len(got) != 1 {
+				t.Fatalf("expected the reading to be produced, got %v", got)
+			}
+			if !tt.accepted && len(got) != 0 {
+				t.Fatalf("expected the reading to be dropped, got %v", got)
+			}
+			if tt.accepted && got[0].Blocked != tt.flagged {
+				t.Fatalf("reading produced with blocked %v, want %v", got[0].Blocked, tt.flagged)
+			}
+		})
+	}
+}
+
+func TestMQTTReadingCarriesTopicOBU(t *testing.T) {
+	broker := startBroker(t)
+	prod := newFakeProducer()
+	sub := startSubscriber(t, broker, "receiver", newTestReceiver(prod, rateLimitConfig{}, auth.Device{ID: "gw-1", OBUIDs: []int{42}}))
+	defer stop(t, sub)
+
+	publish(t, newPublisher(t, broker), "devices/gw-1/obu/42/data", types.OBUData{CurrLat: 52.5, CurrLong: 13.4})
+	data := prod.next(t)
+	if data.OBUID != 42 || data.RequestID == "" || data.ReceivedAt == 0 {
+		t.Fatalf("unexpected reading %+v", data)
+	}
+}
+
+// A failed kafka delivery is retried before the message is acknowledged.
+func TestMQTTRetriesFailedDelivery(t *testing.T) {
+	broker := startBroker(t)
+	prod := newFakeProducer()
+	prod.failures["r1"] = 1
+	sub := startSubscriber(t, broker, "receiver", newTestReceiver(prod, rateLimitConfig{}))
+	defer stop(t, sub)
+
+	publish(t, newPublisher(t, broker), "devices/gw-1/obu/1/data", types.OBUData{RequestID: "r1"})
+	for range 2 {
+		if data := prod.next(t); data.RequestID != "r1" {
+			t.Fatalf("unexpected reading %+v", data)
+		}
+	}
+}
+
+// A message kafka never confirmed is not acknowledged, the broker sends it
+// again to the next subscriber of the session.
+func TestMQTTRedeliversUnconfirmedReading(t *testing.T) {
+	broker := startBroker(t)
+	prod := newFakeProducer()
+	prod.hold = true
+	sub := startSubscriber(t, broker, "receiver", newTestReceiver(prod, rateLimitConfig{}))
+
+	publish(t, newPublisher(t, broker), "devices/gw-1/obu/1/data", types.OBUData{RequestID: "r1"})
+	prod.next(t)
+	sub.Stop()
+
+	prod.mu.Lock()
+	prod.hold = false
+	prod.mu.Unlock()
+	sub = startSubscriber(t, broker, "receiver", newTestReceiver(prod, rateLimitConfig{}))
+	defer stop(t, sub)
+	if data := prod.next(t); data.RequestID != "r1" {
+		t.Fatalf("unexpected reading %+v", data)
+	}
+}
+
+func TestMQTTRequiresDeviceLevelWithAuth(t *testing.T) {
+	dr := newTestReceiver(newFakeProducer(), rateLimitConfig{}, auth.Device{ID: "gw-1"})
+	sub := NewMQTTSubscriber(mqttConfig{broker: "tcp://127.0.0.1:1", topic: "obu/+/data", clientID: "receiver"}, dr)
+	if err := sub.Start(); err == nil {
+		t.Fatal("expected an error for a topic without device level")
+	}
+}
+
+func TestTopicIDs(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		device        string
+		obuID         int
+		wantErr       bool
+	}{
+		{filter: "obu/+/data", topic: "obu/42/data", obuID: 42},
+		{filter: "devices/+/obu/+/data", topic: "devices/gw-1/obu/42/data", device: "gw-1", obuID: 42},
+		{filter: "obu/+/data", topic: "obu/x/data", wantErr: true},
+		{filter: "obu/data", topic: "obu/data", wantErr: true},
+	}
+	for _, tt := range tests {
+		device, obuID, err := topicIDs(tt.filter, tt.topic)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.topic)
+			}
+			continue
+		}
+		if err != nil || device != tt.device || obuID != tt.obuID {
+			t.Errorf("%s: got %q %d %v", tt.topic, device, obuID, err)
+		}
+	}
+}
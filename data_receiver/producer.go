@@ -2,13 +2,27 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/shamssahal/toll-calculator/types"
 )
 
+// ErrProducerQueueFull is returned by ProduceData when the local producer
+// queue cannot take more messages and the caller should back off.
+var ErrProducerQueueFull = errors.New("producer queue full")
+
+// DeliveryFunc is called once the broker acknowledged (err == nil) or
+// finally rejected a message.
+type DeliveryFunc func(error)
+
 type DataProducer interface {
 	ProduceData(types.OBUData) error
+	// ProduceDataAck is ProduceData with a delivery report, for transports
+	// that only acknowledge a reading to the device once it is persisted.
+	ProduceDataAck(types.OBUData, DeliveryFunc) error
 	Flush(int)
 	Close()
 }
@@ -30,15 +44,21 @@ func NewKafkaProducer(topic string) (DataProducer, error) {
 		for e := range p.Events() {
 			switch ev := e.(type) {
 			case *kafka.Message:
-				if ev.TopicPartition.Error != nil {
-					// fmt.Printf("Delivery failed: %v\n", ev.TopicPartition)
-				} else {
-					// fmt.Printf("Delivered message to %v\n", ev.TopicPartition)
+				if onDelivery, ok := ev.Opaque.(DeliveryFunc); ok {
+					onDelivery(ev.TopicPartition.Error)
 				}
 			}
 		}
 	}()
 
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "data_receiver",
+		Name:      "producer_queue_length",
+		Help:      "Messages waiting in the kafka producer queue.",
+	}, func() float64 {
+		return float64(p.Len())
+	})
+
 	return &kafkaProducer{
 		producer: p,
 		topic:    topic,
@@ -46,17 +66,35 @@ func NewKafkaProducer(topic string) (DataProducer, error) {
 }
 
 func (p *kafkaProducer) ProduceData(data types.OBUData) error {
+	return p.produce(data, nil)
+}
+
+func (p *kafkaProducer) ProduceDataAck(data types.OBUData, onDelivery DeliveryFunc) error {
+	return p.produce(data, onDelivery)
+}
+
+func (p *kafkaProducer) produce(data types.OBUData, onDelivery DeliveryFunc) error {
+	var opaque any
+	if onDelivery != nil {
+		opaque = onDelivery
+	}
 	b, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
-	return p.producer.Produce(&kafka.Message{
+	err = p.producer.Produce(&kafka.Message{
 		TopicPartition: kafka.TopicPartition{
 			Topic:     &p.topic,
 			Partition: kafka.PartitionAny,
 		},
-		Value: b,
+		Value:  b,
+		Opaque: opaque,
 	}, nil)
+	var kerr kafka.Error
+	if errors.As(err, &kerr) && kerr.Code() == kafka.ErrQueueFull {
+		return ErrProducerQueueFull
+	}
+	return err
 }
 
 func (p *kafkaProducer) Flush(timeout int) {
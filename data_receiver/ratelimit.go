@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// idle per-OBU buckets are dropped after this long
+const obuBucketTTL = 10 * time.Minute
+
+// tokenBucket refills at rate tokens per second up to burst. A nil bucket
+// never limits.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+func (b *tokenBucket) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Wait blocks until a token is available and reports whether it had to
+// wait at all.
+func (b *tokenBucket) Wait(ctx context.Context) (bool, error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	b.refill(time.Now())
+	b.tokens--
+	deficit := -b.tokens
+	b.mu.Unlock()
+	if deficit <= 0 {
+		return false, nil
+	}
+	t := time.NewTimer(time.Duration(deficit / b.rate * float64(time.Second)))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return true, ctx.Err()
+	case <-t.C:
+		return true, nil
+	}
+}
+
+type rateLimitConfig struct {
+	connRate, obuRate, globalRate    float64
+	connBurst, obuBurst, globalBurst int
+}
+
+// rateLimitConfigFromEnv reads DR_{CONN,OBU,GLOBAL}_{RATE,BURST}. Rates are
+// readings per second, 0 disables the limit.
+func rateLimitConfigFromEnv() rateLimitConfig {
+	rate := func(key string) float64 {
+		v, _ := strconv.ParseFloat(os.Getenv(key), 64)
+		return v
+	}
+	burst := func(key string) int {
+		v, _ := strconv.Atoi(os.Getenv(key))
+		return v
+	}
+	return rateLimitConfig{
+		connRate:    rate("DR_CONN_RATE"),
+		connBurst:   burst("DR_CONN_BURST"),
+		obuRate:     rate("DR_OBU_RATE"),
+		obuBurst:    burst("DR_OBU_BURST"),
+		globalRate:  rate("DR_GLOBAL_RATE"),
+		globalBurst: burst("DR_GLOBAL_BURST"),
+	}
+}
+
+type obuBucket struct {
+	*tokenBucket
+	lastSeen time.Time
+}
+
+type RateLimiter struct {
+	cfg    rateLimitConfig
+	global *tokenBucket
+
+	mu        sync.Mutex
+	obus      map[int]*obuBucket
+	lastSweep time.Time
+}
+
+func NewRateLimiter(cfg rateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		cfg:       cfg,
+		global:    newTokenBucket(cfg.globalRate, cfg.globalBurst),
+		obus:      make(map[int]*obuBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// connLimiter returns a bucket for a single connection. Readings beyond it
+// are not dropped, the receive loop simply reads slower.
+func (l *RateLimiter) connLimiter() *tokenBucket {
+	return newTokenBucket(l.cfg.connRate, l.cfg.connBurst)
+}
+
+func (l *RateLimiter) AllowGlobal() bool {
+	return l.global.Allow()
+}
+
+func (l *RateLimiter) AllowOBU(obuID int) bool {
+	if l.cfg.obuRate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > time.Minute {
+		for id, b := range l.obus {
+			if now.Sub(b.lastSeen) > obuBucketTTL {
+				delete(l.obus, id)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.obus[obuID]
+	if !ok {
+		b = &obuBucket{tokenBucket: newTokenBucket(l.cfg.obuRate, l.cfg.obuBurst)}
+		l.obus[obuID] = b
+	}
+	b.lastSeen = now
+	l.mu.Unlock()
+	return b.Allow()
+}
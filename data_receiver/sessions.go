@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/shamssahal/toll-calculator/data_receiver/auth"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+const (
+	pingInterval = 30 * time.Second
+	// a connection without any message or pong for this long is closed
+	idleTimeout = 3 * pingInterval
+)
+
+// session is one live websocket connection of an OBU device.
+type session struct {
+	id          string
+	remoteAddr  string
+	device      *auth.Device
+	connectedAt time.Time
+	conn        *websocket.Conn
+	cancel      context.CancelFunc
+	// the device asked for a types.Ack per reading
+	acks bool
+	// acks are written from the receive loop and from delivery reports
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	obuIDs   map[int]struct{}
+	messages int64
+	lastSeen time.Time
+}
+
+type sessionInfo struct {
+	ID          string    `json:"id"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	DeviceID    string    `json:"deviceID,omitempty"`
+	OBUIDs      []int     `json:"obuIDs"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Messages    int64     `json:"messages"`
+	LastSeen    time.Time `json:"lastSeen"`
+}
+
+func newSession(conn *websocket.Conn, remoteAddr string, dev *auth.Device, cancel context.CancelFunc) *session {
+	now := time.Now()
+	return &session{
+		id:          uuid.New().String(),
+		remoteAddr:  remoteAddr,
+		device:      dev,
+		connectedAt: now,
+		conn:        conn,
+		cancel:      cancel,
+		obuIDs:      make(map[int]struct{}),
+		lastSeen:    now,
+	}
+}
+
+func (s *session) deviceID() string {
+	if s.device == nil {
+		return ""
+	}
+	return s.device.ID
+}
+
+// seen records activity and pushes the idle deadline out.
+func (s *session) seen() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+	s.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+}
+
+func (s *session) received(obuID int) {
+	s.mu.Lock()
+	s.obuIDs[obuID] = struct{}{}
+	s.messages++
+	s.mu.Unlock()
+	s.seen()
+}
+
+// ack is called from the receive loop and from kafka delivery reports,
+// writeMu keeps it the single writer of data frames on the connection. An
+// ack after the session ended fails on the closed connection.
+func (s *session) ack(requestID, status string, err error) {
+	if !s.acks {
+		return
+	}
+	ack := types.Ack{
+		RequestID: requestID,
+		Status:    status,
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	s.conn.WriteJSON(ack)
+}
+
+func (s *session) info() sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obuIDs := make([]int, 0, len(s.obuIDs))
+	for id := range s.obuIDs {
+		obuIDs = append(obuIDs, id)
+	}
+	slices.Sort(obuIDs)
+	return sessionInfo{
+		ID:          s.id,
+		RemoteAddr:  s.remoteAddr,
+		DeviceID:    s.deviceID(),
+		OBUIDs:      obuIDs,
+		ConnectedAt: s.connectedAt,
+		Messages:    s.messages,
+		LastSeen:    s.lastSeen,
+	}
+}
+
+// heartbeat pings the device until the session ends. Pongs are handled by
+// the pong handler installed on the connection.
+func (s *session) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				s.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (s *session) disconnect(code int, reason string) {
+	closeConn(s.conn, code, reason)
+	s.cancel()
+}
+
+type SessionRegistry struct {
+	mu       sync.RWMutex
+	sessions map[string]*session
+	// set once draining started, no new sessions are accepted afterwards
+	closing bool
+	// one per running receive loop
+	loops sync.WaitGroup
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*session),
+	}
+}
+
+// add registers the session and its receive loop, which must call
+// loopDone when it returns. It fails once the registry is draining.
+func (r *SessionRegistry) add(s *session) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closing {
+		return false
+	}
+	r.sessions[s.id] = s
+	r.loops.Add(1)
+	return true
+}
+
+func (r *SessionRegistry) loopDone() {
+	r.loops.Done()
+}
+
+func (r *SessionRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, id)
+}
+
+func (r *SessionRegistry) get(id string) (*session, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+func (r *SessionRegistry) all() []*session {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+func (r *SessionRegistry) list() []sessionInfo {
+	infos := []sessionInfo{}
+	for _, s := range r.all() {
+		infos = append(infos, s.info())
+	}
+	slices.SortFunc(infos, func(a, b sessionInfo) int {
+		return a.ConnectedAt.Compare(b.ConnectedAt)
+	})
+	return infos
+}
+
+// disconnectDevice closes every session authenticated as the device and
+// returns how many were closed.
+func (r *SessionRegistry) disconnectDevice(deviceID string, code int, reason string) int {
+	n := 0
+	for _, s := range r.all() {
+		if s.deviceID() == deviceID {
+			s.disconnect(code, reason)
+			n++
+		}
+	}
+	return n
+}
+
+// drain asks every device to reconnect elsewhere and waits for their
+// receive loops to finish the reading in flight. Sessions still open when
+// ctx expires are cancelled.
+func (r *SessionRegistry) drain(ctx context.Context) {
+	r.mu.Lock()
+	r.closing = true
+	r.mu.Unlock()
+
+	for _, s := range r.all() {
+		closeConn(s.conn, websocket.CloseServiceRestart, "reconnect elsewhere")
+	}
+	done := make(chan struct{})
+	go func() {
+		r.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+	}
+	for _, s := range r.all() {
+		s.cancel()
+	}
+	<-done
+}
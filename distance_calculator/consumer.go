@@ -11,6 +11,26 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// device clocks further ahead of the receiver than this are not trusted
+	maxClockSkew = 5 * time.Minute
+	// longest wait between attempts to aggregate a distance
+	maxRetryWait = 30 * time.Second
+)
+
+// eventTime bills a reading at the time the device captured it, falling
+// back to the receive time for devices without a (sane) clock.
+func eventTime(data types.OBUData) int64 {
+	received := data.ReceivedAt
+	if received == 0 {
+		received = time.Now().UnixNano()
+	}
+	if data.CapturedAt == 0 || data.CapturedAt > received+int64(maxClockSkew) {
+		return received
+	}
+	return data.CapturedAt
+}
+
 // This can also be called kafka transport
 type KafkaConsumer struct {
 	consumer    *kafka.Consumer
@@ -68,12 +88,18 @@ func (c *KafkaConsumer) readMessageLoop() {
 			logrus.Errorf("calc service error %s", err)
 		}
 		req := &types.AggregateRequest{
-			Value:     dist,
-			ObuID:     int64(data.OBUID),
-			Unix:      time.Now().UnixNano(),
-			RequestID: data.RequestID,
+			Value:      dist,
+			ObuID:      int64(data.OBUID),
+			Unix:       eventTime(data),
+			RequestID:  data.RequestID,
+			ReceivedAt: data.ReceivedAt,
+			PrevLat:    data.PrevLat,
+			PrevLong:   data.PrevLong,
+			CurrLat:    data.CurrLat,
+			CurrLong:   data.CurrLong,
+			Blocked:    data.Blocked,
 		}
-		err = c.aggClient.Aggregate(context.Background(), req)
+		err = c.aggregate(req)
 		if err != nil {
 			logrus.Errorf("aggregate client failure: %v", err)
 			continue
@@ -81,3 +107,22 @@ func (c *KafkaConsumer) readMessageLoop() {
 
 	}
 }
+
+// aggregate sends a distance until the aggregator takes it or rejects it
+// for good, waiting a little longer after every attempt.
+func (c *KafkaConsumer) aggregate(req *types.AggregateRequest) error {
+	wait := 100 * time.Millisecond
+	for {
+		err := c.aggClient.Aggregate(context.Background(), req)
+		if err == nil || !client.Retryable(err) || !c.isRunning {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"obuID": req.ObuID,
+			"wait":  wait,
+			"error": err,
+		}).Warn("aggregator unavailable, retrying")
+		time.Sleep(wait)
+		wait = min(wait*2, maxRetryWait)
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
 
+	"github.com/joho/godotenv"
 	"github.com/shamssahal/toll-calculator/aggregator/client"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
 )
 
 const (
@@ -18,18 +21,37 @@ func main() {
 		err           error
 		svc           CalculatorServicer
 		kafkaConsumer *KafkaConsumer
+		aggClient     client.Client
 	)
 	svc = NewCalculatorService()
 	svc = NewLogMiddleware(svc)
 	// httpClient := client.NewHTTPClient(aggregatorEndpoint)
-	grpcClient, err := client.NewGRPCClient(grpcAggregatorEndpoint)
-	if err != nil {
-		log.Fatal(err)
+	// a sharded cluster gets every distance at the shard owning its OBU
+	if v := os.Getenv("CALC_AGG_SHARDS"); v != "" {
+		shards, err := client.ParseShards(v)
+		if err != nil {
+			log.Fatalf("invalid CALC_AGG_SHARDS: %v", err)
+		}
+		aggClient, err = client.NewShardedGRPCClient(shards, tlsconfig.FromEnv("CALC_AGG"))
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		aggClient, err = client.NewGRPCClientWithTLS(grpcAggregatorEndpoint, tlsconfig.FromEnv("CALC_AGG"))
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	kafkaConsumer, err = NewKafkaConsumer(kafkaTopic, svc, grpcClient)
+	kafkaConsumer, err = NewKafkaConsumer(kafkaTopic, svc, aggClient)
 	if err != nil {
 		log.Fatal(err)
 	}
 	kafkaConsumer.Start()
 	fmt.Println("Distance Calcultor service")
 }
+
+func init() {
+	if err := godotenv.Load(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,87 @@
+package export
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+var csvHeader = []string{
+	"reference", "account_id", "period_from", "period_to",
+	"obu_id", "plate", "class", "distance", "price_per_km", "subtotal", "adjustments", "amount",
+	"currency", "invoice_tax", "invoice_total", "error",
+}
+
+// CSVWriter writes one row per invoice line, the header only once so that
+// bulk exports can append many invoices.
+type CSVWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	return &CSVWriter{w: csv.NewWriter(w)}
+}
+
+func (c *CSVWriter) writeHeader() error {
+	if c.header {
+		return nil
+	}
+	c.header = true
+	return c.w.Write(csvHeader)
+}
+
+func (c *CSVWriter) Write(doc Document) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	var from, to string
+	if doc.Period != nil {
+		from = doc.Period.From.Format(time.RFC3339)
+		to = doc.Period.To.Format(time.RFC3339)
+	}
+	tax := doc.TotalAmount
+	tax.Units -= doc.NetAmount.Units
+	for _, l := range doc.Lines {
+		if err := c.w.Write([]string{
+			doc.Reference, doc.AccountID, from, to,
+			strconv.Itoa(l.OBUID), l.Plate, l.Class,
+			formatDistance(l.Distance), formatPrice(l.PricePerKm), formatAmount(l.Subtotal),
+			formatAdjustments(l.Adjustments), formatAmount(l.Amount),
+			doc.TotalAmount.Currency, formatAmount(tax), formatAmount(doc.TotalAmount), "",
+		}); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// WriteError writes a row that only holds the account and the error, for
+// an invoice of a bulk export that could not be fetched.
+func (c *CSVWriter) WriteError(accountID string, err error) error {
+	if err := c.writeHeader(); err != nil {
+		return err
+	}
+	row := make([]string, len(csvHeader))
+	row[1] = accountID
+	row[len(row)-1] = err.Error()
+	if err := c.w.Write(row); err != nil {
+		return err
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// formatAdjustments lists adjustments as "rule:amount" separated by ";".
+func formatAdjustments(adjustments []types.Adjustment) string {
+	parts := make([]string, len(adjustments))
+	for i, a := range adjustments {
+		parts[i] = a.Rule + ":" + formatAmount(a.Amount)
+	}
+	return strings.Join(parts, ";")
+}
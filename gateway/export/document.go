@@ -0,0 +1,138 @@
+// Package export renders invoices for finance: CSV line items, printable
+// PDFs with the operator's branding and JSON Lines for bulk exports.
+package export
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// Document is the printable form shared by OBU and account invoices.
+type Document struct {
+	Title     string
+	Reference string
+	Issued    time.Time
+	// nil for OBU invoices, which cover everything driven so far
+	Period    *types.Period
+	AccountID string
+	// account name followed by the billing address lines
+	BillTo []string
+	Lines  []Line
+
+	TotalDistance float64
+	// before taxes
+	NetAmount   types.Money
+	Taxes       []types.TaxLine
+	TotalAmount types.Money
+}
+
+// Line is one vehicle on the invoice.
+type Line struct {
+	OBUID      int
+	Plate      string
+	Class      string
+	Distance   float64
+	PricePerKm float64
+	// before adjustments
+	Subtotal    types.Money
+	Adjustments []types.Adjustment
+	Amount      types.Money
+}
+
+func FromInvoice(inv *types.Invoice) Document {
+	return Document{
+		Title:     "Toll invoice",
+		Reference: fmt.Sprintf("OBU-%d", inv.OBUID),
+		Issued:    time.Now().UTC(),
+		AccountID: inv.AccountID,
+		Lines: []Line{{
+			OBUID:       inv.OBUID,
+			Plate:       inv.Plate,
+			Class:       inv.Class,
+			Distance:    inv.TotalDistance,
+			PricePerKm:  inv.PricePerKm,
+			Subtotal:    inv.Subtotal,
+			Adjustments: inv.Adjustments,
+			Amount:      inv.NetAmount,
+		}},
+		TotalDistance: inv.TotalDistance,
+		NetAmount:     inv.NetAmount,
+		Taxes:         inv.Taxes,
+		TotalAmount:   inv.TotalAmount,
+	}
+}
+
+func FromAccountInvoice(inv *types.AccountInvoice) Document {
+	period := inv.Period
+	doc := Document{
+		Title:         "Account invoice",
+		Reference:     fmt.Sprintf("%s-%s", inv.Account.ID, period.From.Format("20060102")),
+		Issued:        time.Now().UTC(),
+		Period:        &period,
+		AccountID:     inv.Account.ID,
+		TotalDistance: inv.TotalDistance,
+		NetAmount:     inv.NetAmount,
+		Taxes:         inv.Taxes,
+		TotalAmount:   inv.TotalAmount,
+	}
+	addr := inv.Account.BillingAddress
+	for _, line := range []string{
+		inv.Account.Name,
+		addr.Line1,
+		addr.Line2,
+		joinNonEmpty(" ", addr.PostalCode, addr.City),
+		addr.Country,
+	} {
+		if line != "" {
+			doc.BillTo = append(doc.BillTo, line)
+		}
+	}
+	for _, v := range inv.Vehicles {
+		doc.Lines = append(doc.Lines, Line{
+			OBUID:       v.OBUID,
+			Plate:       v.Plate,
+			Class:       v.Class,
+			Distance:    v.Distance,
+			PricePerKm:  v.PricePerKm,
+			Subtotal:    v.Subtotal,
+			Adjustments: v.Adjustments,
+			Amount:      v.Amount,
+		})
+	}
+	return doc
+}
+
+func joinNonEmpty(sep string, parts ...string) string {
+	var s string
+	for _, p := range parts {
+		if p == "" {
+			continue
+		}
+		if s != "" {
+			s += sep
+		}
+		s += p
+	}
+	return s
+}
+
+func formatAmount(m types.Money) string {
+	return m.Decimal()
+}
+
+// formatPrice shows at least cents and up to four decimals, prices
+// converted from another currency have more than two.
+func formatPrice(v float64) string {
+	s := strings.TrimRight(fmt.Sprintf("%.4f", v), "0")
+	if i := strings.IndexByte(s, '.'); len(s)-i < 3 {
+		s += strings.Repeat("0", 3-(len(s)-i))
+	}
+	return s
+}
+
+func formatDistance(v float64) string {
+	return fmt.Sprintf("%.3f", v)
+}
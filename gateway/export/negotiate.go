@@ -0,0 +1,89 @@
+package export
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	ContentJSON  = "application/json"
+	ContentJSONL = "application/x-ndjson"
+	ContentCSV   = "text/csv"
+	ContentPDF   = "application/pdf"
+)
+
+// formats lets browsers and scripts pick a format with ?format= instead of
+// an Accept header.
+var formats = map[string]string{
+	"json":  ContentJSON,
+	"jsonl": ContentJSONL,
+	"csv":   ContentCSV,
+	"pdf":   ContentPDF,
+}
+
+// Negotiate picks the offered content type the client prefers, honouring
+// the format query parameter first and then the Accept q-values. Ties go to
+// the earlier offer, a missing Accept header selects the first one. It
+// returns "" when none of the offers is acceptable.
+func Negotiate(r *http.Request, offers ...string) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		for _, offer := range offers {
+			if formats[f] == offer {
+				return offer
+			}
+		}
+		return ""
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return offers[0]
+	}
+	var (
+		best  string
+		bestQ float64
+	)
+	for _, offer := range offers {
+		if q := quality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// quality returns the q-value of the most specific Accept range matching
+// the content type.
+func quality(accept, contentType string) float64 {
+	var (
+		q           float64
+		specificity = -1
+	)
+	typ, _, _ := strings.Cut(contentType, "/")
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+		spec := -1
+		switch {
+		case mediaRange == contentType:
+			spec = 2
+		case mediaRange == typ+"/*":
+			spec = 1
+		case mediaRange == "*/*":
+			spec = 0
+		}
+		if spec <= specificity {
+			continue
+		}
+		rangeQ := 1.0
+		for _, param := range fields[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if k == "q" {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					rangeQ = f
+				}
+			}
+		}
+		q, specificity = rangeQ, spec
+	}
+	return q
+}
@@ -0,0 +1,342 @@
+package export
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultBrandName  = "Toll Calculator"
+	defaultBrandColor = "#1f4e79"
+	defaultFooter     = "Invoice {{.Reference}} - please quote the reference with your payment."
+
+	// A4 in points
+	pageWidth  = 595.0
+	pageHeight = 842.0
+	margin     = 40.0
+	rowHeight  = 16.0
+	// rows stop above the footer
+	bottomLimit = 90.0
+)
+
+// Branding is the operator identity printed on every page.
+type Branding struct {
+	Name    string
+	Address []string
+	// r, g, b in [0, 1]
+	color  [3]float64
+	footer *template.Template
+}
+
+// NewBranding parses the footer as a text/template executed with the
+// Document and the color as #rrggbb. Empty values fall back to defaults.
+func NewBranding(name string, address []string, footer, color string) (Branding, error) {
+	if name == "" {
+		name = defaultBrandName
+	}
+	if footer == "" {
+		footer = defaultFooter
+	}
+	if color == "" {
+		color = defaultBrandColor
+	}
+	b := Branding{Name: name, Address: address}
+	tmpl, err := template.New("footer").Parse(footer)
+	if err != nil {
+		return b, fmt.Errorf("invalid footer template: %w", err)
+	}
+	b.footer = tmpl
+	hex := strings.TrimPrefix(color, "#")
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return b, fmt.Errorf("invalid color %q, expected #rrggbb", color)
+	}
+	b.color = [3]float64{
+		float64(rgb>>16&0xff) / 255,
+		float64(rgb>>8&0xff) / 255,
+		float64(rgb&0xff) / 255,
+	}
+	return b, nil
+}
+
+// BrandingFromEnv reads GATEWAY_BRAND_NAME, GATEWAY_BRAND_ADDRESS (lines
+// separated by ";"), GATEWAY_BRAND_FOOTER and GATEWAY_BRAND_COLOR.
+func BrandingFromEnv() (Branding, error) {
+	var address []string
+	for _, line := range strings.Split(os.Getenv("GATEWAY_BRAND_ADDRESS"), ";") {
+		if line = strings.TrimSpace(line); line != "" {
+			address = append(address, line)
+		}
+	}
+	return NewBranding(
+		os.Getenv("GATEWAY_BRAND_NAME"),
+		address,
+		os.Getenv("GATEWAY_BRAND_FOOTER"),
+		os.Getenv("GATEWAY_BRAND_COLOR"),
+	)
+}
+
+type column struct {
+	title string
+	x     float64
+	// right aligned columns end at x
+	right bool
+}
+
+var columns = []column{
+	{title: "OBU", x: margin},
+	{title: "Plate", x: 170},
+	{title: "Class", x: 260},
+	{title: "Distance (km)", x: 410, right: true},
+	{title: "Price / km", x: 480, right: true},
+	{title: "Amount", x: pageWidth - margin, right: true},
+}
+
+// WritePDF renders the document as a PDF with the standard Helvetica fonts,
+// breaking the line items over as many pages as needed.
+func WritePDF(w io.Writer, doc Document, b Branding) error {
+	if b.footer == nil {
+		var err error
+		if b, err = NewBranding(b.Name, b.Address, "", ""); err != nil {
+			return err
+		}
+	}
+	var footer bytes.Buffer
+	if err := b.footer.Execute(&footer, doc); err != nil {
+		return err
+	}
+
+	var (
+		pages []*pdfPage
+		page  *pdfPage
+		y     float64
+	)
+	newPage := func() {
+		page = &pdfPage{}
+		pages = append(pages, page)
+		page.header(b)
+		y = pageHeight - 110
+	}
+	newPage()
+
+	page.text(fontBold, 16, margin, y, doc.Title)
+	meta := []string{
+		"Reference: " + doc.Reference,
+		"Issued: " + doc.Issued.Format("2006-01-02"),
+	}
+	if doc.Period != nil {
+		meta = append(meta, fmt.Sprintf("Period: %s to %s",
+			doc.Period.From.Format("2006-01-02 15:04"), doc.Period.To.Format("2006-01-02 15:04")))
+	}
+	for i, line := range meta {
+		page.textRight(fontRegular, 9, pageWidth-margin, y-float64(i)*12, line)
+	}
+	y -= 30
+	if len(doc.BillTo) > 0 {
+		page.text(fontBold, 10, margin, y, "Bill to")
+		for _, line := range doc.BillTo {
+			y -= 13
+			page.text(fontRegular, 10, margin, y, line)
+		}
+		y -= 10
+	}
+	y = min(y, pageHeight-110-float64(len(meta))*12) - 20
+
+	tableHeader := func() {
+		for _, c := range columns {
+			if c.right {
+				page.textRight(fontBold, 9, c.x, y, c.title)
+			} else {
+				page.text(fontBold, 9, c.x, y, c.title)
+			}
+		}
+		y -= 6
+		page.line(margin, y, pageWidth-margin, y)
+		y -= rowHeight - 4
+	}
+	tableHeader()
+	for _, l := range doc.Lines {
+		if y < bottomLimit {
+			newPage()
+			tableHeader()
+		}
+		cells := []string{
+			strconv.Itoa(l.OBUID), l.Plate, l.Class,
+			formatDistance(l.Distance), formatPrice(l.PricePerKm), formatAmount(l.Subtotal),
+		}
+		for i, c := range columns {
+			if c.right {
+				page.textRight(fontRegular, 9, c.x, y, cells[i])
+			} else {
+				page.text(fontRegular, 9, c.x, y, cells[i])
+			}
+		}
+		y -= rowHeight
+		// adjustments are listed under their line with the reason
+		for _, a := range l.Adjustments {
+			if y < bottomLimit {
+				newPage()
+				tableHeader()
+			}
+			page.text(fontRegular, 8, columns[1].x, y+3, a.Reason)
+			page.textRight(fontRegular, 8, columns[5].x, y+3, formatAmount(a.Amount))
+			y -= rowHeight - 4
+		}
+	}
+	if y < bottomLimit+30+float64(len(doc.Taxes))*rowHeight {
+		newPage()
+	}
+	page.line(margin, y+rowHeight-6, pageWidth-margin, y+rowHeight-6)
+	y -= 4
+	page.text(fontRegular, 10, margin, y, "Net")
+	page.textRight(fontRegular, 10, columns[3].x, y, formatDistance(doc.TotalDistance))
+	page.textRight(fontRegular, 10, columns[5].x, y, formatAmount(doc.NetAmount))
+	for _, t := range doc.Taxes {
+		y -= rowHeight
+		page.text(fontRegular, 10, margin, y, fmt.Sprintf("%s %s%% of %s", t.Name, t.Rate, formatAmount(t.Base)))
+		page.textRight(fontRegular, 10, columns[5].x, y, formatAmount(t.Amount))
+	}
+	y -= rowHeight + 2
+	page.text(fontBold, 10, margin, y, "Total due ("+doc.TotalAmount.Currency+")")
+	page.textRight(fontBold, 10, columns[5].x, y, formatAmount(doc.TotalAmount))
+
+	for i, p := range pages {
+		p.text(fontRegular, 8, margin, 40, footer.String())
+		p.textRight(fontRegular, 8, pageWidth-margin, 40, fmt.Sprintf("Page %d of %d", i+1, len(pages)))
+	}
+	return writePDFFile(w, pages)
+}
+
+const (
+	fontRegular = "F1"
+	fontBold    = "F2"
+)
+
+// pdfPage collects the content stream operators of one page.
+type pdfPage struct {
+	buf bytes.Buffer
+}
+
+func (p *pdfPage) header(b Branding) {
+	fmt.Fprintf(&p.buf, "%.3f %.3f %.3f rg 0 %.2f %.2f 80 re f\n",
+		b.color[0], b.color[1], b.color[2], pageHeight-80, pageWidth)
+	p.buf.WriteString("1 g\n")
+	p.text(fontBold, 18, margin, pageHeight-38, b.Name)
+	for i, line := range b.Address {
+		if i == 3 {
+			break
+		}
+		p.text(fontRegular, 8, margin, pageHeight-52-float64(i)*9, line)
+	}
+	p.buf.WriteString("0 g\n")
+}
+
+func (p *pdfPage) text(font string, size, x, y float64, s string) {
+	fmt.Fprintf(&p.buf, "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, escapePDF(s))
+}
+
+func (p *pdfPage) textRight(font string, size, x, y float64, s string) {
+	width := textWidth(s, size)
+	if font == fontBold {
+		width *= 1.08
+	}
+	p.text(font, size, x-width, y, s)
+}
+
+func (p *pdfPage) line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(&p.buf, "0.6 G 0.5 w %.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+// textWidth approximates the Helvetica advance widths, exact for the digits
+// and punctuation of the right aligned number columns.
+func textWidth(s string, size float64) float64 {
+	var units float64
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			units += 556
+		case r == '.' || r == ',' || r == ' ' || r == '/':
+			units += 278
+		case r == '-' || r == '(' || r == ')':
+			units += 333
+		case r == 'i' || r == 'j' || r == 'l':
+			units += 222
+		case r == 'f' || r == 't':
+			units += 278
+		case r == 'r':
+			units += 333
+		case r == 'm':
+			units += 833
+		case r == 'w' || r >= 'A' && r <= 'Z':
+			units += 700
+		default:
+			units += 556
+		}
+	}
+	return units * size / 1000
+}
+
+// escapePDF escapes a string literal and maps it to WinAnsiEncoding,
+// replacing characters outside of Latin-1.
+func escapePDF(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32:
+			b.WriteByte(' ')
+		case r < 128:
+			b.WriteRune(r)
+		case r < 256:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// writePDFFile lays out the objects: 1 catalog, 2 page tree, 3 and 4 the
+// fonts, then a page and its content stream per page.
+func writePDFFile(w io.Writer, pages []*pdfPage) error {
+	var (
+		buf     bytes.Buffer
+		offsets []int
+	)
+	object := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, p := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.buf.Len(), p.buf.String()))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := buf.WriteTo(w)
+	return err
+}
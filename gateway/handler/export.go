@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/shamssahal/toll-calculator/aggregator/client"
+	"github.com/shamssahal/toll-calculator/gateway/export"
+	"github.com/shamssahal/toll-calculator/gateway/utils"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+type ExportHandler struct {
+	client client.InvoiceClient
+}
+
+func NewExportHandler(c client.InvoiceClient) *ExportHandler {
+	return &ExportHandler{
+		client: c,
+	}
+}
+
+// exportError takes the place of an invoice that could not be fetched, the
+// status is long sent by then. CSV exports get a row with the error column
+// set instead.
+type exportError struct {
+	AccountID string `json:"accountId"`
+	Error     string `json:"error"`
+}
+
+// HandleExportInvoices streams the account invoices of a period as JSON
+// Lines or CSV, flushing each invoice as soon as the aggregator returns it.
+func (h *ExportHandler) HandleExportInvoices(w http.ResponseWriter, r *http.Request) error {
+	period, err := types.ParsePeriod(r.URL.Query())
+	if err != nil {
+		return utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	contentType := export.Negotiate(r, export.ContentJSONL, export.ContentCSV)
+	if contentType == "" {
+		return utils.WriteJSON(w, http.StatusNotAcceptable,
+			map[string]string{"error": "bulk exports are available as application/x-ndjson and text/csv"})
+	}
+	accounts, err := h.client.Accounts(r.Context())
+	if err != nil {
+		return utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list accounts"})
+	}
+
+	ext := "jsonl"
+	if contentType == export.ContentCSV {
+		ext = "csv"
+	}
+	setAttachment(w, contentType, fmt.Sprintf("invoices-%s-%s.%s",
+		period.From.Format("20060102"), period.To.Format("20060102"), ext))
+	w.WriteHeader(http.StatusOK)
+
+	var (
+		rc    = http.NewResponseController(w)
+		enc   = json.NewEncoder(w)
+		csvw  = export.NewCSVWriter(w)
+		count int
+	)
+	for _, account := range accounts {
+		if r.Context().Err() != nil {
+			return r.Context().Err()
+		}
+		invoice, err := h.client.AccountInvoice(r.Context(), account.ID, period)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"accountId": account.ID,
+				"error":     err,
+			}).Error("bulk export: failed to fetch account invoice")
+			if contentType == export.ContentCSV {
+				err = csvw.WriteError(account.ID, err)
+			} else {
+				err = enc.Encode(exportError{AccountID: account.ID, Error: err.Error()})
+			}
+			if err != nil {
+				return nil
+			}
+			rc.Flush()
+			continue
+		}
+		if contentType == export.ContentCSV {
+			err = csvw.Write(export.FromAccountInvoice(invoice))
+		} else {
+			err = enc.Encode(invoice)
+		}
+		if err != nil {
+			// the client went away
+			return nil
+		}
+		rc.Flush()
+		count++
+	}
+	logrus.WithFields(logrus.Fields{
+		"invoices": count,
+		"accounts": len(accounts),
+	}).Info("bulk export complete")
+	return nil
+}
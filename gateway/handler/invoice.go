@@ -1,23 +1,52 @@
 package handler
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/shamssahal/toll-calculator/aggregator/client"
+	"github.com/shamssahal/toll-calculator/gateway/export"
 	"github.com/shamssahal/toll-calculator/gateway/utils"
+	"github.com/shamssahal/toll-calculator/types"
 )
 
 type InvoiceHandler struct {
-	client *client.HTTPClient
+	client   client.InvoiceClient
+	branding export.Branding
 }
 
-func NewInvoiceHandler(c *client.HTTPClient) *InvoiceHandler {
+func NewInvoiceHandler(c client.InvoiceClient, branding export.Branding) *InvoiceHandler {
 	return &InvoiceHandler{
-		client: c,
+		client:   c,
+		branding: branding,
 	}
 }
 
+// render writes v as JSON or the document as CSV or PDF, whichever the
+// client accepts.
+func (h *InvoiceHandler) render(w http.ResponseWriter, r *http.Request, v any, doc export.Document) error {
+	switch export.Negotiate(r, export.ContentJSON, export.ContentCSV, export.ContentPDF) {
+	case export.ContentJSON:
+		return utils.WriteJSON(w, http.StatusOK, v)
+	case export.ContentCSV:
+		setAttachment(w, export.ContentCSV, doc.Reference+".csv")
+		return export.NewCSVWriter(w).Write(doc)
+	case export.ContentPDF:
+		setAttachment(w, export.ContentPDF, doc.Reference+".pdf")
+		return export.WritePDF(w, doc, h.branding)
+	default:
+		return utils.WriteJSON(w, http.StatusNotAcceptable,
+			map[string]string{"error": "invoices are available as application/json, text/csv and application/pdf"})
+	}
+}
+
+func setAttachment(w http.ResponseWriter, contentType, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+}
+
 func (h *InvoiceHandler) HandleGetInvoice(w http.ResponseWriter, r *http.Request) error {
 	id := r.URL.Query().Get("id")
 	_, err := strconv.Atoi(id)
@@ -29,5 +58,36 @@ func (h *InvoiceHandler) HandleGetInvoice(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		return utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch invoice data"})
 	}
-	return utils.WriteJSON(w, http.StatusOK, invoiceData)
+	return h.render(w, r, invoiceData, export.FromInvoice(invoiceData))
+}
+
+func (h *InvoiceHandler) HandleGetSeries(w http.ResponseWriter, r *http.Request) error {
+	q, err := types.ParseSeriesQuery(r.URL.Query())
+	if err != nil {
+		return utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	series, err := h.client.Series(r.Context(), q)
+	if err != nil {
+		return utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch distance series"})
+	}
+	return utils.WriteJSON(w, http.StatusOK, series)
+}
+
+func (h *InvoiceHandler) HandleGetAccountInvoice(w http.ResponseWriter, r *http.Request) error {
+	accountID := r.URL.Query().Get("id")
+	if accountID == "" {
+		return utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "missing 'id' query parameter"})
+	}
+	period, err := types.ParsePeriod(r.URL.Query())
+	if err != nil {
+		return utils.WriteJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	invoice, err := h.client.AccountInvoice(r.Context(), accountID, period)
+	if errors.Is(err, client.ErrNotFound) {
+		return utils.WriteJSON(w, http.StatusNotFound, map[string]string{"error": "account not found"})
+	}
+	if err != nil {
+		return utils.WriteJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to fetch account invoice"})
+	}
+	return h.render(w, r, invoice, export.FromAccountInvoice(invoice))
 }
@@ -15,8 +15,10 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/shamssahal/toll-calculator/aggregator/client"
 	"github.com/shamssahal/toll-calculator/gateway/config"
+	"github.com/shamssahal/toll-calculator/gateway/export"
 	"github.com/shamssahal/toll-calculator/gateway/handler"
 	"github.com/shamssahal/toll-calculator/gateway/utils"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
 	"github.com/sirupsen/logrus"
 )
 
@@ -25,13 +27,21 @@ func main() {
 	defer cancel()
 
 	var (
-		httpListenAddr   = flag.String("httpListenAddr", ":8000", "specify port for the API Gateway")
-		readTimeout      = 5 * time.Second
-		mux              = http.NewServeMux()
-		aggregatorClient = &client.HTTPClient{Endpoint: config.AggregatorService}
-		invoiceHandler   = handler.NewInvoiceHandler(aggregatorClient)
+		httpListenAddr = flag.String("httpListenAddr", ":8000", "specify port for the API Gateway")
+		readTimeout    = 5 * time.Second
+		mux            = http.NewServeMux()
 	)
 	flag.Parse()
+	aggregatorClient, err := makeAggregatorClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	branding, err := export.BrandingFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	invoiceHandler := handler.NewInvoiceHandler(aggregatorClient, branding)
+	exportHandler := handler.NewExportHandler(aggregatorClient)
 	srv := &http.Server{
 		Addr:        *httpListenAddr,
 		Handler:     mux,
@@ -39,6 +49,9 @@ func main() {
 	}
 
 	mux.HandleFunc("GET /invoice", utils.MakeAPIHandler(invoiceHandler.HandleGetInvoice))
+	mux.HandleFunc("GET /invoice/series", utils.MakeAPIHandler(invoiceHandler.HandleGetSeries))
+	mux.HandleFunc("GET /invoice/account", utils.MakeAPIHandler(invoiceHandler.HandleGetAccountInvoice))
+	mux.HandleFunc("GET /export/invoices", utils.MakeAPIHandler(exportHandler.HandleExportInvoices))
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -46,7 +59,7 @@ func main() {
 	defer close(srvErrCh)
 	go func() {
 		fmt.Printf("Starting api gateway on port %s\n", *httpListenAddr)
-		srvErrCh <- srv.ListenAndServe()
+		srvErrCh <- tlsconfig.ListenAndServe(srv, tlsconfig.FromEnv("GATEWAY"))
 	}()
 
 	select {
@@ -60,6 +73,22 @@ func main() {
 	gracefulShutdown(ctx, readTimeout, srv)
 }
 
+// makeAggregatorClient routes every call to the shard owning its OBU when
+// the aggregator is sharded, GATEWAY_AGG_SHARDS holds the name=endpoint
+// pairs of the shards then and replaces AGG_SERVICE_ENDPOINT.
+func makeAggregatorClient() (client.InvoiceClient, error) {
+	tlsCfg := tlsconfig.FromEnv("GATEWAY_AGG")
+	v := os.Getenv("GATEWAY_AGG_SHARDS")
+	if v == "" {
+		return client.NewHTTPClientWithTLS(config.AggregatorService, tlsCfg)
+	}
+	shards, err := client.ParseShards(v)
+	if err != nil {
+		return nil, err
+	}
+	return client.NewShardedHTTPClient(shards, tlsCfg)
+}
+
 func gracefulShutdown(ctx context.Context, readTimeout time.Duration, srv *http.Server) {
 	ctx, cancel := context.WithTimeout(ctx, readTimeout)
 	defer cancel()
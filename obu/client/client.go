@@ -0,0 +1,292 @@
+// Package client is the reference OBU client. Readings are buffered in a
+// persistent outbox and streamed to the data receiver, which acknowledges
+// every one of them. Unacknowledged readings are sent again, in order, after
+// a reconnect.
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultOutboxSize   = 100_000
+	defaultMinBackoff   = 500 * time.Millisecond
+	defaultMaxBackoff   = 30 * time.Second
+	defaultMaxInFlight  = 256
+	defaultSyncInterval = 100 * time.Millisecond
+	// wait before resending a reading the receiver could not take
+	retryDelay = time.Second
+)
+
+type Config struct {
+	// data receiver websocket endpoint, ws:// or wss://
+	Endpoint string
+	// defaults to websocket.DefaultDialer
+	Dialer *websocket.Dialer
+	// called on every connect so short lived tokens are renewed
+	Header func() http.Header
+	// directory of the persistent outbox, in memory only when empty
+	OutboxDir  string
+	OutboxSize int
+	// how often the outbox is synced to disk, readings pushed since the
+	// last sync are lost on a crash
+	OutboxSyncInterval time.Duration
+	MinBackoff         time.Duration
+	MaxBackoff         time.Duration
+	// readings sent but not yet acknowledged
+	MaxInFlight int
+}
+
+type Client struct {
+	cfg    Config
+	outbox *Outbox
+}
+
+func New(cfg Config) (*Client, error) {
+	if cfg.Dialer == nil {
+		cfg.Dialer = websocket.DefaultDialer
+	}
+	if cfg.OutboxSize <= 0 {
+		cfg.OutboxSize = defaultOutboxSize
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = max(defaultMaxBackoff, cfg.MinBackoff)
+	}
+	if cfg.OutboxSyncInterval <= 0 {
+		cfg.OutboxSyncInterval = defaultSyncInterval
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = defaultMaxInFlight
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("ack", "1")
+	u.RawQuery = q.Encode()
+	cfg.Endpoint = u.String()
+
+	outbox, err := NewOutbox(cfg.OutboxDir, cfg.OutboxSize, cfg.OutboxSyncInterval)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{cfg: cfg, outbox: outbox}, nil
+}
+
+// Send queues a reading for delivery. Readings without a capture time are
+// stamped with the current time, which is kept however late they are sent.
+// It only fails when the outbox is full or cannot be written.
+func (c *Client) Send(data types.OBUData) error {
+	if data.RequestID == "" {
+		data.RequestID = uuid.New().String()
+	}
+	if data.CapturedAt == 0 {
+		data.CapturedAt = time.Now().UnixNano()
+	}
+	return c.outbox.Push(data)
+}
+
+// Pending returns the number of readings not yet acknowledged.
+func (c *Client) Pending() int {
+	return c.outbox.Len()
+}
+
+// Run keeps a connection to the receiver open until ctx is done, backing off
+// exponentially while it is unreachable.
+func (c *Client) Run(ctx context.Context) error {
+	backoff := c.cfg.MinBackoff
+	for {
+		conn, _, err := c.cfg.Dialer.DialContext(ctx, c.cfg.Endpoint, c.header())
+		if err == nil {
+			backoff = c.cfg.MinBackoff
+			logrus.WithField("pending", c.outbox.Len()).Info("connected to data receiver")
+			err = c.stream(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		wait := jitter(backoff)
+		logrus.WithFields(logrus.Fields{
+			"err":     err,
+			"retryIn": wait,
+			"pending": c.outbox.Len(),
+		}).Warn("data receiver unavailable")
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, c.cfg.MaxBackoff)
+	}
+}
+
+func (c *Client) header() http.Header {
+	if c.cfg.Header == nil {
+		return nil
+	}
+	return c.cfg.Header()
+}
+
+// jitter spreads reconnects of many devices between d/2 and d.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// Flush waits until every queued reading has been acknowledged.
+func (c *Client) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for c.outbox.Len() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (c *Client) Close() error {
+	return c.outbox.Close()
+}
+
+// stream sends the outbox over one connection and handles the acks until
+// the connection fails. Every connection starts again from the oldest
+// pending reading.
+func (c *Client) stream(ctx context.Context, conn *websocket.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := &stream{
+		inflight: make(map[string]uint64),
+		wake:     make(chan struct{}, 1),
+		rewind:   -1,
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- c.readAcks(conn, s)
+		cancel()
+	}()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	err := c.writeReadings(ctx, conn, s)
+	cancel()
+	if rerr := <-readErr; err == nil || errors.Is(err, context.Canceled) {
+		err = rerr
+	}
+	return err
+}
+
+type stream struct {
+	mu       sync.Mutex
+	inflight map[string]uint64
+	// oldest sequence number to send again, -1 when nothing needs resending
+	rewind int64
+	wake   chan struct{}
+}
+
+func (s *stream) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) writeReadings(ctx context.Context, conn *websocket.Conn, s *stream) error {
+	var next uint64
+	for {
+		s.mu.Lock()
+		if s.rewind >= 0 {
+			next = min(next, uint64(s.rewind))
+			s.rewind = -1
+		}
+		full := len(s.inflight) >= c.cfg.MaxInFlight
+		s.mu.Unlock()
+
+		var (
+			e  entry
+			ok bool
+		)
+		if !full {
+			e, ok = c.outbox.from(next)
+		}
+		if !ok {
+			select {
+			case <-c.outbox.notify:
+			case <-s.wake:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		next = e.Seq + 1
+
+		s.mu.Lock()
+		_, sent := s.inflight[e.Data.RequestID]
+		if !sent {
+			s.inflight[e.Data.RequestID] = e.Seq
+		}
+		s.mu.Unlock()
+		if sent {
+			continue
+		}
+		if err := conn.WriteJSON(e.Data); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Client) readAcks(conn *websocket.Conn, s *stream) error {
+	for {
+		var ack types.Ack
+		if err := conn.ReadJSON(&ack); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		seq, ok := s.inflight[ack.RequestID]
+		delete(s.inflight, ack.RequestID)
+		s.mu.Unlock()
+		if !ok {
+			continue
+		}
+		switch ack.Status {
+		case types.AckOK, types.AckRejected:
+			if ack.Status == types.AckRejected {
+				logrus.WithFields(logrus.Fields{
+					"requestId": ack.RequestID,
+					"err":       ack.Error,
+				}).Warn("reading rejected by data receiver")
+			}
+			if _, err := c.outbox.Ack(ack.RequestID); err != nil {
+				return err
+			}
+			s.signal()
+		default:
+			// rate limited or not delivered, try again from this reading
+			time.AfterFunc(retryDelay, func() {
+				s.mu.Lock()
+				if s.rewind < 0 || int64(seq) < s.rewind {
+					s.rewind = int64(seq)
+				}
+				s.mu.Unlock()
+				s.signal()
+			})
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/shamssahal/toll-calculator/types"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	outboxFile = "outbox.log"
+	// the log is rewritten once it holds this many acknowledged records,
+	// or fewer when nothing is pending anymore
+	compactAfter     = 10_000
+	compactWhenEmpty = 100
+)
+
+var ErrOutboxFull = errors.New("outbox full")
+
+type entry struct {
+	Seq  uint64        `json:"seq"`
+	Data types.OBUData `json:"data"`
+}
+
+// record is one line of the outbox log, either a buffered reading or the
+// acknowledgement of one.
+type record struct {
+	Seq  uint64         `json:"seq"`
+	Data *types.OBUData `json:"data,omitempty"`
+	Ack  bool           `json:"ack,omitempty"`
+}
+
+// Outbox is a bounded FIFO of readings waiting to be acknowledged by the
+// receiver. With a directory it is backed by an append-only log so buffered
+// readings survive a restart of the device. The log is synced every
+// syncInterval rather than on every write, a crash loses at most the
+// readings pushed in the last interval and resends the ones acked in it.
+type Outbox struct {
+	mu sync.Mutex
+	// pending readings by sequence number and by RequestID
+	entries map[uint64]types.OBUData
+	ids     map[string]uint64
+	// pending sequence numbers in order, acked ones are dropped from the
+	// head as they go and the rest when they make up half of it
+	order   []uint64
+	nextSeq uint64
+	max     int
+	// signalled whenever an entry is pushed
+	notify chan struct{}
+
+	path  string
+	file  *os.File
+	w     *bufio.Writer
+	dirty bool
+	acked int
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewOutbox opens (or creates) the outbox log in dir. An empty dir keeps
+// the outbox in memory only.
+func NewOutbox(dir string, max int, syncInterval time.Duration) (*Outbox, error) {
+	o := &Outbox{
+		entries: make(map[uint64]types.OBUData),
+		ids:     make(map[string]uint64),
+		max:     max,
+		notify:  make(chan struct{}, 1),
+	}
+	if dir == "" {
+		return o, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	o.path = filepath.Join(dir, outboxFile)
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	// start from a compacted log holding only the pending entries
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+	o.done = make(chan struct{})
+	o.wg.Add(1)
+	go o.syncLoop(syncInterval)
+	return o, nil
+}
+
+// load replays the log. A torn last line from a crash mid-write is ignored.
+func (o *Outbox) load() error {
+	f, err := os.Open(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if rec.Ack {
+			o.remove(rec.Seq)
+			continue
+		}
+		if rec.Data != nil {
+			o.add(rec.Seq, *rec.Data)
+		}
+		o.nextSeq = max(o.nextSeq, rec.Seq+1)
+	}
+	return scanner.Err()
+}
+
+func (o *Outbox) add(seq uint64, data types.OBUData) {
+	o.entries[seq] = data
+	o.ids[data.RequestID] = seq
+	o.order = append(o.order, seq)
+}
+
+func (o *Outbox) remove(seq uint64) {
+	data, ok := o.entries[seq]
+	if !ok {
+		return
+	}
+	delete(o.entries, seq)
+	delete(o.ids, data.RequestID)
+	for len(o.order) > 0 {
+		if _, ok := o.entries[o.order[0]]; ok {
+			break
+		}
+		o.order = o.order[1:]
+	}
+	if len(o.order) > 2*len(o.entries)+64 {
+		o.order = slices.DeleteFunc(slices.Clone(o.order), func(seq uint64) bool {
+			_, ok := o.entries[seq]
+			return !ok
+		})
+	}
+}
+
+func (o *Outbox) compact() error {
+	tmp := o.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, seq := range o.order {
+		data, ok := o.entries[seq]
+		if !ok {
+			continue
+		}
+		if err := enc.Encode(record{Seq: seq, Data: &data}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, o.path); err != nil {
+		return err
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file, err = os.OpenFile(o.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	o.w = bufio.NewWriter(o.file)
+	o.dirty = false
+	o.acked = 0
+	return nil
+}
+
+// append buffers rec, it is written and synced by the next sync.
+func (o *Outbox) append(rec record) error {
+	if o.file == nil {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := o.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	o.dirty = true
+	return nil
+}
+
+func (o *Outbox) syncLoop(interval time.Duration) {
+	defer o.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+			if err := o.Sync(); err != nil {
+				logrus.WithField("err", err).Error("failed to sync outbox")
+			}
+		}
+	}
+}
+
+// Sync writes the buffered records and syncs the log. Pushes and acks go
+// on while the file is synced.
+func (o *Outbox) Sync() error {
+	o.mu.Lock()
+	if o.file == nil || !o.dirty {
+		o.mu.Unlock()
+		return nil
+	}
+	if err := o.w.Flush(); err != nil {
+		o.mu.Unlock()
+		return err
+	}
+	o.dirty = false
+	f := o.file
+	o.mu.Unlock()
+	// a compaction in the meantime closed f, it synced its own file
+	if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Push buffers a reading, failing with ErrOutboxFull once max readings are
+// waiting. A reading whose RequestID is already pending is ignored.
+func (o *Outbox) Push(data types.OBUData) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.ids[data.RequestID]; ok {
+		return nil
+	}
+	if o.max > 0 && len(o.entries) >= o.max {
+		return ErrOutboxFull
+	}
+	seq := o.nextSeq
+	if err := o.append(record{Seq: seq, Data: &data}); err != nil {
+		return err
+	}
+	o.nextSeq++
+	o.add(seq, data)
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// from returns the oldest pending entry with a sequence number of at least
+// seq.
+func (o *Outbox) from(seq uint64) (entry, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	i, _ := slices.BinarySearch(o.order, seq)
+	for ; i < len(o.order); i++ {
+		if data, ok := o.entries[o.order[i]]; ok {
+			return entry{Seq: o.order[i], Data: data}, true
+		}
+	}
+	return entry{}, false
+}
+
+// Ack removes the reading with the given request id and reports whether it
+// was pending.
+func (o *Outbox) Ack(requestID string) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	seq, ok := o.ids[requestID]
+	if !ok {
+		return false, nil
+	}
+	if err := o.append(record{Seq: seq, Ack: true}); err != nil {
+		return false, err
+	}
+	o.remove(seq)
+	o.acked++
+	if o.file != nil && (o.acked >= compactAfter || len(o.entries) == 0 && o.acked >= compactWhenEmpty) {
+		return true, o.compact()
+	}
+	return true, nil
+}
+
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+// Close syncs what is buffered and closes the log.
+func (o *Outbox) Close() error {
+	if o.done == nil {
+		return nil
+	}
+	close(o.done)
+	o.wg.Wait()
+	if err := o.Sync(); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.file.Close()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// resolution of the load scheduler
+const loadTick = 10 * time.Millisecond
+
+type loadConfig struct {
+	conns    int
+	rate     float64
+	profile  string
+	rampUp   time.Duration
+	steps    int
+	duration time.Duration
+}
+
+// rateAt returns the target rate elapsed into the run.
+func (c loadConfig) rateAt(elapsed time.Duration) float64 {
+	if c.rampUp <= 0 || elapsed >= c.rampUp {
+		return c.rate
+	}
+	progress := float64(elapsed) / float64(c.rampUp)
+	switch c.profile {
+	case "linear":
+		return c.rate * progress
+	case "step":
+		steps := float64(max(c.steps, 1))
+		return c.rate * math.Ceil(progress*steps) / steps
+	default:
+		return c.rate
+	}
+}
+
+type loadStats struct {
+	mu        sync.Mutex
+	sent      int
+	sendErrs  int
+	statuses  map[string]int
+	latencies []time.Duration
+}
+
+func (s *loadStats) ack(status string, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[status]++
+	s.latencies = append(s.latencies, latency)
+}
+
+// loadConn writes readings from the shared work queue and matches the acks
+// coming back to the time each reading was sent.
+type loadConn struct {
+	conn  *websocket.Conn
+	stats *loadStats
+
+	mu     sync.Mutex
+	sentAt map[string]time.Time
+}
+
+func (c *loadConn) writeLoop(work <-chan types.OBUData, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for data := range work {
+		now := time.Now()
+		data.CapturedAt = now.UnixNano()
+		c.mu.Lock()
+		c.sentAt[data.RequestID] = now
+		c.mu.Unlock()
+		err := c.conn.WriteJSON(data)
+		c.stats.mu.Lock()
+		if err != nil {
+			c.stats.sendErrs++
+		} else {
+			c.stats.sent++
+		}
+		c.stats.mu.Unlock()
+	}
+}
+
+func (c *loadConn) readLoop(done chan<- struct{}) {
+	defer close(done)
+	for {
+		var ack types.Ack
+		if err := c.conn.ReadJSON(&ack); err != nil {
+			return
+		}
+		c.mu.Lock()
+		sent, ok := c.sentAt[ack.RequestID]
+		delete(c.sentAt, ack.RequestID)
+		c.mu.Unlock()
+		if ok {
+			c.stats.ack(ack.Status, time.Since(sent))
+		}
+	}
+}
+
+// runLoadTest drives the receiver at the configured rate profile over
+// several connections and prints throughput and ack latency percentiles.
+func runLoadTest(dial func() (*websocket.Conn, error), vehicles *fleet, cfg loadConfig) {
+	stats := &loadStats{statuses: make(map[string]int)}
+	var (
+		work    = make(chan types.OBUData, cfg.conns)
+		writers sync.WaitGroup
+		conns   []*loadConn
+		readers []chan struct{}
+	)
+	for range max(cfg.conns, 1) {
+		conn, err := dial()
+		if err != nil {
+			log.Fatal(err)
+		}
+		c := &loadConn{conn: conn, stats: stats, sentAt: make(map[string]time.Time)}
+		done := make(chan struct{})
+		writers.Add(1)
+		go c.writeLoop(work, &writers)
+		go c.readLoop(done)
+		conns = append(conns, c)
+		readers = append(readers, done)
+	}
+	log.Printf("Load test: %d vehicles, %d connections, %s profile up to %.0f readings/s for %s",
+		len(vehicles.vehicles), len(conns), cfg.profile, cfg.rate, cfg.duration)
+
+	var (
+		start     = time.Now()
+		ticker    = time.NewTicker(loadTick)
+		allowance float64
+		pending   []types.OBUData
+		lastLog   = start
+	)
+	for now := range ticker.C {
+		elapsed := now.Sub(start)
+		if elapsed >= cfg.duration {
+			break
+		}
+		allowance += cfg.rateAt(elapsed) * loadTick.Seconds()
+		for ; allowance >= 1; allowance-- {
+			if len(pending) == 0 {
+				pending = vehicles.tick(sendInterval)
+				if len(pending) == 0 {
+					break
+				}
+			}
+			work <- pending[0]
+			pending = pending[1:]
+		}
+		if now.Sub(lastLog) >= 5*time.Second {
+			lastLog = now
+			stats.mu.Lock()
+			log.Printf("%s: target %.0f/s, sent %d, acked %d", elapsed.Truncate(time.Second), cfg.rateAt(elapsed), stats.sent, len(stats.latencies))
+			stats.mu.Unlock()
+		}
+	}
+	ticker.Stop()
+	close(work)
+	writers.Wait()
+	sendDone := time.Now()
+
+	// give outstanding acks a moment before closing the connections
+	time.Sleep(2 * time.Second)
+	for _, c := range conns {
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+		c.conn.Close()
+	}
+	for _, done := range readers {
+		<-done
+	}
+	printLoadReport(stats, sendDone.Sub(start))
+}
+
+func printLoadReport(stats *loadStats, elapsed time.Duration) {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	lat := stats.latencies
+	slices.Sort(lat)
+	percentile := func(p float64) time.Duration {
+		if len(lat) == 0 {
+			return 0
+		}
+		return lat[min(len(lat)-1, int(math.Ceil(p/100*float64(len(lat))))-1)]
+	}
+
+	fmt.Println("\n--- load test report ---")
+	fmt.Printf("duration      %s\n", elapsed.Truncate(time.Millisecond))
+	fmt.Printf("sent          %d (%d send errors)\n", stats.sent, stats.sendErrs)
+	fmt.Printf("acked         %d (%d unacknowledged)\n", len(lat), stats.sent-len(lat))
+	for _, status := range []string{types.AckOK, types.AckRejected, types.AckRateLimited, types.AckFailed} {
+		if n := stats.statuses[status]; n > 0 {
+			fmt.Printf("  %-12s%d\n", status, n)
+		}
+	}
+	fmt.Printf("throughput    %.1f sent/s, %.1f acked/s\n",
+		float64(stats.sent)/elapsed.Seconds(), float64(len(lat))/elapsed.Seconds())
+	fmt.Printf("ack latency   p50 %s  p90 %s  p95 %s  p99 %s  max %s\n",
+		percentile(50), percentile(90), percentile(95), percentile(99), percentile(100))
+}
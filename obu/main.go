@@ -1,65 +1,199 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"math"
 	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/shamssahal/toll-calculator/types"
+	"github.com/shamssahal/toll-calculator/data_receiver/auth"
+	"github.com/shamssahal/toll-calculator/obu/client"
+	"github.com/shamssahal/toll-calculator/tlsconfig"
 )
 
-const wsEndpoint = "ws://127.0.0.1:30000/ws"
+const tokenExpiry = 24 * time.Hour
 
 var sendInterval = time.Second
 
-func genCoord() float64 {
-	n := float64(rand.Intn(100) + 1)
-	f := rand.Float64()
-	return n + f
+func generateOBUIDs(rng *rand.Rand, n int) []int {
+	ids := make([]int, n)
+	for i := range n {
+		ids[i] = rng.Intn(math.MaxInt)
+	}
+	return ids
 }
 
-func genLatLong() (float64, float64) {
-	return genCoord(), genCoord()
+func parseOBUIDs(s string) ([]int, error) {
+	var ids []int
+	for _, f := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
 }
 
-func generateOBUIDs(n int) []int {
-	ids := make([]int, n)
-	for i := range n {
-		ids[i] = rand.Intn(math.MaxInt)
+// makeDialer returns the websocket dialer for the receiver and a function
+// building the headers of every new connection, so tokens never go stale.
+func makeDialer(deviceID, deviceSecret string, tlsCfg tlsconfig.Config) (*websocket.Dialer, func() http.Header, error) {
+	dialer := *websocket.DefaultDialer
+	if tlsCfg.ClientEnabled() {
+		cfg, err := tlsCfg.ClientTLS()
+		if err != nil {
+			return nil, nil, err
+		}
+		dialer.TLSClientConfig = cfg
 	}
-	return ids
+	header := func() http.Header {
+		header := http.Header{}
+		if deviceID != "" {
+			token := auth.NewToken(deviceID, deviceSecret, time.Now().Add(tokenExpiry))
+			header.Set("Authorization", "Bearer "+token)
+		}
+		return header
+	}
+	return &dialer, header, nil
 }
 
 func main() {
-	OBUIDs := generateOBUIDs(20)
-	conn, _, err := websocket.DefaultDialer.Dial(wsEndpoint, nil)
+	var (
+		wsEndpoint   = flag.String("endpoint", "ws://127.0.0.1:30000/ws", "data receiver websocket endpoint (ws:// or wss://)")
+		caFile       = flag.String("ca", "", "CA certificate used to verify a wss:// endpoint")
+		certFile     = flag.String("cert", "", "client certificate for mutual TLS")
+		keyFile      = flag.String("key", "", "client key for mutual TLS")
+		deviceID     = flag.String("device", "", "device id registered with the data receiver")
+		deviceSecret = flag.String("secret", "", "device secret used to sign the connection token")
+		obuIDs       = flag.String("obuids", "", "comma separated OBU ids the device reports for (random when empty)")
+		replayFile   = flag.String("replay", "", "replay a recorded trace (jsonl, gpx or csv) instead of generating readings")
+		replayFormat = flag.String("format", "", "trace format, taken from the file extension when empty")
+		replaySpeed  = flag.Float64("speed", 1, "replay speed multiplier, 0 sends as fast as possible")
+		seed         = flag.Int64("seed", time.Now().UnixNano(), "seed for the simulation, reuse it to reproduce a run")
+		routesFile   = flag.String("routes", "", "GeoJSON LineStrings for vehicles to follow (random walk when empty)")
+		gpsNoise     = flag.Float64("noise", 0, "standard deviation of the simulated gps error in meters")
+		dropout      = flag.Float64("dropout", 0, "probability that a reading is lost")
+		stopChance   = flag.Float64("stops", 0.01, "probability per tick that a vehicle stops for a while")
+		loadTest     = flag.Bool("load", false, "run as a load generator and print a latency report")
+		fleetSize    = flag.Int("fleet", 20, "number of simulated vehicles")
+		loadConns    = flag.Int("conns", 1, "load test: number of websocket connections")
+		loadRate     = flag.Float64("rate", 100, "load test: peak readings per second across all connections")
+		loadProfile  = flag.String("profile", "constant", "load test: rate profile, one of constant, linear or step")
+		loadRampUp   = flag.Duration("rampup", 30*time.Second, "load test: time to reach the peak rate for linear and step")
+		loadSteps    = flag.Int("steps", 5, "load test: number of steps for the step profile")
+		loadDuration = flag.Duration("duration", time.Minute, "load test: total duration")
+		outboxDir    = flag.String("outbox", "", "directory buffering unacknowledged readings across restarts (memory only when empty)")
+		outboxSize   = flag.Int("outbox-size", 100_000, "maximum number of buffered readings")
+	)
+	flag.Parse()
+	log.Printf("Simulation seed %d", *seed)
+	rng := rand.New(rand.NewSource(*seed))
+
+	var trace []traceRecord
+	if *replayFile != "" {
+		var err error
+		if trace, err = loadTrace(*replayFile, *replayFormat); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	OBUIDs := generateOBUIDs(rng, *fleetSize)
+	if *obuIDs != "" {
+		ids, err := parseOBUIDs(*obuIDs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		OBUIDs = ids
+	}
+	var routes []route
+	if *routesFile != "" {
+		var err error
+		if routes, err = loadRoutes(*routesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	vehicles := newFleet(OBUIDs, routes, simConfig{
+		noise:      *gpsNoise,
+		dropout:    *dropout,
+		stopChance: *stopChance,
+	}, rng)
+	dialer, header, err := makeDialer(*deviceID, *deviceSecret,
+		tlsconfig.Config{CAFile: *caFile, CertFile: *certFile, KeyFile: *keyFile})
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		for i := range OBUIDs {
-			currLat, currLong := genLatLong()
-			prevLat, prevLong := genLatLong()
-			data := types.OBUData{
-				OBUID:     OBUIDs[i],
-				CurrLat:   currLat,
-				CurrLong:  currLong,
-				PrevLat:   prevLat,
-				PrevLong:  prevLong,
-				RequestID: uuid.New().String(),
-			}
-			if err := conn.WriteJSON(data); err != nil {
-				log.Printf("Failed to send data: %v", err)
-				return // Exit gracefully instead of log.Fatal
+	if *loadTest {
+		dial := func() (*websocket.Conn, error) {
+			u, err := url.Parse(*wsEndpoint)
+			if err != nil {
+				return nil, err
 			}
+			q := u.Query()
+			q.Set("ack", "1")
+			u.RawQuery = q.Encode()
+			conn, _, err := dialer.Dial(u.String(), header())
+			return conn, err
 		}
-		time.Sleep(sendInterval)
+		runLoadTest(dial, vehicles, loadConfig{
+			conns:    *loadConns,
+			rate:     *loadRate,
+			profile:  *loadProfile,
+			rampUp:   *loadRampUp,
+			steps:    *loadSteps,
+			duration: *loadDuration,
+		})
+		return
 	}
-}
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
+	c, err := client.New(client.Config{
+		Endpoint:   *wsEndpoint,
+		Dialer:     dialer,
+		Header:     header,
+		OutboxDir:  *outboxDir,
+		OutboxSize: *outboxSize,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	if n := c.Pending(); n > 0 {
+		log.Printf("Resending %d buffered readings", n)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go c.Run(ctx)
+
+	if trace != nil {
+		if err := replay(c.Send, trace, *replaySpeed); err != nil {
+			log.Printf("Failed to buffer data: %v", err)
+			return
+		}
+		log.Printf("Replayed %d readings from %s, waiting for acknowledgements", len(trace), *replayFile)
+		if err := c.Flush(ctx); err != nil {
+			log.Printf("%d readings left in the outbox", c.Pending())
+		}
+		return
+	}
+	for ctx.Err() == nil {
+		for _, data := range vehicles.tick(sendInterval) {
+			if err := c.Send(data); err != nil {
+				// keep driving, the reading is lost like any other dropout
+				log.Printf("Failed to buffer data: %v", err)
+			}
+		}
+		select {
+		case <-time.After(sendInterval):
+		case <-ctx.Done():
+		}
+	}
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+// traceRecord is one recorded reading and the time it was originally sent.
+// at is zero when the trace carries no timing information.
+type traceRecord struct {
+	at   time.Time
+	data types.OBUData
+}
+
+// loadTrace reads a recorded trace, the format is taken from the file
+// extension unless given explicitly.
+func loadTrace(path, format string) ([]traceRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	var records []traceRecord
+	switch format {
+	case "jsonl", "ndjson", "json":
+		records, err = readJSONLTrace(f)
+	case "gpx":
+		records, err = readGPXTrace(f)
+	case "csv":
+		records, err = readCSVTrace(f)
+	default:
+		return nil, fmt.Errorf("unsupported trace format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// readings without a RequestID get one derived from the trace name and
+	// their position in it, replaying a trace again sends the same ids and
+	// the pipeline counts them once
+	name := filepath.Base(path)
+	for i := range records {
+		if records[i].data.RequestID == "" {
+			records[i].data.RequestID = traceRequestID(name, i+1)
+		}
+	}
+	slices.SortStableFunc(records, func(a, b traceRecord) int {
+		return a.at.Compare(b.at)
+	})
+	return records, nil
+}
+
+// traceRequestID returns the RequestID of the n-th record of a trace.
+func traceRequestID(name string, n int) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(fmt.Sprintf("trace:%s#%d", name, n))).String()
+}
+
+// parseTimestamp accepts RFC3339 strings and unix timestamps in
+// milliseconds.
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if s == "" || s == "null" {
+		return time.Time{}, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// readJSONLTrace reads one types.OBUData per line with an optional
+// "timestamp" field.
+func readJSONLTrace(r io.Reader) ([]traceRecord, error) {
+	var (
+		records []traceRecord
+		scanner = bufio.NewScanner(r)
+	)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		var rec struct {
+			types.OBUData
+			Timestamp json.RawMessage `json:"timestamp"`
+		}
+		if err := json.Unmarshal(b, &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		at, err := parseTimestamp(string(rec.Timestamp))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		records = append(records, traceRecord{at: at, data: rec.OBUData})
+	}
+	return records, scanner.Err()
+}
+
+type gpxFile struct {
+	Tracks []struct {
+		Name     string `xml:"name"`
+		Segments []struct {
+			Points []struct {
+				Lat  float64   `xml:"lat,attr"`
+				Lon  float64   `xml:"lon,attr"`
+				Time time.Time `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// readGPXTrace turns every track into one OBU, named by the track name when
+// it is numeric and numbered from 1 otherwise. Consecutive points of a
+// segment become prev/curr pairs.
+func readGPXTrace(r io.Reader) ([]traceRecord, error) {
+	var gpx gpxFile
+	if err := xml.NewDecoder(r).Decode(&gpx); err != nil {
+		return nil, err
+	}
+	var records []traceRecord
+	for i, trk := range gpx.Tracks {
+		obuID, err := strconv.Atoi(strings.TrimSpace(trk.Name))
+		if err != nil {
+			obuID = i + 1
+		}
+		for _, seg := range trk.Segments {
+			for j := 1; j < len(seg.Points); j++ {
+				prev, curr := seg.Points[j-1], seg.Points[j]
+				records = append(records, traceRecord{
+					at: curr.Time,
+					data: types.OBUData{
+						OBUID:    obuID,
+						CurrLat:  curr.Lat,
+						CurrLong: curr.Lon,
+						PrevLat:  prev.Lat,
+						PrevLong: prev.Lon,
+					},
+				})
+			}
+		}
+	}
+	return records, nil
+}
+
+// readCSVTrace expects a header with at least obuID, lat and long columns
+// and optionally timestamp, prevLat, prevLong and requestId. Without prev
+// columns consecutive rows of the same OBU are paired.
+func readCSVTrace(r io.Reader) ([]traceRecord, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, errors.New("empty csv trace")
+	}
+	cols := make(map[string]int)
+	for i, name := range rows[0] {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"obuid", "lat", "long"} {
+		if _, ok := cols[required]; !ok {
+			return nil, fmt.Errorf("csv trace is missing the %s column", required)
+		}
+	}
+	get := func(row []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	_, hasPrev := cols["prevlat"]
+
+	var (
+		records []traceRecord
+		last    = make(map[int][2]float64)
+	)
+	for n, row := range rows[1:] {
+		line := n + 2
+		obuID, err := strconv.Atoi(get(row, "obuid"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		lat, err := strconv.ParseFloat(get(row, "lat"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		long, err := strconv.ParseFloat(get(row, "long"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		at, err := parseTimestamp(get(row, "timestamp"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		data := types.OBUData{
+			OBUID:     obuID,
+			CurrLat:   lat,
+			CurrLong:  long,
+			RequestID: get(row, "requestid"),
+		}
+		if hasPrev {
+			if data.PrevLat, err = strconv.ParseFloat(get(row, "prevlat"), 64); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			if data.PrevLong, err = strconv.ParseFloat(get(row, "prevlong"), 64); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		} else {
+			prev, ok := last[obuID]
+			last[obuID] = [2]float64{lat, long}
+			if !ok {
+				continue
+			}
+			data.PrevLat, data.PrevLong = prev[0], prev[1]
+		}
+		records = append(records, traceRecord{at: at, data: data})
+	}
+	return records, nil
+}
+
+// replay sends the records preserving the original gaps between them
+// divided by speed. A speed of 0 sends as fast as possible and records
+// without timestamps are sent sendInterval apart. Readings are captured at
+// their recorded time, so they are billed to when they were driven.
+func replay(send func(types.OBUData) error, records []traceRecord, speed float64) error {
+	for i, rec := range records {
+		if i > 0 && speed > 0 {
+			gap := sendInterval
+			if prev := records[i-1].at; !prev.IsZero() && !rec.at.IsZero() {
+				gap = rec.at.Sub(prev)
+			}
+			time.Sleep(time.Duration(float64(gap) / speed))
+		}
+		data := rec.data
+		if data.CapturedAt == 0 && !rec.at.IsZero() {
+			data.CapturedAt = rec.at.UnixNano()
+		}
+		if err := send(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shamssahal/toll-calculator/types"
+)
+
+const (
+	earthRadius  = 6_371_000.0 // meters
+	metersPerDeg = 111_320.0
+
+	// vehicles without a route start around this point
+	defaultCenterLat  = 52.37
+	defaultCenterLong = 4.89
+	defaultSpread     = 0.25 // degrees
+
+	minSpeed = 8.0  // m/s
+	maxSpeed = 33.0 // m/s
+)
+
+type simConfig struct {
+	// standard deviation of the gps error in meters
+	noise float64
+	// probability that a reading is lost
+	dropout float64
+	// probability per tick that a moving vehicle stops
+	stopChance float64
+}
+
+type point struct {
+	lat, long float64
+}
+
+type route []point
+
+// loadRoutes reads LineString and MultiLineString geometries from a GeoJSON
+// FeatureCollection, Feature or bare geometry.
+func loadRoutes(path string) ([]route, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var obj geoJSON
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, err
+	}
+	routes := obj.routes()
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no LineString routes with at least two points in %s", path)
+	}
+	return routes, nil
+}
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+func (g geoJSON) routes() []route {
+	var routes []route
+	switch g.Type {
+	case "FeatureCollection":
+		for _, f := range g.Features {
+			routes = append(routes, f.routes()...)
+		}
+	case "Feature":
+		if g.Geometry != nil {
+			routes = g.Geometry.routes()
+		}
+	case "LineString":
+		var coords [][]float64
+		if json.Unmarshal(g.Coordinates, &coords) == nil {
+			routes = appendRoute(routes, coords)
+		}
+	case "MultiLineString":
+		var lines [][][]float64
+		if json.Unmarshal(g.Coordinates, &lines) == nil {
+			for _, coords := range lines {
+				routes = appendRoute(routes, coords)
+			}
+		}
+	}
+	return routes
+}
+
+// appendRoute converts GeoJSON [long, lat] positions, repeated positions
+// are dropped so every segment has a length.
+func appendRoute(routes []route, coords [][]float64) []route {
+	var r route
+	for _, c := range coords {
+		if len(c) < 2 {
+			continue
+		}
+		p := point{lat: c[1], long: c[0]}
+		if len(r) > 0 && haversine(r[len(r)-1], p) == 0 {
+			continue
+		}
+		r = append(r, p)
+	}
+	if len(r) < 2 {
+		return routes
+	}
+	return append(routes, r)
+}
+
+func toRad(deg float64) float64 { return deg * math.Pi / 180 }
+func toDeg(rad float64) float64 { return rad * 180 / math.Pi }
+
+func haversine(a, b point) float64 {
+	dLat := toRad(b.lat - a.lat)
+	dLong := toRad(b.long - a.long)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.lat))*math.Cos(toRad(b.lat))*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+func bearing(a, b point) float64 {
+	lat1, lat2 := toRad(a.lat), toRad(b.lat)
+	dLong := toRad(b.long - a.long)
+	y := math.Sin(dLong) * math.Cos(lat2)
+	x := math.Cos(lat1)*math.Sin(lat2) - math.Sin(lat1)*math.Cos(lat2)*math.Cos(dLong)
+	return math.Mod(toDeg(math.Atan2(y, x))+360, 360)
+}
+
+// destination moves dist meters from p along the given bearing.
+func destination(p point, bearingDeg, dist float64) point {
+	lat1, long1, brng := toRad(p.lat), toRad(p.long), toRad(bearingDeg)
+	d := dist / earthRadius
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(brng))
+	long2 := long1 + math.Atan2(math.Sin(brng)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+	return point{lat: toDeg(lat2), long: toDeg(long2)}
+}
+
+type vehicle struct {
+	obuID   int
+	pos     point
+	heading float64 // degrees
+	speed   float64 // m/s
+	// speed the vehicle accelerates towards after a stop
+	cruise    float64
+	stopTicks int
+
+	// route following, route is nil for a random walk
+	route   route
+	next    int
+	forward bool
+
+	// the last position reported to the receiver, used as prev so that
+	// consecutive readings always chain up even across dropouts
+	lastSent point
+}
+
+type fleet struct {
+	cfg      simConfig
+	rng      *rand.Rand
+	vehicles []*vehicle
+}
+
+func newFleet(obuIDs []int, routes []route, cfg simConfig, rng *rand.Rand) *fleet {
+	f := &fleet{cfg: cfg, rng: rng}
+	for _, id := range obuIDs {
+		v := &vehicle{
+			obuID:   id,
+			heading: rng.Float64() * 360,
+			cruise:  minSpeed + rng.Float64()*(maxSpeed-minSpeed),
+			forward: true,
+		}
+		v.speed = v.cruise
+		if len(routes) > 0 {
+			v.route = routes[rng.Intn(len(routes))]
+			start := rng.Intn(len(v.route) - 1)
+			v.pos = v.route[start]
+			v.next = start + 1
+			v.heading = bearing(v.pos, v.route[v.next])
+		} else {
+			v.pos = point{
+				lat:  defaultCenterLat + (rng.Float64()*2-1)*defaultSpread,
+				long: defaultCenterLong + (rng.Float64()*2-1)*defaultSpread,
+			}
+		}
+		v.lastSent = v.pos
+		f.vehicles = append(f.vehicles, v)
+	}
+	return f
+}
+
+// tick advances every vehicle by dt and returns the readings that made it
+// through the simulated gps dropouts.
+func (f *fleet) tick(dt time.Duration) []types.OBUData {
+	var readings []types.OBUData
+	for _, v := range f.vehicles {
+		f.move(v, dt.Seconds())
+		if f.rng.Float64() < f.cfg.dropout {
+			continue
+		}
+		curr := f.noisy(v.pos)
+		readings = append(readings, types.OBUData{
+			OBUID:    v.obuID,
+			CurrLat:  curr.lat,
+			CurrLong: curr.long,
+			PrevLat:  v.lastSent.lat,
+			PrevLong: v.lastSent.long,
+			// drawn from the seeded rng so a run can be reproduced exactly
+			RequestID: uuid.Must(uuid.NewRandomFromReader(f.rng)).String(),
+		})
+		v.lastSent = curr
+	}
+	return readings
+}
+
+func (f *fleet) move(v *vehicle, dt float64) {
+	switch {
+	case v.stopTicks > 0:
+		v.stopTicks--
+		v.speed = 0
+		return
+	case f.rng.Float64() < f.cfg.stopChance:
+		// traffic light or congestion, 5 to 60 ticks
+		v.stopTicks = 5 + f.rng.Intn(56)
+		v.speed = 0
+		return
+	}
+	// accelerate back to cruise speed and drift a little around it
+	v.speed = min(v.cruise, v.speed+3*dt) + f.rng.NormFloat64()*0.5
+	v.speed = max(0, min(maxSpeed, v.speed))
+	dist := v.speed * dt
+
+	if v.route == nil {
+		v.heading = math.Mod(v.heading+f.rng.NormFloat64()*10+360, 360)
+		v.pos = destination(v.pos, v.heading, dist)
+		return
+	}
+	// zero length segments are skipped, a route that has nothing but them
+	// leaves the vehicle where it is
+	for empty := 0; dist > 0 && empty < len(v.route); {
+		target := v.route[v.next]
+		left := haversine(v.pos, target)
+		if dist < left {
+			v.heading = bearing(v.pos, target)
+			v.pos = destination(v.pos, v.heading, dist)
+			return
+		}
+		if left == 0 {
+			empty++
+		} else {
+			empty = 0
+		}
+		dist -= left
+		v.pos = target
+		v.advance()
+	}
+}
+
+// advance picks the next route vertex, turning around at either end.
+func (v *vehicle) advance() {
+	if v.forward && v.next == len(v.route)-1 || !v.forward && v.next == 0 {
+		v.forward = !v.forward
+	}
+	if v.forward {
+		v.next++
+	} else {
+		v.next--
+	}
+}
+
+func (f *fleet) noisy(p point) point {
+	if f.cfg.noise <= 0 {
+		return p
+	}
+	return point{
+		lat:  p.lat + f.rng.NormFloat64()*f.cfg.noise/metersPerDeg,
+		long: p.long + f.rng.NormFloat64()*f.cfg.noise/(metersPerDeg*math.Cos(toRad(p.lat))),
+	}
+}
@@ -0,0 +1,26 @@
+#!/bin/sh
+# Generates a throwaway CA plus server and client certificates for local
+# TLS/mTLS testing. Usage: scripts/gencerts.sh [outdir]
+set -e
+
+OUT=${1:-certs}
+mkdir -p "$OUT"
+cd "$OUT"
+
+openssl req -x509 -newkey rsa:2048 -nodes -days 365 \
+	-keyout ca.key -out ca.crt -subj "/CN=toll-calculator-dev-ca"
+
+openssl req -newkey rsa:2048 -nodes \
+	-keyout server.key -out server.csr -subj "/CN=localhost"
+printf "subjectAltName=DNS:localhost,IP:127.0.0.1\nextendedKeyUsage=serverAuth\n" > server.ext
+openssl x509 -req -in server.csr -CA ca.crt -CAkey ca.key -CAcreateserial \
+	-days 365 -out server.crt -extfile server.ext
+
+openssl req -newkey rsa:2048 -nodes \
+	-keyout client.key -out client.csr -subj "/CN=toll-calculator-client"
+printf "extendedKeyUsage=clientAuth\n" > client.ext
+openssl x509 -req -in client.csr -CA ca.crt -CAkey ca.key -CAcreateserial \
+	-days 365 -out client.crt -extfile client.ext
+
+rm -f server.csr server.ext client.csr client.ext ca.srl
+echo "certificates written to $OUT"
@@ -0,0 +1,228 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how often the certificate files are checked for changes
+var reloadInterval = 10 * time.Second
+
+// Config describes the certificate material of one side of a connection.
+// For servers CAFile holds the CA used to verify client certificates, for
+// clients it holds the CA used to verify the server.
+type Config struct {
+	CertFile          string
+	KeyFile           string
+	CAFile            string
+	RequireClientCert bool
+}
+
+// FromEnv reads <prefix>_TLS_CERT, <prefix>_TLS_KEY, <prefix>_TLS_CA and
+// <prefix>_TLS_CLIENT_AUTH.
+func FromEnv(prefix string) Config {
+	requireClientCert, _ := strconv.ParseBool(os.Getenv(prefix + "_TLS_CLIENT_AUTH"))
+	return Config{
+		CertFile:          os.Getenv(prefix + "_TLS_CERT"),
+		KeyFile:           os.Getenv(prefix + "_TLS_KEY"),
+		CAFile:            os.Getenv(prefix + "_TLS_CA"),
+		RequireClientCert: requireClientCert,
+	}
+}
+
+// Enabled reports whether a server should terminate TLS.
+func (c Config) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// ClientEnabled reports whether a client should dial with TLS.
+func (c Config) ClientEnabled() bool {
+	return c.CAFile != "" || c.Enabled()
+}
+
+// ServerTLS builds a server config whose certificate and client CA pool are
+// reloaded from disk when the files change, so rotated certificates are
+// picked up without a restart.
+func (c Config) ServerTLS() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, fmt.Errorf("tls certificate and key must be set")
+	}
+	if c.RequireClientCert && c.CAFile == "" {
+		// without a CA client certificates could not be verified, serving
+		// would silently drop mTLS
+		return nil, fmt.Errorf("tls client auth requires a CA to verify client certificates")
+	}
+	r, err := newReloader(c)
+	if err != nil {
+		return nil, err
+	}
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _, err := r.current()
+			return cert, err
+		},
+	}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		cert, pool, err := r.current()
+		if err != nil {
+			return nil, err
+		}
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.GetCertificate = nil
+		cfg.Certificates = []tls.Certificate{*cert}
+		if pool != nil {
+			cfg.ClientCAs = pool
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			if c.RequireClientCert {
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+		return cfg, nil
+	}
+	return base, nil
+}
+
+// ClientTLS builds a client config verifying the server against CAFile and
+// presenting the (reloadable) client certificate when one is configured.
+func (c Config) ClientTLS() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CAFile != "" {
+		pool, err := loadPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.Enabled() {
+		r, err := newReloader(Config{CertFile: c.CertFile, KeyFile: c.KeyFile})
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _, err := r.current()
+			return cert, err
+		}
+	}
+	return cfg, nil
+}
+
+// ListenAndServe serves srv over TLS when c is enabled and over plain HTTP
+// otherwise.
+func ListenAndServe(srv *http.Server, c Config) error {
+	if !c.Enabled() {
+		return srv.ListenAndServe()
+	}
+	cfg, err := c.ServerTLS()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = cfg
+	return srv.ListenAndServeTLS("", "")
+}
+
+type reloader struct {
+	cfg Config
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	pool      *x509.CertPool
+	modTimes  [3]time.Time
+	checkedAt time.Time
+}
+
+func newReloader(cfg Config) (*reloader, error) {
+	r := &reloader{cfg: cfg}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// current returns the loaded material, checking the files for changes at
+// most once per reloadInterval. A failed reload keeps serving the previous
+// certificate.
+func (r *reloader) current() (*tls.Certificate, *x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) >= reloadInterval {
+		r.checkedAt = time.Now()
+		if r.changed() {
+			if err := r.loadLocked(); err != nil && r.cert == nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return r.cert, r.pool, nil
+}
+
+func (r *reloader) files() [3]string {
+	return [3]string{r.cfg.CertFile, r.cfg.KeyFile, r.cfg.CAFile}
+}
+
+func (r *reloader) changed() bool {
+	for i, f := range r.files() {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err == nil && !info.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *reloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checkedAt = time.Now()
+	return r.loadLocked()
+}
+
+func (r *reloader) loadLocked() error {
+	var modTimes [3]time.Time
+	for i, f := range r.files() {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.cfg.CAFile != "" {
+		if pool, err = loadPool(r.cfg.CAFile); err != nil {
+			return err
+		}
+	}
+	r.cert, r.pool, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+func loadPool(caFile string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,234 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair writes a certificate signed by parent (self signed when nil)
+// and its key to dir, returning both paths, the certificate and the key.
+func writePair(t *testing.T, dir, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, string, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if isCA {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, cert, key
+}
+
+type pki struct {
+	ca, serverCert, serverKey, clientCert, clientKey string
+}
+
+func newPKI(t *testing.T) pki {
+	dir := t.TempDir()
+	ca, _, caCert, caKey := writePair(t, dir, "ca", true, nil, nil)
+	serverCert, serverKey, _, _ := writePair(t, dir, "server", false, caCert, caKey)
+	clientCert, clientKey, _, _ := writePair(t, dir, "client", false, caCert, caKey)
+	return pki{ca, serverCert, serverKey, clientCert, clientKey}
+}
+
+// handshake serves one connection with server and dials it with client.
+func handshake(t *testing.T, server, client *tls.Config) error {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			serverErr <- err
+			return
+		}
+		_, err = conn.Write([]byte{1})
+		serverErr <- err
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), client)
+	if err == nil {
+		// TLS 1.3 reports a rejected client certificate on the first read
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if sErr := <-serverErr; sErr != nil {
+		return sErr
+	}
+	return err
+}
+
+func TestServerTLSRequiresCAForClientAuth(t *testing.T) {
+	p := newPKI(t)
+	_, err := Config{CertFile: p.serverCert, KeyFile: p.serverKey, RequireClientCert: true}.ServerTLS()
+	if err == nil {
+		t.Fatal("expected an error for client auth without a CA")
+	}
+}
+
+func TestServerTLSClientAuth(t *testing.T) {
+	p := newPKI(t)
+	tests := []struct {
+		name       string
+		server     Config
+		client     Config
+		wantFailed bool
+	}{
+		{
+			name:   "tls without client auth",
+			server: Config{CertFile: p.serverCert, KeyFile: p.serverKey},
+			client: Config{CAFile: p.ca},
+		},
+		{
+			name:       "mtls rejects a client without certificate",
+			server:     Config{CertFile: p.serverCert, KeyFile: p.serverKey, CAFile: p.ca, RequireClientCert: true},
+			client:     Config{CAFile: p.ca},
+			wantFailed: true,
+		},
+		{
+			name:   "mtls accepts a client certificate",
+			server: Config{CertFile: p.serverCert, KeyFile: p.serverKey, CAFile: p.ca, RequireClientCert: true},
+			client: Config{CertFile: p.clientCert, KeyFile: p.clientKey, CAFile: p.ca},
+		},
+		{
+			name:       "client rejects an unknown server",
+			server:     Config{CertFile: p.serverCert, KeyFile: p.serverKey},
+			client:     Config{CAFile: newPKI(t).ca},
+			wantFailed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := tt.server.ServerTLS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client, err := tt.client.ClientTLS()
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.ServerName = "127.0.0.1"
+			err = handshake(t, server, client)
+			if tt.wantFailed && err == nil {
+				t.Fatal("expected the handshake to fail")
+			}
+			if !tt.wantFailed && err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+		})
+	}
+}
+
+// servedCert returns the certificate a server with cfg presents.
+func servedCert(t *testing.T, server *tls.Config, ca string) *x509.Certificate {
+	t.Helper()
+	client, err := Config{CAFile: ca}.ClientTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ServerName = "127.0.0.1"
+	var served *x509.Certificate
+	client.VerifyConnection = func(cs tls.ConnectionState) error {
+		served = cs.PeerCertificates[0]
+		return nil
+	}
+	if err := handshake(t, server, client); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	return served
+}
+
+// A rotated certificate is served without a restart, a broken one is not.
+func TestServerTLSReloadsCertificate(t *testing.T) {
+	defer func(interval time.Duration) { reloadInterval = interval }(reloadInterval)
+	reloadInterval = 0
+
+	dir := t.TempDir()
+	caPath, _, caCert, caKey := writePair(t, dir, "ca", true, nil, nil)
+	certPath, keyPath, first, _ := writePair(t, dir, "server", false, caCert, caKey)
+	server, err := Config{CertFile: certPath, KeyFile: keyPath}.ServerTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCert(t, server, caPath); !got.Equal(first) {
+		t.Fatal("not serving the initial certificate")
+	}
+
+	// the files are rewritten in place, as a certificate manager does
+	_, _, rotated, _ := writePair(t, dir, "server", false, caCert, caKey)
+	touch(t, time.Now().Add(time.Minute), certPath, keyPath)
+	if got := servedCert(t, server, caPath); !got.Equal(rotated) {
+		t.Fatal("not serving the rotated certificate")
+	}
+
+	if err := os.WriteFile(keyPath, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	touch(t, time.Now().Add(2*time.Minute), keyPath)
+	if got := servedCert(t, server, caPath); !got.Equal(rotated) {
+		t.Fatal("a broken key replaced the served certificate")
+	}
+}
+
+// touch sets the modification time of files, so a rewrite within the
+// resolution of the file system is noticed.
+func touch(t *testing.T, at time.Time, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		if err := os.Chtimes(f, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
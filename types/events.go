@@ -0,0 +1,32 @@
+package types
+
+const (
+	// the prepaid balance fell below the low balance threshold
+	AccountLowBalance = "low_balance"
+	// the prepaid balance is used up, readings of the account's OBUs may be
+	// blocked until it is topped up
+	AccountDepleted = "depleted"
+	// the balance is back above the threshold
+	AccountReplenished = "replenished"
+	// the OBU no longer belongs to a prepaid account, it was removed or
+	// moved to a postpaid one or its account became postpaid
+	AccountReleased = "released"
+)
+
+// AccountEvent is published by the aggregator for every OBU of a prepaid
+// account whenever the balance state of the account changes, and for a
+// single OBU whenever the account it belongs to changes. Events are keyed
+// by OBU, the latest one is the current state of the OBU.
+type AccountEvent struct {
+	Type      string `json:"type"`
+	AccountID string `json:"accountId"`
+	OBUID     int    `json:"obuID"`
+	Balance   Money  `json:"balance"`
+	// unix nanoseconds
+	At int64 `json:"at"`
+}
+
+// Blocked reports whether readings of the OBU should be held back.
+func (e AccountEvent) Blocked() bool {
+	return e.Type == AccountDepleted
+}
@@ -0,0 +1,262 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const DefaultCurrency = "EUR"
+
+// minor units per ISO 4217 currency, e.g. EUR has cents (2) and JPY none
+var currencyExponents = map[string]int{
+	"AUD": 2, "BHD": 3, "CAD": 2, "CHF": 2, "CZK": 2, "DKK": 2, "EUR": 2,
+	"GBP": 2, "HUF": 2, "INR": 2, "JPY": 0, "KWD": 3, "NOK": 2, "NZD": 2,
+	"PLN": 2, "SEK": 2, "USD": 2,
+}
+
+var ErrCurrencyMismatch = errors.New("currencies do not match")
+
+// Exponent returns the number of minor unit digits of a currency.
+func Exponent(currency string) (int, error) {
+	exp, ok := currencyExponents[currency]
+	if !ok {
+		return 0, fmt.Errorf("unknown currency %q", currency)
+	}
+	return exp, nil
+}
+
+// Money is an exact amount in the minor units of its currency. It encodes
+// to JSON as {"amount": "12.34", "currency": "EUR"}, the amount being a
+// decimal string so that no float parsing is involved on either side.
+type Money struct {
+	Units    int64
+	Currency string
+}
+
+func NewMoney(units int64, currency string) Money {
+	return Money{Units: units, Currency: currency}
+}
+
+// ParseMoney reads a decimal amount of a currency exactly, more digits than
+// the currency has minor units are an error.
+func ParseMoney(amount, currency string) (Money, error) {
+	exp, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok {
+		return Money{}, fmt.Errorf("invalid amount %q", amount)
+	}
+	r.Mul(r, pow10(exp))
+	if !r.IsInt() || !r.Num().IsInt64() {
+		return Money{}, fmt.Errorf("invalid amount %q for %s", amount, currency)
+	}
+	return Money{Units: r.Num().Int64(), Currency: currency}, nil
+}
+
+// FromFloat rounds an amount in major units, e.g. distance times price, to
+// the currency. Floats only ever enter money here, once per amount.
+func FromFloat(v float64, currency string, r Rounding) (Money, error) {
+	exp, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+	f := new(big.Rat)
+	if f.SetFloat64(v) == nil {
+		return Money{}, fmt.Errorf("invalid amount %v", v)
+	}
+	return Money{Units: r.round(f.Mul(f, pow10(exp))), Currency: currency}, nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Units == 0
+}
+
+func (m Money) Neg() Money {
+	return Money{Units: -m.Units, Currency: m.Currency}
+}
+
+// Add sums amounts of the same currency, a zero value takes the currency
+// of the other amount.
+func (m Money) Add(o Money) (Money, error) {
+	switch {
+	case m.Currency == "":
+		m.Currency = o.Currency
+	case o.Currency != "" && o.Currency != m.Currency:
+		return m, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, o.Currency)
+	}
+	m.Units += o.Units
+	return m, nil
+}
+
+// Mul multiplies by an exact factor, e.g. a tax rate, and rounds the result
+// to the currency.
+func (m Money) Mul(factor *big.Rat, r Rounding) Money {
+	x := new(big.Rat).SetInt64(m.Units)
+	return Money{Units: r.round(x.Mul(x, factor)), Currency: m.Currency}
+}
+
+// Float is for display and ratios only, never compute money with it.
+func (m Money) Float() float64 {
+	exp := currencyExponents[m.Currency]
+	f, _ := new(big.Rat).SetFrac(big.NewInt(m.Units), pow10(exp).Num()).Float64()
+	return f
+}
+
+// Decimal formats the amount without the currency, e.g. "-12.30".
+func (m Money) Decimal() string {
+	exp := currencyExponents[m.Currency]
+	units := m.Units
+	sign := ""
+	if units < 0 {
+		sign, units = "-", -units
+	}
+	s := strconv.FormatInt(units, 10)
+	if exp == 0 {
+		return sign + s
+	}
+	if len(s) <= exp {
+		s = strings.Repeat("0", exp-len(s)+1) + s
+	}
+	return sign + s[:len(s)-exp] + "." + s[len(s)-exp:]
+}
+
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+type moneyJSON struct {
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.Decimal(), Currency: m.Currency})
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	var v moneyJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Currency == "" && (v.Amount == "" || v.Amount == "0") {
+		*m = Money{}
+		return nil
+	}
+	parsed, err := ParseMoney(v.Amount, v.Currency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+func (m Money) Proto() *MoneyRecord {
+	return &MoneyRecord{Units: m.Units, Currency: m.Currency}
+}
+
+func MoneyFromProto(r *MoneyRecord) Money {
+	return Money{Units: r.GetUnits(), Currency: r.GetCurrency()}
+}
+
+func pow10(exp int) *big.Rat {
+	return new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+}
+
+const (
+	// ties away from zero, the usual commercial rounding
+	RoundHalfUp = "half-up"
+	// ties to the even neighbour, unbiased over many amounts
+	RoundHalfEven = "half-even"
+	// towards zero
+	RoundDown = "down"
+	// away from zero
+	RoundUp = "up"
+)
+
+// Rounding says how amounts of a currency are rounded to minor units.
+// Increment rounds to multiples of more than one minor unit, e.g. 5 for
+// Swiss cash amounts.
+type Rounding struct {
+	Mode      string
+	Increment int64
+}
+
+var DefaultRounding = Rounding{Mode: RoundHalfUp, Increment: 1}
+
+func (r Rounding) round(x *big.Rat) int64 {
+	inc := max(r.Increment, 1)
+	x = new(big.Rat).Quo(x, new(big.Rat).SetInt64(inc))
+	// truncated quotient and remainder, both with the sign of x
+	q, rem := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		away := false
+		// compare 2*|rem| with the denominator to find ties
+		twice := new(big.Int).Abs(rem)
+		twice.Lsh(twice, 1)
+		half := twice.Cmp(x.Denom())
+		switch r.Mode {
+		case RoundUp:
+			away = true
+		case RoundDown:
+		case RoundHalfEven:
+			away = half > 0 || half == 0 && q.Bit(0) == 1
+		default:
+			away = half >= 0
+		}
+		if away {
+			q.Add(q, big.NewInt(int64(x.Sign())))
+		}
+	}
+	return q.Int64() * inc
+}
+
+// RoundingRules holds the rounding of every currency that does not use
+// DefaultRounding.
+type RoundingRules map[string]Rounding
+
+func (rr RoundingRules) For(currency string) Rounding {
+	if r, ok := rr[currency]; ok {
+		return r
+	}
+	return DefaultRounding
+}
+
+// ParseRoundingRules reads rules like "CHF=half-up/5,JPY=down", the
+// increment being optional.
+func ParseRoundingRules(s string) (RoundingRules, error) {
+	rules := RoundingRules{}
+	if s == "" {
+		return rules, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		currency, rule, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rounding rule %q", pair)
+		}
+		if _, err := Exponent(currency); err != nil {
+			return nil, err
+		}
+		mode, inc, hasInc := strings.Cut(rule, "/")
+		r := Rounding{Mode: mode, Increment: 1}
+		switch mode {
+		case RoundHalfUp, RoundHalfEven, RoundDown, RoundUp:
+		default:
+			return nil, fmt.Errorf("invalid rounding mode %q", mode)
+		}
+		if hasInc {
+			n, err := strconv.ParseInt(inc, 10, 64)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid rounding increment %q", inc)
+			}
+			r.Increment = n
+		}
+		rules[currency] = r
+	}
+	return rules, nil
+}
@@ -0,0 +1,177 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestFromFloat(t *testing.T) {
+	var (
+		halfUp   = Rounding{Mode: RoundHalfUp, Increment: 1}
+		halfEven = Rounding{Mode: RoundHalfEven, Increment: 1}
+		down     = Rounding{Mode: RoundDown, Increment: 1}
+		up       = Rounding{Mode: RoundUp, Increment: 1}
+		cash     = Rounding{Mode: RoundHalfUp, Increment: 5}
+	)
+	// ties are binary fractions, so the float is exactly the tie
+	tests := []struct {
+		v        float64
+		currency string
+		rounding Rounding
+		want     int64
+	}{
+		{0.125, "EUR", halfUp, 13},
+		{-0.125, "EUR", halfUp, -13},
+		{0.125, "EUR", halfEven, 12},
+		{0.375, "EUR", halfEven, 38},
+		{-0.125, "EUR", halfEven, -12},
+		{0.126, "EUR", halfEven, 13},
+		{0.129, "EUR", down, 12},
+		{-0.129, "EUR", down, -12},
+		{0.121, "EUR", up, 13},
+		{-0.121, "EUR", up, -13},
+		{2.5, "JPY", halfUp, 3},
+		{2.5, "JPY", halfEven, 2},
+		{3.5, "JPY", halfEven, 4},
+		{1.0625, "KWD", halfUp, 1063},
+		{1.0625, "KWD", halfEven, 1062},
+		{0.12, "CHF", cash, 10},
+		{0.13, "CHF", cash, 15},
+		{0.125, "CHF", cash, 15},
+		{-0.13, "CHF", cash, -15},
+		// an increment of 0 is 1
+		{0.125, "EUR", Rounding{Mode: RoundHalfUp}, 13},
+	}
+	for _, tt := range tests {
+		got, err := FromFloat(tt.v, tt.currency, tt.rounding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Units != tt.want || got.Currency != tt.currency {
+			t.Errorf("FromFloat(%v, %s, %v) = %v, want %d", tt.v, tt.currency, tt.rounding, got, tt.want)
+		}
+	}
+	if _, err := FromFloat(1, "XXX", halfUp); err == nil {
+		t.Error("expected an error for an unknown currency")
+	}
+}
+
+func TestMul(t *testing.T) {
+	half := big.NewRat(1, 2)
+	tests := []struct {
+		m        Money
+		factor   *big.Rat
+		rounding Rounding
+		want     int64
+	}{
+		{NewMoney(1, "KWD"), half, DefaultRounding, 1},
+		{NewMoney(1, "KWD"), half, Rounding{Mode: RoundHalfEven}, 0},
+		{NewMoney(3, "KWD"), half, Rounding{Mode: RoundHalfEven}, 2},
+		{NewMoney(-3, "EUR"), half, DefaultRounding, -2},
+		// 19% VAT of 10.05
+		{NewMoney(1005, "EUR"), big.NewRat(19, 100), DefaultRounding, 191},
+		{NewMoney(999, "JPY"), big.NewRat(1, 10), DefaultRounding, 100},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Mul(tt.factor, tt.rounding); got.Units != tt.want || got.Currency != tt.m.Currency {
+			t.Errorf("%v.Mul(%v, %v) = %v, want %d", tt.m, tt.factor, tt.rounding, got, tt.want)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		amount, currency string
+		want             int64
+		wantErr          bool
+	}{
+		{amount: "12.34", currency: "EUR", want: 1234},
+		{amount: "-0.05", currency: "EUR", want: -5},
+		{amount: "12", currency: "EUR", want: 1200},
+		{amount: "12.345", currency: "KWD", want: 12345},
+		{amount: "12", currency: "JPY", want: 12},
+		{amount: "12.345", currency: "EUR", wantErr: true},
+		{amount: "12.5", currency: "JPY", wantErr: true},
+		{amount: "1/3", currency: "EUR", wantErr: true},
+		{amount: "abc", currency: "EUR", wantErr: true},
+		{amount: "1", currency: "XXX", wantErr: true},
+		{amount: "100000000000000000000", currency: "EUR", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.amount, tt.currency)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMoney(%q, %s): got error %v", tt.amount, tt.currency, err)
+			continue
+		}
+		if !tt.wantErr && got != NewMoney(tt.want, tt.currency) {
+			t.Errorf("ParseMoney(%q, %s) = %v, want %d", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	tests := []struct {
+		m    Money
+		json string
+	}{
+		{NewMoney(5, "EUR"), `{"amount":"0.05","currency":"EUR"}`},
+		{NewMoney(-5, "EUR"), `{"amount":"-0.05","currency":"EUR"}`},
+		{NewMoney(123456, "EUR"), `{"amount":"1234.56","currency":"EUR"}`},
+		{NewMoney(1234, "JPY"), `{"amount":"1234","currency":"JPY"}`},
+		{NewMoney(-1, "KWD"), `{"amount":"-0.001","currency":"KWD"}`},
+		{NewMoney(12345, "KWD"), `{"amount":"12.345","currency":"KWD"}`},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.json {
+			t.Errorf("%v encodes to %s, want %s", tt.m, b, tt.json)
+		}
+		var got Money
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.m {
+			t.Errorf("%s decodes to %v, want %v", b, got, tt.m)
+		}
+	}
+	var zero Money
+	if err := json.Unmarshal([]byte(`{"amount":"0","currency":""}`), &zero); err != nil || zero != (Money{}) {
+		t.Errorf("got %v, %v for a zero amount", zero, err)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	sum, err := Money{}.Add(NewMoney(5, "EUR"))
+	if err != nil || sum != NewMoney(5, "EUR") {
+		t.Fatalf("got %v, %v", sum, err)
+	}
+	if _, err := sum.Add(NewMoney(5, "USD")); !errors.Is(err, ErrCurrencyMismatch) {
+		t.Fatalf("got %v, want ErrCurrencyMismatch", err)
+	}
+}
+
+func TestParseRoundingRules(t *testing.T) {
+	rules, err := ParseRoundingRules("CHF=half-up/5, JPY=down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.For("CHF"); got != (Rounding{Mode: RoundHalfUp, Increment: 5}) {
+		t.Errorf("got %v for CHF", got)
+	}
+	if got := rules.For("JPY"); got != (Rounding{Mode: RoundDown, Increment: 1}) {
+		t.Errorf("got %v for JPY", got)
+	}
+	if got := rules.For("EUR"); got != DefaultRounding {
+		t.Errorf("got %v for EUR", got)
+	}
+	for _, s := range []string{"CHF", "XXX=down", "CHF=nearest", "CHF=half-up/0", "CHF=half-up/x"} {
+		if _, err := ParseRoundingRules(s); err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+}
@@ -22,11 +22,19 @@ const (
 )
 
 type AggregateRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	ObuID         int64                  `protobuf:"varint,1,opt,name=ObuID,proto3" json:"ObuID,omitempty"`
-	Value         float64                `protobuf:"fixed64,2,opt,name=Value,proto3" json:"Value,omitempty"`
-	Unix          int64                  `protobuf:"varint,3,opt,name=Unix,proto3" json:"Unix,omitempty"`
-	RequestID     string                 `protobuf:"bytes,4,opt,name=RequestID,proto3" json:"RequestID,omitempty"`
+	state      protoimpl.MessageState `protogen:"open.v1"`
+	ObuID      int64                  `protobuf:"varint,1,opt,name=ObuID,proto3" json:"ObuID,omitempty"`
+	Value      float64                `protobuf:"fixed64,2,opt,name=Value,proto3" json:"Value,omitempty"`
+	Unix       int64                  `protobuf:"varint,3,opt,name=Unix,proto3" json:"Unix,omitempty"`
+	RequestID  string                 `protobuf:"bytes,4,opt,name=RequestID,proto3" json:"RequestID,omitempty"`
+	ReceivedAt int64                  `protobuf:"varint,5,opt,name=ReceivedAt,proto3" json:"ReceivedAt,omitempty"`
+	// positions the distance was calculated from
+	PrevLat  float64 `protobuf:"fixed64,6,opt,name=PrevLat,proto3" json:"PrevLat,omitempty"`
+	PrevLong float64 `protobuf:"fixed64,7,opt,name=PrevLong,proto3" json:"PrevLong,omitempty"`
+	CurrLat  float64 `protobuf:"fixed64,8,opt,name=CurrLat,proto3" json:"CurrLat,omitempty"`
+	CurrLong float64 `protobuf:"fixed64,9,opt,name=CurrLong,proto3" json:"CurrLong,omitempty"`
+	// the data receiver flagged the reading of a blocked account
+	Blocked       bool `protobuf:"varint,10,opt,name=Blocked,proto3" json:"Blocked,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -89,6 +97,48 @@ func (x *AggregateRequest) GetRequestID() string {
 	return ""
 }
 
+func (x *AggregateRequest) GetReceivedAt() int64 {
+	if x != nil {
+		return x.ReceivedAt
+	}
+	return 0
+}
+
+func (x *AggregateRequest) GetPrevLat() float64 {
+	if x != nil {
+		return x.PrevLat
+	}
+	return 0
+}
+
+func (x *AggregateRequest) GetPrevLong() float64 {
+	if x != nil {
+		return x.PrevLong
+	}
+	return 0
+}
+
+func (x *AggregateRequest) GetCurrLat() float64 {
+	if x != nil {
+		return x.CurrLat
+	}
+	return 0
+}
+
+func (x *AggregateRequest) GetCurrLong() float64 {
+	if x != nil {
+		return x.CurrLong
+	}
+	return 0
+}
+
+func (x *AggregateRequest) GetBlocked() bool {
+	if x != nil {
+		return x.Blocked
+	}
+	return false
+}
+
 type None struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	unknownFields protoimpl.UnknownFields
@@ -125,20 +175,537 @@ func (*None) Descriptor() ([]byte, []int) {
 	return file_types_ptypes_proto_rawDescGZIP(), []int{1}
 }
 
+type BillingAddress struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Line1         string                 `protobuf:"bytes,1,opt,name=Line1,proto3" json:"Line1,omitempty"`
+	Line2         string                 `protobuf:"bytes,2,opt,name=Line2,proto3" json:"Line2,omitempty"`
+	City          string                 `protobuf:"bytes,3,opt,name=City,proto3" json:"City,omitempty"`
+	PostalCode    string                 `protobuf:"bytes,4,opt,name=PostalCode,proto3" json:"PostalCode,omitempty"`
+	Country       string                 `protobuf:"bytes,5,opt,name=Country,proto3" json:"Country,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BillingAddress) Reset() {
+	*x = BillingAddress{}
+	mi := &file_types_ptypes_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BillingAddress) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BillingAddress) ProtoMessage() {}
+
+func (x *BillingAddress) ProtoReflect() protoreflect.Message {
+	mi := &file_types_ptypes_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BillingAddress.ProtoReflect.Descriptor instead.
+func (*BillingAddress) Descriptor() ([]byte, []int) {
+	return file_types_ptypes_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *BillingAddress) GetLine1() string {
+	if x != nil {
+		return x.Line1
+	}
+	return ""
+}
+
+func (x *BillingAddress) GetLine2() string {
+	if x != nil {
+		return x.Line2
+	}
+	return ""
+}
+
+func (x *BillingAddress) GetCity() string {
+	if x != nil {
+		return x.City
+	}
+	return ""
+}
+
+func (x *BillingAddress) GetPostalCode() string {
+	if x != nil {
+		return x.PostalCode
+	}
+	return ""
+}
+
+func (x *BillingAddress) GetCountry() string {
+	if x != nil {
+		return x.Country
+	}
+	return ""
+}
+
+// MoneyRecord is an exact amount in minor units, e.g. cents.
+type MoneyRecord struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Units         int64                  `protobuf:"varint,1,opt,name=Units,proto3" json:"Units,omitempty"`
+	Currency      string                 `protobuf:"bytes,2,opt,name=Currency,proto3" json:"Currency,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MoneyRecord) Reset() {
+	*x = MoneyRecord{}
+	mi := &file_types_ptypes_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MoneyRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MoneyRecord) ProtoMessage() {}
+
+func (x *MoneyRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_types_ptypes_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MoneyRecord.ProtoReflect.Descriptor instead.
+func (*MoneyRecord) Descriptor() ([]byte, []int) {
+	return file_types_ptypes_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *MoneyRecord) GetUnits() int64 {
+	if x != nil {
+		return x.Units
+	}
+	return 0
+}
+
+func (x *MoneyRecord) GetCurrency() string {
+	if x != nil {
+		return x.Currency
+	}
+	return ""
+}
+
+type AccountRecord struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	ID             string                 `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	Name           string                 `protobuf:"bytes,2,opt,name=Name,proto3" json:"Name,omitempty"`
+	BillingAddress *BillingAddress        `protobuf:"bytes,3,opt,name=BillingAddress,proto3" json:"BillingAddress,omitempty"`
+	Prepaid        bool                   `protobuf:"varint,4,opt,name=Prepaid,proto3" json:"Prepaid,omitempty"`
+	LowBalance     *MoneyRecord           `protobuf:"bytes,6,opt,name=LowBalance,proto3" json:"LowBalance,omitempty"`
+	Currency       string                 `protobuf:"bytes,7,opt,name=Currency,proto3" json:"Currency,omitempty"`
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *AccountRecord) Reset() {
+	*x = AccountRecord{}
+	mi := &file_types_ptypes_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccountRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccountRecord) ProtoMessage() {}
+
+func (x *AccountRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_types_ptypes_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccountRecord.ProtoReflect.Descriptor instead.
+func (*AccountRecord) Descriptor() ([]byte, []int) {
+	return file_types_ptypes_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *AccountRecord) GetID() string {
+	if x != nil {
+		return x.ID
+	}
+	return ""
+}
+
+func (x *AccountRecord) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *AccountRecord) GetBillingAddress() *BillingAddress {
+	if x != nil {
+		return x.BillingAddress
+	}
+	return nil
+}
+
+func (x *AccountRecord) GetPrepaid() bool {
+	if x != nil {
+		return x.Prepaid
+	}
+	return false
+}
+
+func (x *AccountRecord) GetLowBalance() *MoneyRecord {
+	if x != nil {
+		return x.LowBalance
+	}
+	return nil
+}
+
+func (x *AccountRecord) GetCurrency() string {
+	if x != nil {
+		return x.Currency
+	}
+	return ""
+}
+
+type VehicleRecord struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ObuID         int64                  `protobuf:"varint,1,opt,name=ObuID,proto3" json:"ObuID,omitempty"`
+	Plate         string                 `protobuf:"bytes,2,opt,name=Plate,proto3" json:"Plate,omitempty"`
+	Class         string                 `protobuf:"bytes,3,opt,name=Class,proto3" json:"Class,omitempty"`
+	AccountID     string                 `protobuf:"bytes,4,opt,name=AccountID,proto3" json:"AccountID,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VehicleRecord) Reset() {
+	*x = VehicleRecord{}
+	mi := &file_types_ptypes_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VehicleRecord) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VehicleRecord) ProtoMessage() {}
+
+func (x *VehicleRecord) ProtoReflect() protoreflect.Message {
+	mi := &file_types_ptypes_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VehicleRecord.ProtoReflect.Descriptor instead.
+func (*VehicleRecord) Descriptor() ([]byte, []int) {
+	return file_types_ptypes_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *VehicleRecord) GetObuID() int64 {
+	if x != nil {
+		return x.ObuID
+	}
+	return 0
+}
+
+func (x *VehicleRecord) GetPlate() string {
+	if x != nil {
+		return x.Plate
+	}
+	return ""
+}
+
+func (x *VehicleRecord) GetClass() string {
+	if x != nil {
+		return x.Class
+	}
+	return ""
+}
+
+func (x *VehicleRecord) GetAccountID() string {
+	if x != nil {
+		return x.AccountID
+	}
+	return ""
+}
+
+type AccountID struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ID            string                 `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccountID) Reset() {
+	*x = AccountID{}
+	mi := &file_types_ptypes_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccountID) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccountID) ProtoMessage() {}
+
+func (x *AccountID) ProtoReflect() protoreflect.Message {
+	mi := &file_types_ptypes_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccountID.ProtoReflect.Descriptor instead.
+func (*AccountID) Descriptor() ([]byte, []int) {
+	return file_types_ptypes_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *AccountID) GetID() string {
+	if x != nil {
+		return x.ID
+	}
+	return ""
+}
+
+type VehicleID struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ObuID         int64                  `protobuf:"varint,1,opt,name=ObuID,proto3" json:"ObuID,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VehicleID) Reset() {
+	*x = VehicleID{}
+	mi := &file_types_ptypes_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VehicleID) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VehicleID) ProtoMessage() {}
+
+func (x *VehicleID) ProtoReflect() protoreflect.Message {
+	mi := &file_types_ptypes_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VehicleID.ProtoReflect.Descriptor instead.
+func (*VehicleID) Descriptor() ([]byte, []int) {
+	return file_types_ptypes_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *VehicleID) GetObuID() int64 {
+	if x != nil {
+		return x.ObuID
+	}
+	return 0
+}
+
+type AccountList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Accounts      []*AccountRecord       `protobuf:"bytes,1,rep,name=Accounts,proto3" json:"Accounts,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AccountList) Reset() {
+	*x = AccountList{}
+	mi := &file_types_ptypes_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AccountList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AccountList) ProtoMessage() {}
+
+func (x *AccountList) ProtoReflect() protoreflect.Message {
+	mi := &file_types_ptypes_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AccountList.ProtoReflect.Descriptor instead.
+func (*AccountList) Descriptor() ([]byte, []int) {
+	return file_types_ptypes_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *AccountList) GetAccounts() []*AccountRecord {
+	if x != nil {
+		return x.Accounts
+	}
+	return nil
+}
+
+type VehicleList struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Vehicles      []*VehicleRecord       `protobuf:"bytes,1,rep,name=Vehicles,proto3" json:"Vehicles,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *VehicleList) Reset() {
+	*x = VehicleList{}
+	mi := &file_types_ptypes_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *VehicleList) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*VehicleList) ProtoMessage() {}
+
+func (x *VehicleList) ProtoReflect() protoreflect.Message {
+	mi := &file_types_ptypes_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use VehicleList.ProtoReflect.Descriptor instead.
+func (*VehicleList) Descriptor() ([]byte, []int) {
+	return file_types_ptypes_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *VehicleList) GetVehicles() []*VehicleRecord {
+	if x != nil {
+		return x.Vehicles
+	}
+	return nil
+}
+
 var File_types_ptypes_proto protoreflect.FileDescriptor
 
 const file_types_ptypes_proto_rawDesc = "" +
 	"\n" +
-	"\x12types/ptypes.proto\"p\n" +
+	"\x12types/ptypes.proto\"\x96\x02\n" +
 	"\x10AggregateRequest\x12\x14\n" +
 	"\x05ObuID\x18\x01 \x01(\x03R\x05ObuID\x12\x14\n" +
 	"\x05Value\x18\x02 \x01(\x01R\x05Value\x12\x12\n" +
 	"\x04Unix\x18\x03 \x01(\x03R\x04Unix\x12\x1c\n" +
-	"\tRequestID\x18\x04 \x01(\tR\tRequestID\"\x06\n" +
-	"\x04None23\n" +
+	"\tRequestID\x18\x04 \x01(\tR\tRequestID\x12\x1e\n" +
+	"\n" +
+	"ReceivedAt\x18\x05 \x01(\x03R\n" +
+	"ReceivedAt\x12\x18\n" +
+	"\aPrevLat\x18\x06 \x01(\x01R\aPrevLat\x12\x1a\n" +
+	"\bPrevLong\x18\a \x01(\x01R\bPrevLong\x12\x18\n" +
+	"\aCurrLat\x18\b \x01(\x01R\aCurrLat\x12\x1a\n" +
+	"\bCurrLong\x18\t \x01(\x01R\bCurrLong\x12\x18\n" +
+	"\aBlocked\x18\n" +
+	" \x01(\bR\aBlocked\"\x06\n" +
+	"\x04None\"\x8a\x01\n" +
+	"\x0eBillingAddress\x12\x14\n" +
+	"\x05Line1\x18\x01 \x01(\tR\x05Line1\x12\x14\n" +
+	"\x05Line2\x18\x02 \x01(\tR\x05Line2\x12\x12\n" +
+	"\x04City\x18\x03 \x01(\tR\x04City\x12\x1e\n" +
+	"\n" +
+	"PostalCode\x18\x04 \x01(\tR\n" +
+	"PostalCode\x12\x18\n" +
+	"\aCountry\x18\x05 \x01(\tR\aCountry\"?\n" +
+	"\vMoneyRecord\x12\x14\n" +
+	"\x05Units\x18\x01 \x01(\x03R\x05Units\x12\x1a\n" +
+	"\bCurrency\x18\x02 \x01(\tR\bCurrency\"\xd6\x01\n" +
+	"\rAccountRecord\x12\x0e\n" +
+	"\x02ID\x18\x01 \x01(\tR\x02ID\x12\x12\n" +
+	"\x04Name\x18\x02 \x01(\tR\x04Name\x127\n" +
+	"\x0eBillingAddress\x18\x03 \x01(\v2\x0f.BillingAddressR\x0eBillingAddress\x12\x18\n" +
+	"\aPrepaid\x18\x04 \x01(\bR\aPrepaid\x12,\n" +
+	"\n" +
+	"LowBalance\x18\x06 \x01(\v2\f.MoneyRecordR\n" +
+	"LowBalance\x12\x1a\n" +
+	"\bCurrency\x18\a \x01(\tR\bCurrencyJ\x04\b\x05\x10\x06\"o\n" +
+	"\rVehicleRecord\x12\x14\n" +
+	"\x05ObuID\x18\x01 \x01(\x03R\x05ObuID\x12\x14\n" +
+	"\x05Plate\x18\x02 \x01(\tR\x05Plate\x12\x14\n" +
+	"\x05Class\x18\x03 \x01(\tR\x05Class\x12\x1c\n" +
+	"\tAccountID\x18\x04 \x01(\tR\tAccountID\"\x1b\n" +
+	"\tAccountID\x12\x0e\n" +
+	"\x02ID\x18\x01 \x01(\tR\x02ID\"!\n" +
+	"\tVehicleID\x12\x14\n" +
+	"\x05ObuID\x18\x01 \x01(\x03R\x05ObuID\"9\n" +
+	"\vAccountList\x12*\n" +
+	"\bAccounts\x18\x01 \x03(\v2\x0e.AccountRecordR\bAccounts\"9\n" +
+	"\vVehicleList\x12*\n" +
+	"\bVehicles\x18\x01 \x03(\v2\x0e.VehicleRecordR\bVehicles23\n" +
 	"\n" +
 	"Aggregator\x12%\n" +
-	"\tAggregate\x12\x11.AggregateRequest\x1a\x05.NoneB-Z+github.com/shamssahal/toll-calculator/typesb\x06proto3"
+	"\tAggregate\x12\x11.AggregateRequest\x1a\x05.None2\xd1\x02\n" +
+	"\bRegistry\x12,\n" +
+	"\n" +
+	"PutAccount\x12\x0e.AccountRecord\x1a\x0e.AccountRecord\x12(\n" +
+	"\n" +
+	"GetAccount\x12\n" +
+	".AccountID\x1a\x0e.AccountRecord\x12\"\n" +
+	"\rDeleteAccount\x12\n" +
+	".AccountID\x1a\x05.None\x12#\n" +
+	"\fListAccounts\x12\x05.None\x1a\f.AccountList\x12,\n" +
+	"\n" +
+	"PutVehicle\x12\x0e.VehicleRecord\x1a\x0e.VehicleRecord\x12(\n" +
+	"\n" +
+	"GetVehicle\x12\n" +
+	".VehicleID\x1a\x0e.VehicleRecord\x12\"\n" +
+	"\rDeleteVehicle\x12\n" +
+	".VehicleID\x1a\x05.None\x12(\n" +
+	"\fListVehicles\x12\n" +
+	".AccountID\x1a\f.VehicleListB-Z+github.com/shamssahal/toll-calculator/typesb\x06proto3"
 
 var (
 	file_types_ptypes_proto_rawDescOnce sync.Once
@@ -152,19 +719,47 @@ func file_types_ptypes_proto_rawDescGZIP() []byte {
 	return file_types_ptypes_proto_rawDescData
 }
 
-var file_types_ptypes_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_types_ptypes_proto_msgTypes = make([]protoimpl.MessageInfo, 10)
 var file_types_ptypes_proto_goTypes = []any{
 	(*AggregateRequest)(nil), // 0: AggregateRequest
 	(*None)(nil),             // 1: None
+	(*BillingAddress)(nil),   // 2: BillingAddress
+	(*MoneyRecord)(nil),      // 3: MoneyRecord
+	(*AccountRecord)(nil),    // 4: AccountRecord
+	(*VehicleRecord)(nil),    // 5: VehicleRecord
+	(*AccountID)(nil),        // 6: AccountID
+	(*VehicleID)(nil),        // 7: VehicleID
+	(*AccountList)(nil),      // 8: AccountList
+	(*VehicleList)(nil),      // 9: VehicleList
 }
 var file_types_ptypes_proto_depIdxs = []int32{
-	0, // 0: Aggregator.Aggregate:input_type -> AggregateRequest
-	1, // 1: Aggregator.Aggregate:output_type -> None
-	1, // [1:2] is the sub-list for method output_type
-	0, // [0:1] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	2,  // 0: AccountRecord.BillingAddress:type_name -> BillingAddress
+	3,  // 1: AccountRecord.LowBalance:type_name -> MoneyRecord
+	4,  // 2: AccountList.Accounts:type_name -> AccountRecord
+	5,  // 3: VehicleList.Vehicles:type_name -> VehicleRecord
+	0,  // 4: Aggregator.Aggregate:input_type -> AggregateRequest
+	4,  // 5: Registry.PutAccount:input_type -> AccountRecord
+	6,  // 6: Registry.GetAccount:input_type -> AccountID
+	6,  // 7: Registry.DeleteAccount:input_type -> AccountID
+	1,  // 8: Registry.ListAccounts:input_type -> None
+	5,  // 9: Registry.PutVehicle:input_type -> VehicleRecord
+	7,  // 10: Registry.GetVehicle:input_type -> VehicleID
+	7,  // 11: Registry.DeleteVehicle:input_type -> VehicleID
+	6,  // 12: Registry.ListVehicles:input_type -> AccountID
+	1,  // 13: Aggregator.Aggregate:output_type -> None
+	4,  // 14: Registry.PutAccount:output_type -> AccountRecord
+	4,  // 15: Registry.GetAccount:output_type -> AccountRecord
+	1,  // 16: Registry.DeleteAccount:output_type -> None
+	8,  // 17: Registry.ListAccounts:output_type -> AccountList
+	5,  // 18: Registry.PutVehicle:output_type -> VehicleRecord
+	5,  // 19: Registry.GetVehicle:output_type -> VehicleRecord
+	1,  // 20: Registry.DeleteVehicle:output_type -> None
+	9,  // 21: Registry.ListVehicles:output_type -> VehicleList
+	13, // [13:22] is the sub-list for method output_type
+	4,  // [4:13] is the sub-list for method input_type
+	4,  // [4:4] is the sub-list for extension type_name
+	4,  // [4:4] is the sub-list for extension extendee
+	0,  // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_types_ptypes_proto_init() }
@@ -178,9 +773,9 @@ func file_types_ptypes_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_types_ptypes_proto_rawDesc), len(file_types_ptypes_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   2,
+			NumMessages:   10,
 			NumExtensions: 0,
-			NumServices:   1,
+			NumServices:   2,
 		},
 		GoTypes:           file_types_ptypes_proto_goTypes,
 		DependencyIndexes: file_types_ptypes_proto_depIdxs,
@@ -119,3 +119,371 @@ var Aggregator_ServiceDesc = grpc.ServiceDesc{
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "types/ptypes.proto",
 }
+
+const (
+	Registry_PutAccount_FullMethodName    = "/Registry/PutAccount"
+	Registry_GetAccount_FullMethodName    = "/Registry/GetAccount"
+	Registry_DeleteAccount_FullMethodName = "/Registry/DeleteAccount"
+	Registry_ListAccounts_FullMethodName  = "/Registry/ListAccounts"
+	Registry_PutVehicle_FullMethodName    = "/Registry/PutVehicle"
+	Registry_GetVehicle_FullMethodName    = "/Registry/GetVehicle"
+	Registry_DeleteVehicle_FullMethodName = "/Registry/DeleteVehicle"
+	Registry_ListVehicles_FullMethodName  = "/Registry/ListVehicles"
+)
+
+// RegistryClient is the client API for Registry service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RegistryClient interface {
+	PutAccount(ctx context.Context, in *AccountRecord, opts ...grpc.CallOption) (*AccountRecord, error)
+	GetAccount(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*AccountRecord, error)
+	DeleteAccount(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*None, error)
+	ListAccounts(ctx context.Context, in *None, opts ...grpc.CallOption) (*AccountList, error)
+	PutVehicle(ctx context.Context, in *VehicleRecord, opts ...grpc.CallOption) (*VehicleRecord, error)
+	GetVehicle(ctx context.Context, in *VehicleID, opts ...grpc.CallOption) (*VehicleRecord, error)
+	DeleteVehicle(ctx context.Context, in *VehicleID, opts ...grpc.CallOption) (*None, error)
+	ListVehicles(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*VehicleList, error)
+}
+
+type registryClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRegistryClient(cc grpc.ClientConnInterface) RegistryClient {
+	return &registryClient{cc}
+}
+
+func (c *registryClient) PutAccount(ctx context.Context, in *AccountRecord, opts ...grpc.CallOption) (*AccountRecord, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AccountRecord)
+	err := c.cc.Invoke(ctx, Registry_PutAccount_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registryClient) GetAccount(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*AccountRecord, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AccountRecord)
+	err := c.cc.Invoke(ctx, Registry_GetAccount_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registryClient) DeleteAccount(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*None, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(None)
+	err := c.cc.Invoke(ctx, Registry_DeleteAccount_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registryClient) ListAccounts(ctx context.Context, in *None, opts ...grpc.CallOption) (*AccountList, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AccountList)
+	err := c.cc.Invoke(ctx, Registry_ListAccounts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registryClient) PutVehicle(ctx context.Context, in *VehicleRecord, opts ...grpc.CallOption) (*VehicleRecord, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VehicleRecord)
+	err := c.cc.Invoke(ctx, Registry_PutVehicle_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registryClient) GetVehicle(ctx context.Context, in *VehicleID, opts ...grpc.CallOption) (*VehicleRecord, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VehicleRecord)
+	err := c.cc.Invoke(ctx, Registry_GetVehicle_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registryClient) DeleteVehicle(ctx context.Context, in *VehicleID, opts ...grpc.CallOption) (*None, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(None)
+	err := c.cc.Invoke(ctx, Registry_DeleteVehicle_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *registryClient) ListVehicles(ctx context.Context, in *AccountID, opts ...grpc.CallOption) (*VehicleList, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(VehicleList)
+	err := c.cc.Invoke(ctx, Registry_ListVehicles_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// RegistryServer is the server API for Registry service.
+// All implementations must embed UnimplementedRegistryServer
+// for forward compatibility.
+type RegistryServer interface {
+	PutAccount(context.Context, *AccountRecord) (*AccountRecord, error)
+	GetAccount(context.Context, *AccountID) (*AccountRecord, error)
+	DeleteAccount(context.Context, *AccountID) (*None, error)
+	ListAccounts(context.Context, *None) (*AccountList, error)
+	PutVehicle(context.Context, *VehicleRecord) (*VehicleRecord, error)
+	GetVehicle(context.Context, *VehicleID) (*VehicleRecord, error)
+	DeleteVehicle(context.Context, *VehicleID) (*None, error)
+	ListVehicles(context.Context, *AccountID) (*VehicleList, error)
+	mustEmbedUnimplementedRegistryServer()
+}
+
+// UnimplementedRegistryServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRegistryServer struct{}
+
+func (UnimplementedRegistryServer) PutAccount(context.Context, *AccountRecord) (*AccountRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutAccount not implemented")
+}
+func (UnimplementedRegistryServer) GetAccount(context.Context, *AccountID) (*AccountRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetAccount not implemented")
+}
+func (UnimplementedRegistryServer) DeleteAccount(context.Context, *AccountID) (*None, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteAccount not implemented")
+}
+func (UnimplementedRegistryServer) ListAccounts(context.Context, *None) (*AccountList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAccounts not implemented")
+}
+func (UnimplementedRegistryServer) PutVehicle(context.Context, *VehicleRecord) (*VehicleRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PutVehicle not implemented")
+}
+func (UnimplementedRegistryServer) GetVehicle(context.Context, *VehicleID) (*VehicleRecord, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetVehicle not implemented")
+}
+func (UnimplementedRegistryServer) DeleteVehicle(context.Context, *VehicleID) (*None, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteVehicle not implemented")
+}
+func (UnimplementedRegistryServer) ListVehicles(context.Context, *AccountID) (*VehicleList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListVehicles not implemented")
+}
+func (UnimplementedRegistryServer) mustEmbedUnimplementedRegistryServer() {}
+func (UnimplementedRegistryServer) testEmbeddedByValue()                  {}
+
+// UnsafeRegistryServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RegistryServer will
+// result in compilation errors.
+type UnsafeRegistryServer interface {
+	mustEmbedUnimplementedRegistryServer()
+}
+
+func RegisterRegistryServer(s grpc.ServiceRegistrar, srv RegistryServer) {
+	// If the following call pancis, it indicates UnimplementedRegistryServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Registry_ServiceDesc, srv)
+}
+
+func _Registry_PutAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccountRecord)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).PutAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Registry_PutAccount_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).PutAccount(ctx, req.(*AccountRecord))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registry_GetAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccountID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).GetAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Registry_GetAccount_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).GetAccount(ctx, req.(*AccountID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registry_DeleteAccount_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccountID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).DeleteAccount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Registry_DeleteAccount_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).DeleteAccount(ctx, req.(*AccountID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registry_ListAccounts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(None)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).ListAccounts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Registry_ListAccounts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).ListAccounts(ctx, req.(*None))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registry_PutVehicle_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VehicleRecord)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).PutVehicle(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Registry_PutVehicle_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).PutVehicle(ctx, req.(*VehicleRecord))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registry_GetVehicle_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VehicleID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).GetVehicle(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Registry_GetVehicle_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).GetVehicle(ctx, req.(*VehicleID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registry_DeleteVehicle_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(VehicleID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).DeleteVehicle(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Registry_DeleteVehicle_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).DeleteVehicle(ctx, req.(*VehicleID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Registry_ListVehicles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AccountID)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).ListVehicles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Registry_ListVehicles_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).ListVehicles(ctx, req.(*AccountID))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Registry_ServiceDesc is the grpc.ServiceDesc for Registry service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Registry_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "Registry",
+	HandlerType: (*RegistryServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "PutAccount",
+			Handler:    _Registry_PutAccount_Handler,
+		},
+		{
+			MethodName: "GetAccount",
+			Handler:    _Registry_GetAccount_Handler,
+		},
+		{
+			MethodName: "DeleteAccount",
+			Handler:    _Registry_DeleteAccount_Handler,
+		},
+		{
+			MethodName: "ListAccounts",
+			Handler:    _Registry_ListAccounts_Handler,
+		},
+		{
+			MethodName: "PutVehicle",
+			Handler:    _Registry_PutVehicle_Handler,
+		},
+		{
+			MethodName: "GetVehicle",
+			Handler:    _Registry_GetVehicle_Handler,
+		},
+		{
+			MethodName: "DeleteVehicle",
+			Handler:    _Registry_DeleteVehicle_Handler,
+		},
+		{
+			MethodName: "ListVehicles",
+			Handler:    _Registry_ListVehicles_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "types/ptypes.proto",
+}
@@ -0,0 +1,95 @@
+package types
+
+const (
+	ClassMotorcycle = "motorcycle"
+	ClassCar        = "car"
+	ClassVan        = "van"
+	ClassTruck      = "truck"
+	ClassBus        = "bus"
+)
+
+var VehicleClasses = []string{ClassMotorcycle, ClassCar, ClassVan, ClassTruck, ClassBus}
+
+type Address struct {
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	PostalCode string `json:"postalCode"`
+	Country    string `json:"country"`
+}
+
+// Account is the customer that owns one or more vehicles and is billed for
+// them.
+type Account struct {
+	ID             string  `json:"id"`
+	Name           string  `json:"name"`
+	BillingAddress Address `json:"billingAddress"`
+	// prepaid accounts pay in advance and are charged as they drive instead
+	// of at the end of a billing period
+	Prepaid bool `json:"prepaid,omitempty"`
+	// prepaid balance below which the account is warned
+	LowBalance Money `json:"lowBalance,omitzero"`
+	// billing currency, empty for the operator's default currency
+	Currency string `json:"currency,omitempty"`
+}
+
+// Vehicle maps an OBU to the vehicle it is installed in.
+type Vehicle struct {
+	OBUID     int    `json:"obuID"`
+	Plate     string `json:"plate"`
+	Class     string `json:"class"`
+	AccountID string `json:"accountId"`
+}
+
+func (a Account) Record() *AccountRecord {
+	return &AccountRecord{
+		ID:   a.ID,
+		Name: a.Name,
+		BillingAddress: &BillingAddress{
+			Line1:      a.BillingAddress.Line1,
+			Line2:      a.BillingAddress.Line2,
+			City:       a.BillingAddress.City,
+			PostalCode: a.BillingAddress.PostalCode,
+			Country:    a.BillingAddress.Country,
+		},
+		Prepaid:    a.Prepaid,
+		LowBalance: a.LowBalance.Proto(),
+		Currency:   a.Currency,
+	}
+}
+
+func AccountFromRecord(r *AccountRecord) Account {
+	addr := r.GetBillingAddress()
+	return Account{
+		ID:   r.GetID(),
+		Name: r.GetName(),
+		BillingAddress: Address{
+			Line1:      addr.GetLine1(),
+			Line2:      addr.GetLine2(),
+			City:       addr.GetCity(),
+			PostalCode: addr.GetPostalCode(),
+			Country:    addr.GetCountry(),
+		},
+		Prepaid:    r.GetPrepaid(),
+		LowBalance: MoneyFromProto(r.GetLowBalance()),
+		Currency:   r.GetCurrency(),
+	}
+}
+
+func (v Vehicle) Record() *VehicleRecord {
+	return &VehicleRecord{
+		ObuID:     int64(v.OBUID),
+		Plate:     v.Plate,
+		Class:     v.Class,
+		AccountID: v.AccountID,
+	}
+}
+
+func VehicleFromRecord(r *VehicleRecord) Vehicle {
+	return Vehicle{
+		OBUID:     int(r.GetObuID()),
+		Plate:     r.GetPlate(),
+		Class:     r.GetClass(),
+		AccountID: r.GetAccountID(),
+	}
+}
@@ -0,0 +1,25 @@
+package types
+
+import "encoding/json"
+
+// ReplicaBatch is what the aggregators of an HA cluster send each other,
+// the distances they accepted and the changes made to the rest of their
+// state.
+type ReplicaBatch struct {
+	Distances []Distance `json:"distances,omitempty"`
+	Changes   []Change   `json:"changes,omitempty"`
+}
+
+// Change is the new state of an account, vehicle, ledger transaction or
+// dispute, identified by kind and key.
+type Change struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+	// of two changes of the same entry the higher version wins, ties are
+	// broken by the node that made them
+	Version int64  `json:"version,omitempty"`
+	Node    string `json:"node,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	// the entry, empty when it was deleted
+	Data json.RawMessage `json:"data,omitempty"`
+}
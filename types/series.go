@@ -0,0 +1,146 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	ResolutionHour = "hour"
+	ResolutionDay  = "day"
+)
+
+// Window returns the length of the tumbling windows of a resolution.
+func Window(resolution string) (time.Duration, error) {
+	switch resolution {
+	case ResolutionHour:
+		return time.Hour, nil
+	case ResolutionDay:
+		return 24 * time.Hour, nil
+	default:
+		return 0, fmt.Errorf("unknown resolution %q, expected %s or %s", resolution, ResolutionHour, ResolutionDay)
+	}
+}
+
+// SeriesPoint is the distance driven in the window starting at Start.
+type SeriesPoint struct {
+	Start    time.Time `json:"start"`
+	Distance float64   `json:"distance"`
+	Amount   Money     `json:"amount"`
+}
+
+// Series is the distance an OBU drove per window of event time, in UTC.
+type Series struct {
+	OBUID         int           `json:"obuID"`
+	Resolution    string        `json:"resolution"`
+	From          time.Time     `json:"from"`
+	To            time.Time     `json:"to"`
+	TotalDistance float64       `json:"totalDistance"`
+	TotalAmount   Money         `json:"totalAmount"`
+	Points        []SeriesPoint `json:"points"`
+}
+
+// SeriesQuery selects the windows starting in [From, To).
+type SeriesQuery struct {
+	OBUID      int
+	Resolution string
+	From       time.Time
+	To         time.Time
+}
+
+// ParseSeriesQuery reads id, resolution, from and to query parameters. The
+// range defaults to the last day of hours or the last 30 days.
+func ParseSeriesQuery(v url.Values) (SeriesQuery, error) {
+	var (
+		q   SeriesQuery
+		err error
+	)
+	if q.OBUID, err = strconv.Atoi(v.Get("id")); err != nil {
+		return q, errors.New("missing or incorrect 'id' query parameter")
+	}
+	q.Resolution = v.Get("resolution")
+	if q.Resolution == "" {
+		q.Resolution = ResolutionHour
+	}
+	if _, err := Window(q.Resolution); err != nil {
+		return q, err
+	}
+	if q.To, err = parseTime(v.Get("to"), time.Now()); err != nil {
+		return q, fmt.Errorf("incorrect 'to' query parameter: %w", err)
+	}
+	span := 24 * time.Hour
+	if q.Resolution == ResolutionDay {
+		span = 30 * 24 * time.Hour
+	}
+	if q.From, err = parseTime(v.Get("from"), q.To.Add(-span)); err != nil {
+		return q, fmt.Errorf("incorrect 'from' query parameter: %w", err)
+	}
+	if !q.From.Before(q.To) {
+		return q, errors.New("'from' must be before 'to'")
+	}
+	return q, nil
+}
+
+// parseTime accepts RFC3339 and unix seconds.
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (q SeriesQuery) Values() url.Values {
+	return url.Values{
+		"id":         {strconv.Itoa(q.OBUID)},
+		"resolution": {q.Resolution},
+		"from":       {q.From.Format(time.RFC3339)},
+		"to":         {q.To.Format(time.RFC3339)},
+	}
+}
+
+// Period is a billing period [From, To).
+type Period struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// ParsePeriod reads either a "period" calendar month (2006-01) or a "from"
+// and "to" range. The default is the current month up to now.
+func ParsePeriod(v url.Values) (Period, error) {
+	if month := v.Get("period"); month != "" {
+		start, err := time.Parse("2006-01", month)
+		if err != nil {
+			return Period{}, errors.New("incorrect 'period' query parameter, expected YYYY-MM")
+		}
+		return Period{From: start, To: start.AddDate(0, 1, 0)}, nil
+	}
+	now := time.Now().UTC()
+	var (
+		p   Period
+		err error
+	)
+	if p.To, err = parseTime(v.Get("to"), now); err != nil {
+		return p, fmt.Errorf("incorrect 'to' query parameter: %w", err)
+	}
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if p.From, err = parseTime(v.Get("from"), monthStart); err != nil {
+		return p, fmt.Errorf("incorrect 'from' query parameter: %w", err)
+	}
+	if !p.From.Before(p.To) {
+		return p, errors.New("'from' must be before 'to'")
+	}
+	return p, nil
+}
+
+func (p Period) Values() url.Values {
+	return url.Values{
+		"from": {p.From.Format(time.RFC3339)},
+		"to":   {p.To.Format(time.RFC3339)},
+	}
+}
@@ -7,17 +7,107 @@ type OBUData struct {
 	PrevLat   float64 `json:"prevLat"`
 	PrevLong  float64 `json:"prevLong"`
 	RequestID string  `json:"requestId"`
+	// unix nanoseconds when the device took the reading, which can be long
+	// before it reaches us when the device was offline
+	CapturedAt int64 `json:"capturedAt,omitempty"`
+	// unix nanoseconds, set by the data receiver
+	ReceivedAt int64 `json:"receivedAt,omitempty"`
+	// set by the data receiver when the prepaid account of the OBU is
+	// depleted and blocked readings are flagged rather than rejected
+	Blocked bool `json:"blocked,omitempty"`
 }
 
 type Distance struct {
-	Value     float64 `json:"value"`
-	OBUID     int     `json:"obuID"`
-	Unix      int64   `json:"unix"`
-	RequestID string  `json:"requestId"`
+	Value float64 `json:"value"`
+	OBUID int     `json:"obuID"`
+	// event time in unix nanoseconds, the capture time of the reading
+	Unix       int64  `json:"unix"`
+	RequestID  string `json:"requestId"`
+	ReceivedAt int64  `json:"receivedAt"`
+	// positions of the reading the distance was calculated from, kept as
+	// evidence when an invoice is disputed
+	PrevLat  float64 `json:"prevLat,omitempty"`
+	PrevLong float64 `json:"prevLong,omitempty"`
+	CurrLat  float64 `json:"currLat,omitempty"`
+	CurrLong float64 `json:"currLong,omitempty"`
+	// the reading was flagged by the data receiver, see OBUData
+	Blocked bool `json:"blocked,omitempty"`
+}
+
+// Adjustment is an exemption or discount applied to an invoice, negative
+// amounts lower it.
+type Adjustment struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+	Amount Money  `json:"amount"`
+}
+
+// TaxLine is the tax on the net amount of an invoice.
+type TaxLine struct {
+	Name string `json:"name"`
+	// in percent, as configured, e.g. "7.7"
+	Rate   string `json:"rate"`
+	Base   Money  `json:"base"`
+	Amount Money  `json:"amount"`
 }
 
 type Invoice struct {
 	OBUID         int     `json:"obuID"`
 	TotalDistance float64 `json:"totalDistance"`
-	TotalAmount   float64 `json:"totalAmount"`
+	// distance times price, before adjustments
+	Subtotal    Money        `json:"subtotal"`
+	Adjustments []Adjustment `json:"adjustments,omitempty"`
+	// after adjustments, before taxes
+	NetAmount Money     `json:"netAmount"`
+	Taxes     []TaxLine `json:"taxes,omitempty"`
+	// what is due, taxes included
+	TotalAmount Money `json:"totalAmount"`
+	// in the currency of the amounts, a rate rather than an amount so it
+	// keeps its float precision
+	PricePerKm float64 `json:"pricePerKm"`
+	// empty for OBUs missing from the vehicle registry
+	Plate     string `json:"plate,omitempty"`
+	Class     string `json:"class,omitempty"`
+	AccountID string `json:"accountId,omitempty"`
+}
+
+// VehicleSubtotal is the line of one vehicle on an account invoice.
+type VehicleSubtotal struct {
+	OBUID      int     `json:"obuID"`
+	Plate      string  `json:"plate"`
+	Class      string  `json:"class"`
+	Distance   float64 `json:"distance"`
+	PricePerKm float64 `json:"pricePerKm"`
+	// distance times price, before adjustments
+	Subtotal    Money        `json:"subtotal"`
+	Adjustments []Adjustment `json:"adjustments,omitempty"`
+	Amount      Money        `json:"amount"`
+}
+
+// AccountInvoice consolidates every vehicle of an account over a billing
+// period.
+type AccountInvoice struct {
+	Account       Account           `json:"account"`
+	Period        Period            `json:"period"`
+	Vehicles      []VehicleSubtotal `json:"vehicles"`
+	TotalDistance float64           `json:"totalDistance"`
+	// the vehicle amounts summed up, before taxes
+	NetAmount   Money     `json:"netAmount"`
+	Taxes       []TaxLine `json:"taxes,omitempty"`
+	TotalAmount Money     `json:"totalAmount"`
+}
+
+const (
+	AckOK          = "ok"
+	AckRejected    = "rejected"
+	AckRateLimited = "rate_limited"
+	AckFailed      = "failed"
+)
+
+// Ack is written back to devices that asked for acknowledgements when
+// connecting, one per reading.
+type Ack struct {
+	RequestID string `json:"requestId"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
 }